@@ -0,0 +1,12 @@
+// Package exercises holds the files the server is built with: the templates
+// of the pages in views/ and their style sheets in css/. With them embedded,
+// the binary runs from any directory, e.g. alone in a container; the server
+// only reads them from the disk when asked to, see ASSETS_DIR.
+package exercises
+
+import "embed"
+
+// The views/ and css/ directories, as they were at build time.
+//
+//go:embed views css
+var Assets embed.FS
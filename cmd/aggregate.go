@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// A publication year, with how many of the books came out that year and,
+// when asked for, their titles.
+type yearSummary struct {
+	Year   string   `bson:"_id" json:"year"`
+	Count  int      `bson:"count" json:"count"`
+	Titles []string `bson:"titles,omitempty" json:"titles,omitempty"`
+}
+
+// Lists every distinct publication year, oldest first, with the number of
+// books of that year and, if withTitles is set, their titles in alphabetical
+// order. Books without a year are left out.
+// The $match runs on the index of the years, see prepareIndexes, and only
+// the counts leave the database, not the books.
+func findYears(ctx context.Context, coll *mongo.Collection, withTitles bool) ([]yearSummary, error) {
+	group := bson.M{
+		"_id":   "$BookYear",
+		"count": bson.M{"$sum": 1},
+	}
+	pipeline := bson.A{
+		bson.M{"$match": listed(bson.M{"BookYear": bson.M{"$gt": 0}})},
+	}
+	if withTitles {
+		// Sorting the books is only needed for their titles
+		group["titles"] = bson.M{"$push": "$BookName"}
+		pipeline = append(pipeline, bson.M{"$sort": bson.M{"BookName": 1}})
+	}
+	pipeline = append(pipeline,
+		bson.M{"$group": group},
+		bson.M{"$sort": bson.M{"_id": 1}},
+		// Years are strings in the API, see formatNumber
+		bson.M{"$addFields": bson.M{"_id": bson.M{"$toString": "$_id"}}},
+	)
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	years := []yearSummary{}
+	if err = cursor.All(ctx, &years); err != nil {
+		return nil, err
+	}
+	return years, nil
+}
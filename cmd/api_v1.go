@@ -0,0 +1,600 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/features"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Registers version 1 of the REST API on the given group, i.e. the routes
+// described in the README. The JSON keys of a book in this version are the
+// ones of bookFields; a version changing them would come with its own
+// register function instead of modifying this one.
+// The middleware, if any, is applied to every route. Group middleware would
+// also catch unknown paths under the prefix, which breaks our 405 responses.
+// The methods follow the common standard. A very good documentation is found
+// here: https://developer.mozilla.org/en-US/docs/Web/HTTP/Reference/Methods
+// It specifies the expected returned codes for each type of request method.
+// The main routes on books go through the repository, see BookRepository,
+// and are registered first; the others still use the collections, and
+// are only there with STORAGE=mongo.
+func registerAPIv1(g *echo.Group, cols collections, repo BookRepository, auth *authenticator, cache *responseCache, events *eventStreams, flags *features.Set, m ...echo.MiddlewareFunc) {
+	coll := cols.books
+	search := cols.search
+	// The routes changing books need the role given by methodRoles, and
+	// keep the search up to date
+	writes := append(slices.Clip(m), auth.authorize)
+	if search != nil {
+		writes = append(writes, search.markStale)
+	}
+	admin := append(slices.Clip(m), auth.require(roleAdmin))
+	// Without MongoDB, the books link to no authors, and nobody borrows
+	// them, see openMongo
+	var authors *authorStore
+	var checkouts *checkoutStore
+	if coll != nil {
+		authors = &authorStore{authors: cols.authors, books: coll, transactions: cols.transactions}
+		checkouts = &checkoutStore{checkouts: cols.checkouts, books: coll, transactions: cols.transactions}
+	}
+
+	g.GET("/books", func(c echo.Context) error {
+		var query bookQuery
+		var err error
+		query.Sort, query.Descending, err = parseSort(c)
+		if err != nil {
+			return newProblem(http.StatusBadRequest, err.Error())
+		}
+		query.Filter, err = parseFilter(c)
+		if err != nil {
+			return newProblem(http.StatusBadRequest, err.Error())
+		}
+		fields, selected, err := parseFields(c)
+		if err != nil {
+			return newProblem(http.StatusBadRequest, err.Error())
+		}
+		if selected {
+			query.Fields = fields
+		}
+
+		query.Cursor = wantsCursorPagination(c)
+		if query.Cursor {
+			// The cursor only remembers where the previous page stopped, so
+			// it cannot resume a listing sorted by anything else.
+			if c.QueryParam("sort") != "" || c.QueryParam("order") != "" {
+				return newProblem(http.StatusBadRequest, "sort and order cannot be combined with after")
+			}
+			query.After, query.Limit, err = parseCursorPagination(c)
+		} else {
+			query.Offset, query.Limit, err = parsePagination(c)
+		}
+		if err != nil {
+			return newProblem(http.StatusBadRequest, err.Error())
+		}
+
+		list, err := repo.FindAll(c.Request().Context(), query)
+		if err != nil {
+			return repositoryError(err, "database error")
+		}
+		if query.Cursor {
+			setCursorHeaders(c, list.Next, query.Limit)
+		} else {
+			setPaginationHeaders(c, query.Offset, query.Limit, list.Total)
+		}
+
+		response := []map[string]interface{}{}
+		for _, book := range booksToMaps(list.Books) {
+			formatted := map[string]interface{}{}
+			for _, field := range fields {
+				formatted[field] = book[bookFields[field]]
+			}
+			// The list of the names in author, see bookToAPI
+			if names, ok := book["BookAuthors"]; ok && slices.Contains(fields, "author") {
+				formatted["authors"] = names
+			}
+			// Not among the fields, so only for whole books
+			if !selected {
+				formatted["copies"] = book["Copies"]
+				formatted["availableCopies"] = book["AvailableCopies"]
+				formatted["createdAt"] = book["CreatedAt"]
+				formatted["updatedAt"] = book["UpdatedAt"]
+			}
+			if rating, ok := book["Rating"]; ok {
+				formatted["rating"] = rating
+			}
+			if cover, ok := book["Cover"]; ok {
+				formatted["cover"] = cover
+			}
+			if publisher, ok := book["PublisherID"]; ok {
+				formatted["publisherId"] = publisher
+			}
+			if archived, ok := book["Archived"]; ok {
+				formatted["archived"] = archived
+			}
+			response = append(response, formatted)
+		}
+		return sendBookList(c, http.StatusOK, response)
+	}, append(slices.Clip(m), cache.middleware(cache.ttl))...)
+
+	// A POST sent again with its Idempotency-Key gets the same response,
+	// see idempotency.go, where MongoDB keeps them
+	create := writes
+	if cols.idempotencyKeys != nil {
+		create = append(slices.Clip(writes), idempotent(cols.idempotencyKeys))
+	}
+	g.POST("/books", func(c echo.Context) error {
+		var input map[string]interface{}
+		if err := c.Bind(&input); err != nil {
+			return newProblem(http.StatusBadRequest, "invalid request body")
+		}
+
+		// Vérifier les champs
+		book, err := bookFromCreateInput(input)
+		if err != nil {
+			return err
+		}
+		if err := authors.linkBook(c.Request().Context(), &book); err != nil {
+			return serverProblem(err, "database error")
+		}
+		book.Version = 1
+		book.CreatedAt = time.Now()
+		book.UpdatedAt = book.CreatedAt
+
+		// Insérer le livre, sauf si un livre identique existe déjà
+		if err := repo.Insert(c.Request().Context(), book); err != nil {
+			return repositoryError(err, "could not insert book")
+		}
+
+		// Retourner 201 Created
+		return c.JSON(http.StatusCreated, map[string]string{
+			"message": "book created",
+		})
+	}, create...)
+
+	// The last books added, newest first, e.g. /books/recent?limit=5
+	g.GET("/books/recent", func(c echo.Context) error {
+		limit, err := parseLimitOr(c, defaultRecentCount)
+		if err != nil {
+			return newProblem(http.StatusBadRequest, err.Error())
+		}
+
+		books, err := findRecentBooks(c.Request().Context(), coll, repo, limit, nil)
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+
+		response := []map[string]interface{}{}
+		for _, book := range books {
+			response = append(response, bookToAPI(book))
+		}
+		return c.JSON(http.StatusOK, response)
+	}, m...)
+
+	// Full-text search over title, author and edition, see bookSearch.
+	// Every book comes with its relevance score, best matches first, and the
+	// filters of GET /books narrow the search down.
+	// With fuzzy=true, the words may contain typos, see trigramIndex.
+	// With facets=true, the books found are also counted by author, year and
+	// edition, and the response becomes {"hits": [...], "facets": {...}}.
+	g.GET("/books/search", func(c echo.Context) error {
+		query := strings.TrimSpace(c.QueryParam("q"))
+		if query == "" {
+			return newProblem(http.StatusBadRequest, "q is required")
+		}
+		limit, err := parseLimit(c)
+		if err != nil {
+			return newProblem(http.StatusBadRequest, err.Error())
+		}
+		fuzzy, err := parseBoolParam(c, "fuzzy")
+		if err != nil {
+			return newProblem(http.StatusBadRequest, err.Error())
+		}
+		withFacets, err := parseBoolParam(c, "facets")
+		if err != nil {
+			return newProblem(http.StatusBadRequest, err.Error())
+		}
+		filter, err := parseFilter(c)
+		if err != nil {
+			return newProblem(http.StatusBadRequest, err.Error())
+		}
+		// Features still rolled out, see features.go
+		if fuzzy && !flags.Enabled(featureFuzzySearch) {
+			return newProblem(http.StatusBadRequest, "fuzzy is turned off, see the feature "+featureFuzzySearch)
+		}
+		if withFacets && !flags.Enabled(featureSearchFacets) {
+			return newProblem(http.StatusBadRequest, "facets is turned off, see the feature "+featureSearchFacets)
+		}
+		if (fuzzy || withFacets) && search == nil {
+			// Both read the books collection, see bookSearch
+			return newProblem(http.StatusBadRequest, "fuzzy and facets need STORAGE=mongo")
+		}
+		if fuzzy && (withFacets || !filter.isEmpty()) {
+			// The fuzzy search runs in memory, not in the database
+			return newProblem(http.StatusBadRequest, "fuzzy cannot be combined with facets or filters")
+		}
+
+		var hits []searchHit
+		var facets map[string][]facetCount
+		switch {
+		case fuzzy:
+			hits, err = search.fuzzy.search(query, limit)
+		case withFacets:
+			hits, facets, err = search.facetedSearch(c.Request().Context(), query, mongoFilter(filter), limit)
+		default:
+			hits, err = repo.Search(c.Request().Context(), query, filter, limit)
+		}
+		if err != nil {
+			return repositoryError(err, "database error")
+		}
+
+		response := []map[string]interface{}{}
+		for _, hit := range hits {
+			response = append(response, hitToAPI(hit))
+		}
+		if withFacets {
+			return c.JSON(http.StatusOK, map[string]interface{}{
+				"hits":   response,
+				"facets": facets,
+			})
+		}
+		return c.JSON(http.StatusOK, response)
+	}, m...)
+
+	// The changes of the books as they happen, see events.go
+	g.GET("/events", events.serve, m...)
+
+	g.GET("/books/:id", func(c echo.Context) error {
+		bookID := c.Param("id")
+
+		book, err := repo.FindByID(c.Request().Context(), bookID)
+		if err != nil {
+			if errors.Is(err, errBookNotFound) {
+				return newProblem(http.StatusNotFound, fmt.Sprintf("Book with ID: %s not found. Is it stored?", bookID))
+			}
+			return repositoryError(err, "database error")
+		}
+
+		// Construire la réponse JSON
+		response := bookToAPI(book)
+		availability, err := checkouts.availability(c.Request().Context(), book)
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		response["availability"] = availability
+
+		return sendBook(c, http.StatusOK, book.Version, response)
+	}, append(slices.Clip(m), cache.middleware(cache.bookTTL))...)
+
+	// PUT replaces the whole book: everything the client does not send is
+	// gone afterwards. To change only some fields, use PATCH.
+	g.PUT("/books/:id", func(c echo.Context) error {
+		bookID := c.Param("id")
+
+		var input map[string]interface{}
+		if err := bindBody(c, &input); err != nil {
+			return newProblem(http.StatusBadRequest, "invalid request body")
+		}
+
+		book, err := bookFromInput(bookID, input)
+		if err != nil {
+			return err
+		}
+		if err := authors.linkBook(c.Request().Context(), &book); err != nil {
+			return serverProblem(err, "database error")
+		}
+
+		if err := repo.Update(c.Request().Context(), bookID, book, parseIfMatch(c)); err != nil {
+			return repositoryError(err, "failed to update book")
+		}
+
+		return c.JSON(http.StatusOK, map[string]string{"message": "book updated"})
+	}, writes...)
+
+	g.DELETE("/books/:id", func(c echo.Context) error {
+		// Récupérer l'ID logique depuis l'URL
+		bookID := c.Param("id")
+
+		// Mettre le livre à la corbeille, voir trash.go, s'il est
+		// toujours dans la version du client
+		if err := repo.Delete(c.Request().Context(), bookID, parseIfMatch(c)); err != nil {
+			return repositoryError(err, "could not delete book")
+		}
+
+		// Suppression réussie
+		return c.JSON(http.StatusOK, map[string]string{
+			"message": "book deleted",
+		})
+	}, writes...)
+
+	// Archived books leave the listings, but not the catalog, see
+	// archive.go
+	g.POST("/books/:id/archive", archiveBook(repo, true), writes...)
+	g.POST("/books/:id/unarchive", archiveBook(repo, false), writes...)
+
+	// How often the responses came from the cache, see responseCache
+	g.GET("/admin/cache", cache.stats, admin...)
+
+	// The features being rolled out, see features.go
+	featureRoutes := &featureAdmin{flags: flags}
+	g.GET("/admin/features", featureRoutes.list, admin...)
+	g.PUT("/admin/features/:name", featureRoutes.override, admin...)
+	g.DELETE("/admin/features/:name", featureRoutes.reset, admin...)
+
+	// The read-only mode, see maintenance.go
+	g.GET("/admin/maintenance", cols.maintenance.show, admin...)
+	g.PUT("/admin/maintenance", cols.maintenance.change, admin...)
+
+	// Taking the instance out of the load balancer, see drain.go
+	g.GET("/admin/drain", cols.drain.show, admin...)
+	g.POST("/admin/drain", cols.drain.start, admin...)
+	g.DELETE("/admin/drain", cols.drain.stop, admin...)
+
+	// Everything else keeps its data in MongoDB, next to the books, so with
+	// another STORAGE it is not served at all, rather than answering for
+	// another catalog
+	if coll == nil {
+		return
+	}
+
+	g.POST("/books/batch", func(c echo.Context) error {
+		return createBooksBatch(c, coll, authors, cols.transactions)
+	}, writes...)
+
+	g.DELETE("/books", func(c echo.Context) error {
+		return deleteBooksBatch(c, coll)
+	}, writes...)
+
+	g.PATCH("/books/batch", func(c echo.Context) error {
+		return updateBooksBatch(c, coll, authors, cols.revisions)
+	}, writes...)
+
+	// The books of the publishers, as ONIX messages, see onix.go
+	g.POST("/import/onix", importONIX(coll, authors, cols.transactions), writes...)
+
+	// The cover is a multipart upload, see covers.go
+	covers := &coverStore{bucket: cols.covers, books: coll}
+	g.POST("/books/:id/cover", covers.upload, writes...)
+
+	// Tags are added by editors, and removing them is an edit as well, not
+	// a deletion which methodRoles keeps for admins
+	g.POST("/books/:id/tags", addTags(coll), writes...)
+	g.DELETE("/books/:id/tags", removeTags(coll), append(slices.Clip(m), auth.require(roleEditor))...)
+	g.GET("/tags", func(c echo.Context) error {
+		tags, err := findTags(c.Request().Context(), coll)
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		return c.JSON(http.StatusOK, tags)
+	}, m...)
+
+	// Publishers too; unlinking a book from its publisher is an edit, as
+	// for the tags
+	publishers := &publisherStore{publishers: cols.publishers, books: coll}
+	publishers.register(g, m, writes)
+	g.DELETE("/books/:id/publisher", publishers.unlink, append(slices.Clip(m), auth.require(roleEditor))...)
+
+	// Authors are managed like books: reading is public, and the writes
+	// need the same roles
+	authors.register(g, m, writes)
+
+	// Every series with its volumes in reading order
+	g.GET("/series", func(c echo.Context) error {
+		series, err := findSeries(c.Request().Context(), coll)
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		return c.JSON(http.StatusOK, series)
+	}, m...)
+
+	// The books of one series, in reading order
+	g.GET("/series/:name", func(c echo.Context) error {
+		books, err := findSeriesBooks(c.Request().Context(), coll, c.Param("name"), nil)
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		if len(books) == 0 {
+			return newProblem(http.StatusNotFound, "no series with this name")
+		}
+		response := []map[string]interface{}{}
+		for _, book := range books {
+			response = append(response, bookToAPI(book))
+		}
+		return c.JSON(http.StatusOK, response)
+	}, m...)
+
+	// With titles=true, each year also lists the titles of its books
+	g.GET("/years", func(c echo.Context) error {
+		withTitles, err := parseBoolParam(c, "titles")
+		if err != nil {
+			return newProblem(http.StatusBadRequest, err.Error())
+		}
+		years, err := findYears(c.Request().Context(), coll, withTitles)
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		return c.JSON(http.StatusOK, years)
+	}, m...)
+
+	// The whole catalog as a file, e.g. /export?format=ndjson&gzip=true,
+	// see exportBooks
+	g.GET("/export", exportBooks(cols.listings), m...)
+
+	// Completes the beginning of a title or an author, for the typeahead of
+	// the search bar, e.g. /suggest?q=fr
+	g.GET("/suggest", func(c echo.Context) error {
+		prefix := strings.TrimSpace(c.QueryParam("q"))
+		if prefix == "" {
+			return newProblem(http.StatusBadRequest, "q is required")
+		}
+		suggestions, err := search.suggestions.suggest(prefix)
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		return c.JSON(http.StatusOK, suggestions)
+	}, m...)
+
+	// Suggests other books to readers of this one, see bookSearch.related
+	g.GET("/books/:id/related", func(c echo.Context) error {
+		bookID := c.Param("id")
+		limit, err := parseLimitOr(c, defaultRelatedCount)
+		if err != nil {
+			return newProblem(http.StatusBadRequest, err.Error())
+		}
+
+		var book BookStore
+		err = coll.FindOne(c.Request().Context(), live(bson.M{"ID": bookID})).Decode(&book)
+		if err == mongo.ErrNoDocuments {
+			return errBookNotFound
+		}
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		related, err := search.related(c.Request().Context(), book, limit)
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+
+		response := []map[string]interface{}{}
+		for _, other := range related {
+			formatted := bookToAPI(other.BookStore)
+			formatted["reasons"] = other.Reasons
+			response = append(response, formatted)
+		}
+		return c.JSON(http.StatusOK, response)
+	}, m...)
+
+	// PATCH changes only some fields of a book. The body is either a JSON
+	// Merge Patch (see mergePatchUpdate), which is also what we assume for
+	// plain application/json, or a JSON Patch (see applyJSONPatch).
+	g.PATCH("/books/:id", func(c echo.Context) error {
+		bookID := c.Param("id")
+
+		switch mediaType(c) {
+		case "application/merge-patch+json", "application/json":
+		case "application/json-patch+json":
+			return applyJSONPatchRequest(c, coll, authors, cols.revisions, bookID)
+		default:
+			return newProblem(http.StatusUnsupportedMediaType,
+				"content type must be application/merge-patch+json or application/json-patch+json")
+		}
+
+		patch, err := decodeJSONObject(c.Request().Body)
+		if err != nil {
+			return newProblem(http.StatusBadRequest, "invalid request body")
+		}
+		update, err := mergePatchUpdate(bookID, patch)
+		if err != nil {
+			return err
+		}
+		if err := authors.linkUpdate(c.Request().Context(), update); err != nil {
+			return serverProblem(err, "database error")
+		}
+
+		filter := live(bson.M{"ID": bookID})
+		conditional := addIfMatch(c, filter)
+		if len(update) == 0 {
+			// An empty patch changes nothing, but the book must still exist.
+			count, err := coll.CountDocuments(c.Request().Context(), filter)
+			if err != nil {
+				return serverProblem(err, "database error")
+			}
+			if count == 0 {
+				return notFoundOrPreconditionFailed(c.Request().Context(), coll, bookID)
+			}
+			return c.JSON(http.StatusOK, map[string]string{"message": "book updated"})
+		}
+
+		// The book as it was is kept, see revisions.go
+		var before BookStore
+		err = coll.FindOneAndUpdate(c.Request().Context(), filter, update).Decode(&before)
+		if err == mongo.ErrNoDocuments {
+			if conditional {
+				return notFoundOrPreconditionFailed(c.Request().Context(), coll, bookID)
+			}
+			return errBookNotFound
+		}
+		if err != nil {
+			return serverProblem(err, "failed to update book")
+		}
+		cols.revisions.record(c.Request().Context(), before)
+
+		return c.JSON(http.StatusOK, map[string]string{"message": "book updated"})
+	}, writes...)
+
+	// Deleted books go to the trash, where admins can get them back, see
+	// trash.go
+	g.GET("/books/trash", listTrash(coll), admin...)
+	g.POST("/books/:id/restore", restoreBook(coll), append(slices.Clip(admin), search.markStale)...)
+
+	// Hands out the API keys and the user accounts, see apiKeyAuth
+	g.POST("/admin/keys", auth.keys.createKey, admin...)
+	g.GET("/admin/keys", auth.keys.listKeys, admin...)
+	g.DELETE("/admin/keys/:id", auth.keys.revokeKey, admin...)
+
+	// How busy the connections to MongoDB are, see poolStats
+	g.GET("/admin/pool", cols.pool.stats, admin...)
+	g.POST("/admin/users", createUser(cols.users), admin...)
+
+	// Candidates for a catalog cleanup, see findDuplicates, and merging
+	// them, see bookMerger
+	g.GET("/admin/duplicates", listDuplicates(coll), admin...)
+	merger := &bookMerger{
+		books:        coll,
+		reviews:      &reviewStore{reviews: cols.reviews, books: coll},
+		checkouts:    cols.checkouts,
+		readingLists: cols.readingLists,
+		revisions:    cols.revisions,
+		transactions: cols.transactions,
+	}
+	g.POST("/admin/merge", merger.merge, append(slices.Clip(admin), requireFeature(flags, featureBookMerge), search.markStale)...)
+
+	// Snapshots of the books collection, see backupStore
+	g.POST("/admin/backup", cols.backups.create, admin...)
+	g.GET("/admin/backups", cols.backups.list, admin...)
+	g.POST("/admin/restore", cols.backups.restore, append(slices.Clip(admin), search.markStale)...)
+
+	// The reading lists of the logged in user, see readingLists
+	lists := &readingLists{entries: cols.readingLists, books: coll}
+	lists.register(g, append(slices.Clip(m), auth.requireUser)...)
+
+	// The staff lends the books
+	checkouts.register(g, append(slices.Clip(m), auth.require(roleEditor)))
+
+	// Everybody reads the reviews, logged in users write them
+	reviews := &reviewStore{reviews: cols.reviews, books: coll}
+	reviews.register(g, m, append(slices.Clip(m), auth.requireUser))
+
+	// The books as they were before each change, see revisions.go
+	cols.revisions.register(g, m, writes, repo, authors)
+
+	// Logging in, see jwtAuth
+	g.POST("/auth/login", auth.tokens.login, m...)
+	g.POST("/auth/refresh", auth.tokens.refresh, m...)
+	g.POST("/auth/logout", auth.tokens.logout, m...)
+}
+
+// The day the unversioned /api routes were deprecated, as a Unix timestamp
+// (2026-10-14).
+const apiDeprecationDate = 1791936000
+
+// Marks every response of a deprecated route group with a Deprecation header
+// (https://www.rfc-editor.org/rfc/rfc9745) and a Link to the same resource
+// in the version replacing it, e.g. /api/books -> /api/v1/books.
+func deprecatedAPI(prefix string, successor string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			header := c.Response().Header()
+			header.Set("Deprecation", fmt.Sprintf("@%d", apiDeprecationDate))
+			path := successor + strings.TrimPrefix(c.Request().URL.Path, prefix)
+			header.Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", path))
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/CAPS-Cloud/exercises/internal/features"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// The admin token of the test servers.
+const testAdminToken = "test-admin-token"
+
+// A server with the routes of the repository, as without MongoDB, on a
+// fresh SQLite file.
+func newTestServer(t *testing.T) (*echo.Echo, BookRepository) {
+	t.Helper()
+	repo, err := openSQLiteRepository(filepath.Join(t.TempDir(), "books.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := newResponseCache(config.Cache{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags, err := features.New(featureDefinitions, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := newJWTAuth(nil, nil, "test-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &authenticator{keys: newAPIKeyAuth(nil, testAdminToken), tokens: tokens}
+	cols := collections{maintenance: newMaintenanceMode(false, ""), drain: &drainState{}}
+	events := newEventStreams(newBookChanges(nil, nil, cache))
+
+	e := echo.New()
+	e.HTTPErrorHandler = problemErrorHandler
+	registerAPIv1(e.Group("/api"), cols, repo, auth, cache, events, flags)
+	return e, repo
+}
+
+// Sends a request with a JSON body, as an admin.
+func sendJSON(e *echo.Echo, method string, target string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(adminTokenHeader, testAdminToken)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPutBook(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"without the id", `{"title": "Dune", "author": "Frank Herbert", "year": 1966}`, http.StatusOK},
+		{"with the id of the URL", `{"id": "dune", "title": "Dune", "author": "Frank Herbert"}`, http.StatusOK},
+		{"with another id", `{"id": "other", "title": "Dune", "author": "Frank Herbert"}`, http.StatusUnprocessableEntity},
+		{"with an unknown field", `{"title": "Dune", "author": "Frank Herbert", "colour": "red"}`, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, repo := newTestServer(t)
+			rec := sendJSON(e, http.MethodPost, "/api/books", `{"id": "dune", "title": "Dune", "author": "Frank Herbert", "year": 1965}`)
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("POST: got %d: %s", rec.Code, rec.Body)
+			}
+
+			rec = sendJSON(e, http.MethodPut, "/api/books/dune", tt.body)
+			if rec.Code != tt.status {
+				t.Fatalf("PUT: got %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			book, err := repo.FindByID(context.Background(), "dune")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if book.ID != "dune" || book.BookName != "Dune" {
+				t.Errorf("stored %+v", book)
+			}
+		})
+	}
+}
+
+// A server with every route, on a mocked MongoDB, see withMockMongo.
+func newMockMongoServer(t *testing.T, mt *mtest.T) *echo.Echo {
+	t.Helper()
+	cache, err := newResponseCache(config.Cache{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags, err := features.New(featureDefinitions, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := newJWTAuth(mt.Coll, mt.Coll, "test-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &authenticator{keys: newAPIKeyAuth(mt.Coll, testAdminToken), tokens: tokens}
+	search := newBookSearch(mt.Coll, searchConfig{Language: "english"})
+	revisions := &revisionStore{revisions: mt.Coll}
+	cols := collections{
+		books:        mt.Coll,
+		listings:     mt.Coll,
+		search:       search,
+		revisions:    revisions,
+		pool:         &poolStats{},
+		maintenance:  newMaintenanceMode(false, ""),
+		drain:        &drainState{},
+		backups:      &backupStore{books: mt.Coll},
+		transactions: &transactions{},
+	}
+	repo := &mongoBookRepository{coll: mt.Coll, listings: mt.Coll, search: search, revisions: revisions}
+	events := newEventStreams(newBookChanges(mt.Coll, search, cache))
+
+	e := echo.New()
+	e.HTTPErrorHandler = problemErrorHandler
+	registerAPIv1(e.Group("/api"), cols, repo, auth, cache, events, flags)
+	return e
+}
+
+func TestRelatedBooksErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		// Whether the database fails, rather than finding no book
+		fails  bool
+		status int
+		detail string
+	}{
+		{"of a missing book", false, http.StatusNotFound, "book not found"},
+		{"when the database fails", true, http.StatusInternalServerError, "database error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withMockMongo(t, func(mt *mtest.T) {
+				e := newMockMongoServer(t, mt)
+				if tt.fails {
+					mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 1, Message: "boom"}))
+				} else {
+					mt.AddMockResponses(mockCursor(mt))
+				}
+
+				req := httptest.NewRequest(http.MethodGet, "/api/books/dune/related", nil)
+				rec := httptest.NewRecorder()
+				e.ServeHTTP(rec, req)
+				if rec.Code != tt.status {
+					t.Fatalf("got %d, want %d: %s", rec.Code, tt.status, rec.Body)
+				}
+				var problem problemError
+				if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil {
+					t.Fatal(err)
+				}
+				if problem.Detail != tt.detail {
+					t.Errorf("got the detail %q, want %q", problem.Detail, tt.detail)
+				}
+			})
+		})
+	}
+}
+
+func TestListBooksEmpty(t *testing.T) {
+	e, _ := newTestServer(t)
+	req := httptest.NewRequest(http.MethodGet, "/api/books?author=nobody", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body)
+	}
+	var books []map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &books); err != nil {
+		t.Fatal(err)
+	}
+	if books == nil {
+		t.Errorf("got %s, want []", strings.TrimSpace(rec.Body.String()))
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The header clients send their API key in.
+const apiKeyHeader = "X-API-Key"
+
+// The header of the token protecting the admin endpoints.
+const adminTokenHeader = "X-Admin-Token"
+
+// An API key, as we store it. We never store the key itself, only its
+// SHA-256 hash: someone reading the database cannot use the keys. Keys are
+// long random strings, so unlike passwords they need no slow hash.
+// ID names the key in the admin endpoints, e.g. to revoke it.
+type apiKey struct {
+	ID        string    `bson:"_id" json:"id"`
+	Name      string    `bson:"Name" json:"name"`
+	Hash      string    `bson:"Hash" json:"-"`
+	Role      role      `bson:"Role,omitempty" json:"role"`
+	CreatedAt time.Time `bson:"CreatedAt" json:"createdAt"`
+}
+
+// Checks API keys, and serves the admin endpoints to hand them out. Besides
+// the admin keys and users, a single token given to the server in the
+// ADMIN_TOKEN environment variable grants admin access, e.g. to create the
+// first admin user.
+type apiKeyAuth struct {
+	keys       *mongo.Collection
+	adminToken string
+}
+
+func newAPIKeyAuth(keys *mongo.Collection, adminToken string) *apiKeyAuth {
+	return &apiKeyAuth{keys: keys, adminToken: adminToken}
+}
+
+// Every request looks its key up by hash.
+func prepareAPIKeyIndexes(coll *mongo.Collection) error {
+	_, err := coll.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "Hash", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the stored key, or nil if there is none like it.
+func (a *apiKeyAuth) lookup(ctx context.Context, key string) (*apiKey, error) {
+	if a.keys == nil {
+		// Without MongoDB, no key was ever handed out
+		return nil, nil
+	}
+	var found apiKey
+	err := a.keys.FindOne(ctx, bson.M{"Hash": hashAPIKey(key)}).Decode(&found)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &found, nil
+}
+
+// Whether the token is the ADMIN_TOKEN. Without one, nothing is.
+func (a *apiKeyAuth) isAdminToken(token string) bool {
+	if a.adminToken == "" {
+		return false
+	}
+	// Comparing in constant time does not tell an attacker how many
+	// characters they got right
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.adminToken)) == 1
+}
+
+// Returns n random bytes, encoded for URLs and headers.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Handles POST /api/admin/keys. The body names the new key, e.g. after its
+// owner, and may give its role: {"name": "library frontend", "role":
+// "viewer"}. The key itself is only part of this response, it cannot be
+// shown again later.
+func (a *apiKeyAuth) createKey(c echo.Context) error {
+	var input struct {
+		Name string `json:"name"`
+		Role string `json:"role"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return newProblem(http.StatusBadRequest, "invalid request body")
+	}
+	input.Name = strings.TrimSpace(input.Name)
+	errs := fieldErrors{}
+	if input.Name == "" {
+		errs["name"] = "is required"
+	}
+	keyRole, ok := parseRole(input.Role)
+	if !ok {
+		errs["role"] = roleError
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	id, err := randomToken(9)
+	if err != nil {
+		return serverProblem(err, "could not create key")
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		return serverProblem(err, "could not create key")
+	}
+	key := "bk_" + secret
+
+	record := apiKey{ID: id, Name: input.Name, Hash: hashAPIKey(key), Role: keyRole, CreatedAt: time.Now()}
+	if _, err = a.keys.InsertOne(c.Request().Context(), record); err != nil {
+		return serverProblem(err, "could not create key")
+	}
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"id":        record.ID,
+		"name":      record.Name,
+		"key":       key,
+		"role":      record.Role,
+		"createdAt": record.CreatedAt.UTC().Format(time.RFC3339),
+	})
+}
+
+// Handles GET /api/admin/keys, listing the keys without their secret.
+func (a *apiKeyAuth) listKeys(c echo.Context) error {
+	cursor, err := a.keys.Find(c.Request().Context(), bson.M{}, options.Find().SetSort(bson.M{"CreatedAt": 1}))
+	if err != nil {
+		return serverProblem(err, "database error")
+	}
+	keys := []apiKey{}
+	if err = cursor.All(c.Request().Context(), &keys); err != nil {
+		return serverProblem(err, "database error")
+	}
+	for i := range keys {
+		keys[i].Role = keys[i].Role.orDefault()
+	}
+	return c.JSON(http.StatusOK, keys)
+}
+
+// Handles DELETE /api/admin/keys/:id. The key stops working at once.
+func (a *apiKeyAuth) revokeKey(c echo.Context) error {
+	result, err := a.keys.DeleteOne(c.Request().Context(), bson.M{"_id": c.Param("id")})
+	if err != nil {
+		return serverProblem(err, "could not revoke key")
+	}
+	if result.DeletedCount == 0 {
+		return newProblem(http.StatusNotFound, "API key not found")
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "key revoked"})
+}
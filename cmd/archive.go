@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Archiving a book withdraws it from the catalog: unlike a deleted one, it
+// stays where it is and keeps its ID, its reviews and its checkouts, and
+// GET /books/:id still finds it. Only the listings leave it out, unless
+// asked with ?include_archived=true, see bookFilter: the book table, the
+// search, the series, the tags, the years and the suggestions. The export and
+// the backups, which stand for the whole catalog, keep it.
+
+// Like live, but also leaves the archived books out, for the listings.
+// Books archived have Archived: true, the others no Archived at all.
+func listed(filter bson.M) bson.M {
+	result := live(filter)
+	result["Archived"] = bson.M{"$ne": true}
+	return result
+}
+
+// The update archiving a book, or taking it out of the archive. It counts
+// the version up, see trashUpdate.
+func archiveUpdate(archived bool) bson.M {
+	update := bson.M{
+		"$inc":         bson.M{"Version": 1},
+		"$currentDate": bson.M{"UpdatedAt": true},
+	}
+	if archived {
+		update["$set"] = bson.M{"Archived": true}
+	} else {
+		update["$unset"] = bson.M{"Archived": ""}
+	}
+	return update
+}
+
+// Handles POST /books/:id/archive and POST /books/:id/unarchive. Archiving
+// an archived book changes nothing but its version, as does unarchiving a
+// listed one.
+func archiveBook(repo BookRepository, archived bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := repo.Archive(c.Request().Context(), c.Param("id"), archived, parseIfMatch(c)); err != nil {
+			return repositoryError(err, "could not archive book")
+		}
+		message := "book archived"
+		if !archived {
+			message = "book unarchived"
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": message})
+	}
+}
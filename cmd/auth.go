@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// What a user or an API key may do. Each role may do everything the ones
+// before it may:
+//
+//	viewer  read books
+//	editor  also create and update books
+//	admin   also delete books, and use the admin endpoints
+type role string
+
+const (
+	roleViewer role = "viewer"
+	roleEditor role = "editor"
+	roleAdmin  role = "admin"
+)
+
+var roleRanks = map[role]int{roleViewer: 1, roleEditor: 2, roleAdmin: 3}
+
+// The role of users and keys created without one. Those created before we
+// had roles could create, update and delete books; they keep the first two.
+const defaultRole = roleEditor
+
+const roleError = "must be viewer, editor or admin"
+
+// Reads a role given to the admin endpoints, empty meaning defaultRole.
+func parseRole(value string) (role, bool) {
+	if value == "" {
+		return defaultRole, true
+	}
+	_, ok := roleRanks[role(value)]
+	return role(value), ok
+}
+
+func (r role) orDefault() role {
+	if _, ok := roleRanks[r]; !ok {
+		return defaultRole
+	}
+	return r
+}
+
+func (r role) atLeast(required role) bool {
+	return roleRanks[r.orDefault()] >= roleRanks[required]
+}
+
+// The policy for the book routes: the role needed for each method. Reading
+// is open to everybody, so the web pages work without logging in.
+var methodRoles = map[string]role{
+	http.MethodPost:   roleEditor,
+	http.MethodPut:    roleEditor,
+	http.MethodPatch:  roleEditor,
+	http.MethodDelete: roleAdmin,
+}
+
+// Who sent a request, and what they may do. IsUser tells a logged in user,
+// whose Name is their username, from the API keys and the admin token. The
+// names of the keys are only labels, several keys may have the same; KeyID
+// tells which key it was.
+type principal struct {
+	Name   string
+	Role   role
+	IsUser bool
+	KeyID  string
+}
+
+// Decides who may do what: the caller is either a program with an API key
+// (see apikeys.go), a logged in user with an access token (see jwt.go), or
+// an admin with the ADMIN_TOKEN.
+type authenticator struct {
+	keys   *apiKeyAuth
+	tokens *jwtAuth
+}
+
+// Finds out who sent the request, or returns nil when they did not say. Bad
+// credentials are an error, even if the route would not need any.
+func (a *authenticator) authenticate(c echo.Context) (*principal, error) {
+	header := c.Request().Header
+	p, err := a.identify(c.Request().Context(), header)
+	if err != nil && header.Get(adminTokenHeader) == "" && header.Get(echo.HeaderAuthorization) != "" {
+		// A bad access token, see RFC 6750
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+	}
+	return p, err
+}
+
+// Finds out who sent the headers, as authenticate does. The gRPC service
+// reads them from the metadata of its calls, see grpc.go.
+func (a *authenticator) identify(ctx context.Context, header http.Header) (*principal, error) {
+	if token := header.Get(adminTokenHeader); token != "" {
+		if !a.keys.isAdminToken(token) {
+			return nil, newProblem(http.StatusUnauthorized, "invalid admin token")
+		}
+		return &principal{Name: "admin token", Role: roleAdmin}, nil
+	}
+	if authorization := header.Get(echo.HeaderAuthorization); authorization != "" {
+		p, err := a.tokens.verify(authorization)
+		if err != nil {
+			return nil, newProblem(http.StatusUnauthorized, err.Error())
+		}
+		return p, nil
+	}
+	if key := header.Get(apiKeyHeader); key != "" {
+		found, err := a.keys.lookup(ctx, key)
+		if err != nil {
+			return nil, serverProblem(err, "database error")
+		}
+		if found == nil {
+			return nil, newProblem(http.StatusUnauthorized, "invalid API key")
+		}
+		return &principal{Name: found.Name, Role: found.Role.orDefault(), KeyID: found.ID}, nil
+	}
+	return nil, nil
+}
+
+// Lets only the callers with at least the given role through. The others
+// get 401 Unauthorized when they did not say who they are, and 403
+// Forbidden otherwise. The caller is kept under "principal" in the context.
+func (a *authenticator) require(required role) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			p, err := a.authenticate(c)
+			if err != nil {
+				return err
+			}
+			if p == nil {
+				return newProblem(http.StatusUnauthorized,
+					"credentials are required: an API key in "+apiKeyHeader+" or a Bearer token")
+			}
+			if !p.Role.atLeast(required) {
+				return newProblem(http.StatusForbidden, "this needs the "+string(required)+" role")
+			}
+			c.Set("principal", p)
+			return next(c)
+		}
+	}
+}
+
+// Lets only logged in users through, for the routes about their own data.
+func (a *authenticator) requireUser(next echo.HandlerFunc) echo.HandlerFunc {
+	return a.require(roleViewer)(func(c echo.Context) error {
+		if !currentPrincipal(c).IsUser {
+			return newProblem(http.StatusForbidden, "this needs a logged in user, not an API key")
+		}
+		return next(c)
+	})
+}
+
+// The caller, as found by require.
+func currentPrincipal(c echo.Context) *principal {
+	p, _ := c.Get("principal").(*principal)
+	return p
+}
+
+// Applies the methodRoles policy to a route.
+func (a *authenticator) authorize(next echo.HandlerFunc) echo.HandlerFunc {
+	guarded := map[role]echo.HandlerFunc{}
+	for _, required := range methodRoles {
+		guarded[required] = a.require(required)(next)
+	}
+	return func(c echo.Context) error {
+		required, ok := methodRoles[c.Request().Method]
+		if !ok {
+			return next(c)
+		}
+		return guarded[required](c)
+	}
+}
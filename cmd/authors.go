@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// An author, stored in their own collection. Books reference their authors
+// by ID (BookStore.AuthorIDs) and keep a copy of the names in BookAuthors, so
+// listing, sorting and searching books does not need a join. Renaming an
+// author updates that copy in all their books.
+// Key is the name as normalizeText gives it: it is unique, so "Mary Shelley"
+// and "mary  shelley" are the same author.
+type author struct {
+	ID          string    `bson:"_id"`
+	Name        string    `bson:"Name"`
+	Key         string    `bson:"Key"`
+	BirthYear   int       `bson:"BirthYear,omitempty"`
+	Nationality string    `bson:"Nationality,omitempty"`
+	Bio         string    `bson:"Bio,omitempty"`
+	CreatedAt   time.Time `bson:"CreatedAt"`
+	UpdatedAt   time.Time `bson:"UpdatedAt,omitempty"`
+}
+
+// An author with the IDs of their books, as listed by GET /api/authors.
+type authorSummary struct {
+	author  `bson:",inline"`
+	Count   int      `bson:"count"`
+	BookIDs []string `bson:"books"`
+}
+
+// The longest value, in characters, each field of an author accepts.
+var maxAuthorFieldLengths = map[string]int{
+	"name":        maxFieldLengths["author"],
+	"nationality": 100,
+	"bio":         5000,
+}
+
+// The authors, and the books referencing them.
+type authorStore struct {
+	authors      *mongo.Collection
+	books        *mongo.Collection
+	transactions *transactions
+}
+
+// The unique index on Key keeps one author per name. Books are looked up by
+// AuthorID, see prepareIndexes.
+func prepareAuthorIndexes(coll *mongo.Collection) error {
+	_, err := coll.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "Key", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// Returns the author with the given name, creating them if needed. This is
+// how books get their AuthorID: clients send the name, as they always did.
+func (a *authorStore) byName(ctx context.Context, name string) (author, error) {
+	upsert := func() (author, error) {
+		var found author
+		now := time.Now()
+		err := a.authors.FindOneAndUpdate(ctx,
+			bson.M{"Key": normalizeText(name)},
+			bson.M{"$setOnInsert": bson.M{
+				"_id":       primitive.NewObjectID().Hex(),
+				"Name":      name,
+				"CreatedAt": now,
+				"UpdatedAt": now,
+			}},
+			options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+		).Decode(&found)
+		return found, err
+	}
+	found, err := upsert()
+	if mongo.IsDuplicateKeyError(err) {
+		// Two requests created the author at the same time; the other one
+		// won, so now we find theirs
+		found, err = upsert()
+	}
+	return found, err
+}
+
+// Links the book to its authors, by the names in BookAuthors. The book gets
+// the names as the authors have them, e.g. "Mary Shelley" for "mary
+// shelley".
+// Without MongoDB, a is nil and the book keeps its names as they are.
+func (a *authorStore) linkBook(ctx context.Context, book *BookStore) error {
+	if a == nil {
+		return nil
+	}
+	ids, names, err := a.link(ctx, book.BookAuthors)
+	if err != nil {
+		return err
+	}
+	book.AuthorIDs = ids
+	book.BookAuthors = names
+	return nil
+}
+
+// Does the same as linkBook for a MongoDB update changing the authors, as
+// given by mergePatchUpdate.
+func (a *authorStore) linkUpdate(ctx context.Context, update bson.M) error {
+	set, _ := update["$set"].(bson.M)
+	names, ok := set["BookAuthor"].([]string)
+	if !ok {
+		return nil
+	}
+	ids, names, err := a.link(ctx, names)
+	if err != nil {
+		return err
+	}
+	set["AuthorID"] = ids
+	set["BookAuthor"] = names
+	return nil
+}
+
+// Returns the IDs of the authors with the given names, and their names as
+// the authors have them.
+func (a *authorStore) link(ctx context.Context, names []string) ([]string, []string, error) {
+	var ids, canonical []string
+	for _, name := range names {
+		found, err := a.byName(ctx, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, found.ID)
+		canonical = append(canonical, found.Name)
+	}
+	return ids, canonical, nil
+}
+
+// Lists the authors in alphabetical order, with the number and the IDs of
+// their books, those they wrote with others included. Books in the trash are
+// left out.
+func (a *authorStore) list(ctx context.Context) ([]authorSummary, error) {
+	pipeline := append(bson.A{bson.M{"$sort": bson.M{"Key": 1}}}, lookupBookIDs(a.books, "AuthorID")...)
+	cursor, err := a.authors.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	authors := []authorSummary{}
+	if err = cursor.All(ctx, &authors); err != nil {
+		return nil, err
+	}
+	return authors, nil
+}
+
+// Aggregation stages adding to each document the IDs of the books whose
+// field references it, in "books", and their number, in "count". The field
+// may be one ID, like PublisherID, or a list of them, like AuthorID: an
+// equality matches any element of a list. Books in the trash are left out.
+// The join on localField and foreignField runs on the index of the field,
+// see prepareIndexes, instead of going through every book for each
+// document; it needs MongoDB 5.0 or later with a pipeline.
+func lookupBookIDs(books *mongo.Collection, field string) bson.A {
+	return bson.A{
+		bson.M{"$lookup": bson.M{
+			"from":         books.Name(),
+			"localField":   "_id",
+			"foreignField": field,
+			"pipeline": bson.A{
+				bson.M{"$match": live(bson.M{})},
+				bson.M{"$sort": bson.M{"ID": 1}},
+				bson.M{"$project": bson.M{"_id": 0, "ID": 1}},
+			},
+			"as": "books",
+		}},
+		bson.M{"$addFields": bson.M{
+			"books": "$books.ID",
+			"count": bson.M{"$size": "$books"},
+		}},
+	}
+}
+
+// Returns the author with the given ID and their books, ordered by year,
+// with the fields of the book table only.
+// A missing author is a mongo.ErrNoDocuments.
+func (a *authorStore) find(ctx context.Context, id string) (author, []BookStore, error) {
+	var found author
+	if err := a.authors.FindOne(ctx, bson.M{"_id": id}).Decode(&found); err != nil {
+		return author{}, nil, err
+	}
+	// Only what the page of the author shows, see bookTableProjection
+	opts := options.Find().
+		SetSort(bson.D{{Key: "BookYear", Value: 1}, {Key: "_id", Value: 1}}).
+		SetProjection(bookTableProjection)
+	cursor, err := a.books.Find(ctx, live(bson.M{"AuthorID": id}), opts)
+	if err != nil {
+		return author{}, nil, err
+	}
+	books := []BookStore{}
+	if err = cursor.All(ctx, &books); err != nil {
+		return author{}, nil, err
+	}
+	return found, books, nil
+}
+
+// The names of the other authors of the books, i.e. those the author wrote
+// books with, in alphabetical order.
+func coauthors(a author, books []BookStore) []string {
+	names := []string{}
+	seen := map[string]bool{a.Key: true}
+	for _, book := range books {
+		for _, name := range book.BookAuthors {
+			if key := normalizeText(name); !seen[key] {
+				seen[key] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return normalizeText(names[i]) < normalizeText(names[j]) })
+	return names
+}
+
+// An author with the keys of the API.
+func authorToAPI(a author) map[string]interface{} {
+	response := map[string]interface{}{
+		"id":   a.ID,
+		"name": a.Name,
+	}
+	if a.BirthYear != 0 {
+		response["birthYear"] = a.BirthYear
+	}
+	if a.Nationality != "" {
+		response["nationality"] = a.Nationality
+	}
+	if a.Bio != "" {
+		response["bio"] = a.Bio
+	}
+	// Authors created before we tracked updates only have CreatedAt
+	if !a.CreatedAt.IsZero() {
+		response["createdAt"] = a.CreatedAt.UTC().Format(time.RFC3339)
+	}
+	if !a.UpdatedAt.IsZero() {
+		response["updatedAt"] = a.UpdatedAt.UTC().Format(time.RFC3339)
+	}
+	return response
+}
+
+// Builds an author from the body of a POST or PUT. As for books, the body
+// describes the whole author: the name is required, and the optional fields
+// left out are removed.
+func authorFromInput(input map[string]interface{}) (author, error) {
+	errs := fieldErrors{}
+	var result author
+	for key, raw := range input {
+		switch key {
+		case "id":
+			// Given by the URL, or by us for a new author
+		case "name", "nationality", "bio":
+			value, ok := raw.(string)
+			if !ok && raw != nil {
+				errs[key] = "must be a string"
+				continue
+			}
+			value = strings.TrimSpace(value)
+			if utf8.RuneCountInString(value) > maxAuthorFieldLengths[key] {
+				errs[key] = fmt.Sprintf("must be at most %d characters long", maxAuthorFieldLengths[key])
+				continue
+			}
+			switch key {
+			case "name":
+				result.Name = value
+			case "nationality":
+				result.Nationality = value
+			case "bio":
+				result.Bio = value
+			}
+		case "birthYear":
+			year, message := parseBirthYear(raw)
+			if message != "" {
+				errs[key] = message
+				continue
+			}
+			result.BirthYear = year
+		default:
+			errs[key] = "is not a field of an author"
+		}
+	}
+	if _, invalid := errs["name"]; !invalid && result.Name == "" {
+		errs["name"] = "is required"
+	}
+	if len(errs) > 0 {
+		return author{}, errs
+	}
+	result.Key = normalizeText(result.Name)
+	return result, nil
+}
+
+// Reads the birth year of an author, a JSON number or a string like "1797".
+// null or "" means there is none, i.e. 0.
+func parseBirthYear(raw interface{}) (int, string) {
+	var year int
+	switch value := raw.(type) {
+	case nil:
+		return 0, ""
+	case float64:
+		if value != float64(int(value)) {
+			return 0, "must be a whole number"
+		}
+		year = int(value)
+	case string:
+		if value == "" {
+			return 0, ""
+		}
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, "must be a whole number"
+		}
+		year = parsed
+	default:
+		return 0, "must be a whole number"
+	}
+	if year == 0 {
+		return 0, "cannot be 0"
+	}
+	if year > time.Now().Year() {
+		return 0, "cannot be in the future"
+	}
+	return year, ""
+}
+
+// Registers the routes of the authors. Reading is public like for books;
+// the writes get the given middleware, see registerAPIv1.
+func (a *authorStore) register(g *echo.Group, reads []echo.MiddlewareFunc, writes []echo.MiddlewareFunc) {
+	g.GET("/authors", func(c echo.Context) error {
+		authors, err := a.list(c.Request().Context())
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		response := []map[string]interface{}{}
+		for _, summary := range authors {
+			formatted := authorToAPI(summary.author)
+			formatted["count"] = summary.Count
+			formatted["books"] = summary.BookIDs
+			response = append(response, formatted)
+		}
+		return c.JSON(http.StatusOK, response)
+	}, reads...)
+
+	// The author, with their books and the authors they wrote them with
+	g.GET("/authors/:id", func(c echo.Context) error {
+		found, books, err := a.find(c.Request().Context(), c.Param("id"))
+		if err == mongo.ErrNoDocuments {
+			return newProblem(http.StatusNotFound, "author not found")
+		}
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		response := authorToAPI(found)
+		formatted := []map[string]interface{}{}
+		for _, book := range books {
+			formatted = append(formatted, bookToAPI(book))
+		}
+		response["books"] = formatted
+		response["coauthors"] = coauthors(found, books)
+		return c.JSON(http.StatusOK, response)
+	}, reads...)
+
+	g.POST("/authors", func(c echo.Context) error {
+		var input map[string]interface{}
+		if err := c.Bind(&input); err != nil {
+			return newProblem(http.StatusBadRequest, "invalid request body")
+		}
+		created, err := authorFromInput(input)
+		if err != nil {
+			return err
+		}
+		created.ID = primitive.NewObjectID().Hex()
+		created.CreatedAt = time.Now()
+		created.UpdatedAt = created.CreatedAt
+
+		_, err = a.authors.InsertOne(c.Request().Context(), created)
+		if mongo.IsDuplicateKeyError(err) {
+			return newProblem(http.StatusConflict, "another author has this name")
+		}
+		if err != nil {
+			return serverProblem(err, "could not insert author")
+		}
+		return c.JSON(http.StatusCreated, authorToAPI(created))
+	}, writes...)
+
+	// Replaces the author. A new name is copied into all their books.
+	g.PUT("/authors/:id", func(c echo.Context) error {
+		id := c.Param("id")
+		var input map[string]interface{}
+		if err := bindBody(c, &input); err != nil {
+			return newProblem(http.StatusBadRequest, "invalid request body")
+		}
+		if bodyID, ok := input["id"]; ok && bodyID != id {
+			return fieldErrors{"id": "must be the ID of the URL"}
+		}
+		updated, err := authorFromInput(input)
+		if err != nil {
+			return err
+		}
+
+		set := bson.M{"Name": updated.Name, "Key": updated.Key, "UpdatedAt": time.Now()}
+		unset := bson.M{}
+		optional := map[string]interface{}{
+			"BirthYear":   updated.BirthYear,
+			"Nationality": updated.Nationality,
+			"Bio":         updated.Bio,
+		}
+		for field, value := range optional {
+			if value == "" || value == 0 {
+				unset[field] = ""
+			} else {
+				set[field] = value
+			}
+		}
+		update := bson.M{"$set": set}
+		if len(unset) > 0 {
+			update["$unset"] = unset
+		}
+
+		// Books in the trash too, so they have the right name if restored.
+		// The name is the one at the same position as the ID.
+		rename := bson.A{bson.M{"$set": bson.M{
+			"BookAuthor": bson.M{"$map": bson.M{
+				"input": bson.M{"$range": bson.A{0, bson.M{"$size": "$AuthorID"}}},
+				"as":    "i",
+				"in": bson.M{"$cond": bson.A{
+					bson.M{"$eq": bson.A{bson.M{"$arrayElemAt": bson.A{"$AuthorID", "$$i"}}, id}},
+					// A name starting with $ would be a field otherwise
+					bson.M{"$literal": updated.Name},
+					bson.M{"$arrayElemAt": bson.A{"$BookAuthor", "$$i"}},
+				}},
+			}},
+			"Version":   bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$Version", 0}}, 1}},
+			"UpdatedAt": "$$NOW",
+		}}}
+		// The author and their books are renamed together, see
+		// transactions.go
+		err = a.transactions.run(c.Request().Context(), func(ctx context.Context) error {
+			err := a.authors.FindOneAndUpdate(ctx, bson.M{"_id": id}, update,
+				options.FindOneAndUpdate().SetReturnDocument(options.After),
+			).Decode(&updated)
+			if mongo.IsDuplicateKeyError(err) {
+				return newProblem(http.StatusConflict, "another author has this name")
+			}
+			if err == mongo.ErrNoDocuments {
+				return newProblem(http.StatusNotFound, "author not found")
+			}
+			if err != nil {
+				return serverProblem(err, "failed to update author")
+			}
+			_, err = a.books.UpdateMany(ctx,
+				bson.M{"AuthorID": id, "BookAuthor": bson.M{"$ne": updated.Name}},
+				rename,
+			)
+			if err != nil {
+				return serverProblem(err, "failed to update the books of the author")
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, authorToAPI(updated))
+	}, writes...)
+
+	// Only authors without books can be deleted; their books have to be
+	// deleted or given to another author first.
+	g.DELETE("/authors/:id", func(c echo.Context) error {
+		id := c.Param("id")
+		err := a.transactions.run(c.Request().Context(), func(ctx context.Context) error {
+			count, err := a.books.CountDocuments(ctx, live(bson.M{"AuthorID": id}))
+			if err != nil {
+				return serverProblem(err, "database error")
+			}
+			if count > 0 {
+				return newProblem(http.StatusConflict, fmt.Sprintf("the author still has %d books", count))
+			}
+
+			result, err := a.authors.DeleteOne(ctx, bson.M{"_id": id})
+			if err != nil {
+				return serverProblem(err, "could not delete author")
+			}
+			if result.DeletedCount == 0 {
+				return newProblem(http.StatusNotFound, "author not found")
+			}
+			// Books in the trash forget the author: the ID becomes "",
+			// keeping the other IDs at the position of their names. If the
+			// books are restored, they get linked to an author by name
+			// again at the next start, see migrateAuthors.
+			_, err = a.books.UpdateMany(ctx,
+				bson.M{"AuthorID": id},
+				bson.M{"$set": bson.M{"AuthorID.$[deleted]": ""}},
+				options.Update().SetArrayFilters(options.ArrayFilters{
+					Filters: []interface{}{bson.M{"deleted": id}},
+				}),
+			)
+			if err != nil {
+				return serverProblem(err, "could not update the books of the author")
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "author deleted"})
+	}, writes...)
+}
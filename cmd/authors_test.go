@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestPutAuthor(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"without the id", `{"name": "Mary Shelley", "birthYear": 1797}`, http.StatusOK},
+		{"with the id of the URL", `{"id": "a1", "name": "Mary Shelley"}`, http.StatusOK},
+		{"with another id", `{"id": "a2", "name": "Mary Shelley"}`, http.StatusUnprocessableEntity},
+		{"without a name", `{"birthYear": 1797}`, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withMockMongo(t, func(mt *mtest.T) {
+				authors := &authorStore{authors: mt.Coll, books: mt.Coll}
+				e := echo.New()
+				e.HTTPErrorHandler = problemErrorHandler
+				authors.register(e.Group("/api"), nil, nil)
+
+				mt.AddMockResponses(
+					// The author, renamed
+					mockOK(bson.E{Key: "value", Value: bson.D{{Key: "_id", Value: "a1"}, {Key: "Name", Value: "Mary Shelley"}}}),
+					// Their books
+					mockOK(bson.E{Key: "n", Value: 0}, bson.E{Key: "nModified", Value: 0}),
+				)
+				rec := sendJSON(e, http.MethodPut, "/api/authors/a1", tt.body)
+				if rec.Code != tt.status {
+					t.Fatalf("got %d, want %d: %s", rec.Code, tt.status, rec.Body)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How many books a restore inserts at once.
+const restoreBatchSize = 500
+
+// Backups are named after the time they were taken, in UTC, e.g.
+// books-20261014T120000.000Z.ndjson.gz, so they sort by age. Restores only
+// accept such names, which cannot point out of the directory.
+const backupTimeLayout = "20060102T150405.000Z"
+
+var backupName = regexp.MustCompile(`^books-\d{8}T\d{6}\.\d{3}Z\.ndjson\.gz$`)
+
+// Snapshots of the books collection, kept as files in a directory. Unlike
+// the export, see exportBooks, a backup holds the documents exactly as they
+// are stored, the trash included, so restoring it gives the collection back
+// as it was. Each line of the (gzipped) file is a document in canonical
+// Extended JSON, see
+// https://www.mongodb.com/docs/manual/reference/mongodb-extended-json/
+// which keeps the types JSON does not have, like dates and ObjectIDs.
+type backupStore struct {
+	dir          string
+	books        *mongo.Collection
+	transactions *transactions
+}
+
+// A backup file, as listed by GET /admin/backups.
+type backupInfo struct {
+	Name string `json:"name"`
+	// The number of documents, only known right after the backup was taken
+	Books     int64     `json:"books,omitempty"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Writes every document of the collection into a new backup file. The file
+// is written under a temporary name first, so that a failed backup never
+// looks like a complete one.
+func (s *backupStore) snapshot(ctx context.Context) (backupInfo, error) {
+	if err := os.MkdirAll(s.dir, 0o750); err != nil {
+		return backupInfo{}, err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".backup-*")
+	if err != nil {
+		return backupInfo{}, err
+	}
+	// Does nothing once the file is renamed
+	defer os.Remove(tmp.Name())
+
+	createdAt := time.Now().UTC()
+	count, err := s.write(ctx, tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return backupInfo{}, err
+	}
+	name := "books-" + createdAt.Format(backupTimeLayout) + ".ndjson.gz"
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, name)); err != nil {
+		return backupInfo{}, err
+	}
+	stat, err := os.Stat(filepath.Join(s.dir, name))
+	if err != nil {
+		return backupInfo{}, err
+	}
+	return backupInfo{Name: name, Books: count, Size: stat.Size(), CreatedAt: createdAt}, nil
+}
+
+// Writes the documents of the collection, one per line, gzipped. They are
+// read one at a time, see streamBookTable.
+func (s *backupStore) write(ctx context.Context, w io.Writer) (int64, error) {
+	cursor, err := s.books.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	gz := gzip.NewWriter(w)
+	var count int64
+	for cursor.Next(ctx) {
+		line, err := bson.MarshalExtJSON(cursor.Current, true, false)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := gz.Write(append(line, '\n')); err != nil {
+			return 0, err
+		}
+		count++
+	}
+	if err := cursor.Err(); err != nil {
+		return 0, err
+	}
+	return count, gz.Close()
+}
+
+// Calls fn with every document of the backup, in order, and returns how many
+// there were. A damaged file is an error, possibly after some calls.
+func (s *backupStore) read(name string, fn func(doc bson.D) error) (int64, error) {
+	file, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return 0, err
+	}
+	lines := bufio.NewReader(gz)
+
+	var count int64
+	for {
+		line, err := lines.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return count, nil
+		}
+		if err != nil && err != io.EOF {
+			return count, err
+		}
+		var doc bson.D
+		if err := bson.UnmarshalExtJSON(line, true, &doc); err != nil {
+			return count, err
+		}
+		if err := fn(doc); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// Takes a backup of the books, see snapshot.
+func (s *backupStore) create(c echo.Context) error {
+	info, err := s.snapshot(c.Request().Context())
+	if err != nil {
+		return serverProblem(err, "could not write the backup")
+	}
+	return c.JSON(http.StatusCreated, info)
+}
+
+// Lists the backups, newest first.
+func (s *backupStore) list(c echo.Context) error {
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		// No backup was taken yet
+		return c.JSON(http.StatusOK, []backupInfo{})
+	}
+	if err != nil {
+		return serverProblem(err, "could not list the backups")
+	}
+	backups := []backupInfo{}
+	for _, entry := range entries {
+		if !backupName.MatchString(entry.Name()) {
+			continue
+		}
+		stat, err := entry.Info()
+		if err != nil {
+			return serverProblem(err, "could not list the backups")
+		}
+		backups = append(backups, backupInfo{Name: entry.Name(), Size: stat.Size(), CreatedAt: stat.ModTime().UTC()})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Name > backups[j].Name })
+	return c.JSON(http.StatusOK, backups)
+}
+
+// Replaces every document of the collection with those of a backup, given
+// as {"name": "books-...ndjson.gz"}. With "dryRun": true, the backup is only
+// read, and the response tells how many books it would restore and replace.
+// The backup is read completely before anything changes, so a damaged file
+// is refused. The books as they are before the restore are backed up first:
+// restoring that backup undoes the restore.
+// On a replica set, the restore is a transaction, see transactions.go, which
+// MongoDB limits to a minute by default: very large collections may need
+// mongorestore instead. Elsewhere, a restore failing halfway leaves part of
+// the backup in the collection, until the backup taken before is restored.
+func (s *backupStore) restore(c echo.Context) error {
+	var input struct {
+		Name   string `json:"name"`
+		DryRun bool   `json:"dryRun"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return newProblem(http.StatusBadRequest, "invalid request body")
+	}
+	if !backupName.MatchString(input.Name) {
+		return fieldErrors{"name": "must be the name of a backup, see GET /admin/backups"}
+	}
+
+	count, err := s.read(input.Name, func(bson.D) error { return nil })
+	if errors.Is(err, fs.ErrNotExist) {
+		return newProblem(http.StatusNotFound, "backup not found")
+	}
+	if err != nil {
+		return newProblem(http.StatusUnprocessableEntity, "the backup is damaged: "+err.Error())
+	}
+	current, err := s.books.CountDocuments(c.Request().Context(), bson.M{})
+	if err != nil {
+		return serverProblem(err, "database error")
+	}
+	result := map[string]interface{}{
+		"name":     input.Name,
+		"books":    count,
+		"replaced": current,
+		"dryRun":   input.DryRun,
+	}
+	if input.DryRun {
+		return c.JSON(http.StatusOK, result)
+	}
+
+	before, err := s.snapshot(c.Request().Context())
+	if err != nil {
+		return serverProblem(err, "could not back up the books before restoring")
+	}
+	err = s.transactions.run(c.Request().Context(), func(ctx context.Context) error {
+		if _, err := s.books.DeleteMany(ctx, bson.M{}); err != nil {
+			return err
+		}
+		batch := []interface{}{}
+		insert := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			_, err := s.books.InsertMany(ctx, batch)
+			batch = []interface{}{}
+			return err
+		}
+		_, err := s.read(input.Name, func(doc bson.D) error {
+			batch = append(batch, doc)
+			if len(batch) < restoreBatchSize {
+				return nil
+			}
+			return insert()
+		})
+		if err != nil {
+			return err
+		}
+		return insert()
+	})
+	if err != nil {
+		return serverProblem(err, "could not restore the backup, the books before it are in "+before.Name)
+	}
+	result["backup"] = before.Name
+	return c.JSON(http.StatusOK, result)
+}
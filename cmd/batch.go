@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The most books a single batch request may contain.
+const maxBatchSize = 1000
+
+// The outcome for one element of a batch request. Index is the position of
+// the element in the request body, and Status the code the equivalent single
+// request would have received.
+// Validation failures list the offending fields in Errors.
+type batchResult struct {
+	Index  int         `json:"index"`
+	ID     string      `json:"id,omitempty"`
+	Status int         `json:"status"`
+	Error  string      `json:"error,omitempty"`
+	Errors fieldErrors `json:"errors,omitempty"`
+}
+
+// Records a failed validation in a batch result.
+func (r *batchResult) invalid(err error) {
+	r.Status = http.StatusUnprocessableEntity
+	r.Error = "invalid fields"
+	if errs, ok := err.(fieldErrors); ok {
+		r.Errors = errs
+	} else {
+		r.Error = err.Error()
+	}
+}
+
+// Handles POST /api/books/batch. The body is an array of books, in the same
+// format as POST /api/books, see insertBooks. One bad book does not fail the
+// others, so the response is a 207 Multi-Status with one result per book, in
+// the order of the request.
+// With `?atomic=true`, the batch is inserted entirely or not at all, in a
+// transaction when MongoDB has them, see insertBatchAtomically.
+func createBooksBatch(c echo.Context, coll *mongo.Collection, authors *authorStore, tx *transactions) error {
+	atomic, err := parseBoolParam(c, "atomic")
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+	var inputs []map[string]interface{}
+	if err := c.Bind(&inputs); err != nil {
+		return newProblem(http.StatusBadRequest, "request body must be an array of books")
+	}
+	if len(inputs) == 0 || len(inputs) > maxBatchSize {
+		return newProblem(http.StatusBadRequest,
+			fmt.Sprintf("a batch must contain between 1 and %d books", maxBatchSize))
+	}
+	results := insertBooks(c, coll, authors, tx, inputs, atomic)
+	return c.JSON(http.StatusMultiStatus, map[string]interface{}{"results": results})
+}
+
+// Inserts the books of a batch, given as the bodies of POST /api/books.
+// Every book is validated and checked for duplicates on its own, and all the
+// valid ones are inserted with a single InsertMany: one round-trip for the
+// whole batch instead of one per book. Returns one result per book, in
+// order.
+func insertBooks(c echo.Context, coll *mongo.Collection, authors *authorStore, tx *transactions, inputs []map[string]interface{}, atomic bool) []batchResult {
+	results := make([]batchResult, len(inputs))
+	var docs []interface{}
+	// For every document we insert, the index of its book in the request.
+	var positions []int
+	// In atomic mode, the MongoIDs of the documents, to remove them again
+	var ids []primitive.ObjectID
+	// The IDs of the books earlier in this batch
+	seen := map[string]bool{}
+	now := time.Now()
+
+	for i, input := range inputs {
+		results[i].Index = i
+		book, err := bookFromCreateInput(input)
+		if err != nil {
+			results[i].invalid(err)
+			continue
+		}
+		results[i].ID = book.ID
+		if err := authors.linkBook(c.Request().Context(), &book); err != nil {
+			results[i].Status = http.StatusInternalServerError
+			results[i].Error = "database error"
+			continue
+		}
+
+		// Same duplicate rule as for a single POST. Within the batch, the
+		// IDs are unique as well, identical books or not.
+		count, err := coll.CountDocuments(c.Request().Context(), live(duplicateFilter(book)))
+		if err != nil {
+			results[i].Status = http.StatusInternalServerError
+			results[i].Error = "database error"
+			continue
+		}
+		if count > 0 {
+			results[i].Status = http.StatusConflict
+			results[i].Error = "duplicate book entry"
+			continue
+		}
+		if seen[book.ID] {
+			results[i].Status = http.StatusConflict
+			results[i].Error = "another book with this ID exists"
+			continue
+		}
+		seen[book.ID] = true
+		book.Version = 1
+		book.CreatedAt = now
+		book.UpdatedAt = now
+
+		positions = append(positions, i)
+		results[i].Status = http.StatusCreated
+		if atomic {
+			book.MongoID = primitive.NewObjectID()
+			ids = append(ids, book.MongoID)
+		}
+		docs = append(docs, book)
+	}
+
+	if atomic {
+		if len(docs) < len(inputs) {
+			// Another book failed, none is inserted
+			failDependents(results, positions, -1)
+		} else {
+			insertBatchAtomically(c, coll, tx, docs, ids, positions, results)
+		}
+	} else if len(docs) > 0 {
+		// Unordered, so MongoDB keeps going after a failed insert and
+		// tells us about every failure at once.
+		_, err := coll.InsertMany(c.Request().Context(), docs, options.InsertMany().SetOrdered(false))
+		var bulkErr mongo.BulkWriteException
+		if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil {
+			for _, writeErr := range bulkErr.WriteErrors {
+				i := positions[writeErr.Index]
+				if mongo.IsDuplicateKeyError(writeErr) {
+					// The ID is taken, by another book or one earlier
+					// in this batch
+					results[i].Status = http.StatusConflict
+					results[i].Error = "another book with this ID exists"
+					continue
+				}
+				results[i].Status = http.StatusInternalServerError
+				results[i].Error = "could not insert book"
+			}
+		} else if err != nil {
+			for _, i := range positions {
+				results[i].Status = http.StatusInternalServerError
+				results[i].Error = "could not insert book"
+			}
+		}
+	}
+	return results
+}
+
+// Inserts the documents of an atomic batch, all of them or none. The insert
+// is ordered, so MongoDB stops at the first failure. In a transaction, the
+// books inserted before are never seen; without one, they are removed again
+// by their MongoIDs. The book that failed gets its own status, and the others
+// 424 Failed Dependency.
+func insertBatchAtomically(c echo.Context, coll *mongo.Collection, tx *transactions, docs []interface{}, ids []primitive.ObjectID, positions []int, results []batchResult) {
+	err := tx.run(c.Request().Context(), func(ctx context.Context) error {
+		_, err := coll.InsertMany(ctx, docs)
+		if err != nil && !inTransaction(ctx) {
+			if _, undoErr := coll.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}}); undoErr != nil {
+				requestLogger(c).Error("could not remove the books of a failed batch", "error", undoErr)
+			}
+		}
+		return err
+	})
+	if err == nil {
+		return
+	}
+
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil && len(bulkErr.WriteErrors) > 0 &&
+		mongo.IsDuplicateKeyError(bulkErr.WriteErrors[0]) {
+		// The ID was taken by a book inserted since we checked
+		failed := positions[bulkErr.WriteErrors[0].Index]
+		failDependents(results, positions, failed)
+		results[failed].Status = http.StatusConflict
+		results[failed].Error = "another book with this ID exists"
+		return
+	}
+	requestLogger(c).Error("could not insert a batch of books", "error", err)
+	for _, i := range positions {
+		results[i].Status = http.StatusInternalServerError
+		results[i].Error = "could not insert book"
+	}
+}
+
+// Marks the books of an atomic batch as not inserted, except the one at the
+// index failed, which has its own status.
+func failDependents(results []batchResult, positions []int, failed int) {
+	for _, i := range positions {
+		if i != failed {
+			results[i].Status = http.StatusFailedDependency
+			results[i].Error = "not inserted, another book of the batch failed"
+		}
+	}
+}
+
+// The filter finding books identical to the given one, ignoring the MongoID.
+// Empty optional fields are not stored, so they match books without them.
+func duplicateFilter(book BookStore) bson.M {
+	filter := bson.M{
+		"ID":         book.ID,
+		"BookName":   book.BookName,
+		"BookAuthor": book.BookAuthors,
+	}
+	if book.BookEdition == "" {
+		filter["BookEdition"] = bson.M{"$in": bson.A{"", nil}}
+	} else {
+		filter["BookEdition"] = book.BookEdition
+	}
+	numbers := map[string]int{
+		"BookPages": book.BookPages,
+		"BookYear":  book.BookYear,
+	}
+	for field, value := range numbers {
+		if value == 0 {
+			filter[field] = nil
+		} else {
+			filter[field] = value
+		}
+	}
+	return filter
+}
+
+// The body of DELETE /api/books. Exactly one of IDs and Filter selects the
+// books to delete, and Confirm must be set: a bulk delete cannot be undone.
+type bulkDeleteRequest struct {
+	IDs     []string          `json:"ids"`
+	Filter  map[string]string `json:"filter"`
+	Confirm bool              `json:"confirm"`
+}
+
+// Handles DELETE /api/books, deleting either the books with the given IDs, or
+// all the books matching a filter, e.g.
+//
+//	{"filter": {"author": "Mary Shelley"}, "confirm": true}
+//
+// Unlike the filters of GET /api/books, values must match exactly here, so a
+// typo cannot wipe more books than intended.
+func deleteBooksBatch(c echo.Context, coll *mongo.Collection) error {
+	var input bulkDeleteRequest
+	if err := c.Bind(&input); err != nil {
+		return newProblem(http.StatusBadRequest, "invalid request body")
+	}
+
+	filter := bson.M{}
+	switch {
+	case len(input.IDs) > 0 && len(input.Filter) > 0:
+		return newProblem(http.StatusBadRequest, "give either ids or filter, not both")
+	case len(input.IDs) > 0:
+		filter["ID"] = bson.M{"$in": input.IDs}
+	case len(input.Filter) > 0:
+		for key, value := range input.Filter {
+			mongoField, ok := bookFields[key]
+			if !ok {
+				return newProblem(http.StatusBadRequest, fmt.Sprintf("unknown field %q", key))
+			}
+			filter[mongoField] = storedValue(key, value)
+		}
+	default:
+		return newProblem(http.StatusBadRequest, "ids or filter is required")
+	}
+
+	if !input.Confirm {
+		return newProblem(http.StatusBadRequest, "set confirm to true to delete these books")
+	}
+
+	// As for a single book, the books only go to the trash
+	result, err := coll.UpdateMany(c.Request().Context(), live(filter), trashUpdate())
+	if err != nil {
+		return serverProblem(err, "could not delete books")
+	}
+
+	return c.JSON(http.StatusOK, map[string]int64{"deleted": result.MatchedCount})
+}
+
+// One element of PATCH /api/books/batch: the book to change, and a JSON Merge
+// Patch of the changes, as for PATCH /api/books/:id.
+type batchUpdate struct {
+	ID      string                 `json:"id"`
+	Changes map[string]interface{} `json:"changes"`
+}
+
+// Handles PATCH /api/books/batch, e.g. to fix the edition of many books at
+// once. All the updates are sent to MongoDB in one bulk write. As for batch
+// creation, every element gets its own result in a 207 Multi-Status.
+// The books as they were before are read beforehand and kept as revisions,
+// see revisions.go: a change made by another request in between is missing
+// from their history.
+func updateBooksBatch(c echo.Context, coll *mongo.Collection, authors *authorStore, revisions *revisionStore) error {
+	var inputs []batchUpdate
+	if err := c.Bind(&inputs); err != nil {
+		return newProblem(http.StatusBadRequest, "request body must be an array of {id, changes}")
+	}
+	if len(inputs) == 0 || len(inputs) > maxBatchSize {
+		return newProblem(http.StatusBadRequest,
+			fmt.Sprintf("a batch must contain between 1 and %d updates", maxBatchSize))
+	}
+
+	// A bulk write only tells how many documents matched in total, so we
+	// look up beforehand which of the books exist.
+	var ids []string
+	for _, input := range inputs {
+		ids = append(ids, input.ID)
+	}
+	existing, err := existingBooks(c.Request().Context(), coll, ids)
+	if err != nil {
+		return serverProblem(err, "database error")
+	}
+
+	results := make([]batchResult, len(inputs))
+	var models []mongo.WriteModel
+	var positions []int
+	for i, input := range inputs {
+		results[i] = batchResult{Index: i, ID: input.ID}
+		if input.ID == "" {
+			results[i].Status = http.StatusBadRequest
+			results[i].Error = "id is required"
+			continue
+		}
+		update, err := mergePatchUpdate(input.ID, input.Changes)
+		if err != nil {
+			results[i].invalid(err)
+			continue
+		}
+		if _, ok := existing[input.ID]; !ok {
+			results[i].Status = http.StatusNotFound
+			results[i].Error = "book not found"
+			continue
+		}
+
+		if err := authors.linkUpdate(c.Request().Context(), update); err != nil {
+			results[i].Status = http.StatusInternalServerError
+			results[i].Error = "database error"
+			continue
+		}
+
+		results[i].Status = http.StatusOK
+		if len(update) == 0 {
+			continue
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(live(bson.M{"ID": input.ID})).
+			SetUpdate(update))
+		positions = append(positions, i)
+	}
+
+	if len(models) > 0 {
+		_, err := coll.BulkWrite(c.Request().Context(), models, options.BulkWrite().SetOrdered(false))
+		var bulkErr mongo.BulkWriteException
+		if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil {
+			for _, writeErr := range bulkErr.WriteErrors {
+				i := positions[writeErr.Index]
+				results[i].Status = http.StatusInternalServerError
+				results[i].Error = "failed to update book"
+			}
+		} else if err != nil {
+			for _, i := range positions {
+				results[i].Status = http.StatusInternalServerError
+				results[i].Error = "failed to update book"
+			}
+		}
+		for _, i := range positions {
+			if results[i].Status == http.StatusOK {
+				revisions.record(c.Request().Context(), existing[results[i].ID])
+			}
+		}
+	}
+
+	return c.JSON(http.StatusMultiStatus, map[string]interface{}{"results": results})
+}
+
+// Returns the books with the given IDs stored in the database, and not in
+// the trash, by ID.
+func existingBooks(ctx context.Context, coll *mongo.Collection, ids []string) (map[string]BookStore, error) {
+	cursor, err := coll.Find(ctx, live(bson.M{"ID": bson.M{"$in": ids}}))
+	if err != nil {
+		return nil, err
+	}
+	var found []BookStore
+	if err = cursor.All(ctx, &found); err != nil {
+		return nil, err
+	}
+
+	existing := map[string]BookStore{}
+	for _, book := range found {
+		existing[book.ID] = book
+	}
+	return existing, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/labstack/echo/v4"
+)
+
+// When the storage of the books cannot be reached, every request of the main
+// routes would wait for its timeout before failing, and the requests would
+// stack up meanwhile. A circuit breaker stops that: after
+// STORAGE_BREAKER_FAILURES failures in a row, it opens, and the operations of
+// the repository fail at once with 503 Service Unavailable, for
+// STORAGE_BREAKER_COOLDOWN. Then it is half-open: a single operation tries
+// the storage again, and the breaker closes if it works, or opens again
+// otherwise. Only the failures of the storage count, see
+// storageUnavailable: a book not found or a conflict is an answer.
+//
+// The state of the breaker is the storage_circuit_state metric, and /readyz
+// tells it, so a load balancer routes around an instance that cannot reach
+// its storage.
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	}
+	return "closed"
+}
+
+type circuitBreaker struct {
+	// The failures in a row that open it, and how long it stays open
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	// Whether the operation trying the storage, when half-open, is running
+	probing bool
+
+	// How many times it opened, for the metrics
+	opened atomic.Int64
+}
+
+// The error of the operations refused by an open breaker.
+type circuitOpenError struct {
+	// When the breaker lets an operation through again
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("the circuit breaker of the storage is open, for %s", e.retryAfter.Round(time.Second))
+}
+
+// The breaker of the settings, nil without one.
+func newCircuitBreaker(settings config.Storage) *circuitBreaker {
+	if settings.BreakerFailures == 0 {
+		return nil
+	}
+	return &circuitBreaker{threshold: settings.BreakerFailures, cooldown: settings.BreakerCooldown}
+}
+
+// Whether an operation may go to the storage, and whether it is the one
+// trying it when half-open. The error is a *circuitOpenError otherwise.
+func (b *circuitBreaker) allow() (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if wait := b.cooldown - time.Since(b.openedAt); wait > 0 {
+			return false, &circuitOpenError{retryAfter: wait}
+		}
+		b.state = breakerHalfOpen
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return false, &circuitOpenError{retryAfter: time.Second}
+		}
+		b.probing = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// Counts the outcome of an operation allow let through.
+func (b *circuitBreaker) record(probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		// The client left, which tells nothing about the storage
+	case err != nil && storageUnavailable(err):
+		b.failures++
+		if probe || b.state == breakerClosed && b.failures >= b.threshold {
+			b.state = breakerOpen
+			b.openedAt = time.Now()
+			b.failures = 0
+			b.opened.Add(1)
+			slog.Warn("the storage is unavailable, the circuit breaker opens", "cooldown", b.cooldown, "error", err)
+		}
+	case probe:
+		b.state = breakerClosed
+		b.failures = 0
+		slog.Info("the storage answers again, the circuit breaker closes")
+	case b.state == breakerClosed:
+		b.failures = 0
+	}
+}
+
+func (b *circuitBreaker) current() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		// The next operation will try the storage
+		return breakerHalfOpen
+	}
+	return b.state
+}
+
+// Runs an operation of the storage, if the breaker lets it.
+func guarded[T any](b *circuitBreaker, call func() (T, error)) (T, error) {
+	probe, err := b.allow()
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	result, err := call()
+	b.record(probe, err)
+	return result, err
+}
+
+func guardedErr(b *circuitBreaker, call func() error) error {
+	_, err := guarded(b, func() (struct{}, error) {
+		return struct{}{}, call()
+	})
+	return err
+}
+
+// A BookRepository behind a circuit breaker.
+type breakerRepository struct {
+	repo    BookRepository
+	breaker *circuitBreaker
+}
+
+func (r *breakerRepository) FindAll(ctx context.Context, query bookQuery) (bookList, error) {
+	return guarded(r.breaker, func() (bookList, error) {
+		return r.repo.FindAll(ctx, query)
+	})
+}
+
+func (r *breakerRepository) FindByID(ctx context.Context, id string) (BookStore, error) {
+	return guarded(r.breaker, func() (BookStore, error) {
+		return r.repo.FindByID(ctx, id)
+	})
+}
+
+func (r *breakerRepository) Insert(ctx context.Context, book BookStore) error {
+	return guardedErr(r.breaker, func() error {
+		return r.repo.Insert(ctx, book)
+	})
+}
+
+func (r *breakerRepository) Update(ctx context.Context, id string, book BookStore, versions []int64) error {
+	return guardedErr(r.breaker, func() error {
+		return r.repo.Update(ctx, id, book, versions)
+	})
+}
+
+func (r *breakerRepository) Delete(ctx context.Context, id string, versions []int64) error {
+	return guardedErr(r.breaker, func() error {
+		return r.repo.Delete(ctx, id, versions)
+	})
+}
+
+func (r *breakerRepository) Archive(ctx context.Context, id string, archived bool, versions []int64) error {
+	return guardedErr(r.breaker, func() error {
+		return r.repo.Archive(ctx, id, archived, versions)
+	})
+}
+
+func (r *breakerRepository) Search(ctx context.Context, query string, filter bookFilter, limit int64) ([]searchHit, error) {
+	return guarded(r.breaker, func() ([]searchHit, error) {
+		return r.repo.Search(ctx, query, filter, limit)
+	})
+}
+
+// The ID of no book, that /readyz looks for.
+const readinessProbeID = "readyz"
+
+// Handles GET /readyz: 200 when the storage answers, 503 when it does not,
+// or when the breaker is open, or the instance is draining, see drain.go.
+// The lookup of a book that does not exist goes through the breaker like any
+// other, so when half-open, it may be the one trying the storage.
+func readiness(repo BookRepository, breaker *circuitBreaker, drain *drainState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if drain.draining() {
+			return c.JSON(http.StatusServiceUnavailable, map[string]interface{}{"status": "draining"})
+		}
+		_, err := repo.FindByID(c.Request().Context(), readinessProbeID)
+		ready := err == nil || errors.Is(err, errBookNotFound)
+		response := map[string]interface{}{"status": "ready"}
+		if breaker != nil {
+			response["storageBreaker"] = breaker.current().String()
+		}
+		if !ready {
+			var open *circuitOpenError
+			if !errors.As(err, &open) {
+				// The breaker logs when it opens
+				requestLogger(c).Warn("not ready, the storage does not answer", "error", err)
+			}
+			response["status"] = "unavailable"
+			return c.JSON(http.StatusServiceUnavailable, response)
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// The key of the generation of the cached responses in Redis, see
+// responseCache.
+const cacheGenerationKey = "cache:generation"
+
+// Keeps the responses of the most read routes in Redis, when REDIS_URL is
+// set, so they are not built from the database again for every request.
+// Invalidating single entries would mean knowing every listing a book
+// appears in. Instead, every key contains the current generation, which each
+// change of the data increments, see invalidate: the responses cached before
+// are never read again and expire with their TTL.
+// Without Redis, or when it fails, the requests are simply answered without
+// the cache.
+type responseCache struct {
+	client *redis.Client
+	// The TTL of the listings and pages, and the one of single books
+	ttl     time.Duration
+	bookTTL time.Duration
+
+	hits   atomic.Int64
+	misses atomic.Int64
+	errors atomic.Int64
+}
+
+// The headers never cached. The compression, running before the cache, adds
+// its own to the headers of the handler, see compressWriter: the cached body
+// is the uncompressed one, which a HIT compresses again, if the client
+// accepts it. Its Vary: Accept-Encoding is left out as well, but not the
+// Vary of the handler.
+var uncachedHeaders = map[string]bool{
+	"X-Cache":                  true,
+	echo.HeaderContentEncoding: true,
+	echo.HeaderContentLength:   true,
+}
+
+// A response as stored in Redis. Header only has the headers the handler
+// added, not the ones of the middleware running before the cache, see
+// uncachedHeaders.
+type cachedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// Connects to the Redis of the settings, e.g. redis://localhost:6379/0.
+// Without a URL, the cache is disabled. The listings and the pages change
+// with every book, so they are kept a shorter time than a single book.
+func newResponseCache(settings config.Cache) (*responseCache, error) {
+	cache := &responseCache{ttl: settings.TTL, bookTTL: settings.BookTTL}
+	if settings.RedisURL == "" {
+		return cache, nil
+	}
+	options, err := redis.ParseURL(settings.RedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("REDIS_URL is invalid: %w", err)
+	}
+	cache.client = redis.NewClient(options)
+	if err = cache.client.Ping(context.Background()).Err(); err != nil {
+		return nil, fmt.Errorf("could not connect to Redis: %w", err)
+	}
+	return cache, nil
+}
+
+// Closes the connections to Redis, when the server stops.
+func (rc *responseCache) close() {
+	if rc.client == nil {
+		return
+	}
+	if err := rc.client.Close(); err != nil {
+		slog.Error("could not close the connections to Redis", "error", err)
+	}
+}
+
+// The key of the response to the request in the given generation. The
+// response depends on the path with its query, and on the format the client
+// accepts, see negotiateFormat.
+func cacheKey(c echo.Context, generation int64) string {
+	sum := sha256.Sum256([]byte(c.Request().RequestURI + "\n" + c.Request().Header.Get(echo.HeaderAccept)))
+	return fmt.Sprintf("cache:%d:%s", generation, base64.RawURLEncoding.EncodeToString(sum[:]))
+}
+
+// Serves GET requests from the cache, and stores the successful responses
+// to the requests it could not serve for ttl. A cached response carrying an ETag is still
+// answered with 304 Not Modified when the client has it already. The
+// X-Cache header tells whether the response came from the cache.
+func (rc *responseCache) middleware(ttl time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if rc.client == nil || c.Request().Method != http.MethodGet {
+				return next(c)
+			}
+			ctx := c.Request().Context()
+
+			// Read before the handler: a change during the request makes
+			// the response part of the previous generation
+			generation, err := rc.client.Get(ctx, cacheGenerationKey).Int64()
+			if err != nil && err != redis.Nil {
+				rc.errors.Add(1)
+				requestLogger(c).Error("could not read the cache generation", "error", err)
+				return next(c)
+			}
+			key := cacheKey(c, generation)
+
+			raw, err := rc.client.Get(ctx, key).Bytes()
+			if err == nil {
+				var cached cachedResponse
+				if err = json.Unmarshal(raw, &cached); err == nil {
+					rc.hits.Add(1)
+					return cached.send(c)
+				}
+			}
+			if err != redis.Nil {
+				rc.errors.Add(1)
+				requestLogger(c).Error("could not read a cached response", "key", key, "error", err)
+			}
+			rc.misses.Add(1)
+
+			before := c.Response().Header().Clone()
+			recorder := &cacheRecorder{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = recorder
+			c.Response().Header().Set("X-Cache", "MISS")
+			if err := next(c); err != nil {
+				return err
+			}
+			if c.Response().Status != http.StatusOK {
+				return nil
+			}
+
+			cached := cachedResponse{Status: c.Response().Status, Header: http.Header{}, Body: recorder.body.Bytes()}
+			for name, values := range c.Response().Header() {
+				if uncachedHeaders[name] {
+					continue
+				}
+				added := values[len(before[name]):]
+				if name == echo.HeaderVary {
+					added = slices.DeleteFunc(slices.Clone(added), func(value string) bool {
+						return value == echo.HeaderAcceptEncoding
+					})
+				}
+				if len(added) > 0 {
+					cached.Header[name] = added
+				}
+			}
+			encoded, err := json.Marshal(cached)
+			if err == nil {
+				err = rc.client.Set(ctx, key, encoded, ttl).Err()
+			}
+			if err != nil {
+				rc.errors.Add(1)
+				requestLogger(c).Error("could not cache a response", "key", key, "error", err)
+			}
+			return nil
+		}
+	}
+}
+
+// Writes a cached response, or 304 Not Modified, see sendWithETag.
+func (cached cachedResponse) send(c echo.Context) error {
+	header := c.Response().Header()
+	for name, values := range cached.Header {
+		for _, value := range values {
+			header.Add(name, value)
+		}
+	}
+	header.Set("X-Cache", "HIT")
+	if etag := cached.Header.Get("ETag"); etag != "" && etagMatches(c.Request().Header.Get("If-None-Match"), etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	c.Response().WriteHeader(cached.Status)
+	_, err := c.Response().Write(cached.Body)
+	return err
+}
+
+// Keeps a copy of the body written by the handler.
+type cacheRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *cacheRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// Starts a new generation after every request that may have changed the
+// data, i.e. every successful request with another method than GET, HEAD or
+// OPTIONS, whichever route it went to.
+func (rc *responseCache) invalidate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+		switch c.Request().Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return err
+		}
+		if err != nil || c.Response().Status >= http.StatusBadRequest {
+			return err
+		}
+		// Even if the client left meanwhile: the change is made
+		if incrErr := rc.newGeneration(context.WithoutCancel(c.Request().Context())); incrErr != nil {
+			requestLogger(c).Error("could not make the cached responses stale", "error", incrErr)
+		}
+		return err
+	}
+}
+
+// Makes every cached response stale. The change stream calls this as well,
+// for the changes made elsewhere, see changes.go.
+func (rc *responseCache) newGeneration(ctx context.Context) error {
+	if rc.client == nil {
+		return nil
+	}
+	if err := rc.client.Incr(ctx, cacheGenerationKey).Err(); err != nil {
+		// The cached responses may now be stale until they expire
+		rc.errors.Add(1)
+		return err
+	}
+	return nil
+}
+
+// Handles GET /api/admin/cache, the counters of the cache since the start.
+func (rc *responseCache) stats(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"enabled": rc.client != nil,
+		"ttl":     rc.ttl.String(),
+		"bookTtl": rc.bookTTL.String(),
+		"hits":    rc.hits.Load(),
+		"misses":  rc.misses.Load(),
+		"errors":  rc.errors.Load(),
+	})
+}
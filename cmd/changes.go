@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How long to wait before following the change stream again after it failed.
+const changeStreamRetry = 5 * time.Second
+
+// How many changes a slow listener may lag behind before it misses some,
+// see bookChanges.subscribe.
+const changeBuffer = 64
+
+// How many of the last changes are kept, for the clients of /api/events
+// coming back after a disconnection, see bookChanges.subscribeAfter.
+const changeHistory = 1000
+
+// A change of a live book. Moving a book to the trash is a deletion, and
+// restoring it a creation, since only live books are visible.
+type bookChange struct {
+	// "created", "updated" or "deleted"
+	Type string
+	// The book after the change, or before it for a deletion
+	Book BookStore
+	// The number of the change on this instance, from 1, see publish
+	Seq uint64
+}
+
+// An event of the change stream, with the fields we need, see
+// https://www.mongodb.com/docs/manual/reference/change-events/
+type changeEvent struct {
+	OperationType string `bson:"operationType"`
+	// The whole book after the change. For updates, MongoDB reads it again
+	// after the update, so it is missing when the book was deleted since.
+	FullDocument      *BookStore `bson:"fullDocument"`
+	UpdateDescription struct {
+		UpdatedFields bson.M   `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+}
+
+// Follows the change stream of the books collection: every change, whoever
+// made it, makes the in-memory indexes of the search and the cached
+// responses stale, and is passed on to the listeners of the live updates.
+// The middleware of the routes changing books still invalidate right after
+// a write through this instance, so its client never reads a response older
+// than its write, even before the event arrives.
+// MongoDB only has change streams on replica sets and sharded clusters, like
+// transactions. On a standalone server, only the writes through this
+// instance are seen, as before, and announcingRepository publishes them.
+type bookChanges struct {
+	coll   *mongo.Collection
+	search *bookSearch
+	cache  *responseCache
+
+	// Tells the numbers of the changes of this instance from those of the
+	// others, e.g. "3f2a9c1e", see eventID
+	origin string
+
+	mu        sync.Mutex
+	listeners map[chan bookChange]bool
+	// The last changeHistory changes, oldest first, and the number of the
+	// last one
+	history []bookChange
+	last    uint64
+}
+
+func newBookChanges(coll *mongo.Collection, search *bookSearch, cache *responseCache) *bookChanges {
+	return &bookChanges{
+		coll:      coll,
+		search:    search,
+		cache:     cache,
+		origin:    fmt.Sprintf("%08x", rand.Uint32()),
+		listeners: map[chan bookChange]bool{},
+	}
+}
+
+// Starts following the change stream in the background, if the server has
+// one.
+func (bc *bookChanges) watch(supported bool) {
+	if !supported {
+		slog.Warn("MongoDB is a standalone server, changes made by other instances are not seen until the next write")
+		return
+	}
+	go bc.follow()
+}
+
+// Reads the change stream until it fails, then opens it again where it
+// stopped. The driver already resumes by itself after a short disconnection;
+// this is for the longer ones. When even the resume token is too old,
+// e.g. after the server was down for days, we start again from now.
+func (bc *bookChanges) follow() {
+	var resumeToken bson.Raw
+	for {
+		opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+		if resumeToken != nil {
+			opts.SetResumeAfter(resumeToken)
+		}
+		stream, err := bc.coll.Watch(context.Background(), mongo.Pipeline{}, opts)
+		if err != nil {
+			resumeToken = nil
+		} else {
+			for stream.Next(context.Background()) {
+				var event changeEvent
+				if err := stream.Decode(&event); err != nil {
+					slog.Error("could not decode a change of the books", "error", err)
+				} else {
+					bc.apply(event)
+				}
+				resumeToken = stream.ResumeToken()
+			}
+			err = stream.Err()
+			stream.Close(context.Background())
+		}
+
+		// Changes may be missed until the stream is back
+		bc.invalidate()
+		slog.Warn("the change stream of the books failed, following it again", "retry_in", changeStreamRetry, "error", err)
+		time.Sleep(changeStreamRetry)
+	}
+}
+
+// Makes everything built from the books stale.
+func (bc *bookChanges) invalidate() {
+	bc.search.fuzzy.invalidate()
+	bc.search.suggestions.invalidate()
+	if err := bc.cache.newGeneration(context.Background()); err != nil {
+		slog.Error("could not make the cached responses stale", "error", err)
+	}
+}
+
+func (bc *bookChanges) apply(event changeEvent) {
+	bc.invalidate()
+	if change, ok := changeOf(event); ok {
+		bc.publish(change)
+	}
+}
+
+// The change of a live book an event is, if any. Deleting a document for
+// good is not one: only books in the trash are, see trash.go.
+func changeOf(event changeEvent) (bookChange, bool) {
+	book := event.FullDocument
+	if book == nil {
+		return bookChange{}, false
+	}
+	switch event.OperationType {
+	case "insert":
+		if book.DeletedAt.IsZero() {
+			return bookChange{Type: "created", Book: *book}, true
+		}
+	case "update", "replace":
+		_, trashed := event.UpdateDescription.UpdatedFields["DeletedAt"]
+		restored := slices.Contains(event.UpdateDescription.RemovedFields, "DeletedAt")
+		switch {
+		case !book.DeletedAt.IsZero() && trashed:
+			return bookChange{Type: "deleted", Book: *book}, true
+		case book.DeletedAt.IsZero() && restored:
+			return bookChange{Type: "created", Book: *book}, true
+		case book.DeletedAt.IsZero():
+			return bookChange{Type: "updated", Book: *book}, true
+		}
+	}
+	return bookChange{}, false
+}
+
+// Registers a listener of the changes, until the returned function is
+// called. A listener that does not keep up misses changes rather than
+// holding up the others: once changeBuffer changes wait in its channel, the
+// next ones are dropped until it catches up.
+func (bc *bookChanges) subscribe() (<-chan bookChange, func()) {
+	listener := make(chan bookChange, changeBuffer)
+	bc.mu.Lock()
+	bc.listeners[listener] = true
+	bc.mu.Unlock()
+	return listener, bc.unsubscriber(listener)
+}
+
+// Like subscribe, but also returns the changes kept since the one numbered
+// seq, for a listener coming back, in the same lock so none is missed or
+// sent twice. complete is false when some are not kept anymore, or seq is
+// not one of ours.
+func (bc *bookChanges) subscribeAfter(seq uint64) (<-chan bookChange, []bookChange, bool, func()) {
+	listener := make(chan bookChange, changeBuffer)
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.listeners[listener] = true
+	complete := seq <= bc.last && (len(bc.history) == 0 || bc.history[0].Seq <= seq+1)
+	var missed []bookChange
+	for _, change := range bc.history {
+		if change.Seq > seq {
+			missed = append(missed, change)
+		}
+	}
+	return listener, missed, complete, bc.unsubscriber(listener)
+}
+
+func (bc *bookChanges) unsubscriber(listener chan bookChange) func() {
+	return func() {
+		bc.mu.Lock()
+		delete(bc.listeners, listener)
+		bc.mu.Unlock()
+	}
+}
+
+// Numbers the change, keeps it, and passes it on to the listeners.
+func (bc *bookChanges) publish(change bookChange) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.last++
+	change.Seq = bc.last
+	bc.history = append(bc.history, change)
+	if len(bc.history) > changeHistory {
+		bc.history = slices.Delete(bc.history, 0, len(bc.history)-changeHistory)
+	}
+	for listener := range bc.listeners {
+		select {
+		case listener <- change:
+		default:
+		}
+	}
+}
+
+// Publishes the changes made through the repository, for when the change
+// stream does not see them: MongoDB is a standalone server, or the books are
+// in another database, see openBookRepository. Only the changes made through
+// this instance and the main routes are seen then; the batches, the patches
+// and the restorations from the trash show after the next refresh.
+type announcingRepository struct {
+	BookRepository
+	changes *bookChanges
+}
+
+func (r *announcingRepository) Insert(ctx context.Context, book BookStore) error {
+	if err := r.BookRepository.Insert(ctx, book); err != nil {
+		return err
+	}
+	r.changes.publish(bookChange{Type: "created", Book: book})
+	return nil
+}
+
+func (r *announcingRepository) Update(ctx context.Context, id string, book BookStore, versions []int64) error {
+	if err := r.BookRepository.Update(ctx, id, book, versions); err != nil {
+		return err
+	}
+	r.announceUpdate(ctx, id)
+	return nil
+}
+
+func (r *announcingRepository) Archive(ctx context.Context, id string, archived bool, versions []int64) error {
+	if err := r.BookRepository.Archive(ctx, id, archived, versions); err != nil {
+		return err
+	}
+	r.announceUpdate(ctx, id)
+	return nil
+}
+
+func (r *announcingRepository) Delete(ctx context.Context, id string, versions []int64) error {
+	// A deletion tells the book as it was
+	before, err := r.BookRepository.FindByID(ctx, id)
+	if err != nil {
+		before = BookStore{ID: id}
+	}
+	if err := r.BookRepository.Delete(ctx, id, versions); err != nil {
+		return err
+	}
+	r.changes.publish(bookChange{Type: "deleted", Book: before})
+	return nil
+}
+
+// Publishes the book as it is after an update, read again.
+func (r *announcingRepository) announceUpdate(ctx context.Context, id string) {
+	book, err := r.BookRepository.FindByID(ctx, id)
+	if err != nil {
+		slog.Warn("could not read a book again for the live updates", "request_id", requestID(ctx), "id", id, "error", err)
+		return
+	}
+	r.changes.publish(bookChange{Type: "updated", Book: book})
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// How long a book is lent when the checkout does not say
+	defaultLoanDays = 14
+	// The latest a book may be due, in days from now
+	maxLoanDays = 365
+	// The longest name of a borrower, in characters
+	maxBorrowerLength = 200
+	// The most copies of a book the library may have
+	maxCopies = 9999
+)
+
+// A book lent to somebody, recorded by the staff of the library. The
+// borrower is whoever has the book, not necessarily a user of the API.
+// ReturnedAt is missing while the book is out.
+type checkout struct {
+	ID           string     `bson:"_id" json:"id"`
+	BookID       string     `bson:"BookID" json:"bookId"`
+	Borrower     string     `bson:"Borrower" json:"borrower"`
+	CheckedOutBy string     `bson:"CheckedOutBy" json:"checkedOutBy"`
+	CheckedOutAt time.Time  `bson:"CheckedOutAt" json:"checkedOutAt"`
+	DueAt        time.Time  `bson:"DueAt" json:"dueAt"`
+	ReturnedAt   *time.Time `bson:"ReturnedAt,omitempty" json:"returnedAt,omitempty"`
+}
+
+// The checkouts, stored in their own collection, and the books they lend.
+// Every book counts its checkouts that are not returned yet in CheckedOut,
+// so that lending a book checks that a copy is left and takes it in a single
+// update: two requests cannot lend the last copy.
+type checkoutStore struct {
+	checkouts    *mongo.Collection
+	books        *mongo.Collection
+	transactions *transactions
+}
+
+// The checkouts of a book are listed newest first, the open ones by due
+// date, for the overdue ones.
+func prepareCheckoutIndexes(coll *mongo.Collection) error {
+	_, err := coll.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "BookID", Value: 1}, {Key: "CheckedOutAt", Value: -1}}},
+		{Keys: bson.D{{Key: "DueAt", Value: 1}}},
+	})
+	return err
+}
+
+// The filter of the checkouts not returned yet.
+func notReturned(filter bson.M) bson.M {
+	filter["ReturnedAt"] = bson.M{"$exists": false}
+	return filter
+}
+
+// Reads the body of POST /api/books/:id/checkout, e.g.
+// {"borrower": "Ada Lovelace", "dueAt": "2024-06-01"}. The borrower is
+// required; without dueAt, the book is due in defaultLoanDays days.
+func checkoutFromInput(input map[string]interface{}, now time.Time) (checkout, error) {
+	errs := fieldErrors{}
+	result := checkout{DueAt: now.AddDate(0, 0, defaultLoanDays)}
+	for key, raw := range input {
+		value, ok := raw.(string)
+		if !ok && raw != nil {
+			errs[key] = "must be a string"
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "borrower":
+			if utf8.RuneCountInString(value) > maxBorrowerLength {
+				errs[key] = fmt.Sprintf("must be at most %d characters long", maxBorrowerLength)
+				continue
+			}
+			result.Borrower = value
+		case "dueAt":
+			if value == "" {
+				continue
+			}
+			due, message := parseDueAt(value, now)
+			if message != "" {
+				errs[key] = message
+				continue
+			}
+			result.DueAt = due
+		default:
+			errs[key] = "is not a field of a checkout"
+		}
+	}
+	if _, invalid := errs["borrower"]; !invalid && result.Borrower == "" {
+		errs["borrower"] = "is required"
+	}
+	if len(errs) > 0 {
+		return checkout{}, errs
+	}
+	return result, nil
+}
+
+// Reads a due date, a day like "2024-06-01", due at its end in UTC, or a
+// time like "2024-06-01T18:00:00+02:00". It must be in the future, and at
+// most maxLoanDays days away.
+func parseDueAt(value string, now time.Time) (time.Time, string) {
+	due, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		day, dayErr := time.Parse(time.DateOnly, value)
+		if dayErr != nil {
+			return time.Time{}, "must be a date like 2024-06-01 or a time like 2024-06-01T18:00:00Z"
+		}
+		due = day.Add(24*time.Hour - time.Second)
+	}
+	if !due.After(now) {
+		return time.Time{}, "must be in the future"
+	}
+	if due.After(now.AddDate(0, 0, maxLoanDays)) {
+		return time.Time{}, fmt.Sprintf("must be at most %d days away", maxLoanDays)
+	}
+	return due, ""
+}
+
+// The number of copies of the book the library has. Books without Copies
+// were added before we counted them, and have one.
+func bookCopies(book BookStore) int {
+	if book.Copies == 0 {
+		return 1
+	}
+	return book.Copies
+}
+
+// The number of copies of the book that are not checked out.
+func availableCopies(book BookStore) int {
+	return max(0, bookCopies(book)-book.CheckedOut)
+}
+
+// Tells whether the book can be borrowed, for the book detail:
+// {"available": true}, or false with the time the first copy is due back.
+func (s *checkoutStore) availability(ctx context.Context, book BookStore) (map[string]interface{}, error) {
+	if availableCopies(book) > 0 {
+		return map[string]interface{}{"available": true}, nil
+	}
+	if s == nil {
+		// Without MongoDB, nobody borrows the books, see openMongo
+		return map[string]interface{}{"available": false}, nil
+	}
+	var next checkout
+	err := s.checkouts.FindOne(ctx,
+		notReturned(bson.M{"BookID": book.ID}),
+		options.FindOne().SetSort(bson.M{"DueAt": 1}),
+	).Decode(&next)
+	if err == mongo.ErrNoDocuments {
+		return map[string]interface{}{"available": false}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"available": false, "dueAt": next.DueAt}, nil
+}
+
+// Lists the checkouts matching the filter, in the given order.
+func (s *checkoutStore) list(ctx context.Context, filter bson.M, sort bson.D) ([]checkout, error) {
+	cursor, err := s.checkouts.Find(ctx, filter, options.Find().SetSort(sort))
+	if err != nil {
+		return nil, err
+	}
+	checkouts := []checkout{}
+	if err = cursor.All(ctx, &checkouts); err != nil {
+		return nil, err
+	}
+	return checkouts, nil
+}
+
+// Registers the routes of the checkouts. Lending and taking back books is
+// the job of the library staff, who get the given middleware; so is seeing
+// who has which book.
+func (s *checkoutStore) register(g *echo.Group, staff []echo.MiddlewareFunc) {
+	g.POST("/books/:id/checkout", func(c echo.Context) error {
+		bookID := c.Param("id")
+		var input map[string]interface{}
+		if err := bindBody(c, &input); err != nil {
+			return newProblem(http.StatusBadRequest, "invalid request body")
+		}
+		now := time.Now()
+		created, err := checkoutFromInput(input, now)
+		if err != nil {
+			return err
+		}
+
+		created.ID = primitive.NewObjectID().Hex()
+		created.BookID = bookID
+		created.CheckedOutBy = currentPrincipal(c).Name
+		created.CheckedOutAt = now
+
+		// The copy and the checkout go together, see transactions.go
+		err = s.transactions.run(c.Request().Context(), func(ctx context.Context) error {
+			// Only a copy that is not out can be taken, see bookCopies.
+			// Lending it changes the availability of the book, so its
+			// version goes up.
+			copyLeft := bson.M{"$lt": bson.A{
+				bson.M{"$ifNull": bson.A{"$CheckedOut", 0}},
+				bson.M{"$ifNull": bson.A{"$Copies", 1}},
+			}}
+			result, err := s.books.UpdateOne(ctx,
+				live(bson.M{"ID": bookID, "$expr": copyLeft}),
+				bson.M{"$inc": bson.M{"CheckedOut": 1, "Version": 1}, "$currentDate": bson.M{"UpdatedAt": true}},
+			)
+			if err != nil {
+				return serverProblem(err, "failed to update book")
+			}
+			if result.MatchedCount == 0 {
+				count, err := s.books.CountDocuments(ctx, live(bson.M{"ID": bookID}))
+				if err != nil {
+					return serverProblem(err, "database error")
+				}
+				if count == 0 {
+					return errBookNotFound
+				}
+				return newProblem(http.StatusConflict, "every copy of the book is checked out")
+			}
+
+			if _, err := s.checkouts.InsertOne(ctx, created); err != nil {
+				if !inTransaction(ctx) {
+					// The book is not lent after all
+					_, undoErr := s.books.UpdateOne(ctx,
+						live(bson.M{"ID": bookID}),
+						bson.M{"$inc": bson.M{"CheckedOut": -1, "Version": 1}, "$currentDate": bson.M{"UpdatedAt": true}},
+					)
+					if undoErr != nil {
+						requestLogger(c).Error("could not give back a book not lent after all", "book", bookID, "error", undoErr)
+					}
+				}
+				return serverProblem(err, "could not insert checkout")
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusCreated, created)
+	}, staff...)
+
+	// Takes a copy back, closing its checkout: the one given by
+	// {"checkoutId": "..."} or {"borrower": "..."}, or else the oldest one
+	g.POST("/books/:id/return", func(c echo.Context) error {
+		bookID := c.Param("id")
+		var input struct {
+			CheckoutID string `json:"checkoutId"`
+			Borrower   string `json:"borrower"`
+		}
+		if err := c.Bind(&input); err != nil {
+			return newProblem(http.StatusBadRequest, "invalid request body")
+		}
+		filter := notReturned(bson.M{"BookID": bookID})
+		if input.CheckoutID != "" {
+			filter["_id"] = input.CheckoutID
+		}
+		if input.Borrower != "" {
+			filter["Borrower"] = strings.TrimSpace(input.Borrower)
+		}
+
+		now := time.Now()
+		var returned checkout
+		err := s.transactions.run(c.Request().Context(), func(ctx context.Context) error {
+			err := s.checkouts.FindOneAndUpdate(ctx,
+				filter,
+				bson.M{"$set": bson.M{"ReturnedAt": now}},
+				options.FindOneAndUpdate().
+					SetSort(bson.M{"CheckedOutAt": 1}).
+					SetReturnDocument(options.After),
+			).Decode(&returned)
+			if err == mongo.ErrNoDocuments {
+				return newProblem(http.StatusConflict, "no such copy of the book is checked out")
+			}
+			if err != nil {
+				return serverProblem(err, "failed to update checkout")
+			}
+			_, err = s.books.UpdateOne(ctx,
+				live(bson.M{"ID": bookID, "CheckedOut": bson.M{"$gt": 0}}),
+				bson.M{"$inc": bson.M{"CheckedOut": -1, "Version": 1}, "$currentDate": bson.M{"UpdatedAt": true}},
+			)
+			if err != nil {
+				return serverProblem(err, "failed to update book")
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, returned)
+	}, staff...)
+
+	// Sets the number of copies, e.g. {"copies": 3}. There cannot be fewer
+	// than are checked out.
+	g.PUT("/books/:id/copies", func(c echo.Context) error {
+		bookID := c.Param("id")
+		var input map[string]interface{}
+		if err := c.Bind(&input); err != nil {
+			return newProblem(http.StatusBadRequest, "invalid request body")
+		}
+		copies, ok := input["copies"].(float64)
+		if !ok || copies != math.Trunc(copies) || copies < 1 || copies > maxCopies {
+			return fieldErrors{"copies": fmt.Sprintf("must be a whole number from 1 to %d", maxCopies)}
+		}
+
+		var book BookStore
+		err := s.books.FindOneAndUpdate(c.Request().Context(),
+			live(bson.M{"ID": bookID, "$expr": bson.M{"$lte": bson.A{
+				bson.M{"$ifNull": bson.A{"$CheckedOut", 0}}, int(copies),
+			}}}),
+			bson.M{"$set": bson.M{"Copies": int(copies)}, "$inc": bson.M{"Version": 1}, "$currentDate": bson.M{"UpdatedAt": true}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&book)
+		if err == mongo.ErrNoDocuments {
+			err = s.books.FindOne(c.Request().Context(), live(bson.M{"ID": bookID})).Decode(&book)
+			if err != nil {
+				return err
+			}
+			return newProblem(http.StatusConflict, fmt.Sprintf("%d copies of the book are checked out", book.CheckedOut))
+		}
+		if err != nil {
+			return serverProblem(err, "failed to update book")
+		}
+		return c.JSON(http.StatusOK, map[string]int{
+			"copies":          bookCopies(book),
+			"availableCopies": availableCopies(book),
+		})
+	}, staff...)
+
+	// Every checkout of a book, the newest first
+	g.GET("/books/:id/checkouts", func(c echo.Context) error {
+		checkouts, err := s.list(c.Request().Context(),
+			bson.M{"BookID": c.Param("id")},
+			bson.D{{Key: "CheckedOutAt", Value: -1}, {Key: "_id", Value: -1}},
+		)
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		return c.JSON(http.StatusOK, checkouts)
+	}, staff...)
+
+	// The books that are out, those due first at the top. ?borrower= gives
+	// the ones of a borrower.
+	g.GET("/checkouts", func(c echo.Context) error {
+		filter := notReturned(bson.M{})
+		if borrower := c.QueryParam("borrower"); borrower != "" {
+			filter["Borrower"] = borrower
+		}
+		checkouts, err := s.list(c.Request().Context(), filter, bson.D{{Key: "DueAt", Value: 1}, {Key: "_id", Value: 1}})
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		return c.JSON(http.StatusOK, checkouts)
+	}, staff...)
+
+	// The books that should be back already, the most overdue first
+	g.GET("/checkouts/overdue", func(c echo.Context) error {
+		filter := notReturned(bson.M{"DueAt": bson.M{"$lt": time.Now()}})
+		checkouts, err := s.list(c.Request().Context(), filter, bson.D{{Key: "DueAt", Value: 1}, {Key: "_id", Value: 1}})
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		return c.JSON(http.StatusOK, checkouts)
+	}, staff...)
+}
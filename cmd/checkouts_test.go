@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestCheckOutBook(t *testing.T) {
+	nextWeek := time.Now().AddDate(0, 0, 7).Format(time.DateOnly)
+	tests := []struct {
+		name string
+		body string
+		// Whether a copy of the book is left
+		copyLeft bool
+		status   int
+	}{
+		{"for the default loan", `{"borrower": "Ada Lovelace"}`, true, http.StatusCreated},
+		{"until a given day", `{"borrower": "Ada Lovelace", "dueAt": "` + nextWeek + `"}`, true, http.StatusCreated},
+		{"when every copy is out", `{"borrower": "Ada Lovelace"}`, false, http.StatusConflict},
+		{"without a borrower", `{"dueAt": "` + nextWeek + `"}`, true, http.StatusUnprocessableEntity},
+		{"due in the past", `{"borrower": "Ada Lovelace", "dueAt": "2000-01-01"}`, true, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withMockMongo(t, func(mt *mtest.T) {
+				checkouts := &checkoutStore{checkouts: mt.Coll, books: mt.Coll}
+				e := echo.New()
+				e.HTTPErrorHandler = problemErrorHandler
+				checkouts.register(e.Group("/api"), []echo.MiddlewareFunc{asPrincipal(principal{Name: "desk", Role: roleEditor})})
+
+				if tt.copyLeft {
+					// A copy is taken, and the checkout inserted
+					mt.AddMockResponses(mockOK(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}), mockOK(bson.E{Key: "n", Value: 1}))
+				} else {
+					// None is left, but the book exists
+					mt.AddMockResponses(mockOK(bson.E{Key: "n", Value: 0}, bson.E{Key: "nModified", Value: 0}), mockCursor(mt, bson.D{{Key: "n", Value: 1}}))
+				}
+
+				rec := sendJSON(e, http.MethodPost, "/api/books/dune/checkout", tt.body)
+				if rec.Code != tt.status {
+					t.Fatalf("got %d, want %d: %s", rec.Code, tt.status, rec.Body)
+				}
+				if tt.status != http.StatusCreated {
+					return
+				}
+				var created checkout
+				if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+					t.Fatal(err)
+				}
+				if created.BookID != "dune" || created.Borrower != "Ada Lovelace" || created.CheckedOutBy != "desk" || !created.DueAt.After(time.Now()) {
+					t.Errorf("created %+v", created)
+				}
+			})
+		})
+	}
+}
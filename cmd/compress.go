@@ -0,0 +1,235 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/labstack/echo/v4"
+)
+
+// The responses are compressed when the client accepts it, with Brotli or
+// gzip, whichever it prefers (Brotli for a tie, it makes smaller files).
+// Only the text formats are, see compressibleTypes: images and gzipped
+// backups would only grow. Neither are the responses under
+// COMPRESSION_MIN_LENGTH bytes, for which the headers of the compression cost
+// more than they save. A response streamed in several parts, like the book
+// table, is compressed part by part.
+
+// The media types worth compressing.
+var compressibleTypes = []string{
+	"text/html", "text/css", "text/plain", "text/csv", "text/xml", "text/yaml",
+	"application/json", "application/problem+json", "application/x-ndjson",
+	"application/xml", "application/yaml", "application/x-yaml", "application/javascript",
+}
+
+// The encoders are large, so they are reused between responses.
+var (
+	gzipWriters   = sync.Pool{New: func() interface{} { return gzip.NewWriter(io.Discard) }}
+	brotliWriters = sync.Pool{New: func() interface{} {
+		// Level 4 compresses about as fast as gzip, and still better
+		return brotli.NewWriterLevel(io.Discard, 4)
+	}}
+)
+
+// Compresses the responses of the handlers, once minLength bytes are
+// written, see above.
+func compressResponses(minLength int) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			// Whether or not this one is compressed, the next one may be
+			c.Response().Header().Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+			encoding := acceptedEncoding(c.Request().Header.Get(echo.HeaderAcceptEncoding))
+			if encoding == "" || c.Request().Method == http.MethodHead {
+				return next(c)
+			}
+
+			writer := &compressWriter{ResponseWriter: c.Response().Writer, encoding: encoding, minLength: minLength}
+			c.Response().Writer = writer
+			defer func() {
+				writer.close()
+				c.Response().Writer = writer.ResponseWriter
+			}()
+			return next(c)
+		}
+	}
+}
+
+// The encoding to compress with, "br" or "gzip", from the Accept-Encoding of
+// the request, e.g. "gzip, deflate, br;q=0.9"; "" when it takes neither.
+func acceptedEncoding(header string) string {
+	quality := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		quality[strings.ToLower(strings.TrimSpace(name))] = q
+	}
+	accepts := func(name string) float64 {
+		if q, ok := quality[name]; ok {
+			return q
+		}
+		return quality["*"]
+	}
+	br, gz := accepts("br"), accepts("gzip")
+	switch {
+	case br > 0 && br >= gz:
+		return "br"
+	case gz > 0:
+		return "gzip"
+	}
+	return ""
+}
+
+// Holds the first bytes of the response back, until there are minLength of
+// them or the handler flushes: then the response is compressed, if its type
+// is compressibleTypes, and sent as it is otherwise.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding  string
+	minLength int
+
+	status  int
+	pending []byte
+	decided bool
+	// Set once compressing
+	encoder io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.decided {
+		w.pending = append(w.pending, b...)
+		if len(w.pending) < w.minLength {
+			return len(b), nil
+		}
+		if err := w.decide(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Sends the header, compressing or not, then the bytes held back.
+func (w *compressWriter) decide() error {
+	w.decided = true
+	header := w.Header()
+	if w.compressible() {
+		header.Set(echo.HeaderContentEncoding, w.encoding)
+		// The length of the uncompressed body, if the handler set it
+		header.Del(echo.HeaderContentLength)
+		w.encoder = w.newEncoder()
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	pending := w.pending
+	w.pending = nil
+	if len(pending) == 0 {
+		return nil
+	}
+	var err error
+	if w.encoder != nil {
+		_, err = w.encoder.Write(pending)
+	} else {
+		_, err = w.ResponseWriter.Write(pending)
+	}
+	return err
+}
+
+func (w *compressWriter) compressible() bool {
+	if w.status < http.StatusOK || w.status == http.StatusNoContent || w.status == http.StatusNotModified {
+		return false
+	}
+	header := w.Header()
+	if header.Get(echo.HeaderContentEncoding) != "" {
+		// Already compressed by the handler
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get(echo.HeaderContentType))
+	return err == nil && slices.Contains(compressibleTypes, mediaType)
+}
+
+func (w *compressWriter) newEncoder() io.WriteCloser {
+	if w.encoding == "br" {
+		encoder := brotliWriters.Get().(*brotli.Writer)
+		encoder.Reset(w.ResponseWriter)
+		return encoder
+	}
+	encoder := gzipWriters.Get().(*gzip.Writer)
+	encoder.Reset(w.ResponseWriter)
+	return encoder
+}
+
+// Sends what was written so far, compressed if it is worth it: a streamed
+// response is most likely long.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		if err := w.decide(); err != nil {
+			return
+		}
+	}
+	switch encoder := w.encoder.(type) {
+	case *gzip.Writer:
+		encoder.Flush()
+	case *brotli.Writer:
+		encoder.Flush()
+	}
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// For http.NewResponseController.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Ends the response: sends a short one as it is, or finishes the compressed
+// stream. Nothing is sent when the handler wrote nothing at all, e.g. when
+// it returned an error for problemErrorHandler to answer.
+func (w *compressWriter) close() {
+	if !w.decided {
+		if w.status == 0 {
+			return
+		}
+		w.decided = true
+		w.ResponseWriter.WriteHeader(w.status)
+		if len(w.pending) > 0 {
+			w.ResponseWriter.Write(w.pending)
+		}
+		return
+	}
+	if w.encoder == nil {
+		return
+	}
+	w.encoder.Close()
+	switch encoder := w.encoder.(type) {
+	case *gzip.Writer:
+		gzipWriters.Put(encoder)
+	case *brotli.Writer:
+		brotliWriters.Put(encoder)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Every book carries a Version, incremented by each update, and its ETag is
+// derived from it. Clients that send the ETag back in an If-Match header only
+// get their PUT, PATCH or DELETE applied if nobody changed the book since
+// they read it; otherwise they receive 412 Precondition Failed, instead of
+// silently overwriting somebody else's changes.
+// Books stored before versions existed have no Version field and count as
+// version 0.
+
+// The ETag of a given version of a book. It is a strong tag: the version
+// changes with every update, so equal tags mean equal books. Strong tags
+// must also differ between representations, so formats other than JSON
+// get a suffix, e.g. "3-xml".
+func versionETag(version int64, format responseFormat) string {
+	if format.name == jsonFormat.name {
+		return fmt.Sprintf(`"%d"`, version)
+	}
+	return fmt.Sprintf(`"%d-%s"`, version, format.name)
+}
+
+// Reads the versions the If-Match header accepts. It returns nil when the
+// request has no such condition. "*" only asks for the book to exist, which
+// the handlers check anyway.
+// If-Match uses the strong comparison, so weak tags never match; a header
+// without any usable tag gives an empty list, which matches nothing.
+func parseIfMatch(c echo.Context) []int64 {
+	header := strings.TrimSpace(c.Request().Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return nil
+	}
+
+	versions := []int64{}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if strings.HasPrefix(tag, "W/") {
+			continue
+		}
+		number, _, _ := strings.Cut(strings.Trim(tag, `"`), "-")
+		version, err := strconv.ParseInt(number, 10, 64)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	return versions
+}
+
+// Restricts a filter selecting a book to the given versions.
+func matchVersions(filter bson.M, versions []int64) {
+	in := bson.A{}
+	for _, version := range versions {
+		in = append(in, version)
+		if version == 0 {
+			// Matches the books without a Version field
+			in = append(in, nil)
+		}
+	}
+	filter["Version"] = bson.M{"$in": in}
+}
+
+// Adds the condition of the If-Match header to a filter selecting a book,
+// see parseIfMatch. It returns false when the request has no such condition.
+func addIfMatch(c echo.Context, filter bson.M) bool {
+	versions := parseIfMatch(c)
+	if versions == nil {
+		return false
+	}
+	matchVersions(filter, versions)
+	return true
+}
+
+// Answers a conditional write that matched no document: either the book
+// does not exist, or it exists in another version than the client expects.
+func notFoundOrPreconditionFailed(ctx context.Context, coll *mongo.Collection, bookID string) error {
+	count, err := coll.CountDocuments(ctx, live(bson.M{"ID": bookID}))
+	if err != nil {
+		return serverProblem(err, "database error")
+	}
+	if count == 0 {
+		return errBookNotFound
+	}
+	return errBookModified
+}
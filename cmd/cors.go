@@ -0,0 +1,26 @@
+package main
+
+import (
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// Browsers only let a page call the API of another origin, e.g. a single
+// page app on https://app.example.com, when the API agrees: before anything
+// but a simple GET, the browser asks with an OPTIONS "preflight" request,
+// which this middleware answers from the CORS_* settings. With
+// CORS_ALLOWED_ORIGINS empty, the default, the API agrees to nothing and
+// only pages of its own origin may call it.
+func corsPolicy(settings config.CORS) echo.MiddlewareFunc {
+	return middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins:     settings.AllowedOrigins,
+		AllowMethods:     settings.AllowedMethods,
+		AllowHeaders:     settings.AllowedHeaders,
+		ExposeHeaders:    settings.ExposedHeaders,
+		AllowCredentials: settings.AllowCredentials,
+		MaxAge:           int(settings.MaxAge / time.Second),
+	})
+}
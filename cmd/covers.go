@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"slices"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// The largest cover we accept, in bytes
+	maxCoverSize = 5 << 20
+	// The width of the thumbnails shown in the book table, in pixels
+	thumbnailWidth = 80
+	// The largest image we make a thumbnail of, in pixels
+	maxThumbnailSourcePixels = 50_000_000
+)
+
+// The image formats a cover may have. http.DetectContentType tells them
+// apart by their first bytes, so the Content-Type the client sends does not
+// matter.
+var coverContentTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+// Where the cover of a book is stored. The images are too large for the book
+// document (at most 16 MB, and we read books all the time), so they are
+// files in GridFS, which splits them into chunks, see
+// https://www.mongodb.com/docs/manual/core/gridfs/
+// Thumbnail is missing for formats the standard library cannot decode, i.e.
+// WebP; the full cover is shown instead.
+type coverRef struct {
+	ID          primitive.ObjectID `bson:"ID"`
+	Thumbnail   primitive.ObjectID `bson:"Thumbnail,omitempty"`
+	ContentType string             `bson:"ContentType"`
+}
+
+// The covers of the books, in the GridFS bucket "covers". The TTL index
+// purging the trash cannot delete them with their book, so the files of
+// purged books stay behind until somebody removes them.
+type coverStore struct {
+	bucket *gridfs.Bucket
+	books  *mongo.Collection
+}
+
+// The bucket is made of the collections covers.files and covers.chunks,
+// next to the books. The driver creates their indexes on the first upload.
+func prepareCoverBucket(books *mongo.Collection) (*gridfs.Bucket, error) {
+	return gridfs.NewBucket(books.Database(), options.GridFSBucket().SetName("covers"))
+}
+
+// Handles POST /api/books/:id/cover, a multipart/form-data upload with the
+// image in the "cover" field. A new cover replaces the previous one.
+func (s *coverStore) upload(c echo.Context) error {
+	bookID := c.Param("id")
+	header, err := c.FormFile("cover")
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "the image must be sent as multipart/form-data, in the field cover")
+	}
+	if header.Size > maxCoverSize {
+		return newProblem(http.StatusRequestEntityTooLarge, fmt.Sprintf("a cover must be at most %d MB", maxCoverSize>>20))
+	}
+	file, err := header.Open()
+	if err != nil {
+		return serverProblem(err, "could not read upload")
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxCoverSize))
+	if err != nil {
+		return serverProblem(err, "could not read upload")
+	}
+	contentType := http.DetectContentType(data)
+	if !slices.Contains(coverContentTypes, contentType) {
+		return newProblem(http.StatusUnsupportedMediaType, "a cover must be a JPEG, PNG, GIF or WebP image")
+	}
+
+	count, err := s.books.CountDocuments(c.Request().Context(), live(bson.M{"ID": bookID}))
+	if err != nil {
+		return serverProblem(err, "database error")
+	}
+	if count == 0 {
+		return errBookNotFound
+	}
+
+	cover := coverRef{ContentType: contentType}
+	metadata := bson.M{"BookID": bookID, "ContentType": contentType}
+	cover.ID, err = s.bucket.UploadFromStream(bookID, bytes.NewReader(data), options.GridFSUpload().SetMetadata(metadata))
+	if err != nil {
+		return serverProblem(err, "could not store cover")
+	}
+	if thumbnail, thumbnailType, ok := makeThumbnail(data); ok {
+		metadata := bson.M{"BookID": bookID, "ContentType": thumbnailType, "Thumbnail": true}
+		cover.Thumbnail, err = s.bucket.UploadFromStream(bookID, bytes.NewReader(thumbnail), options.GridFSUpload().SetMetadata(metadata))
+		if err != nil {
+			s.deleteFiles(c, &cover)
+			return serverProblem(err, "could not store cover")
+		}
+	}
+
+	// The previous cover is replaced, so its files can go
+	var previous BookStore
+	err = s.books.FindOneAndUpdate(c.Request().Context(),
+		live(bson.M{"ID": bookID}),
+		bson.M{"$set": bson.M{"Cover": cover}, "$inc": bson.M{"Version": 1}, "$currentDate": bson.M{"UpdatedAt": true}},
+		options.FindOneAndUpdate().SetProjection(bson.M{"Cover": 1}),
+	).Decode(&previous)
+	if err != nil {
+		// Deleted in the meantime
+		s.deleteFiles(c, &cover)
+		return err
+	}
+	s.deleteFiles(c, previous.Cover)
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "cover uploaded", "cover": coverPath(bookID)})
+}
+
+// Deletes the files of a cover that is no longer used. A failure only
+// leaves unused files behind, so it is logged but not sent to the client.
+func (s *coverStore) deleteFiles(c echo.Context, cover *coverRef) {
+	if cover == nil {
+		return
+	}
+	for _, id := range []primitive.ObjectID{cover.ID, cover.Thumbnail} {
+		if id.IsZero() {
+			continue
+		}
+		if err := s.bucket.Delete(id); err != nil && err != gridfs.ErrFileNotFound {
+			requestLogger(c).Error("could not delete the file of a cover", "file", id.Hex(), "error", err)
+		}
+	}
+}
+
+// Handles GET /covers/:id, the cover of the book with that ID, or its
+// thumbnail with ?size=thumbnail. A new cover gets new files, so the ID of
+// the file is a good ETag and browsers may keep the image for a while.
+func (s *coverStore) serve(c echo.Context) error {
+	var book BookStore
+	err := s.books.FindOne(c.Request().Context(),
+		live(bson.M{"ID": c.Param("id")}),
+		options.FindOne().SetProjection(bson.M{"Cover": 1}),
+	).Decode(&book)
+	if err == mongo.ErrNoDocuments || (err == nil && book.Cover == nil) {
+		return newProblem(http.StatusNotFound, "this book has no cover")
+	}
+	if err != nil {
+		return serverProblem(err, "database error")
+	}
+
+	fileID := book.Cover.ID
+	contentType := book.Cover.ContentType
+	if c.QueryParam("size") == "thumbnail" && !book.Cover.Thumbnail.IsZero() {
+		fileID = book.Cover.Thumbnail
+		contentType = thumbnailContentType(contentType)
+	}
+
+	etag := `"` + fileID.Hex() + `"`
+	c.Response().Header().Set("ETag", etag)
+	c.Response().Header().Set("Cache-Control", "public, max-age=86400")
+	if etagMatches(c.Request().Header.Get("If-None-Match"), etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	stream, err := s.bucket.OpenDownloadStream(fileID)
+	if err != nil {
+		return serverProblem(err, "could not read cover")
+	}
+	defer stream.Close()
+	return c.Stream(http.StatusOK, contentType, stream)
+}
+
+// Where the cover of a book is served.
+func coverPath(bookID string) string {
+	return "/covers/" + bookID
+}
+
+// PNG and GIF thumbnails are PNGs, to keep transparency, JPEG ones JPEGs.
+func thumbnailContentType(contentType string) string {
+	if contentType == "image/jpeg" {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+// Scales the image down to thumbnailWidth pixels wide, keeping its aspect
+// ratio. Every pixel of the thumbnail is the average of the pixels of the
+// image it covers, which looks much better than just picking one of them.
+// Images that are small already, or cannot be decoded, get no thumbnail.
+func makeThumbnail(data []byte) ([]byte, string, bool) {
+	decoders := map[string]func(io.Reader) (image.Image, error){
+		"image/jpeg": jpeg.Decode,
+		"image/png":  png.Decode,
+		"image/gif":  gif.Decode,
+	}
+	contentType := http.DetectContentType(data)
+	decode, ok := decoders[contentType]
+	if !ok {
+		return nil, "", false
+	}
+	// A small file may still claim to be a huge image, which would take
+	// gigabytes to decode
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width*config.Height > maxThumbnailSourcePixels {
+		return nil, "", false
+	}
+	src, err := decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", false
+	}
+	bounds := src.Bounds()
+	if bounds.Dx() <= thumbnailWidth {
+		return nil, "", false
+	}
+
+	width := thumbnailWidth
+	height := max(1, bounds.Dy()*width/bounds.Dx())
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*bounds.Dy()/height)
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := max(x0+1, bounds.Min.X+(x+1)*bounds.Dx()/width)
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pixel := color.NRGBAModel.Convert(src.At(sx, sy)).(color.NRGBA)
+					r += uint64(pixel.R)
+					g += uint64(pixel.G)
+					b += uint64(pixel.B)
+					a += uint64(pixel.A)
+					n++
+				}
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: uint8(a / n)})
+		}
+	}
+
+	var buf bytes.Buffer
+	outputType := thumbnailContentType(contentType)
+	if outputType == "image/jpeg" {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, dst)
+	}
+	if err != nil {
+		return nil, "", false
+	}
+	return buf.Bytes(), outputType, true
+}
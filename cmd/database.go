@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// Where the server finds MongoDB, and the names it stores the books under,
+// see config.Mongo. Every other collection, like the users or the reviews,
+// is in the same database, under a name of its own.
+type mongoConfig struct {
+	config.Mongo
+	// Where the listings of books read from, see listings; nil for the
+	// primary, like every other read
+	listingReadPreference *readpref.ReadPref
+	// How many members of a replica set must have a write before it is
+	// acknowledged; nil for what the URI or the server says
+	writeConcern *writeconcern.WriteConcern
+}
+
+// The longest wait between two attempts to reach MongoDB.
+const maxRetryDelay = 30 * time.Second
+
+// Turns the settings, checked by config.Load already, into the options of
+// the driver, see
+// https://www.mongodb.com/docs/manual/core/read-preference/ and
+// https://www.mongodb.com/docs/manual/reference/write-concern/
+func newMongoConfig(settings config.Mongo) (mongoConfig, error) {
+	mc := mongoConfig{Mongo: settings}
+	if settings.ReadPreference != "primary" {
+		mode, err := readpref.ModeFromString(settings.ReadPreference)
+		if err != nil {
+			return mc, fmt.Errorf("MONGO_READ_PREFERENCE: %w", err)
+		}
+		var readOptions []readpref.Option
+		if settings.MaxStaleness != 0 {
+			readOptions = append(readOptions, readpref.WithMaxStaleness(settings.MaxStaleness))
+		}
+		if mc.listingReadPreference, err = readpref.New(mode, readOptions...); err != nil {
+			return mc, fmt.Errorf("MONGO_READ_PREFERENCE: %w", err)
+		}
+	}
+	switch settings.WriteConcern {
+	case "":
+	case "majority":
+		mc.writeConcern = writeconcern.Majority()
+	default:
+		members, err := strconv.Atoi(settings.WriteConcern)
+		if err != nil {
+			return mc, fmt.Errorf("MONGO_WRITE_CONCERN: %w", err)
+		}
+		mc.writeConcern = &writeconcern.WriteConcern{W: members}
+	}
+	return mc, nil
+}
+
+// The options of the client connecting to MongoDB.
+// The pool counters are kept by pool, the durations of the commands by
+// commands, see metrics.go.
+func (config mongoConfig) clientOptions(pool *poolStats, commands *event.CommandMonitor) *options.ClientOptions {
+	opts := options.Client().
+		ApplyURI(config.URI).
+		SetMaxPoolSize(config.MaxPoolSize).
+		SetMinPoolSize(config.MinPoolSize).
+		SetMaxConnIdleTime(config.MaxConnIdleTime).
+		SetPoolMonitor(pool.monitor()).
+		SetMonitor(commands)
+	if config.Username != "" {
+		// Keeps the authSource and the mechanism the URI may give
+		var credential options.Credential
+		if opts.Auth != nil {
+			credential = *opts.Auth
+		}
+		credential.Username = config.Username
+		credential.Password = config.Password
+		opts.SetAuth(credential)
+	}
+	if config.writeConcern != nil {
+		opts.SetWriteConcern(config.writeConcern)
+	}
+	if config.ReplicaSet != "" {
+		opts.SetReplicaSet(config.ReplicaSet)
+	}
+	return opts
+}
+
+// Connects to MongoDB and makes sure it answers, so that a wrong URI or
+// password stops the server, rather than failing its first requests. The
+// error does not repeat the URI, which may hold a password.
+// MongoDB may still be starting, e.g. when both are started by
+// docker-compose, so the server tries again a few times, waiting twice as
+// long every time: 1s, 2s, 4s... up to maxRetryDelay. A URI that cannot be
+// parsed is not retried.
+func connectMongo(config mongoConfig, pool *poolStats, commands *event.CommandMonitor) (*mongo.Client, error) {
+	client, err := mongo.Connect(context.Background(), config.clientOptions(pool, commands))
+	if err != nil {
+		return nil, fmt.Errorf("invalid MONGO_URI: %w", err)
+	}
+	delay := config.RetryDelay
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), config.ConnectTimeout)
+		err = client.Ping(ctx, nil)
+		cancel()
+		if err == nil {
+			return client, nil
+		}
+		if attempt == config.ConnectRetries {
+			client.Disconnect(context.Background())
+			return nil, fmt.Errorf("could not connect to MongoDB: %w", err)
+		}
+		slog.Warn("MongoDB does not answer yet, trying again", "attempt", attempt+1, "retry_in", delay, "error", err)
+		time.Sleep(delay)
+		delay = min(2*delay, maxRetryDelay)
+	}
+}
+
+// The books collection for the listings of books, GET /books and the book
+// table, for instance, which may read from the secondaries of a replica set
+// with MONGO_READ_PREFERENCE, taking the load off the primary. Secondaries
+// lag behind a little, so a book just added may be missing from a listing
+// for a moment; everything else, like GET /books/:id, checking an If-Match
+// or a transaction, reads from the primary.
+func (config mongoConfig) listings(coll *mongo.Collection) (*mongo.Collection, error) {
+	if config.listingReadPreference == nil {
+		return coll, nil
+	}
+	return coll.Clone(options.Collection().SetReadPreference(config.listingReadPreference))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The routes to look inside a running server, for admins only:
+//
+//	GET /debug/pprof/             the profiles of net/http/pprof
+//	GET /debug/pprof/profile      a CPU profile, of 30 seconds or ?seconds=
+//	GET /debug/pprof/heap         the memory in use
+//	GET /debug/pprof/goroutine    the goroutines, ?debug=2 for their stacks
+//	GET /debug/runtime            the goroutines, memory and GC in JSON
+//
+// The profiles are read with go tool pprof, once downloaded, e.g.
+//
+//	curl -H "X-Admin-Token: $ADMIN_TOKEN" -o cpu.out localhost:3030/debug/pprof/profile
+//	go tool pprof -http=:8081 cpu.out
+//
+// When the server is slow, a CPU profile tells where its time goes, and a
+// goroutine dump what the requests are waiting for.
+func registerDebug(e *echo.Echo, auth *authenticator) {
+	g := e.Group("/debug", auth.require(roleAdmin))
+
+	// pprof.Index serves the named profiles too, like heap or goroutine:
+	// it takes their name from the path after /debug/pprof/
+	g.GET("/pprof/*", echo.WrapHandler(http.HandlerFunc(pprof.Index)))
+	g.GET("/pprof/cmdline", echo.WrapHandler(http.HandlerFunc(pprof.Cmdline)))
+	g.GET("/pprof/profile", echo.WrapHandler(http.HandlerFunc(pprof.Profile)))
+	g.GET("/pprof/trace", echo.WrapHandler(http.HandlerFunc(pprof.Trace)))
+	// go tool pprof looks up the symbols with POST
+	g.Match([]string{http.MethodGet, http.MethodPost}, "/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+
+	g.GET("/runtime", runtimeStats)
+}
+
+// Handles GET /debug/runtime. The sizes are in bytes, and the pauses of
+// the garbage collector in milliseconds.
+func runtimeStats(c echo.Context) error {
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+	response := map[string]interface{}{
+		"goVersion":      runtime.Version(),
+		"goroutines":     runtime.NumGoroutine(),
+		"gomaxprocs":     runtime.GOMAXPROCS(0),
+		"cpus":           runtime.NumCPU(),
+		"heapAlloc":      memory.HeapAlloc,
+		"heapInUse":      memory.HeapInuse,
+		"heapObjects":    memory.HeapObjects,
+		"sys":            memory.Sys,
+		"gcCycles":       memory.NumGC,
+		"gcPauseTotalMs": float64(memory.PauseTotalNs) / float64(time.Millisecond),
+	}
+	if memory.NumGC > 0 {
+		response["lastGC"] = time.Unix(0, int64(memory.LastGC)).UTC().Format(time.RFC3339)
+		response["lastGCPauseMs"] = float64(memory.PauseNs[(memory.NumGC+255)%256]) / float64(time.Millisecond)
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		response["module"] = info.Main.Path
+		response["version"] = info.Main.Version
+	}
+	return c.JSON(http.StatusOK, response)
+}
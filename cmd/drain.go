@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Before an instance is taken out of a blue/green deployment, the load
+// balancer should stop sending it new clients. POST /api/v1/admin/drain makes
+// /readyz fail with {"status": "draining"}, which tells it so, while the
+// server keeps answering every request that still reaches it, those in
+// flight and those of the connections kept alive. The instance may be
+// stopped once the load balancer took it out, or put back with DELETE
+// /api/v1/admin/drain. A restart ends the draining as well.
+
+// Whether the instance is draining, and since when. Safe for concurrent use.
+type drainState struct {
+	since atomic.Pointer[time.Time]
+}
+
+// What the routes of the draining answer.
+type drainStatus struct {
+	Draining bool       `json:"draining"`
+	Since    *time.Time `json:"since,omitempty"`
+}
+
+func (d *drainState) draining() bool {
+	return d.since.Load() != nil
+}
+
+func (d *drainState) status() drainStatus {
+	since := d.since.Load()
+	return drainStatus{Draining: since != nil, Since: since}
+}
+
+// Handles POST /api/v1/admin/drain. Draining again keeps the first time.
+func (d *drainState) start(c echo.Context) error {
+	now := time.Now()
+	if d.since.CompareAndSwap(nil, &now) {
+		requestLogger(c).Warn("draining, /readyz fails until the instance stops")
+	}
+	return c.JSON(http.StatusOK, d.status())
+}
+
+// Handles DELETE /api/v1/admin/drain.
+func (d *drainState) stop(c echo.Context) error {
+	if d.since.Swap(nil) != nil {
+		requestLogger(c).Info("no longer draining, /readyz tells the state of the storage again")
+	}
+	return c.JSON(http.StatusOK, d.status())
+}
+
+// Handles GET /api/v1/admin/drain.
+func (d *drainState) show(c echo.Context) error {
+	return c.JSON(http.StatusOK, d.status())
+}
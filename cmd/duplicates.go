@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Books that are probably the same, because their title and author only
+// differ in case, spacing or accents, e.g. "José Eustasio Rivera" and
+// "jose eustasio  rivera".
+type duplicateSet struct {
+	Title  string                   `json:"title"`
+	Author string                   `json:"author"`
+	Books  []map[string]interface{} `json:"books"`
+}
+
+// The form of a title or an author that equal ones share: without accents,
+// in lowercase, and with single spaces between the words.
+// To remove the accents, decomposing "é" gives "e" followed by a combining
+// accent (a nonspacing mark), which we drop. A transformer keeps state, so
+// every call needs its own.
+func normalizeText(text string) string {
+	stripDiacritics := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	stripped, _, err := transform.String(stripDiacritics, text)
+	if err != nil {
+		stripped = text
+	}
+	return strings.Join(strings.Fields(strings.ToLower(stripped)), " ")
+}
+
+// Groups the books by normalized title and author, and returns the groups
+// with more than one book, largest first. MongoDB cannot remove accents, so
+// the grouping happens here, but we only read the fields it needs, one book
+// at a time.
+func findDuplicates(ctx context.Context, coll *mongo.Collection) ([]duplicateSet, error) {
+	opts := options.Find().
+		SetProjection(bson.M{"ID": 1, "BookName": 1, "BookAuthor": 1}).
+		SetSort(bson.M{"_id": 1})
+	cursor, err := coll.Find(ctx, live(bson.M{}), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	groups := map[[2]string]*duplicateSet{}
+	for cursor.Next(ctx) {
+		var book BookStore
+		if err := cursor.Decode(&book); err != nil {
+			return nil, err
+		}
+		key := [2]string{normalizeText(book.BookName), normalizeText(joinAuthors(book.BookAuthors))}
+		if groups[key] == nil {
+			groups[key] = &duplicateSet{Title: key[0], Author: key[1]}
+		}
+		groups[key].Books = append(groups[key].Books, map[string]interface{}{
+			"id":     book.ID,
+			"title":  book.BookName,
+			"author": joinAuthors(book.BookAuthors),
+		})
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	sets := []duplicateSet{}
+	for _, group := range groups {
+		if len(group.Books) > 1 {
+			sets = append(sets, *group)
+		}
+	}
+	slices.SortFunc(sets, func(a, b duplicateSet) int {
+		if len(a.Books) != len(b.Books) {
+			return len(b.Books) - len(a.Books)
+		}
+		return strings.Compare(a.Title+"\x00"+a.Author, b.Title+"\x00"+b.Author)
+	})
+	return sets, nil
+}
+
+// Handles GET /api/admin/duplicates.
+func listDuplicates(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		sets, err := findDuplicates(c.Request().Context(), coll)
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		return c.JSON(http.StatusOK, sets)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Sends a list of books in the format the client asked for (see
+// negotiateFormat), with an ETag, or a bare 304 Not Modified when the client
+// already has this exact response, as told by its If-None-Match header.
+// Clients polling the API then only download the books when something changed.
+// The tag is a hash of the encoded body. It is weak ("W/"), because two
+// responses with the same tag hold the same books, but e.g. compression may
+// change the bytes on the wire.
+// Streamed formats like CSV are sent as they are produced, without an ETag.
+func sendBookList(c echo.Context, status int, books []map[string]interface{}) error {
+	format, ok := negotiateFormat(c, bookListFormats)
+	if !ok {
+		return notAcceptable(bookListFormats)
+	}
+	if format.stream != nil {
+		c.Response().Header().Add(echo.HeaderVary, echo.HeaderAccept)
+		c.Response().Header().Set(echo.HeaderContentType, format.mediaTypes[0]+"; charset=utf-8")
+		c.Response().WriteHeader(status)
+		return format.stream(c.Response(), books)
+	}
+	encoded, err := format.encode(books)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(encoded)
+	etag := fmt.Sprintf(`W/"%s"`, base64.RawURLEncoding.EncodeToString(sum[:16]))
+	return sendWithETag(c, status, format, etag, encoded)
+}
+
+// Same as sendBookList for a single book, whose ETag is its version (see
+// versionETag). This is the tag clients send back in If-Match.
+func sendBook(c echo.Context, status int, version int64, book map[string]interface{}) error {
+	format, ok := negotiateFormat(c, bookFormats)
+	if !ok {
+		return notAcceptable(bookFormats)
+	}
+	encoded, err := format.encode(book)
+	if err != nil {
+		return err
+	}
+	return sendWithETag(c, status, format, versionETag(version, format), encoded)
+}
+
+func sendWithETag(c echo.Context, status int, format responseFormat, etag string, encoded []byte) error {
+	// Caches must not hand out the XML version to somebody asking for JSON
+	c.Response().Header().Add(echo.HeaderVary, echo.HeaderAccept)
+	c.Response().Header().Set("ETag", etag)
+	if etagMatches(c.Request().Header.Get("If-None-Match"), etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.Blob(status, format.mediaTypes[0], encoded)
+}
+
+func notAcceptable(offered []responseFormat) error {
+	return newProblem(http.StatusNotAcceptable, "the response can only be sent as "+formatNames(offered))
+}
+
+// Reports whether an If-None-Match header, which may list several tags or be
+// "*", contains the given tag. If-None-Match uses the weak comparison, so the
+// W/ prefix does not matter.
+func etagMatches(header string, etag string) bool {
+	if header == "" {
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// For the programs that cannot open a WebSocket, GET /api/events streams the
+// changes of the books as Server-Sent Events
+// (https://html.spec.whatwg.org/multipage/server-sent-events.html), which
+// an EventSource of the browser, or curl -N, reads:
+//
+//	id: 3f2a9c1e-42
+//	event: updated
+//	data: {"id":"42","title":"Dune",...}
+//
+// The event is "created", "updated" or "deleted", see bookChange, and the
+// data the book as GET /api/books/:id returns it, as it was for a deletion.
+// A client that lost the connection sends the ID of the last event it got
+// in Last-Event-ID, as EventSource does by itself, and gets what it missed
+// first. The instance only keeps its last changeHistory changes, and only
+// knows its own IDs: when it cannot tell what the client missed, it sends a
+// "reset" event instead, after which the client should read the books again.
+
+const (
+	// How often a comment is sent when nothing changes, so the proxies in
+	// between keep the connection open, and the dead ones are noticed
+	eventsKeepAlive = 30 * time.Second
+	// How long sending an event may take before the client is given up
+	eventsWriteTimeout = 10 * time.Second
+)
+
+// The streams of /api/events, ended when the server shuts down.
+type eventStreams struct {
+	changes *bookChanges
+
+	once sync.Once
+	done chan struct{}
+}
+
+func newEventStreams(changes *bookChanges) *eventStreams {
+	return &eventStreams{changes: changes, done: make(chan struct{})}
+}
+
+// The ID of an event, e.g. "3f2a9c1e-42": the origin of the instance and the
+// number of the change.
+func (s *eventStreams) eventID(change bookChange) string {
+	return s.changes.origin + "-" + strconv.FormatUint(change.Seq, 10)
+}
+
+// The number of the change of a Last-Event-ID, if it is one of ours.
+func (s *eventStreams) parseEventID(id string) (uint64, bool) {
+	origin, seq, found := strings.Cut(id, "-")
+	if !found || origin != s.changes.origin {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	return n, err == nil
+}
+
+// Handles GET /api/events, until the client goes away.
+func (s *eventStreams) serve(c echo.Context) error {
+	var changes <-chan bookChange
+	var missed []bookChange
+	reset := false
+	var unsubscribe func()
+	if last := c.Request().Header.Get("Last-Event-ID"); last == "" {
+		changes, unsubscribe = s.changes.subscribe()
+	} else {
+		seq, ours := s.parseEventID(last)
+		var complete bool
+		changes, missed, complete, unsubscribe = s.changes.subscribeAfter(seq)
+		reset = !ours || !complete
+	}
+	defer unsubscribe()
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, "text/event-stream")
+	header.Set(echo.HeaderCacheControl, "no-cache")
+	// Or nginx holds the events back until it has enough of them
+	header.Set("X-Accel-Buffering", "no")
+	c.Response().WriteHeader(http.StatusOK)
+
+	// The timeouts of the HTTP server would end the stream, see limits.go;
+	// from now on, each event moves the deadline
+	controller := http.NewResponseController(c.Response())
+	_ = controller.SetReadDeadline(time.Time{})
+	send := func(event string) error {
+		_ = controller.SetWriteDeadline(time.Now().Add(eventsWriteTimeout))
+		if _, err := c.Response().Write([]byte(event)); err != nil {
+			return err
+		}
+		return controller.Flush()
+	}
+
+	// Sends the header right away, so the client knows it is connected
+	hello := ": connected\n\n"
+	if reset {
+		// The changes kept are not all the client missed, they would not
+		// bring it up to date. It resumes from the last one we have.
+		last := bookChange{}
+		if len(missed) > 0 {
+			last = missed[len(missed)-1]
+		}
+		hello, missed = fmt.Sprintf("id: %s\nevent: reset\ndata: {}\n\n", s.eventID(last)), nil
+	}
+	if err := send(hello); err != nil {
+		return nil
+	}
+	for _, change := range missed {
+		if err := send(s.format(change)); err != nil {
+			return nil
+		}
+	}
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case change := <-changes:
+			if err := send(s.format(change)); err != nil {
+				return nil
+			}
+		case <-keepAlive.C:
+			if err := send(": keep-alive\n\n"); err != nil {
+				return nil
+			}
+		case <-c.Request().Context().Done():
+			return nil
+		case <-s.done:
+			return nil
+		}
+	}
+}
+
+// The event of a change, see above.
+func (s *eventStreams) format(change bookChange) string {
+	// A book always encodes
+	data, _ := json.Marshal(bookToAPI(change.Book))
+	return fmt.Sprintf("id: %s\nevent: %s\ndata: %s\n\n", s.eventID(change), change.Type, data)
+}
+
+// Ends the streams when the server shuts down, which waits for them
+// otherwise. The clients connect again to the next instance, which sends
+// them a reset.
+func (s *eventStreams) close() {
+	s.once.Do(func() { close(s.done) })
+}
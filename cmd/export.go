@@ -0,0 +1,113 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The formats of an export, by the value of ?format: a JSON array of books,
+// like GET /books returns, or one book per line (https://github.com/ndjson),
+// which tools can read line by line.
+var exportFormats = map[string]struct {
+	contentType string
+	extension   string
+}{
+	"json":   {echo.MIMEApplicationJSON, "json"},
+	"ndjson": {"application/x-ndjson", "ndjson"},
+}
+
+// Answers with every book of the catalog as a file to download, e.g.
+// books-2026-10-14.json, with the keys of the API, see bookToAPI. With
+// ?gzip=true, the file is compressed, as books-2026-10-14.json.gz.
+// The books are read and written one at a time, like streamBookTable does,
+// so exporting a large catalog does not need more memory than a small one.
+func exportBooks(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		name := c.QueryParam("format")
+		if name == "" {
+			name = "json"
+		}
+		format, ok := exportFormats[name]
+		if !ok {
+			return newProblem(http.StatusBadRequest, "format must be json or ndjson")
+		}
+		compressed, err := parseBoolParam(c, "gzip")
+		if err != nil {
+			return newProblem(http.StatusBadRequest, err.Error())
+		}
+
+		// In the order they were added, so two exports are easy to compare
+		opts := options.Find().SetSort(bson.M{"_id": 1})
+		cursor, err := coll.Find(c.Request().Context(), live(bson.M{}), opts)
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		defer cursor.Close(c.Request().Context())
+
+		filename := fmt.Sprintf("books-%s.%s", time.Now().UTC().Format(time.DateOnly), format.extension)
+		contentType := format.contentType
+		if compressed {
+			filename += ".gz"
+			contentType = "application/gzip"
+		}
+		header := c.Response().Header()
+		header.Set(echo.HeaderContentType, contentType)
+		header.Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+		c.Response().WriteHeader(http.StatusOK)
+
+		if !compressed {
+			return writeBooks(c.Request().Context(), c.Response(), cursor, name == "ndjson")
+		}
+		gz := gzip.NewWriter(c.Response())
+		if err := writeBooks(c.Request().Context(), gz, cursor, name == "ndjson"); err != nil {
+			gz.Close()
+			return err
+		}
+		// Writes the end of the compressed file
+		return gz.Close()
+	}
+}
+
+// Writes the books of the cursor as a JSON array, or one per line. An error
+// may come after part of the books were written, see streamBookTable.
+func writeBooks(ctx context.Context, w io.Writer, cursor *mongo.Cursor, lines bool) error {
+	// The encoder ends every book with a newline
+	encoder := json.NewEncoder(w)
+	if !lines {
+		if _, err := io.WriteString(w, "[\n"); err != nil {
+			return err
+		}
+	}
+	for first := true; cursor.Next(ctx); first = false {
+		var book BookStore
+		if err := cursor.Decode(&book); err != nil {
+			return err
+		}
+		if !lines && !first {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if err := encoder.Encode(bookToAPI(book)); err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if !lines {
+		_, err := io.WriteString(w, "]\n")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/CAPS-Cloud/exercises/internal/features"
+	"github.com/labstack/echo/v4"
+)
+
+// The features that can be turned off while they are rolled out, see
+// internal/features. FEATURES changes their defaults, and the admins
+// override them at runtime:
+//
+//	GET    /api/v1/admin/features         every feature and its state
+//	PUT    /api/v1/admin/features/:name   {"enabled": false} turns it off
+//	DELETE /api/v1/admin/features/:name   back to the configuration
+
+const (
+	featureFuzzySearch  = "fuzzy_search"
+	featureSearchFacets = "search_facets"
+	featureBookMerge    = "book_merge"
+)
+
+var featureDefinitions = []features.Definition{
+	{
+		Name:        featureFuzzySearch,
+		Description: "The search tolerating typos, GET /books/search?fuzzy=true, and the search bar trying it when nothing matches",
+		Default:     true,
+	},
+	{
+		Name:        featureSearchFacets,
+		Description: "The counts of the books found by author, year and edition, GET /books/search?facets=true",
+		Default:     true,
+	},
+	{
+		Name:        featureBookMerge,
+		Description: "Merging duplicate books, POST /admin/merge",
+		Default:     true,
+	},
+}
+
+// Answers 404 Not Found while the feature is off, as if its route did not
+// exist.
+func requireFeature(flags *features.Set, name string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !flags.Enabled(name) {
+				return newProblem(http.StatusNotFound, "the feature "+name+" is turned off")
+			}
+			return next(c)
+		}
+	}
+}
+
+// The routes of the admins changing the features, see above.
+type featureAdmin struct {
+	flags *features.Set
+}
+
+// Handles GET /api/v1/admin/features.
+func (a *featureAdmin) list(c echo.Context) error {
+	return c.JSON(http.StatusOK, a.flags.List())
+}
+
+// Handles PUT /api/v1/admin/features/:name.
+func (a *featureAdmin) override(c echo.Context) error {
+	var input struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return newProblem(http.StatusBadRequest, "invalid request body")
+	}
+	if input.Enabled == nil {
+		return fieldErrors{"enabled": "is required"}
+	}
+	name := c.Param("name")
+	if err := a.flags.Override(name, *input.Enabled); err != nil {
+		return featureError(err)
+	}
+	requestLogger(c).Info("feature overridden", "feature", name, "enabled", *input.Enabled)
+	return a.send(c, name)
+}
+
+// Handles DELETE /api/v1/admin/features/:name.
+func (a *featureAdmin) reset(c echo.Context) error {
+	name := c.Param("name")
+	if err := a.flags.Reset(name); err != nil {
+		return featureError(err)
+	}
+	requestLogger(c).Info("feature reset to its configuration", "feature", name)
+	return a.send(c, name)
+}
+
+// Answers with the state of the feature.
+func (a *featureAdmin) send(c echo.Context, name string) error {
+	for _, flag := range a.flags.List() {
+		if flag.Name == name {
+			return c.JSON(http.StatusOK, flag)
+		}
+	}
+	return newProblem(http.StatusNotFound, "unknown feature")
+}
+
+func featureError(err error) error {
+	if errors.Is(err, features.ErrUnknown) {
+		return newProblem(http.StatusNotFound, "unknown feature")
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The style sheets are served under names holding a hash of their content,
+// e.g. /css/index.3f2a1b9c5d.css, which the pages get from the asset
+// function of the templates:
+//
+//	<link rel="stylesheet" href="{{ asset "css/index.css" }}" />
+//
+// A changed file gets a new name, so the browsers may keep a file for a year
+// without asking whether it changed. The plain names still work, but the
+// browsers check them every time. In development mode, the files change
+// while the server runs, so the pages link the plain names.
+
+// How long the browsers keep the files under their hashed names.
+const fingerprintedCacheControl = "public, max-age=31536000, immutable"
+
+// The hashed names of the files of the assets, nil in development mode.
+type fingerprints struct {
+	// e.g. css/index.css → css/index.3f2a1b9c5d.css
+	hashed map[string]string
+	// and back
+	plain map[string]string
+}
+
+// Hashes the files of the directory of the assets.
+func fingerprintAssets(assets fs.FS, dir string) (*fingerprints, error) {
+	f := &fingerprints{hashed: map[string]string{}, plain: map[string]string{}}
+	err := fs.WalkDir(assets, dir, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(assets, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		ext := path.Ext(name)
+		hashed := strings.TrimSuffix(name, ext) + "." + hex.EncodeToString(sum[:5]) + ext
+		f.hashed[name] = hashed
+		f.plain[hashed] = name
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// The URL of a file of the assets, e.g. css/index.css, for the asset
+// function of the templates.
+func (f *fingerprints) url(name string) string {
+	if f != nil {
+		if hashed, ok := f.hashed[name]; ok {
+			return "/" + hashed
+		}
+	}
+	return "/" + name
+}
+
+// Serves the files of a directory of the assets, under their hashed names
+// or their plain ones, see above. The route ends with /*.
+func (f *fingerprints) serve(assets fs.FS, dir string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		rest, err := url.PathUnescape(c.Param("*"))
+		if err != nil {
+			return echo.ErrNotFound
+		}
+		name := path.Join(dir, rest)
+		if !strings.HasPrefix(name, dir+"/") {
+			return echo.ErrNotFound
+		}
+		if f != nil {
+			if plain, ok := f.plain[name]; ok {
+				c.Response().Header().Set(echo.HeaderCacheControl, fingerprintedCacheControl)
+				return echo.StaticFileHandler(plain, assets)(c)
+			}
+		}
+		c.Response().Header().Set(echo.HeaderCacheControl, "no-cache")
+		if err := echo.StaticFileHandler(name, assets)(c); err != nil {
+			c.Response().Header().Del(echo.HeaderCacheControl)
+			return err
+		}
+		return nil
+	}
+}
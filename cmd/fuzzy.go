@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// How similar a book must be to the query to be found by a fuzzy search,
+// between 0 and 1. The value is the one PostgreSQL's pg_trgm uses by default:
+// low enough for "shelly" to find "Shelley" (0.5), high enough to leave out
+// unrelated names.
+const fuzzyThreshold = 0.3
+
+// An in-memory trigram index over the titles and authors, for searches that
+// tolerate typos. The text index of MongoDB only finds words with the same
+// stem, so "Shelly" never matches "Shelley"; comparing the trigrams (the
+// groups of three letters) of the words does.
+// The index is built from the collection when first needed, and built again
+// after every write through the API, see bookSearch.markStale. Writes made by other
+// means, e.g. another instance of the server, are seen through the change
+// stream, see changes.go; on a standalone MongoDB, only after the next
+// restart or write.
+type trigramIndex struct {
+	coll *mongo.Collection
+
+	mu    sync.Mutex
+	stale bool
+	books []indexedBook
+	// For each trigram, the position in books of those having it
+	postings map[string][]int
+}
+
+type indexedBook struct {
+	book BookStore
+	// The trigrams of each word of the title and author
+	words []map[string]bool
+}
+
+func newTrigramIndex(coll *mongo.Collection) *trigramIndex {
+	return &trigramIndex{coll: coll, stale: true}
+}
+
+// Marks the index as outdated, so the next fuzzy search builds it again.
+func (idx *trigramIndex) invalidate() {
+	idx.mu.Lock()
+	idx.stale = true
+	idx.mu.Unlock()
+}
+
+func (idx *trigramIndex) rebuild() error {
+	cursor, err := idx.coll.Find(context.Background(), listed(bson.M{}))
+	if err != nil {
+		return err
+	}
+	var books []BookStore
+	if err = cursor.All(context.Background(), &books); err != nil {
+		return err
+	}
+
+	idx.books = nil
+	idx.postings = map[string][]int{}
+	for i, book := range books {
+		var words []map[string]bool
+		for _, word := range splitWords(book.BookName + " " + strings.Join(book.BookAuthors, " ")) {
+			grams := trigrams(word)
+			words = append(words, grams)
+			for gram := range grams {
+				if n := len(idx.postings[gram]); n == 0 || idx.postings[gram][n-1] != i {
+					idx.postings[gram] = append(idx.postings[gram], i)
+				}
+			}
+		}
+		idx.books = append(idx.books, indexedBook{book: book, words: words})
+	}
+	idx.stale = false
+	return nil
+}
+
+// Finds the books resembling the query, best matches first. Each word of the
+// query is compared with the most similar word of the book, so the order of
+// the words does not matter ("Poe Alan" finds "Edgar Allan Poe"), and the
+// score of a book is the average over the words of the query.
+func (idx *trigramIndex) search(query string, limit int64) ([]searchHit, error) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.stale {
+		if err := idx.rebuild(); err != nil {
+			return nil, err
+		}
+	}
+
+	var queryWords []map[string]bool
+	candidates := map[int]bool{}
+	for _, word := range splitWords(query) {
+		grams := trigrams(word)
+		queryWords = append(queryWords, grams)
+		for gram := range grams {
+			for _, i := range idx.postings[gram] {
+				candidates[i] = true
+			}
+		}
+	}
+
+	hits := []searchHit{}
+	for i := range candidates {
+		var total float64
+		for _, queryWord := range queryWords {
+			best := 0.0
+			for _, word := range idx.books[i].words {
+				best = max(best, similarity(queryWord, word))
+			}
+			total += best
+		}
+		if score := total / float64(len(queryWords)); score >= fuzzyThreshold {
+			hits = append(hits, searchHit{BookStore: idx.books[i].book, Score: score})
+		}
+	}
+
+	// Same order as the text search: by score, then by insertion
+	slices.SortFunc(hits, func(a, b searchHit) int {
+		if a.Score != b.Score {
+			if a.Score > b.Score {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.MongoID.Hex(), b.MongoID.Hex())
+	})
+	if int64(len(hits)) > limit {
+		hits = hits[:limit]
+	}
+	return hits, nil
+}
+
+// Splits a text into lowercase words, dropping punctuation.
+func splitWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// The trigrams of a word, padded the way pg_trgm does it so that the start
+// and the end of words weigh more: "poe" gives "  p", " po", "poe" and "oe ".
+func trigrams(word string) map[string]bool {
+	runes := []rune("  " + word + " ")
+	grams := map[string]bool{}
+	for i := 0; i+3 <= len(runes); i++ {
+		grams[string(runes[i:i+3])] = true
+	}
+	return grams
+}
+
+// The share of trigrams two words have in common (Jaccard index).
+func similarity(a, b map[string]bool) float64 {
+	common := 0
+	for gram := range a {
+		if b[gram] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(a)+len(b)-common)
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/handler"
+	"github.com/99designs/gqlgen/graphql/handler/extension"
+	"github.com/99designs/gqlgen/graphql/handler/transport"
+	"github.com/CAPS-Cloud/exercises/internal/features"
+	"github.com/labstack/echo/v4"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//go:generate go run github.com/99designs/gqlgen generate
+
+// Besides the REST API, /graphql serves the catalog as a graph, described by
+// schema.graphqls: a client asks for the fields it needs, and follows the
+// books to their authors and the authors to their books in a single request.
+//
+//	POST /graphql
+//	{"query": "{ author(id: \"...\") { name books { title year } } }"}
+//
+// GET /graphql?query=... works as well, so the answers may be cached. The
+// graph only reads; the changes go through the REST API. The resolvers below
+// answer its fields from the same repository and collections as the REST
+// API, and gqlgen generates the rest, graphql_generated.go, from the schema
+// and gqlgen.yml.
+
+// The most fields a query may ask for, counting each once whatever the
+// length of its list. This bounds the queries following the authors to their
+// books and back again.
+const graphComplexityLimit = 200
+
+// The types of the schema, see schema.graphqls.
+
+type graphBook struct {
+	ID              string
+	Title           string
+	AuthorNames     []string
+	Pages           *int
+	Edition         *string
+	Year            *int
+	Series          *string
+	Volume          *int
+	Tags            []string
+	PublisherID     *string
+	Rating          *ratingSummary
+	Copies          int
+	AvailableCopies int
+	Cover           *string
+	CreatedAt       string
+	UpdatedAt       string
+
+	// For the authors, see graphBookResolver
+	authorIDs []string
+}
+
+type graphAuthor struct {
+	ID          string
+	Name        string
+	BirthYear   *int
+	Nationality *string
+	Bio         *string
+}
+
+type graphYear struct {
+	Year  int
+	Count int
+}
+
+type graphBookPage struct {
+	Total int
+	Books []*graphBook
+}
+
+type graphSearchHit struct {
+	Score float64
+	Book  *graphBook
+}
+
+// A pointer to the value, nil for its zero value, for the optional fields.
+func optional[T comparable](value T) *T {
+	var zero T
+	if value == zero {
+		return nil
+	}
+	return &value
+}
+
+// A book with the types of the schema.
+func graphBookFrom(book BookStore) *graphBook {
+	result := &graphBook{
+		ID:              book.ID,
+		Title:           book.BookName,
+		AuthorNames:     book.BookAuthors,
+		Pages:           optional(book.BookPages),
+		Edition:         optional(book.BookEdition),
+		Year:            optional(book.BookYear),
+		Series:          optional(book.Series),
+		Volume:          optional(book.SeriesVolume),
+		Tags:            book.Tags,
+		PublisherID:     optional(book.PublisherID),
+		Rating:          book.Rating,
+		Copies:          bookCopies(book),
+		AvailableCopies: availableCopies(book),
+		CreatedAt:       createdAt(book).UTC().Format(time.RFC3339),
+		UpdatedAt:       updatedAt(book).UTC().Format(time.RFC3339),
+		authorIDs:       book.AuthorIDs,
+	}
+	if result.AuthorNames == nil {
+		result.AuthorNames = []string{}
+	}
+	if result.Tags == nil {
+		result.Tags = []string{}
+	}
+	if book.Cover != nil {
+		result.Cover = optional(coverPath(book.ID))
+	}
+	return result
+}
+
+func graphBooksFrom(books []BookStore) []*graphBook {
+	result := make([]*graphBook, 0, len(books))
+	for _, book := range books {
+		result = append(result, graphBookFrom(book))
+	}
+	return result
+}
+
+// An author with the types of the schema.
+func graphAuthorFrom(a author) *graphAuthor {
+	return &graphAuthor{
+		ID:          a.ID,
+		Name:        a.Name,
+		BirthYear:   optional(a.BirthYear),
+		Nationality: optional(a.Nationality),
+		Bio:         optional(a.Bio),
+	}
+}
+
+// The resolvers of the schema. Like the REST API, they only see the live
+// books, and the years and the searches only the listed ones.
+type graphResolver struct {
+	repo    BookRepository
+	search  *bookSearch
+	authors *authorStore
+	flags   *features.Set
+}
+
+func (r *graphResolver) Query() QueryResolver   { return &graphQueryResolver{r} }
+func (r *graphResolver) Book() BookResolver     { return &graphBookResolver{r} }
+func (r *graphResolver) Author() AuthorResolver { return &graphAuthorResolver{r} }
+func (r *graphResolver) Year() YearResolver     { return &graphYearResolver{r} }
+
+type graphQueryResolver struct{ *graphResolver }
+
+// The limits of a page, checked like those of GET /api/v1/books, see
+// parsePagination.
+func graphPagination(limit, offset int) (int64, int64, error) {
+	if limit < 1 {
+		return 0, 0, newProblem(http.StatusBadRequest, "limit must be a positive number")
+	}
+	if offset < 0 {
+		return 0, 0, newProblem(http.StatusBadRequest, "offset must be zero or a positive number")
+	}
+	return min(int64(limit), maxPageSize), int64(offset), nil
+}
+
+func (r *graphQueryResolver) Books(ctx context.Context, limit int, offset int, author *string, year *int, tag *string) (*graphBookPage, error) {
+	query := bookQuery{}
+	var err error
+	if query.Limit, query.Offset, err = graphPagination(limit, offset); err != nil {
+		return nil, err
+	}
+	if author != nil {
+		query.Filter.Author = *author
+	}
+	if year != nil {
+		query.Filter.Year = *year
+	}
+	if tag != nil {
+		if normalized := normalizeTag(*tag); normalized != "" {
+			query.Filter.Tags = []string{normalized}
+		}
+	}
+	list, err := r.repo.FindAll(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &graphBookPage{Total: int(list.Total), Books: graphBooksFrom(list.Books)}, nil
+}
+
+func (r *graphQueryResolver) Book(ctx context.Context, id string) (*graphBook, error) {
+	book, err := r.repo.FindByID(ctx, id)
+	if errors.Is(err, errBookNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return graphBookFrom(book), nil
+}
+
+func (r *graphQueryResolver) Authors(ctx context.Context) ([]*graphAuthor, error) {
+	summaries, err := r.authors.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*graphAuthor, 0, len(summaries))
+	for _, summary := range summaries {
+		result = append(result, graphAuthorFrom(summary.author))
+	}
+	return result, nil
+}
+
+func (r *graphQueryResolver) Author(ctx context.Context, id string) (*graphAuthor, error) {
+	var found author
+	err := r.authors.authors.FindOne(ctx, bson.M{"_id": id}).Decode(&found)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return graphAuthorFrom(found), nil
+}
+
+func (r *graphQueryResolver) Years(ctx context.Context) ([]*graphYear, error) {
+	years, err := findYears(ctx, r.authors.books, false)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*graphYear, 0, len(years))
+	for _, summary := range years {
+		// A string in the REST API, see findYears
+		year, err := strconv.Atoi(summary.Year)
+		if err != nil {
+			return nil, fmt.Errorf("invalid year %q: %w", summary.Year, err)
+		}
+		result = append(result, &graphYear{Year: year, Count: summary.Count})
+	}
+	return result, nil
+}
+
+func (r *graphQueryResolver) Search(ctx context.Context, q string, limit int, fuzzy bool) ([]*graphSearchHit, error) {
+	if q == "" {
+		return nil, newProblem(http.StatusBadRequest, "q must not be empty")
+	}
+	n, _, err := graphPagination(limit, 0)
+	if err != nil {
+		return nil, err
+	}
+	var hits []searchHit
+	if fuzzy {
+		// Still rolled out, see features.go
+		if !r.flags.Enabled(featureFuzzySearch) {
+			return nil, newProblem(http.StatusBadRequest, "fuzzy is turned off, see the feature "+featureFuzzySearch)
+		}
+		hits, err = r.search.fuzzy.search(q, n)
+	} else {
+		hits, err = r.repo.Search(ctx, q, bookFilter{}, n)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*graphSearchHit, 0, len(hits))
+	for _, hit := range hits {
+		result = append(result, &graphSearchHit{Score: hit.Score, Book: graphBookFrom(hit.BookStore)})
+	}
+	return result, nil
+}
+
+type graphBookResolver struct{ *graphResolver }
+
+// The authors of the book, in the order of its names.
+func (r *graphBookResolver) Authors(ctx context.Context, obj *graphBook) ([]*graphAuthor, error) {
+	if len(obj.authorIDs) == 0 {
+		return []*graphAuthor{}, nil
+	}
+	cursor, err := r.authors.authors.Find(ctx, bson.M{"_id": bson.M{"$in": obj.authorIDs}})
+	if err != nil {
+		return nil, err
+	}
+	var found []author
+	if err = cursor.All(ctx, &found); err != nil {
+		return nil, err
+	}
+	byID := map[string]author{}
+	for _, a := range found {
+		byID[a.ID] = a
+	}
+	result := make([]*graphAuthor, 0, len(found))
+	for _, id := range obj.authorIDs {
+		if a, ok := byID[id]; ok {
+			result = append(result, graphAuthorFrom(a))
+		}
+	}
+	return result, nil
+}
+
+type graphAuthorResolver struct{ *graphResolver }
+
+// The books of the author, ordered by year like on their page, see
+// authorStore.find.
+func (r *graphAuthorResolver) Books(ctx context.Context, obj *graphAuthor) ([]*graphBook, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "BookYear", Value: 1}, {Key: "_id", Value: 1}})
+	return r.findBooks(ctx, live(bson.M{"AuthorID": obj.ID}), opts)
+}
+
+type graphYearResolver struct{ *graphResolver }
+
+// The books of the year, in alphabetical order, like the titles of GET
+// /api/v1/years?titles=true.
+func (r *graphYearResolver) Books(ctx context.Context, obj *graphYear) ([]*graphBook, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "BookName", Value: 1}, {Key: "_id", Value: 1}})
+	return r.findBooks(ctx, listed(bson.M{"BookYear": obj.Year}), opts)
+}
+
+func (r *graphResolver) findBooks(ctx context.Context, filter bson.M, opts *options.FindOptions) ([]*graphBook, error) {
+	cursor, err := r.authors.books.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	books := []BookStore{}
+	if err = cursor.All(ctx, &books); err != nil {
+		return nil, err
+	}
+	return graphBooksFrom(books), nil
+}
+
+// The errors of the resolvers, told like those of the REST API, see
+// problemFor: the clients see the detail of the problem and its status, in
+// the extensions of the error, and the causes of the failures end up in the
+// logs. The errors of the query itself, like an unknown field, stay as
+// gqlgen tells them.
+func presentGraphError(ctx context.Context, err error) *gqlerror.Error {
+	gqlErr := graphql.DefaultErrorPresenter(ctx, err)
+	if gqlErr.Err == nil {
+		return gqlErr
+	}
+	p := problemFor(gqlErr.Err)
+	if p.Status >= http.StatusInternalServerError {
+		slog.Error("could not answer a GraphQL query", "request_id", requestID(ctx),
+			"path", gqlErr.Path.String(), "status", p.Status, "error", gqlErr.Err)
+	}
+	gqlErr.Message = p.Detail
+	gqlErr.Extensions = map[string]interface{}{"status": p.Status}
+	return gqlErr
+}
+
+// A resolver that panics fails its field with a 500, like a handler does,
+// see logPanic.
+func recoverGraphPanic(ctx context.Context, err any) error {
+	return serverProblem(fmt.Errorf("a resolver panicked: %v\n%s", err, debug.Stack()), "internal server error")
+}
+
+// Handles GET and POST /graphql.
+func serveGraphQL(resolver *graphResolver) echo.HandlerFunc {
+	srv := handler.New(NewExecutableSchema(Config{Resolvers: resolver}))
+	srv.AddTransport(transport.GET{})
+	srv.AddTransport(transport.POST{})
+	srv.Use(extension.Introspection{})
+	srv.Use(extension.FixedComplexityLimit(graphComplexityLimit))
+	srv.SetErrorPresenter(presentGraphError)
+	srv.SetRecoverFunc(recoverGraphPanic)
+	return echo.WrapHandler(srv)
+}
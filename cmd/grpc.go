@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/bookpb"
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// For the internal services preferring gRPC to the REST API, the server
+// offers the BookService of internal/bookpb/books.proto on GRPC_PORT, e.g.
+//
+//	grpcurl -plaintext -d '{"query": "frankenstein"}' localhost:3031 bookstore.v1.BookService/SearchBooks
+//
+// It goes through the same BookRepository as the REST API and checks the
+// books with the same rules, so both see the same books and answer the same
+// errors, as gRPC status codes. The credentials are the same as well, in the
+// metadata of the calls: x-api-key, authorization or x-admin-token. Creating
+// and updating books needs the editor role, deleting them the admin role, as
+// for methodRoles, and in read-only mode, see maintenance.go, the calls
+// changing books fail with UNAVAILABLE. With TLS_CERT_FILE, the port speaks
+// TLS with the certificate of the HTTP server; the certificates of Let's
+// Encrypt are only for HTTPS, so with TLS_AUTOCERT_DOMAINS it stays plain,
+// for the services of the same network.
+
+// The methods of BookService changing books, with the HTTP method of the
+// REST route doing the same, whose role they need, see methodRoles.
+var rpcWrites = map[string]string{
+	bookpb.BookService_CreateBook_FullMethodName: http.MethodPost,
+	bookpb.BookService_UpdateBook_FullMethodName: http.MethodPut,
+	bookpb.BookService_DeleteBook_FullMethodName: http.MethodDelete,
+}
+
+// The gRPC status code of the HTTP status of a problem.
+var rpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusUnauthorized:        codes.Unauthenticated,
+	http.StatusForbidden:           codes.PermissionDenied,
+	http.StatusNotFound:            codes.NotFound,
+	http.StatusConflict:            codes.AlreadyExists,
+	http.StatusPreconditionFailed:  codes.Aborted,
+	http.StatusUnprocessableEntity: codes.InvalidArgument,
+	http.StatusTooManyRequests:     codes.ResourceExhausted,
+	http.StatusServiceUnavailable:  codes.Unavailable,
+}
+
+// The BookService, on the repository and the authors of the REST API.
+type bookService struct {
+	bookpb.UnimplementedBookServiceServer
+	repo    BookRepository
+	search  *bookSearch
+	authors *authorStore
+	cache   *responseCache
+}
+
+// The server of GRPC_PORT, nil without one. It is started and stopped along
+// with the HTTP server, see serve.
+func newGRPCServer(settings config.Config, service *bookService, auth *authenticator, maintenance *maintenanceMode) (*grpc.Server, error) {
+	if settings.GRPCPort == 0 {
+		return nil, nil
+	}
+	interceptor := &rpcInterceptor{auth: auth, maintenance: maintenance, timeout: settings.Limits.RequestTimeout}
+	options := []grpc.ServerOption{
+		grpc.UnaryInterceptor(interceptor.intercept),
+		grpc.MaxRecvMsgSize(settings.Limits.BodyLimit),
+	}
+	if settings.TLS.CertFile != "" {
+		creds, err := credentials.NewServerTLSFromFile(settings.TLS.CertFile, settings.TLS.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, grpc.Creds(creds))
+	}
+	server := grpc.NewServer(options...)
+	bookpb.RegisterBookServiceServer(server, service)
+	// So tools like grpcurl find the methods without books.proto
+	reflection.Register(server)
+	return server, nil
+}
+
+// Serves the calls on GRPC_PORT, at BIND_ADDRESS, until the server stops.
+func startGRPCServer(server *grpc.Server, settings config.Config) error {
+	listener, err := net.Listen("tcp", listenAddress(settings, settings.GRPCPort))
+	if err != nil {
+		return err
+	}
+	slog.Info("gRPC server started", "address", listener.Addr().String())
+	return server.Serve(listener)
+}
+
+// Waits for the calls in flight, like e.Shutdown, and cuts those still
+// running when ctx is done.
+func stopGRPCServer(ctx context.Context, server *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		server.Stop()
+	}
+}
+
+// What the middleware of the HTTP server does, for the calls: the request
+// ID, the timeout, the log, the panics, the read-only mode and the roles.
+type rpcInterceptor struct {
+	auth        *authenticator
+	maintenance *maintenanceMode
+	timeout     time.Duration
+}
+
+func (i *rpcInterceptor) intercept(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (response any, err error) {
+	start := time.Now()
+	md, _ := metadata.FromIncomingContext(ctx)
+	// The metadata are the headers of HTTP/2, so they read like them
+	header := http.Header{}
+	for key, values := range md {
+		header[http.CanonicalHeaderKey(key)] = values
+	}
+
+	// See requestid.go
+	id := header.Get(echo.HeaderXRequestID)
+	if !validRequestID(id) {
+		id = uuid.NewString()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs("x-request-id", id))
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+	ctx, cancel := context.WithTimeout(ctx, i.timeout)
+	defer cancel()
+	logger := slog.With("method", info.FullMethod, "request_id", id)
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			logger.Error("a handler panicked", "error", recovered, "stack", string(debug.Stack()))
+			err = status.Error(codes.Internal, "internal server error")
+		}
+		logger.Info("call",
+			"code", status.Code(err).String(),
+			"latency_ms", float64(time.Since(start).Microseconds())/1000,
+		)
+	}()
+
+	if method, ok := rpcWrites[info.FullMethod]; ok {
+		if state := i.maintenance.state(); state.ReadOnly {
+			detail := "the server is read-only for maintenance, try again later"
+			if state.Message != "" {
+				detail += ": " + state.Message
+			}
+			return nil, status.Error(codes.Unavailable, detail)
+		}
+		p, err := i.auth.identify(ctx, header)
+		if err != nil {
+			return nil, rpcError(logger, err)
+		}
+		required := methodRoles[method]
+		if p == nil {
+			return nil, status.Error(codes.Unauthenticated,
+				"credentials are required: an API key in x-api-key or a Bearer token")
+		}
+		if !p.Role.atLeast(required) {
+			return nil, status.Error(codes.PermissionDenied, "this needs the "+string(required)+" role")
+		}
+		logger = logger.With("user", p.Name)
+	}
+
+	response, err = handler(ctx, req)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			logger.Warn("the call took too long", "error", err)
+			return nil, status.Errorf(codes.DeadlineExceeded, "the call took more than %s, try again later", i.timeout)
+		}
+		return nil, rpcError(logger, err)
+	}
+	return response, nil
+}
+
+// The gRPC status of an error of the service, told as by problemFor. The
+// causes of the failures end up in the log; the invalid fields travel as a
+// BadRequest, and the time to wait before trying again as a RetryInfo, in
+// the details of the status.
+func rpcError(logger *slog.Logger, err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	p := problemFor(err)
+	code, ok := rpcCodes[p.Status]
+	if !ok {
+		code = codes.Internal
+		if p.Status < http.StatusInternalServerError {
+			code = codes.InvalidArgument
+		}
+	}
+	if p.Status >= http.StatusInternalServerError {
+		logger.Error("could not answer a call", "status", p.Status, "error", err)
+	}
+
+	st := status.New(code, p.Detail)
+	var details []protoadapt.MessageV1
+	if len(p.Errors) > 0 {
+		badRequest := &errdetails.BadRequest{}
+		for field, message := range p.Errors {
+			// "author" is the field of the JSON bodies
+			if field == "author" {
+				field = "authors"
+			}
+			badRequest.FieldViolations = append(badRequest.FieldViolations,
+				&errdetails.BadRequest_FieldViolation{Field: "book." + field, Description: message})
+		}
+		sort.Slice(badRequest.FieldViolations, func(a, b int) bool {
+			return badRequest.FieldViolations[a].Field < badRequest.FieldViolations[b].Field
+		})
+		details = append(details, badRequest)
+	}
+	if p.retryAfter > 0 {
+		details = append(details, &errdetails.RetryInfo{RetryDelay: durationpb.New(p.retryAfter)})
+	}
+	if len(details) > 0 {
+		// Only fails for details that are not messages
+		if withDetails, err := st.WithDetails(details...); err == nil {
+			st = withDetails
+		}
+	}
+	return st.Err()
+}
+
+// A book as a message of books.proto.
+func bookToRPC(book BookStore) *bookpb.Book {
+	result := &bookpb.Book{
+		Id:              book.ID,
+		Title:           book.BookName,
+		Authors:         book.BookAuthors,
+		AuthorIds:       book.AuthorIDs,
+		Edition:         book.BookEdition,
+		Pages:           int32(book.BookPages),
+		Year:            int32(book.BookYear),
+		Series:          book.Series,
+		Volume:          int32(book.SeriesVolume),
+		Tags:            book.Tags,
+		PublisherId:     book.PublisherID,
+		Copies:          int32(bookCopies(book)),
+		AvailableCopies: int32(availableCopies(book)),
+		CreatedAt:       timestamppb.New(createdAt(book)),
+		UpdatedAt:       timestamppb.New(updatedAt(book)),
+		Version:         book.Version,
+		Archived:        book.Archived,
+	}
+	if book.Rating != nil {
+		result.Rating = &bookpb.Rating{Average: book.Rating.Average, Count: int32(book.Rating.Count)}
+	}
+	return result
+}
+
+// The input of a book as the body of a REST request, for bookFromInput,
+// which checks it.
+func bookInputToAPI(input *bookpb.BookInput) (map[string]interface{}, error) {
+	if input == nil {
+		return nil, newProblem(http.StatusBadRequest, "book is required")
+	}
+	body := map[string]interface{}{}
+	set := func(key string, value string) {
+		if value != "" {
+			body[key] = value
+		}
+	}
+	set("id", input.Id)
+	set("title", input.Title)
+	set("edition", input.Edition)
+	set("series", input.Series)
+	// Numbers are decoded from JSON as float64, see inputValue
+	for key, value := range map[string]int32{"pages": input.Pages, "year": input.Year, "volume": input.Volume} {
+		if value != 0 {
+			body[key] = float64(value)
+		}
+	}
+	if len(input.Authors) > 0 {
+		authors := []interface{}{}
+		for _, name := range input.Authors {
+			authors = append(authors, name)
+		}
+		body["authors"] = authors
+	}
+	return body, nil
+}
+
+// The limit of a page, defaultPageSize when zero, see parseLimit.
+func rpcLimit(limit int32) (int64, error) {
+	if limit == 0 {
+		return defaultPageSize, nil
+	}
+	if limit < 0 {
+		return 0, newProblem(http.StatusBadRequest, "limit must be a positive number")
+	}
+	return min(int64(limit), maxPageSize), nil
+}
+
+// The versions the book must be in, like those of If-Match, nil for any.
+func rpcVersions(version int64) []int64 {
+	if version == 0 {
+		return nil
+	}
+	return []int64{version}
+}
+
+// After a change: the indexes of the search and the cached responses of the
+// REST API are outdated, as after the writes of markStale and invalidate.
+func (s *bookService) changed(ctx context.Context) {
+	if s.search != nil {
+		s.search.fuzzy.invalidate()
+		s.search.suggestions.invalidate()
+	}
+	if err := s.cache.newGeneration(context.WithoutCancel(ctx)); err != nil {
+		slog.Error("could not make the cached responses stale", "request_id", requestID(ctx), "error", err)
+	}
+}
+
+func (s *bookService) ListBooks(ctx context.Context, req *bookpb.ListBooksRequest) (*bookpb.ListBooksResponse, error) {
+	query := bookQuery{
+		Filter:     bookFilter{Author: req.Author, Year: int(req.Year)},
+		Sort:       req.Sort,
+		Descending: req.Descending,
+		Offset:     req.Offset,
+	}
+	var err error
+	if query.Limit, err = rpcLimit(req.Limit); err != nil {
+		return nil, err
+	}
+	if query.Offset < 0 {
+		return nil, newProblem(http.StatusBadRequest, "offset must be zero or a positive number")
+	}
+	if query.Sort != "" && !slices.Contains(sortableFields, query.Sort) {
+		return nil, newProblem(http.StatusBadRequest, fmt.Sprintf("sort must be one of %s", strings.Join(sortableFields, ", ")))
+	}
+	for _, tag := range req.Tags {
+		if tag = normalizeTag(tag); tag != "" {
+			query.Filter.Tags = append(query.Filter.Tags, tag)
+		}
+	}
+	list, err := s.repo.FindAll(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	response := &bookpb.ListBooksResponse{Total: list.Total}
+	for _, book := range list.Books {
+		response.Books = append(response.Books, bookToRPC(book))
+	}
+	return response, nil
+}
+
+func (s *bookService) GetBook(ctx context.Context, req *bookpb.GetBookRequest) (*bookpb.Book, error) {
+	book, err := s.repo.FindByID(ctx, req.Id)
+	if err != nil {
+		return nil, err
+	}
+	return bookToRPC(book), nil
+}
+
+// Does what POST /api/v1/books does, and answers the book as stored.
+func (s *bookService) CreateBook(ctx context.Context, req *bookpb.CreateBookRequest) (*bookpb.Book, error) {
+	input, err := bookInputToAPI(req.Book)
+	if err != nil {
+		return nil, err
+	}
+	book, err := bookFromCreateInput(input)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authors.linkBook(ctx, &book); err != nil {
+		return nil, serverProblem(err, "database error")
+	}
+	book.Version = 1
+	book.CreatedAt = time.Now()
+	book.UpdatedAt = book.CreatedAt
+	if err := s.repo.Insert(ctx, book); err != nil {
+		return nil, repositoryError(err, "could not insert book")
+	}
+	s.changed(ctx)
+	return s.GetBook(ctx, &bookpb.GetBookRequest{Id: book.ID})
+}
+
+// Does what PUT /api/v1/books/{id} does, and answers the book as stored.
+func (s *bookService) UpdateBook(ctx context.Context, req *bookpb.UpdateBookRequest) (*bookpb.Book, error) {
+	input, err := bookInputToAPI(req.Book)
+	if err != nil {
+		return nil, err
+	}
+	book, err := bookFromInput(req.Id, input)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authors.linkBook(ctx, &book); err != nil {
+		return nil, serverProblem(err, "database error")
+	}
+	if err := s.repo.Update(ctx, req.Id, book, rpcVersions(req.Version)); err != nil {
+		return nil, repositoryError(err, "failed to update book")
+	}
+	s.changed(ctx)
+	return s.GetBook(ctx, &bookpb.GetBookRequest{Id: req.Id})
+}
+
+// Moves the book to the trash, like DELETE /api/v1/books/{id}.
+func (s *bookService) DeleteBook(ctx context.Context, req *bookpb.DeleteBookRequest) (*emptypb.Empty, error) {
+	if err := s.repo.Delete(ctx, req.Id, rpcVersions(req.Version)); err != nil {
+		return nil, repositoryError(err, "could not delete book")
+	}
+	s.changed(ctx)
+	return &emptypb.Empty{}, nil
+}
+
+func (s *bookService) SearchBooks(ctx context.Context, req *bookpb.SearchBooksRequest) (*bookpb.SearchBooksResponse, error) {
+	query := strings.TrimSpace(req.Query)
+	if query == "" {
+		return nil, newProblem(http.StatusBadRequest, "query is required")
+	}
+	limit, err := rpcLimit(req.Limit)
+	if err != nil {
+		return nil, err
+	}
+	hits, err := s.repo.Search(ctx, query, bookFilter{}, limit)
+	if err != nil {
+		return nil, err
+	}
+	response := &bookpb.SearchBooksResponse{}
+	for _, hit := range hits {
+		response.Hits = append(response.Hits, &bookpb.SearchHit{Book: bookToRPC(hit.BookStore), Score: hit.Score})
+	}
+	return response, nil
+}
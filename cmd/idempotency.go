@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How long we remember the response to an Idempotency-Key.
+const idempotencyKeyTTL = 24 * time.Hour
+
+// What we remember about a request sent with an Idempotency-Key
+// (https://datatracker.ietf.org/doc/draft-ietf-httpapi-idempotency-key-header/).
+// The keys are the ones of a client, so Key is scoped by it, see
+// idempotencyScope, e.g. "user:alice:3f2a...". Fingerprint identifies the
+// request, so a key cannot be reused for another one. Until the handler is done, Completed is false and there is no
+// response yet.
+type idempotencyRecord struct {
+	Key         string    `bson:"_id"`
+	Fingerprint string    `bson:"Fingerprint"`
+	Completed   bool      `bson:"Completed"`
+	Status      int       `bson:"Status,omitempty"`
+	ContentType string    `bson:"ContentType,omitempty"`
+	Body        []byte    `bson:"Body,omitempty"`
+	CreatedAt   time.Time `bson:"CreatedAt"`
+}
+
+// Lets MongoDB delete the records once their key expired. The TTL monitor
+// only runs about once a minute, so reads check the age as well.
+func prepareIdempotencyIndexes(coll *mongo.Collection) error {
+	_, err := coll.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "CreatedAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(idempotencyKeyTTL.Seconds())),
+	})
+	return err
+}
+
+// Makes a handler safe to retry. A client sending the same request twice
+// with the same Idempotency-Key header, e.g. because the network dropped the
+// first response, gets the stored response back instead of creating the book
+// a second time. Requests without the header are handled as usual.
+// Server errors are not remembered, so the client can try again.
+func idempotent(keys *mongo.Collection) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key := c.Request().Header.Get("Idempotency-Key")
+			if key == "" {
+				return next(c)
+			}
+			// Two clients may well pick the same key
+			key = idempotencyScope(c) + ":" + key
+
+			body, err := io.ReadAll(c.Request().Body)
+			if err != nil {
+				return newProblem(http.StatusBadRequest, "could not read request body")
+			}
+			c.Request().Body = io.NopCloser(bytes.NewReader(body))
+			sum := sha256.Sum256(append([]byte(key+"\n"+c.Request().Method+" "+c.Request().URL.Path+"\n"), body...))
+			fingerprint := hex.EncodeToString(sum[:])
+
+			// Claiming the key is a single insert, so two concurrent
+			// requests with the same key cannot both run the handler.
+			record := idempotencyRecord{Key: key, Fingerprint: fingerprint, CreatedAt: time.Now()}
+			_, err = keys.InsertOne(c.Request().Context(), record)
+			if mongo.IsDuplicateKeyError(err) {
+				return replayIdempotent(c, keys, key, fingerprint)
+			}
+			if err != nil {
+				return serverProblem(err, "database error")
+			}
+
+			// Keep a copy of everything the handler writes
+			recorder := &recordingWriter{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = recorder
+			if err := next(c); err != nil {
+				c.Error(err)
+			}
+
+			status := c.Response().Status
+			// Even if the client left meanwhile, so it can send the key
+			// again
+			ctx := context.WithoutCancel(c.Request().Context())
+			if status >= http.StatusInternalServerError {
+				_, err = keys.DeleteOne(ctx, bson.M{"_id": key})
+			} else {
+				_, err = keys.UpdateOne(ctx, bson.M{"_id": key}, bson.M{"$set": bson.M{
+					"Completed":   true,
+					"Status":      status,
+					"ContentType": c.Response().Header().Get(echo.HeaderContentType),
+					"Body":        recorder.body.Bytes(),
+				}})
+			}
+			if err != nil {
+				requestLogger(c).Error("could not keep the response for the idempotency key", "error", err)
+			}
+			return nil
+		}
+	}
+}
+
+// Who the keys of the request belong to: the caller authorize found, i.e.
+// the user, the API key, by its ID since the names repeat, or the admin
+// token, or else the address of the client.
+func idempotencyScope(c echo.Context) string {
+	if p, ok := c.Get("principal").(*principal); ok && p != nil {
+		switch {
+		case p.IsUser:
+			return "user:" + p.Name
+		case p.KeyID != "":
+			return "key:" + p.KeyID
+		default:
+			return "client:" + p.Name
+		}
+	}
+	return "ip:" + echo.ExtractIPDirect()(c.Request())
+}
+
+// Answers a request whose key was already used.
+func replayIdempotent(c echo.Context, keys *mongo.Collection, key string, fingerprint string) error {
+	var record idempotencyRecord
+	err := keys.FindOne(c.Request().Context(), bson.M{"_id": key}).Decode(&record)
+	if err == mongo.ErrNoDocuments || (err == nil && time.Since(record.CreatedAt) > idempotencyKeyTTL) {
+		// Expired in between: the client has to send a new key
+		return newProblem(http.StatusConflict, "Idempotency-Key expired, please retry with a new one")
+	}
+	if err != nil {
+		return serverProblem(err, "database error")
+	}
+
+	if record.Fingerprint != fingerprint {
+		return newProblem(http.StatusUnprocessableEntity, "Idempotency-Key was already used for another request")
+	}
+	if !record.Completed {
+		return newProblem(http.StatusConflict, "a request with this Idempotency-Key is still in progress")
+	}
+
+	c.Response().Header().Set("Idempotent-Replayed", "true")
+	return c.Blob(record.Status, record.ContentType, record.Body)
+}
+
+// An http.ResponseWriter remembering the body written through it.
+type recordingWriter struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
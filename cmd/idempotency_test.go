@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestIdempotencyScope(t *testing.T) {
+	tests := []struct {
+		name      string
+		principal *principal
+		want      string
+	}{
+		{"a user", &principal{Name: "ada", IsUser: true}, "user:ada"},
+		{"an API key", &principal{Name: "importer", KeyID: "k1"}, "key:k1"},
+		{"another key of the same name", &principal{Name: "importer", KeyID: "k2"}, "key:k2"},
+		{"the admin token", &principal{Name: "admin token", Role: roleAdmin}, "client:admin token"},
+		{"nobody", nil, "ip:192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/books", nil)
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+			if tt.principal != nil {
+				c.Set("principal", tt.principal)
+			}
+			if got := idempotencyScope(c); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// One operation of a JSON Patch document (https://www.rfc-editor.org/rfc/rfc6902).
+// A patch is an array of these, applied in order, e.g.
+//
+//	[
+//	  {"op": "test", "path": "/year", "value": "1818"},
+//	  {"op": "replace", "path": "/year", "value": "1831"}
+//	]
+//
+// A raw message lets us tell a missing value apart from a `null` one.
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Returned when a `test` operation does not match the current book, so the
+// handler can answer with 409 Conflict instead of 400.
+type patchTestFailedError struct {
+	Path string
+}
+
+func (e *patchTestFailedError) Error() string {
+	return fmt.Sprintf("test failed for %s", e.Path)
+}
+
+func decodeJSONPatch(body io.Reader) ([]patchOperation, error) {
+	var ops []patchOperation
+	if err := json.NewDecoder(body).Decode(&ops); err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+// Applies the operations, in order, to a book given with its API keys (see
+// storedToAPI). We support add, remove, replace and test; books are flat, so a
+// path always names one of the top-level keys, like "/title".
+// If any operation fails, the error is returned and the caller must discard
+// the document: as the RFC requires, a patch is applied completely or not at
+// all.
+func applyJSONPatch(doc map[string]interface{}, ops []patchOperation) error {
+	for i, op := range ops {
+		key, err := patchKey(op.Path)
+		if err != nil {
+			return fmt.Errorf("operation %d: %w", i, err)
+		}
+		if _, ok := bookFields[key]; !ok && key != "authors" {
+			return fmt.Errorf("operation %d: unknown field %q", i, key)
+		}
+		_, exists := doc[key]
+
+		switch op.Op {
+		case "add":
+			value, err := patchValue(op, key)
+			if err != nil {
+				return fmt.Errorf("operation %d: %w", i, err)
+			}
+			doc[key] = value
+			replaceAuthorKey(doc, key)
+		case "replace":
+			if !exists {
+				return fmt.Errorf("operation %d: %s does not exist", i, op.Path)
+			}
+			value, err := patchValue(op, key)
+			if err != nil {
+				return fmt.Errorf("operation %d: %w", i, err)
+			}
+			doc[key] = value
+			replaceAuthorKey(doc, key)
+		case "remove":
+			if !exists {
+				return fmt.Errorf("operation %d: %s does not exist", i, op.Path)
+			}
+			delete(doc, key)
+		case "test":
+			value, err := patchValue(op, key)
+			if err != nil {
+				return fmt.Errorf("operation %d: %w", i, err)
+			}
+			if !exists || !samePatchValue(key, doc[key], value) {
+				return &patchTestFailedError{Path: op.Path}
+			}
+		default:
+			return fmt.Errorf("operation %d: unsupported op %q", i, op.Op)
+		}
+	}
+	return nil
+}
+
+// author and authors are the same field, see storedToAPI: setting one of
+// them replaces the other.
+func replaceAuthorKey(doc map[string]interface{}, key string) {
+	switch key {
+	case "author":
+		delete(doc, "authors")
+	case "authors":
+		delete(doc, "author")
+	}
+}
+
+// Turns a JSON Pointer (https://www.rfc-editor.org/rfc/rfc6901) like "/title"
+// into the key it points to.
+func patchKey(path string) (string, error) {
+	if !strings.HasPrefix(path, "/") || strings.Count(path, "/") != 1 {
+		return "", fmt.Errorf("path %q must point to a field of the book", path)
+	}
+	key := strings.TrimPrefix(path, "/")
+	return strings.NewReplacer("~1", "/", "~0", "~").Replace(key), nil
+}
+
+// Reads the value of an operation on the given key the way the other
+// requests read fields, see inputValue: as a string, numbers included. The
+// authors may be lists, so they are kept as they are, to be checked by
+// bookFromInput with the rest of the book.
+func patchValue(op patchOperation, key string) (interface{}, error) {
+	if op.Value == nil {
+		return nil, fmt.Errorf("%s on %s needs a value", op.Op, op.Path)
+	}
+	var raw interface{}
+	if err := json.Unmarshal(op.Value, &raw); err != nil {
+		return nil, fmt.Errorf("value of %s is not valid JSON", op.Path)
+	}
+	if key == "author" || key == "authors" {
+		return raw, nil
+	}
+	value, message := inputValue(key, raw)
+	if message != "" {
+		return nil, fmt.Errorf("value of %s %s", op.Path, message)
+	}
+	return value, nil
+}
+
+// Tells whether a `test` operation holds. Strings are compared as stored,
+// e.g. an ISBN with or without hyphens, lists of authors as JSON.
+func samePatchValue(key string, current interface{}, value interface{}) bool {
+	currentString, ok := current.(string)
+	valueString, valueOK := value.(string)
+	if !ok || !valueOK {
+		currentJSON, _ := json.Marshal(current)
+		valueJSON, _ := json.Marshal(value)
+		return bytes.Equal(currentJSON, valueJSON)
+	}
+	return storedValue(key, currentString) == storedValue(key, valueString)
+}
+
+// Converts a document as stored in the database into the API keys, leaving
+// out the fields the document does not have. A single author is in author,
+// like before books could have several, so patches written back then keep
+// working; several authors are in authors, a list.
+func storedToAPI(stored map[string]interface{}) map[string]interface{} {
+	doc := map[string]interface{}{}
+	for apiKey, mongoField := range bookFields {
+		value, ok := stored[mongoField]
+		if !ok {
+			continue
+		}
+		if names, isList := value.(primitive.A); isList && apiKey == "author" {
+			if len(names) == 1 {
+				doc["author"] = names[0]
+			} else {
+				doc["authors"] = []interface{}(names)
+			}
+			continue
+		}
+		// Numbers are strings in the API, see formatNumber
+		switch n := value.(type) {
+		case int32:
+			value = formatNumber(int(n))
+		case int64:
+			value = formatNumber(int(n))
+		}
+		doc[apiKey] = value
+	}
+	return doc
+}
+
+// Handles a PATCH request with a JSON Patch body. Operations like `test` need
+// the current book, so we read it, apply the patch in memory and write the
+// result back.
+// The write only succeeds if the stored document is still the one we read:
+// otherwise somebody changed the book in between, our `test` operations may
+// no longer hold, and the client gets a 409 Conflict to retry.
+func applyJSONPatchRequest(c echo.Context, coll *mongo.Collection, authors *authorStore, revisions *revisionStore, bookID string) error {
+	ops, err := decodeJSONPatch(c.Request().Body)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "invalid request body")
+	}
+
+	filter := live(bson.M{"ID": bookID})
+	conditional := addIfMatch(c, filter)
+	var stored bson.M
+	err = coll.FindOne(c.Request().Context(), filter).Decode(&stored)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			if conditional {
+				return notFoundOrPreconditionFailed(c.Request().Context(), coll, bookID)
+			}
+			return errBookNotFound
+		}
+		return serverProblem(err, "database error")
+	}
+
+	doc := storedToAPI(stored)
+	if err := applyJSONPatch(doc, ops); err != nil {
+		var testFailed *patchTestFailedError
+		if errors.As(err, &testFailed) {
+			return newProblem(http.StatusConflict, err.Error())
+		}
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+	book, err := bookFromInput(bookID, doc)
+	if err != nil {
+		return err
+	}
+	if err := authors.linkBook(c.Request().Context(), &book); err != nil {
+		return serverProblem(err, "database error")
+	}
+
+	var before BookStore
+	err = coll.FindOneAndUpdate(c.Request().Context(), live(stored), replaceUpdate(book)).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		return newProblem(http.StatusConflict, "book was modified concurrently, please retry")
+	}
+	if err != nil {
+		return serverProblem(err, "failed to update book")
+	}
+	revisions.record(c.Request().Context(), before)
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "book updated"})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPatchKey(t *testing.T) {
+	tests := []struct {
+		path string
+		key  string
+		ok   bool
+	}{
+		{"/title", "title", true},
+		{"/a~1b", "a/b", true},
+		{"/a~0b", "a~b", true},
+		{"/a~01", "a~1", true},
+		{"title", "", false},
+		{"/title/0", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			key, err := patchKey(tt.path)
+			if (err == nil) != tt.ok || key != tt.key {
+				t.Errorf("got %q, %v, want %q", key, err, tt.key)
+			}
+		})
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	book := func() map[string]interface{} {
+		return map[string]interface{}{"id": "frankenstein", "title": "Frankenstein", "author": "Mary Shelley", "year": "1818"}
+	}
+	tests := []struct {
+		name  string
+		patch string
+		// The book after the patch, or nil if it fails
+		want map[string]interface{}
+		// Part of the error, when it fails
+		err string
+	}{
+		{
+			name:  "replaces after a test",
+			patch: `[{"op": "test", "path": "/year", "value": "1818"}, {"op": "replace", "path": "/year", "value": 1831}]`,
+			want:  map[string]interface{}{"id": "frankenstein", "title": "Frankenstein", "author": "Mary Shelley", "year": "1831"},
+		},
+		{
+			name:  "adds and removes",
+			patch: `[{"op": "add", "path": "/pages", "value": "280"}, {"op": "remove", "path": "/year"}]`,
+			want:  map[string]interface{}{"id": "frankenstein", "title": "Frankenstein", "author": "Mary Shelley", "pages": "280"},
+		},
+		{
+			name:  "replaces author by authors",
+			patch: `[{"op": "add", "path": "/authors", "value": ["Mary Shelley", "Percy Shelley"]}]`,
+			want:  map[string]interface{}{"id": "frankenstein", "title": "Frankenstein", "authors": []interface{}{"Mary Shelley", "Percy Shelley"}, "year": "1818"},
+		},
+		{
+			name:  "fails a test",
+			patch: `[{"op": "test", "path": "/year", "value": "1831"}]`,
+			err:   "test failed for /year",
+		},
+		{
+			name:  "replaces a missing field",
+			patch: `[{"op": "replace", "path": "/series", "value": "Gothic"}]`,
+			err:   "operation 0: /series does not exist",
+		},
+		{
+			name:  "removes a missing field",
+			patch: `[{"op": "remove", "path": "/pages"}]`,
+			err:   "operation 0: /pages does not exist",
+		},
+		{
+			name:  "of an unknown field",
+			patch: `[{"op": "add", "path": "/colour", "value": "red"}]`,
+			err:   `operation 0: unknown field "colour"`,
+		},
+		{
+			name:  "without a value",
+			patch: `[{"op": "add", "path": "/title"}]`,
+			err:   "add on /title needs a value",
+		},
+		{
+			name:  "with an unsupported op",
+			patch: `[{"op": "move", "path": "/title"}]`,
+			err:   `unsupported op "move"`,
+		},
+		{
+			name:  "with a wrong value",
+			patch: `[{"op": "add", "path": "/year", "value": 18.5}]`,
+			err:   "value of /year must be a whole number",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ops []patchOperation
+			if err := json.Unmarshal([]byte(tt.patch), &ops); err != nil {
+				t.Fatal(err)
+			}
+			doc := book()
+			err := applyJSONPatch(doc, ops)
+			if tt.want == nil {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got the error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(doc, tt.want) {
+				t.Errorf("got %v, want %v", doc, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyJSONPatchTestFailed(t *testing.T) {
+	ops := []patchOperation{{Op: "test", Path: "/title", Value: json.RawMessage(`"Dracula"`)}}
+	err := applyJSONPatch(map[string]interface{}{"title": "Frankenstein"}, ops)
+	var failed *patchTestFailedError
+	if !errors.As(err, &failed) || failed.Path != "/title" {
+		t.Errorf("got %v, want a failed test of /title", err)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How long the tokens issued at login are valid. Access tokens are checked
+// without asking the database, so they cannot be revoked: they expire soon
+// instead. Refresh tokens get new access tokens without logging in again.
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 7 * 24 * time.Hour
+)
+
+// A refresh token, as we store it: like the API keys, only its hash.
+// Every refresh token is used once, and replaced by a new one of the same
+// family, i.e. coming from the same login. A token used a second time must
+// have been stolen, by the client or the thief, and the whole family is
+// revoked, see
+// https://datatracker.ietf.org/doc/html/draft-ietf-oauth-security-topics#name-refresh-token-protection
+type refreshToken struct {
+	Hash      string    `bson:"_id"`
+	Username  string    `bson:"Username"`
+	Family    string    `bson:"Family"`
+	Used      bool      `bson:"Used"`
+	ExpiresAt time.Time `bson:"ExpiresAt"`
+}
+
+// Logs users in and checks the JSON Web Tokens (https://www.rfc-editor.org/rfc/rfc7519)
+// it gave them. The tokens are signed with HMAC-SHA256 and the secret from
+// the JWT_SECRET environment variable. Without it, a random secret is used,
+// and the tokens stop working when the server restarts.
+type jwtAuth struct {
+	users         *mongo.Collection
+	refreshTokens *mongo.Collection
+	secret        []byte
+}
+
+func newJWTAuth(users *mongo.Collection, refreshTokens *mongo.Collection, secret string) (*jwtAuth, error) {
+	if secret == "" {
+		random, err := randomToken(32)
+		if err != nil {
+			return nil, err
+		}
+		secret = random
+	}
+	return &jwtAuth{users: users, refreshTokens: refreshTokens, secret: []byte(secret)}, nil
+}
+
+// Lets MongoDB delete the refresh tokens once they expired, and find those of
+// a family quickly.
+func prepareRefreshTokenIndexes(coll *mongo.Collection) error {
+	_, err := coll.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "ExpiresAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+		{Keys: bson.D{{Key: "Family", Value: 1}}},
+	})
+	return err
+}
+
+// What an access token says: who the user is, and their role when the
+// token was issued. A changed role takes effect with the next token.
+type accessClaims struct {
+	Role role `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// Returns the user named by the access token in the Authorization header.
+func (a *jwtAuth) verify(header string) (*principal, error) {
+	raw, found := strings.CutPrefix(header, "Bearer ")
+	if !found {
+		return nil, errors.New("the Authorization header must be a Bearer token")
+	}
+	claims := accessClaims{}
+	_, err := jwt.ParseWithClaims(raw, &claims, func(token *jwt.Token) (interface{}, error) {
+		return a.secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, errors.New("invalid or expired token")
+	}
+	return &principal{Name: claims.Subject, Role: claims.Role.orDefault(), IsUser: true}, nil
+}
+
+// Issues a new access token and a new refresh token of the given family.
+func (a *jwtAuth) issueTokens(c echo.Context, account *user, family string) error {
+	username := account.Username
+	now := time.Now()
+	access, err := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims{
+		Role: account.Role.orDefault(),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   username,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(accessTokenTTL)),
+		},
+	}).SignedString(a.secret)
+	if err != nil {
+		return serverProblem(err, "could not issue token")
+	}
+
+	refresh, err := randomToken(32)
+	if err != nil {
+		return serverProblem(err, "could not issue token")
+	}
+	_, err = a.refreshTokens.InsertOne(c.Request().Context(), refreshToken{
+		Hash:      hashAPIKey(refresh),
+		Username:  username,
+		Family:    family,
+		ExpiresAt: now.Add(refreshTokenTTL),
+	})
+	if err != nil {
+		return serverProblem(err, "could not issue token")
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"accessToken":  access,
+		"tokenType":    "Bearer",
+		"expiresIn":    int(accessTokenTTL.Seconds()),
+		"refreshToken": refresh,
+	})
+}
+
+// Handles POST /api/auth/login with {"username": "ada", "password": "..."}.
+func (a *jwtAuth) login(c echo.Context) error {
+	var input struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return newProblem(http.StatusBadRequest, "invalid request body")
+	}
+	found, err := checkPassword(c.Request().Context(), a.users, input.Username, input.Password)
+	if err != nil {
+		return serverProblem(err, "database error")
+	}
+	if found == nil {
+		return newProblem(http.StatusUnauthorized, "wrong username or password")
+	}
+
+	family, err := randomToken(9)
+	if err != nil {
+		return serverProblem(err, "could not issue token")
+	}
+	return a.issueTokens(c, found, family)
+}
+
+// Handles POST /api/auth/refresh with {"refreshToken": "..."}, answering
+// like login. The refresh token sent cannot be used again.
+func (a *jwtAuth) refresh(c echo.Context) error {
+	var input struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return newProblem(http.StatusBadRequest, "invalid request body")
+	}
+
+	// Marking the token used in the same operation that finds it: of two
+	// concurrent requests with the same token, only one sees it unused.
+	var token refreshToken
+	err := a.refreshTokens.FindOneAndUpdate(c.Request().Context(),
+		bson.M{"_id": hashAPIKey(input.RefreshToken)},
+		bson.M{"$set": bson.M{"Used": true}},
+	).Decode(&token)
+	if err == mongo.ErrNoDocuments {
+		return newProblem(http.StatusUnauthorized, "invalid refresh token")
+	}
+	if err != nil {
+		return serverProblem(err, "database error")
+	}
+	if token.Used {
+		if _, err := a.refreshTokens.DeleteMany(c.Request().Context(), bson.M{"Family": token.Family}); err != nil {
+			return serverProblem(err, "database error")
+		}
+		return newProblem(http.StatusUnauthorized, "refresh token was already used, please log in again")
+	}
+	// The TTL monitor only runs about once a minute
+	if time.Now().After(token.ExpiresAt) {
+		return newProblem(http.StatusUnauthorized, "invalid refresh token")
+	}
+
+	// The user may have been deleted, or got another role, since
+	var account user
+	err = a.users.FindOne(c.Request().Context(), bson.M{"_id": token.Username}).Decode(&account)
+	if err == mongo.ErrNoDocuments {
+		return newProblem(http.StatusUnauthorized, "invalid refresh token")
+	}
+	if err != nil {
+		return serverProblem(err, "database error")
+	}
+	return a.issueTokens(c, &account, token.Family)
+}
+
+// Handles POST /api/auth/logout with {"refreshToken": "..."}: the refresh
+// tokens of this login stop working. The access token stays valid until it
+// expires.
+func (a *jwtAuth) logout(c echo.Context) error {
+	var input struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return newProblem(http.StatusBadRequest, "invalid request body")
+	}
+	var token refreshToken
+	err := a.refreshTokens.FindOne(c.Request().Context(), bson.M{"_id": hashAPIKey(input.RefreshToken)}).Decode(&token)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return serverProblem(err, "database error")
+	}
+	if err == nil {
+		if _, err := a.refreshTokens.DeleteMany(c.Request().Context(), bson.M{"Family": token.Family}); err != nil {
+			return serverProblem(err, "database error")
+		}
+	}
+	return c.NoContent(http.StatusNoContent)
+}
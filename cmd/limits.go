@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// A client cannot hold the server up for ever, nor make it read as much as
+// it likes:
+//
+//   - a request body may be at most BODY_LIMIT bytes, or UPLOAD_LIMIT for
+//     the multipart/form-data uploads, like the covers. A larger one is
+//     refused with 413 Request Entity Too Large, before or while it is read.
+//   - the connection has READ_HEADER_TIMEOUT to send the headers, and
+//     READ_TIMEOUT the whole request; then WRITE_TIMEOUT for the server to
+//     answer, and IDLE_TIMEOUT to wait for the next request, if kept alive.
+//   - a handler has REQUEST_TIMEOUT to answer: then the context of the
+//     request is cancelled, so are the queries made with it, and the client
+//     gets 503 Service Unavailable.
+
+// Sets the timeouts of the connections of the servers.
+func applyTimeouts(settings config.Limits, servers ...*http.Server) {
+	for _, server := range servers {
+		server.ReadHeaderTimeout = settings.ReadHeaderTimeout
+		server.ReadTimeout = settings.ReadTimeout
+		server.WriteTimeout = settings.WriteTimeout
+		server.IdleTimeout = settings.IdleTimeout
+	}
+}
+
+// Refuses the request bodies over the limits of the settings, see above.
+func limitBodies(settings config.Limits) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r := c.Request()
+			limit := int64(settings.BodyLimit)
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get(echo.HeaderContentType)); mediaType == echo.MIMEMultipartForm {
+				limit = int64(settings.UploadLimit)
+			}
+			if r.ContentLength > limit {
+				return bodyTooLarge(limit)
+			}
+
+			// Without a Content-Length, or with a wrong one, the body is
+			// cut when it goes over
+			body := &limitedBody{ReadCloser: http.MaxBytesReader(c.Response(), r.Body, limit)}
+			r.Body = body
+			err := next(c)
+			if err != nil && body.exceeded {
+				// Whatever the handler made of the failed read, usually
+				// "invalid request body"
+				return bodyTooLarge(limit)
+			}
+			return err
+		}
+	}
+}
+
+func bodyTooLarge(limit int64) *problemError {
+	return newProblem(http.StatusRequestEntityTooLarge, fmt.Sprintf("the request body must be at most %d bytes", limit))
+}
+
+// A body telling whether it went over its limit.
+type limitedBody struct {
+	io.ReadCloser
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var maxBytes *http.MaxBytesError
+	if errors.As(err, &maxBytes) {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// Cancels the context of the requests still handled after timeout. The
+// profiles of /debug/pprof take as long as they are asked to, and the
+// WebSockets of /ws and the events of /api/events last as long as their
+// client, so they are left alone.
+func timeoutRequests(timeout time.Duration) echo.MiddlewareFunc {
+	return middleware.ContextTimeoutWithConfig(middleware.ContextTimeoutConfig{
+		Timeout: timeout,
+		Skipper: func(c echo.Context) bool {
+			switch c.Path() {
+			case "/ws", "/api/events", "/api/v1/events":
+				return true
+			}
+			return strings.HasPrefix(c.Path(), "/debug/pprof/")
+		},
+		ErrorHandler: func(err error, c echo.Context) error {
+			// The handler may have wrapped the error of the query, or
+			// made its own of it
+			if !errors.Is(c.Request().Context().Err(), context.DeadlineExceeded) {
+				return err
+			}
+			p := newProblem(http.StatusServiceUnavailable, fmt.Sprintf("the request took more than %s, try again later", timeout))
+			p.cause = err
+			return p
+		},
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/labstack/echo/v4"
+)
+
+// The server listens on PORT, at every address of the machine, or only at
+// BIND_ADDRESS, e.g. 127.0.0.1 behind a proxy on the same machine. With
+// UNIX_SOCKET, it listens on that Unix socket instead, which a proxy like
+// nginx reaches without a port:
+//
+//	location / {
+//	    proxy_pass http://unix:/run/bookstore/bookstore.sock;
+//	}
+//
+// The file of the socket gets the permissions of UNIX_SOCKET_MODE, so only
+// its owner and group, e.g. the one of the proxy, may connect by default. It
+// is removed when the server stops.
+
+// The address of BIND_ADDRESS and the port, for net.Listen.
+func listenAddress(settings config.Config, port int) string {
+	return net.JoinHostPort(settings.BindAddress, strconv.Itoa(port))
+}
+
+// Makes e listen on UNIX_SOCKET, if set, rather than on the address given to
+// e.Start.
+func listenUnixSocket(e *echo.Echo, settings config.Config) error {
+	if settings.UnixSocket == "" {
+		return nil
+	}
+	path := settings.UnixSocket
+	// A server stopped without a chance to clean up leaves its socket
+	// behind, and listening would fail on it. A socket that still answers
+	// belongs to a running server, though.
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return fmt.Errorf("another server is listening on %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	// Checked by config.Load
+	mode, _ := strconv.ParseUint(settings.UnixSocketMode, 8, 9)
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		listener.Close()
+		return err
+	}
+	e.Listener = listener
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The reading lists every user has, in the order we show them.
+var listNames = []string{"want-to-read", "reading", "finished"}
+
+// A book on the reading list of a user. A book is on at most one list of a
+// user: putting it on another one moves it there, e.g. from "reading" to
+// "finished". The entry only references the book by its ID, so a changed
+// book shows up changed on the lists.
+type listEntry struct {
+	Username string    `bson:"Username"`
+	BookID   string    `bson:"BookID"`
+	List     string    `bson:"List"`
+	AddedAt  time.Time `bson:"AddedAt"`
+}
+
+// The reading lists of all users, stored in their own collection.
+type readingLists struct {
+	entries *mongo.Collection
+	books   *mongo.Collection
+}
+
+// The unique index keeps a book on one list per user, and serves listing
+// the books of a user.
+func prepareReadingListIndexes(coll *mongo.Collection) error {
+	_, err := coll.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "Username", Value: 1}, {Key: "BookID", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// Returns the books on each list of the user, in the order they were added.
+// Books deleted since are left out, and come back if restored. A nil
+// projection reads whole books, see findAllBooks.
+func (r *readingLists) booksOf(ctx context.Context, username string, projection bson.M) (map[string][]BookStore, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "AddedAt", Value: 1}})
+	cursor, err := r.entries.Find(ctx, bson.M{"Username": username}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var entries []listEntry
+	if err = cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		ids = append(ids, entry.BookID)
+	}
+	opts = options.Find()
+	if projection != nil {
+		// The ID matches the books with their entries
+		opts.SetProjection(withFields(projection, "ID"))
+	}
+	cursor, err = r.books.Find(ctx, live(bson.M{"ID": bson.M{"$in": ids}}), opts)
+	if err != nil {
+		return nil, err
+	}
+	var books []BookStore
+	if err = cursor.All(ctx, &books); err != nil {
+		return nil, err
+	}
+	byID := map[string]BookStore{}
+	for _, book := range books {
+		byID[book.ID] = book
+	}
+
+	lists := map[string][]BookStore{}
+	for _, name := range listNames {
+		lists[name] = []BookStore{}
+	}
+	for _, entry := range entries {
+		if book, ok := byID[entry.BookID]; ok {
+			lists[entry.List] = append(lists[entry.List], book)
+		}
+	}
+	return lists, nil
+}
+
+func listsToAPI(lists map[string][]BookStore) map[string][]map[string]interface{} {
+	response := map[string][]map[string]interface{}{}
+	for name, books := range lists {
+		response[name] = []map[string]interface{}{}
+		for _, book := range books {
+			response[name] = append(response[name], bookToAPI(book))
+		}
+	}
+	return response
+}
+
+func checkListName(c echo.Context) (string, error) {
+	name := c.Param("list")
+	if !slices.Contains(listNames, name) {
+		return "", newProblem(http.StatusNotFound, "no list named "+name+", the lists are want-to-read, reading and finished")
+	}
+	return name, nil
+}
+
+// Registers the routes of the reading lists, for the logged in user.
+func (r *readingLists) register(g *echo.Group, m ...echo.MiddlewareFunc) {
+	// All the lists at once: {"want-to-read": [...], "reading": [...], ...}
+	g.GET("/users/me/lists", func(c echo.Context) error {
+		lists, err := r.booksOf(c.Request().Context(), currentPrincipal(c).Name, nil)
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		return c.JSON(http.StatusOK, listsToAPI(lists))
+	}, m...)
+
+	g.GET("/users/me/lists/:list", func(c echo.Context) error {
+		name, err := checkListName(c)
+		if err != nil {
+			return err
+		}
+		lists, err := r.booksOf(c.Request().Context(), currentPrincipal(c).Name, nil)
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		return c.JSON(http.StatusOK, listsToAPI(lists)[name])
+	}, m...)
+
+	// Puts the book on the list, moving it from another list if needed
+	g.PUT("/users/me/lists/:list/:bookId", func(c echo.Context) error {
+		name, err := checkListName(c)
+		if err != nil {
+			return err
+		}
+		bookID := c.Param("bookId")
+		count, err := r.books.CountDocuments(c.Request().Context(), live(bson.M{"ID": bookID}))
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		if count == 0 {
+			return errBookNotFound
+		}
+
+		username := currentPrincipal(c).Name
+		_, err = r.entries.UpdateOne(c.Request().Context(),
+			bson.M{"Username": username, "BookID": bookID},
+			bson.M{"$set": bson.M{"List": name, "AddedAt": time.Now()}},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return serverProblem(err, "could not update list")
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "book added to " + name})
+	}, m...)
+
+	g.DELETE("/users/me/lists/:list/:bookId", func(c echo.Context) error {
+		name, err := checkListName(c)
+		if err != nil {
+			return err
+		}
+		result, err := r.entries.DeleteOne(c.Request().Context(), bson.M{
+			"Username": currentPrincipal(c).Name,
+			"BookID":   c.Param("bookId"),
+			"List":     name,
+		})
+		if err != nil {
+			return serverProblem(err, "could not update list")
+		}
+		if result.DeletedCount == 0 {
+			return newProblem(http.StatusNotFound, "the book is not on "+name)
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "book removed from " + name})
+	}, m...)
+}
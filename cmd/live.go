@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// The pages follow the changes of the books over a WebSocket, /ws: every
+// book created, updated or deleted, by this instance or any other, see
+// changes.go, is sent as a row of the book table, which the ws extension of
+// htmx swaps into the page as an out-of-band swap
+// (https://htmx.org/attributes/hx-swap-oob/):
+//
+//	<tbody hx-swap-oob="beforeend:#books"><tr id="row-42">...  created
+//	<tr id="row-42" hx-swap-oob="true">...</tr>                updated
+//	<tr id="row-42" hx-swap-oob="delete">...</tr>              deleted
+//
+// so the rows of the book table change without a refresh, and so do those of
+// the other tables showing the book. Only the table of /books gets the new
+// books, at its end. The socket only sends; what the page sends is ignored.
+
+const (
+	// How long sending a message may take before the connection is given
+	// up, e.g. for a browser that went to sleep
+	liveWriteTimeout = 10 * time.Second
+	// How often the server pings the pages, so the proxies in between keep
+	// the connection open, and the dead ones are noticed
+	livePingInterval = 30 * time.Second
+	// How long a page may take to answer a ping
+	livePongTimeout = livePingInterval + 10*time.Second
+	// The pages do not send anything but the answers to the pings
+	liveReadLimit = 512
+)
+
+// The WebSockets of the pages, closed when the server shuts down.
+type liveUpdates struct {
+	changes  *bookChanges
+	upgrader websocket.Upgrader
+
+	mu     sync.Mutex
+	conns  map[*websocket.Conn]bool
+	closed bool
+}
+
+func newLiveUpdates(changes *bookChanges) *liveUpdates {
+	// The upgrader only accepts the pages of our own origin by default, so
+	// another site cannot follow the changes from the browser of a user
+	return &liveUpdates{changes: changes, conns: map[*websocket.Conn]bool{}}
+}
+
+// Handles GET /ws, for as long as the page stays open.
+func (l *liveUpdates) serve(c echo.Context) error {
+	conn, err := l.upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		// The upgrader answered already, e.g. with 400 Bad Request for a
+		// request that is not a WebSocket handshake
+		return nil
+	}
+	// For the request log: the response went out on the connection itself
+	c.Response().Status = http.StatusSwitchingProtocols
+	if !l.add(conn) {
+		conn.Close()
+		return nil
+	}
+	defer l.remove(conn)
+	changes, unsubscribe := l.changes.subscribe()
+	defer unsubscribe()
+
+	// The deadlines of the HTTP server still hold for the connection, see
+	// limits.go; from now on, the pongs and each message set them.
+	conn.SetReadLimit(liveReadLimit)
+	conn.SetReadDeadline(time.Now().Add(livePongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(livePongTimeout))
+	})
+	// Reading handles the pongs and the close of the page, and fails once
+	// the connection is gone
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(livePingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case change := <-changes:
+			message, err := l.render(c, change)
+			if err != nil {
+				requestLogger(c).Error("could not render a change for the live updates", "error", err)
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+			if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return nil
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(liveWriteTimeout)); err != nil {
+				return nil
+			}
+		case <-gone:
+			return nil
+		}
+	}
+}
+
+// The rows of a change, see above. An archived book leaves the tables.
+func (l *liveUpdates) render(c echo.Context, change bookChange) ([]byte, error) {
+	row := booksToMaps([]BookStore{change.Book})[0]
+	switch {
+	case change.Type == "deleted" || change.Book.Archived:
+		row["SwapOOB"] = "delete"
+	case change.Type == "updated":
+		row["SwapOOB"] = "true"
+	}
+	data := map[string]interface{}{"Created": change.Type == "created" && !change.Book.Archived, "Book": row}
+	var message bytes.Buffer
+	if err := c.Echo().Renderer.Render(&message, "book-change", data, c); err != nil {
+		return nil, err
+	}
+	return message.Bytes(), nil
+}
+
+func (l *liveUpdates) add(conn *websocket.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return false
+	}
+	l.conns[conn] = true
+	return true
+}
+
+func (l *liveUpdates) remove(conn *websocket.Conn) {
+	l.mu.Lock()
+	delete(l.conns, conn)
+	l.mu.Unlock()
+	conn.Close()
+}
+
+// Closes the WebSockets when the server shuts down, telling the pages so:
+// the HTTP server only waits for the requests it still handles, and the
+// WebSockets are not anymore. The pages connect again to the next instance.
+func (l *liveUpdates) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "the server is shutting down")
+	for conn := range l.conns {
+		if err := conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second)); err != nil {
+			slog.Debug("could not close a WebSocket", "error", err)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The server logs with log/slog: each message comes with attributes, like
+// the route and the caller of a request, written as key=value pairs or as
+// JSON, see LOG_FORMAT, so the logs can be searched rather than read.
+
+// The levels of the logger, by their names in LOG_LEVEL.
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// The logger of LOG_LEVEL and LOG_FORMAT, writing to the standard error.
+// With LOG_LEVEL=off, it writes nothing at all.
+func newLogger(level string, format string) *slog.Logger {
+	if level == "off" {
+		return slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	options := &slog.HandlerOptions{
+		Level: logLevels[level],
+		// Durations as 1.5s rather than 1500000000 nanoseconds in JSON
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			if a.Value.Kind() == slog.KindDuration {
+				a.Value = slog.StringValue(a.Value.Duration().String())
+			}
+			return a
+		},
+	}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, options))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, options))
+}
+
+// Logs the error that keeps the server from starting, and stops it.
+func fatal(err error) {
+	slog.Error("could not start the server", "error", err)
+	os.Exit(1)
+}
+
+// Logs a panic of a handler, with the stack of its goroutine, for the
+// Recover middleware. The request fails with the panic as its error.
+func logPanic(c echo.Context, err error, stack []byte) error {
+	requestLogger(c).Error("a handler panicked", "error", err, "stack", string(stack))
+	return err
+}
+
+// The logger for the messages about a request: they tell its method and
+// route, the caller when there is one, and its ID, see requestid.go, so the
+// messages of one request can be found together.
+func requestLogger(c echo.Context) *slog.Logger {
+	logger := slog.With("method", c.Request().Method, "route", routeOf(c))
+	if id := requestID(c.Request().Context()); id != "" {
+		logger = logger.With("request_id", id)
+	}
+	if p := currentPrincipal(c); p != nil {
+		logger = logger.With("user", p.Name)
+	}
+	return logger
+}
+
+// The route of the request, e.g. /api/v1/books/:id, or "unmatched" when
+// none has its path.
+func routeOf(c echo.Context) string {
+	if route := c.Path(); route != "" {
+		return route
+	}
+	return "unmatched"
+}
+
+// Logs every request once it is answered, with its path, status, how long
+// it took in milliseconds, and the bytes of its body and of the response,
+// as sent, compressed or not, see compress.go.
+// The errors of the handlers are answered here, see problemErrorHandler, so
+// the log gets their status.
+func logRequests(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		body := &countingBody{ReadCloser: c.Request().Body}
+		c.Request().Body = body
+		writer := &countingWriter{ResponseWriter: c.Response().Writer}
+		c.Response().Writer = writer
+		if err := next(c); err != nil {
+			c.Error(err)
+		}
+
+		// What the handler read, or what the client said it would send,
+		// when the handler did not read it all
+		bytesIn := max(body.read, c.Request().ContentLength)
+		requestLogger(c).Info("request",
+			"path", c.Request().URL.Path,
+			"status", c.Response().Status,
+			"latency_ms", float64(time.Since(start).Microseconds())/1000,
+			"bytes_in", bytesIn,
+			"bytes_out", writer.written,
+		)
+		return nil
+	}
+}
+
+// A request body counting the bytes read from it.
+type countingBody struct {
+	io.ReadCloser
+	read int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	return n, err
+}
+
+// A response writer counting the bytes of the body written through it.
+type countingWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// For http.NewResponseController, which flushes and hijacks through it.
+func (w *countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
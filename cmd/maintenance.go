@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// During a migration or a backup, the books should not change. In read-only
+// mode, the server keeps answering the reads, GET, HEAD and OPTIONS, but
+// refuses the other requests with 503 Service Unavailable, and the message
+// of the admins, if any. READ_ONLY=true starts the server in it, and the
+// admins turn it on and off while it runs:
+//
+//	GET /api/v1/admin/maintenance   {"readOnly": true, "message": "...", "since": "..."}
+//	PUT /api/v1/admin/maintenance   {"readOnly": true, "message": "migrating the books"}
+//
+// The routes of the mode itself and of the logins keep working, so an admin
+// can always turn it off, and so does the draining, see drain.go. Like the
+// features, the mode holds for the instance that got it, until it restarts.
+// The jobs of the server, like emptying the trash, are not requests and keep
+// running.
+
+// The mode of the server, safe for concurrent use.
+type maintenanceMode struct {
+	mu       sync.RWMutex
+	readOnly bool
+	message  string
+	since    time.Time
+}
+
+// What GET /api/v1/admin/maintenance answers.
+type maintenanceState struct {
+	ReadOnly bool   `json:"readOnly"`
+	Message  string `json:"message,omitempty"`
+	// When the mode was turned on
+	Since *time.Time `json:"since,omitempty"`
+}
+
+func newMaintenanceMode(readOnly bool, message string) *maintenanceMode {
+	m := &maintenanceMode{}
+	m.set(readOnly, message)
+	return m
+}
+
+func (m *maintenanceMode) set(readOnly bool, message string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if readOnly && !m.readOnly {
+		m.since = time.Now()
+	}
+	m.readOnly = readOnly
+	m.message = strings.TrimSpace(message)
+}
+
+func (m *maintenanceMode) state() maintenanceState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	state := maintenanceState{ReadOnly: m.readOnly}
+	if m.readOnly {
+		since := m.since
+		state.Message, state.Since = m.message, &since
+	}
+	return state
+}
+
+// The routes still open in read-only mode, beyond the reads, see above.
+// Queries are POSTed to /graphql, which never changes anything.
+func allowedWhileReadOnly(route string) bool {
+	return route == "/graphql" || strings.HasSuffix(route, "/admin/maintenance") || strings.HasSuffix(route, "/admin/drain") ||
+		strings.HasSuffix(route, "/auth/login") || strings.HasSuffix(route, "/auth/refresh") || strings.HasSuffix(route, "/auth/logout")
+}
+
+// Refuses the requests changing something while the server is read-only.
+func (m *maintenanceMode) refuseWrites(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		switch c.Request().Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return next(c)
+		}
+		if state := m.state(); state.ReadOnly && !allowedWhileReadOnly(c.Path()) {
+			detail := "the server is read-only for maintenance, try again later"
+			if state.Message != "" {
+				detail += ": " + state.Message
+			}
+			return newProblem(http.StatusServiceUnavailable, detail)
+		}
+		return next(c)
+	}
+}
+
+// Handles GET /api/v1/admin/maintenance.
+func (m *maintenanceMode) show(c echo.Context) error {
+	return c.JSON(http.StatusOK, m.state())
+}
+
+// Handles PUT /api/v1/admin/maintenance.
+func (m *maintenanceMode) change(c echo.Context) error {
+	var input struct {
+		ReadOnly *bool  `json:"readOnly"`
+		Message  string `json:"message"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return newProblem(http.StatusBadRequest, "invalid request body")
+	}
+	if input.ReadOnly == nil {
+		return fieldErrors{"readOnly": "is required"}
+	}
+	m.set(*input.ReadOnly, input.Message)
+	if *input.ReadOnly {
+		requestLogger(c).Warn("the server is read-only for maintenance", "message", input.Message)
+	} else {
+		requestLogger(c).Info("the server accepts the changes again")
+	}
+	return c.JSON(http.StatusOK, m.state())
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Merges the duplicates of a book, as found by findDuplicates, into it:
+//
+//	POST /api/admin/merge
+//	{"primary": "example1", "duplicates": ["example1-copy", "vortex"]}
+//
+// The primary book keeps its title and authors, and gets what only the
+// duplicates know, see mergedBook. The reviews, checkouts and reading list
+// entries of the duplicates move to it, and the duplicates go to the trash.
+// Everything happens in one transaction, see transactions.go: a merge
+// failing halfway would leave references split between books that no
+// longer say which ones belonged together, so standalone servers, which
+// have no transactions, cannot merge.
+type bookMerger struct {
+	books        *mongo.Collection
+	reviews      *reviewStore
+	checkouts    *mongo.Collection
+	readingLists *mongo.Collection
+	revisions    *revisionStore
+	transactions *transactions
+}
+
+// The body of POST /admin/merge.
+type mergeRequest struct {
+	Primary    string   `json:"primary"`
+	Duplicates []string `json:"duplicates"`
+}
+
+func (r mergeRequest) validate() error {
+	errs := fieldErrors{}
+	if r.Primary == "" {
+		errs["primary"] = "is required"
+	}
+	if len(r.Duplicates) == 0 {
+		errs["duplicates"] = "must list at least one book"
+	}
+	for i, id := range r.Duplicates {
+		if id == "" || id == r.Primary || slices.Index(r.Duplicates, id) != i {
+			errs["duplicates"] = "must be other books than the primary one, each listed once"
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// The primary book completed with the duplicates: the fields it has no
+// value for get the one of the first duplicate having one, the tags are
+// those of every book, and the copies add up, since each record stood for
+// copies of its own. The series and its volume go together.
+func mergedBook(primary BookStore, duplicates []BookStore) BookStore {
+	merged := primary
+	merged.Copies = bookCopies(primary)
+	for _, duplicate := range duplicates {
+		if merged.BookEdition == "" {
+			merged.BookEdition = duplicate.BookEdition
+		}
+		if merged.BookPages == 0 {
+			merged.BookPages = duplicate.BookPages
+		}
+		if merged.BookYear == 0 {
+			merged.BookYear = duplicate.BookYear
+		}
+		if merged.Series == "" {
+			merged.Series = duplicate.Series
+			merged.SeriesVolume = duplicate.SeriesVolume
+		}
+		if merged.PublisherID == "" {
+			merged.PublisherID = duplicate.PublisherID
+		}
+		if merged.Cover == nil {
+			merged.Cover = duplicate.Cover
+		}
+		for _, tag := range duplicate.Tags {
+			if !slices.Contains(merged.Tags, tag) {
+				merged.Tags = append(merged.Tags, tag)
+			}
+		}
+		merged.Copies += bookCopies(duplicate)
+		merged.CheckedOut += duplicate.CheckedOut
+	}
+	return merged
+}
+
+// The fields of the merged book that may differ from the primary one.
+func mergeUpdate(merged BookStore) bson.M {
+	set := bson.M{"Copies": merged.Copies, "CheckedOut": merged.CheckedOut}
+	for field, value := range map[string]interface{}{
+		"BookEdition":  merged.BookEdition,
+		"BookPages":    merged.BookPages,
+		"BookYear":     merged.BookYear,
+		"Series":       merged.Series,
+		"SeriesVolume": merged.SeriesVolume,
+		"PublisherID":  merged.PublisherID,
+	} {
+		if value != "" && value != 0 {
+			set[field] = value
+		}
+	}
+	if merged.Cover != nil {
+		set["Cover"] = merged.Cover
+	}
+	if len(merged.Tags) > 0 {
+		set["Tags"] = merged.Tags
+	}
+	return bson.M{"$set": set, "$inc": bson.M{"Version": 1}, "$currentDate": bson.M{"UpdatedAt": true}}
+}
+
+// Points the documents of coll referring to one book to another one, and
+// returns how many were moved. With a user field, each user has at most one
+// document per book, e.g. one review: the documents of the users who already
+// have one for the other book are deleted instead.
+func moveReferences(ctx context.Context, coll *mongo.Collection, from string, to string, userField string) (int64, error) {
+	if userField != "" {
+		users, err := coll.Distinct(ctx, userField, bson.M{"BookID": to})
+		if err != nil {
+			return 0, err
+		}
+		if len(users) > 0 {
+			_, err = coll.DeleteMany(ctx, bson.M{"BookID": from, userField: bson.M{"$in": users}})
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	result, err := coll.UpdateMany(ctx, bson.M{"BookID": from}, bson.M{"$set": bson.M{"BookID": to}})
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// Handles POST /admin/merge, see bookMerger.
+func (m *bookMerger) merge(c echo.Context) error {
+	var input mergeRequest
+	if err := c.Bind(&input); err != nil {
+		return newProblem(http.StatusBadRequest, "invalid request body")
+	}
+	if err := input.validate(); err != nil {
+		return err
+	}
+	if m.transactions == nil || !m.transactions.supported {
+		return newProblem(http.StatusNotImplemented, "merging books needs transactions, which MongoDB only has on replica sets")
+	}
+
+	var primary BookStore
+	moved := map[string]int64{}
+	err := m.transactions.run(c.Request().Context(), func(ctx context.Context) error {
+		// Runs again when MongoDB retries the transaction
+		clear(moved)
+
+		ids := append([]string{input.Primary}, input.Duplicates...)
+		cursor, err := m.books.Find(ctx, live(bson.M{"ID": bson.M{"$in": ids}}))
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		var found []BookStore
+		if err = cursor.All(ctx, &found); err != nil {
+			return serverProblem(err, "database error")
+		}
+		byID := map[string]BookStore{}
+		for _, book := range found {
+			byID[book.ID] = book
+		}
+		var duplicates []BookStore
+		for _, id := range ids {
+			book, ok := byID[id]
+			if !ok {
+				return newProblem(http.StatusNotFound, "book "+id+" not found")
+			}
+			if id != input.Primary {
+				duplicates = append(duplicates, book)
+			}
+		}
+		primary = byID[input.Primary]
+
+		for _, duplicate := range duplicates {
+			for name, ref := range map[string]struct {
+				coll      *mongo.Collection
+				userField string
+			}{
+				"reviews":   {m.reviews.reviews, "Username"},
+				"checkouts": {m.checkouts, ""},
+				"lists":     {m.readingLists, "Username"},
+			} {
+				count, err := moveReferences(ctx, ref.coll, duplicate.ID, primary.ID, ref.userField)
+				if err != nil {
+					return serverProblem(err, "could not move the "+name+" of book "+duplicate.ID)
+				}
+				moved[name] += count
+			}
+		}
+
+		update := mergeUpdate(mergedBook(primary, duplicates))
+		if _, err := m.books.UpdateOne(ctx, bson.M{"_id": primary.MongoID}, update); err != nil {
+			return serverProblem(err, "could not update book "+primary.ID)
+		}
+		// The cover now belongs to the primary book: deleting it from a
+		// duplicate restored from the trash must not remove the file
+		trash := trashUpdate()
+		trash["$unset"] = bson.M{"Cover": ""}
+		_, err = m.books.UpdateMany(ctx,
+			live(bson.M{"ID": bson.M{"$in": input.Duplicates}}),
+			trash,
+		)
+		if err != nil {
+			return serverProblem(err, "could not delete the duplicates")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The merge is done: the rating only sums up the reviews, and the
+	// revision only serves undoing edits, so they can come after it
+	m.revisions.record(c.Request().Context(), primary)
+	if err := m.reviews.refreshRating(c.Request().Context(), primary.ID); err != nil {
+		requestLogger(c).Error("could not refresh the rating of a merged book", "book", primary.ID, "error", err)
+	}
+	var merged BookStore
+	if err := m.books.FindOne(c.Request().Context(), bson.M{"_id": primary.MongoID}).Decode(&merged); err != nil {
+		return serverProblem(err, "database error")
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"book":      bookToAPI(merged),
+		"merged":    input.Duplicates,
+		"reviews":   moved["reviews"],
+		"checkouts": moved["checkouts"],
+		"lists":     moved["lists"],
+	})
+}
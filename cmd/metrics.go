@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// The metrics of the server, served at /metrics in the text format of
+// Prometheus, see https://prometheus.io/docs/concepts/metric_types/
+// Requests are counted by route, e.g. /api/v1/books/:id, rather than by
+// path, so each book does not get metrics of its own. The counters of the
+// cache and of the connection pools are read from responseCache and
+// poolStats when Prometheus scrapes them.
+type metrics struct {
+	registry *prometheus.Registry
+
+	requests  *prometheus.CounterVec
+	durations *prometheus.HistogramVec
+	inFlight  prometheus.Gauge
+	commands  *prometheus.HistogramVec
+	retries   *prometheus.CounterVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "The requests answered, by method, route and status.",
+		}, []string{"method", "route", "status"}),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "How long the requests took to answer, by method, route and status.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "The requests being answered.",
+		}),
+		commands: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "mongodb_command_duration_seconds",
+			Help: "How long the commands sent to MongoDB took, by command and outcome.",
+			// Most commands take a few milliseconds
+			Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		}, []string{"command", "outcome"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mongodb_operation_retries_total",
+			Help: "The operations of the books tried again after a transient error, by operation, see retry.go.",
+		}, []string{"operation"}),
+	}
+	m.registry.MustRegister(m.requests, m.durations, m.inFlight, m.commands, m.retries,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Counts the requests and measures how long they take. The errors of the
+// handlers are answered here, see problemErrorHandler, so the metrics get
+// their status.
+func (m *metrics) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		m.inFlight.Inc()
+		defer m.inFlight.Dec()
+		start := time.Now()
+		if err := next(c); err != nil {
+			c.Error(err)
+		}
+
+		labels := prometheus.Labels{
+			"method": c.Request().Method,
+			"route":  routeOf(c),
+			"status": strconv.Itoa(c.Response().Status),
+		}
+		m.requests.With(labels).Inc()
+		m.durations.With(labels).Observe(time.Since(start).Seconds())
+		return nil
+	}
+}
+
+// The monitor to give the client, see mongoConfig.clientOptions: it times
+// every command, like a find or an insert.
+func (m *metrics) commandMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			m.commands.WithLabelValues(e.CommandName, "ok").Observe(e.Duration.Seconds())
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			m.commands.WithLabelValues(e.CommandName, "error").Observe(e.Duration.Seconds())
+		},
+	}
+}
+
+// Publishes the counters of the cache, the state of the pools, without
+// MongoDB none, and the one of the circuit breaker, if any.
+func (m *metrics) watch(cache *responseCache, pool *poolStats, breaker *circuitBreaker) {
+	cacheRequests := func(result string, count func() int64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "cache_requests_total",
+			Help:        "The requests the response cache was asked for, by result.",
+			ConstLabels: prometheus.Labels{"result": result},
+		}, func() float64 { return float64(count()) })
+	}
+	poolGauge := func(name string, help string, value func() float64) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, value)
+	}
+	m.registry.MustRegister(
+		cacheRequests("hit", cache.hits.Load),
+		cacheRequests("miss", cache.misses.Load),
+		cacheRequests("error", cache.errors.Load),
+	)
+	if pool != nil {
+		m.registry.MustRegister(
+			poolGauge("mongodb_pool_connections_open", "The connections open to MongoDB.",
+				func() float64 { return float64(pool.open.Load()) }),
+			poolGauge("mongodb_pool_connections_in_use", "The connections lent to operations.",
+				func() float64 { return float64(pool.inUse.Load()) }),
+			poolGauge("mongodb_pool_waiting", "The operations waiting for a connection.",
+				func() float64 { return float64(pool.waiting.Load()) }),
+			poolGauge("mongodb_pool_saturation", "The share of the connections in use, from 0 to 1.",
+				pool.saturation),
+		)
+	}
+	if breaker != nil {
+		m.registry.MustRegister(
+			poolGauge("storage_circuit_state", "The circuit breaker of the storage: 0 closed, 1 half-open, 2 open.",
+				func() float64 { return float64(breaker.current()) }),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Name: "storage_circuit_opened_total",
+				Help: "How many times the circuit breaker of the storage opened.",
+			}, func() float64 { return float64(breaker.opened.Load()) }),
+		)
+	}
+}
+
+// Serves the metrics to Prometheus.
+func (m *metrics) handler() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/isbn"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The collection recording the migrations applied to the database.
+const migrationsCollection = "schema_migrations"
+
+// A change of the stored data, like a field becoming a number, applied once
+// to every database, in the order of the versions.
+// A failed migration is run again at the next start, so it must cope with
+// the data it already changed: every migration below only touches the
+// documents still in the old shape.
+type migration struct {
+	version int
+	name    string
+	apply   func(books *mongo.Collection) error
+}
+
+// The migrations, oldest first. A change of the model adds one at the end,
+// with the next version. Released migrations are never changed or removed:
+// the databases that applied them will not run them again.
+// Databases that existed before the migrations were recorded run all of
+// them once, which finds nothing left to change.
+var migrations = []migration{
+	{1, "store pages and year as numbers", migrateNumericFields},
+	{2, "store editions as ISBN-13", migrateEditions},
+	{3, "store the authors of a book as a list", migrateAuthorLists},
+	{4, "stamp books with when they were added and changed", migrateTimestamps},
+}
+
+// A migration as recorded in migrationsCollection. AppliedAt is missing
+// while it runs.
+type appliedMigration struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"Name"`
+	StartedAt time.Time `bson:"StartedAt"`
+	AppliedAt time.Time `bson:"AppliedAt,omitempty"`
+}
+
+// Applies the migrations the database has not seen yet, recording each of
+// them. Called at every start, before anything reads the books.
+// Recording a migration before applying it claims it: a second instance
+// starting at the same time gets a duplicate key and stops, instead of
+// migrating the same documents.
+func runMigrations(books *mongo.Collection) error {
+	records := books.Database().Collection(migrationsCollection)
+	cursor, err := records.Find(context.Background(), bson.M{})
+	if err != nil {
+		return err
+	}
+	var recorded []appliedMigration
+	if err = cursor.All(context.Background(), &recorded); err != nil {
+		return err
+	}
+	applied := map[int]appliedMigration{}
+	for _, record := range recorded {
+		applied[record.Version] = record
+	}
+
+	for _, m := range migrations {
+		if record, ok := applied[m.version]; ok {
+			if record.AppliedAt.IsZero() {
+				return fmt.Errorf("migration %d (%s) started at %s without finishing; if no other instance is running it, delete its document from %s to run it again",
+					m.version, m.name, record.StartedAt.Format(time.RFC3339), migrationsCollection)
+			}
+			continue
+		}
+
+		_, err := records.InsertOne(context.Background(), appliedMigration{
+			Version:   m.version,
+			Name:      m.name,
+			StartedAt: time.Now(),
+		})
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("migration %d (%s) is being applied by another instance", m.version, m.name)
+		}
+		if err != nil {
+			return err
+		}
+		if err := m.apply(books); err != nil {
+			// So that it runs again at the next start
+			if _, deleteErr := records.DeleteOne(context.Background(), bson.M{"_id": m.version}); deleteErr != nil {
+				slog.Error("could not release a failed migration", "version", m.version, "error", deleteErr)
+			}
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		_, err = records.UpdateOne(context.Background(),
+			bson.M{"_id": m.version},
+			bson.M{"$set": bson.M{"AppliedAt": time.Now()}},
+		)
+		if err != nil {
+			return err
+		}
+		slog.Info("applied a migration", "version", m.version, "name", m.name)
+	}
+	return nil
+}
+
+// The steps migrations are made of.
+
+// Converts the values of the field stored with another type, e.g. "1818",
+// to the given one, e.g. "int", see
+// https://www.mongodb.com/docs/manual/reference/operator/aggregation/convert/
+// Values that cannot be converted, like "" or "unknown", are removed. The
+// conversion is a single update, run by the database itself. Returns the
+// number of documents changed.
+func convertField(coll *mongo.Collection, field string, to string) (int64, error) {
+	convert := bson.A{bson.M{"$set": bson.M{field: bson.M{"$convert": bson.M{
+		"input":   bson.M{"$trim": bson.M{"input": "$" + field}},
+		"to":      to,
+		"onError": "$$REMOVE",
+		"onNull":  "$$REMOVE",
+	}}}}}
+	// Only strings are trimmed and converted; arrays of strings match
+	// $type "string" too
+	filter := bson.M{field: bson.M{"$type": "string", "$not": bson.M{"$type": "array"}}}
+	result, err := coll.UpdateMany(context.Background(), filter, convert)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// Gives the field another name in every document having it.
+func renameField(coll *mongo.Collection, from string, to string) (int64, error) {
+	result, err := coll.UpdateMany(context.Background(),
+		bson.M{from: bson.M{"$exists": true}},
+		bson.M{"$rename": bson.M{from: to}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// Creates an index, e.g. one that cannot be built at every start because
+// the data has to be fixed first. Dropping the index it replaces, if any, is
+// up to the migration.
+func createIndex(coll *mongo.Collection, model mongo.IndexModel) error {
+	_, err := coll.Indexes().CreateOne(context.Background(), model)
+	return err
+}
+
+// Books used to store their pages and year as strings, like "1818", which
+// sort and compare as text: "99" came after "1000". This converts them into
+// numbers, and removes those that are not numbers at all: a book without a
+// valid year has no year.
+func migrateNumericFields(coll *mongo.Collection) error {
+	for _, field := range []string{"BookPages", "BookYear"} {
+		converted, err := convertField(coll, field, "int")
+		if err != nil {
+			return err
+		}
+		if converted > 0 {
+			slog.Info("converted a field of the books to numbers", "field", field, "books", converted)
+		}
+	}
+	return nil
+}
+
+// Editions used to be stored as sent, e.g. "958-30-0804-4", "9583008044"
+// or "978-958-30-0804-7" for the same book. This stores the valid ones as
+// ISBN-13 without hyphens, see isbn.Normalize. Invalid ones are left alone,
+// to be fixed by hand: we only log how many there are.
+// MongoDB cannot compute check digits, so the books are updated one by one;
+// those already normalized are left out by the filter, a 13 digit string.
+func migrateEditions(coll *mongo.Collection) error {
+	filter := bson.M{"BookEdition": bson.M{"$type": "string", "$not": bson.M{"$regex": `^\d{13}$`}}}
+	opts := options.Find().SetProjection(bson.M{"BookEdition": 1})
+	cursor, err := coll.Find(context.Background(), filter, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	converted, invalid := 0, 0
+	for cursor.Next(context.Background()) {
+		var book BookStore
+		if err := cursor.Decode(&book); err != nil {
+			return err
+		}
+		normalized, err := isbn.Normalize(book.BookEdition)
+		if err != nil {
+			invalid++
+			continue
+		}
+		_, err = coll.UpdateOne(context.Background(),
+			bson.M{"_id": book.MongoID},
+			bson.M{"$set": bson.M{"BookEdition": normalized}})
+		if err != nil {
+			return err
+		}
+		converted++
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if converted > 0 || invalid > 0 {
+		slog.Info("normalized the edition of the books", "books", converted, "invalid_isbn", invalid)
+	}
+	return nil
+}
+
+// Books used to have a single author, a string in BookAuthor, with its ID
+// in AuthorID. Both are lists now, in the same order, see BookStore. This
+// turns the strings into lists of one; an empty author becomes no author.
+// Like convertField, it is one update run by the database. Lists of strings
+// match $type "string" too, hence the $not.
+func migrateAuthorLists(coll *mongo.Collection) error {
+	toList := bson.A{bson.M{"$set": bson.M{
+		"BookAuthor": bson.M{"$cond": bson.A{
+			bson.M{"$eq": bson.A{"$BookAuthor", ""}}, bson.A{}, bson.A{"$BookAuthor"},
+		}},
+		"AuthorID": bson.M{"$cond": bson.A{
+			bson.M{"$eq": bson.A{bson.M{"$type": "$AuthorID"}, "string"}}, bson.A{"$AuthorID"}, "$$REMOVE",
+		}},
+	}}}
+	result, err := coll.UpdateMany(context.Background(),
+		bson.M{"BookAuthor": bson.M{"$type": "string", "$not": bson.M{"$type": "array"}}},
+		toList,
+	)
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount > 0 {
+		slog.Info("converted the author of the books to a list", "books", result.ModifiedCount)
+	}
+	return nil
+}
+
+// Books stored before we tracked insertion times have no CreatedAt, and
+// none had an UpdatedAt. This gives them the time their MongoID was
+// generated in, see createdAt, and then their CreatedAt as UpdatedAt, so the
+// filters and sorts on both find every book. One update run by the
+// database, like migrateAuthorLists.
+func migrateTimestamps(coll *mongo.Collection) error {
+	stamp := bson.A{
+		bson.M{"$set": bson.M{"CreatedAt": bson.M{"$ifNull": bson.A{"$CreatedAt", bson.M{"$toDate": "$_id"}}}}},
+		bson.M{"$set": bson.M{"UpdatedAt": bson.M{"$ifNull": bson.A{"$UpdatedAt", "$CreatedAt"}}}},
+	}
+	result, err := coll.UpdateMany(context.Background(),
+		bson.M{"$or": bson.A{
+			bson.M{"CreatedAt": bson.M{"$exists": false}},
+			bson.M{"UpdatedAt": bson.M{"$exists": false}},
+		}},
+		stamp,
+	)
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount > 0 {
+		slog.Info("stamped the books with their creation and update times", "books", result.ModifiedCount)
+	}
+	return nil
+}
+
+// Books stored before authors had their own collection only have the names
+// in BookAuthor. This links them, and the books restored from the trash after
+// one of their authors was deleted (see authorStore.register), to the authors
+// of those names, creating the authors as needed. Only those books are read,
+// one at a time, and each author is looked up once.
+func migrateAuthors(ctx context.Context, authors *authorStore) error {
+	unlinked := bson.M{"$or": bson.A{
+		bson.M{"AuthorID": bson.M{"$exists": false}},
+		bson.M{"AuthorID": ""},
+	}}
+	opts := options.Find().SetProjection(bson.M{"BookAuthor": 1})
+	cursor, err := authors.books.Find(ctx, unlinked, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	byName := map[string]author{}
+	linked := 0
+	for cursor.Next(ctx) {
+		var book BookStore
+		if err := cursor.Decode(&book); err != nil {
+			return err
+		}
+		if len(book.BookAuthors) == 0 {
+			continue
+		}
+		var ids, names []string
+		for _, name := range book.BookAuthors {
+			found, ok := byName[normalizeText(name)]
+			if !ok {
+				if found, err = authors.byName(ctx, name); err != nil {
+					return err
+				}
+				byName[normalizeText(name)] = found
+			}
+			ids = append(ids, found.ID)
+			names = append(names, found.Name)
+		}
+		_, err = authors.books.UpdateOne(ctx,
+			bson.M{"_id": book.MongoID},
+			bson.M{"$set": bson.M{"AuthorID": ids, "BookAuthor": names}, "$inc": bson.M{"Version": 1}, "$currentDate": bson.M{"UpdatedAt": true}},
+		)
+		if err != nil {
+			return err
+		}
+		linked++
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if linked > 0 {
+		slog.Info("linked the books to their authors", "books", linked)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// Runs test against a mocked MongoDB, see mtest: each command the handlers
+// send gets the next of the responses given to mt.AddMockResponses, and
+// mt.GetStartedEvent tells what they sent.
+func withMockMongo(t *testing.T, test func(mt *mtest.T)) {
+	t.Helper()
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("mongo", test)
+}
+
+// The reply of MongoDB to a command that went well, like an update.
+func mockOK(fields ...bson.E) bson.D {
+	return mtest.CreateSuccessResponse(fields...)
+}
+
+// The reply to a find, an aggregate or a count, with the documents given.
+func mockCursor(mt *mtest.T, documents ...bson.D) bson.D {
+	return mtest.CreateCursorResponse(0, mt.Coll.Database().Name()+"."+mt.Coll.Name(), mtest.FirstBatch, documents...)
+}
+
+// The commands sent to MongoDB since the test began, e.g. "update".
+func sentCommands(mt *mtest.T) []string {
+	var names []string
+	for _, started := range mt.GetAllStartedEvents() {
+		names = append(names, started.CommandName)
+	}
+	return names
+}
+
+// Lets the requests through as the principal given, as auth.require does.
+func asPrincipal(p principal) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("principal", &p)
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"gopkg.in/yaml.v3"
+)
+
+// A representation the book endpoints can answer with. The first media type
+// is the Content-Type we send; the others are aliases clients may ask for in
+// their Accept header.
+// Formats either encode the whole body at once, or stream it to the client
+// piece by piece.
+type responseFormat struct {
+	name       string
+	mediaTypes []string
+	encode     func(body interface{}) ([]byte, error)
+	stream     func(w io.Writer, body interface{}) error
+}
+
+var (
+	jsonFormat = responseFormat{name: "json", mediaTypes: []string{"application/json"}, encode: json.Marshal}
+	xmlFormat  = responseFormat{name: "xml", mediaTypes: []string{"application/xml", "text/xml"}, encode: encodeXML}
+	yamlFormat = responseFormat{name: "yaml", mediaTypes: []string{"application/yaml", "application/x-yaml", "text/yaml"}, encode: yaml.Marshal}
+	csvFormat  = responseFormat{name: "csv", mediaTypes: []string{"text/csv"}, stream: streamCSV}
+)
+
+// The formats of /api/books/:id, JSON first since it is the default.
+var bookFormats = []responseFormat{jsonFormat, xmlFormat, yamlFormat}
+
+// Lists can also be sent as CSV, one book per row, for spreadsheets.
+var bookListFormats = []responseFormat{jsonFormat, xmlFormat, yamlFormat, csvFormat}
+
+// Picks the format to answer with from the Accept header
+// (https://developer.mozilla.org/en-US/docs/Web/HTTP/Content_negotiation).
+// Media ranges are tried by decreasing quality (q=...), and for equal quality
+// in the order the client listed them. Without an Accept header, or with
+// */*, the first offered format wins. The returned format's only media type
+// is the one to send as Content-Type. The second return value is false when
+// the client accepts none of the offered formats.
+func negotiateFormat(c echo.Context, offered []responseFormat) (responseFormat, bool) {
+	header := c.Request().Header.Get(echo.HeaderAccept)
+	if strings.TrimSpace(header) == "" {
+		return offered[0], true
+	}
+
+	type mediaRange struct {
+		mediaType string
+		quality   float64
+	}
+	var ranges []mediaRange
+	// Media types the client explicitly refuses with q=0
+	refused := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		if quality > 0 {
+			ranges = append(ranges, mediaRange{mediaType, quality})
+		} else {
+			refused[mediaType] = true
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].quality > ranges[j].quality
+	})
+
+	for _, r := range ranges {
+		for _, format := range offered {
+			for _, mediaType := range format.mediaTypes {
+				if refused[mediaType] {
+					continue
+				}
+				if r.mediaType == "*/*" || r.mediaType == mediaType ||
+					(strings.HasSuffix(r.mediaType, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(r.mediaType, "*"))) {
+					// Answer with the media type that matched, e.g.
+					// text/xml for text/*
+					chosen := format
+					chosen.mediaTypes = []string{mediaType}
+					return chosen, true
+				}
+			}
+		}
+	}
+	return responseFormat{}, false
+}
+
+// The names of the offered formats, to tell clients what they can ask for.
+func formatNames(offered []responseFormat) string {
+	var names []string
+	for _, format := range offered {
+		names = append(names, format.mediaTypes[0])
+	}
+	return strings.Join(names, ", ")
+}
+
+// encoding/xml cannot marshal maps, so we write the elements ourselves:
+//
+//	<books>
+//	  <book><id>example1</id><title>The Vortex</title>...</book>
+//	</books>
+//
+// Keys come in the order of apiFields, and missing keys are left out.
+func encodeXML(body interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+
+	var err error
+	switch v := body.(type) {
+	case []map[string]interface{}:
+		list := xml.StartElement{Name: xml.Name{Local: "books"}}
+		if err = enc.EncodeToken(list); err != nil {
+			return nil, err
+		}
+		for _, book := range v {
+			if err = encodeXMLBook(enc, book); err != nil {
+				return nil, err
+			}
+		}
+		err = enc.EncodeToken(list.End())
+	case map[string]interface{}:
+		err = encodeXMLBook(enc, v)
+	default:
+		err = fmt.Errorf("cannot encode %T as XML", body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = enc.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeXMLBook(enc *xml.Encoder, book map[string]interface{}) error {
+	element := xml.StartElement{Name: xml.Name{Local: "book"}}
+	if err := enc.EncodeToken(element); err != nil {
+		return err
+	}
+	for _, key := range apiFields {
+		value, ok := book[key]
+		if !ok {
+			continue
+		}
+		if err := enc.EncodeElement(value, xml.StartElement{Name: xml.Name{Local: key}}); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(element.End())
+}
+
+// Writes a list of books as CSV (https://www.rfc-editor.org/rfc/rfc4180),
+// with a header row naming the columns. encoding/csv takes care of quoting
+// values containing commas, quotes or line breaks.
+// The columns are the keys of apiFields the books have, so they follow the
+// `fields` parameter. Rows are flushed to the client regularly instead of
+// building the whole file in memory first.
+func streamCSV(w io.Writer, body interface{}) error {
+	books, ok := body.([]map[string]interface{})
+	if !ok {
+		return fmt.Errorf("cannot encode %T as CSV", body)
+	}
+
+	var columns []string
+	for _, key := range apiFields {
+		for _, book := range books {
+			if _, ok := book[key]; ok {
+				columns = append(columns, key)
+				break
+			}
+		}
+	}
+	if len(books) == 0 {
+		columns = apiFields
+	}
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(columns); err != nil {
+		return err
+	}
+	row := make([]string, len(columns))
+	for i, book := range books {
+		for j, key := range columns {
+			value, _ := book[key].(string)
+			row[j] = value
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+		if i%100 == 99 {
+			writer.Flush()
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
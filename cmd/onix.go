@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/CAPS-Cloud/exercises/internal/isbn"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// Publishers send the metadata of their books as ONIX for Books 3.0
+// messages (https://www.editeur.org/83/Overview/), an XML file with one
+// <Product> per book. POST /api/import/onix adds their books to the catalog,
+// like POST /api/books/batch does, with one result per product, in the order
+// of the message. A product becomes the book:
+//
+//	id       RecordReference
+//	title    the distinctive title (TitleType 01) of DescriptiveDetail
+//	authors  the Contributors "By (author)" (ContributorRole A01), in the
+//	         order of their SequenceNumber
+//	edition  the ISBN-13 of ProductIdentifier (ProductIDType 15, or a GTIN-13
+//	         that is an ISBN, or an ISBN-10)
+//	pages    the page count of Extent (ExtentType 00 or 11, ExtentUnit 03)
+//	year     the publication date of PublishingDetail (PublishingDateRole 01)
+//	series   the title of the publisher's Collection (CollectionType 10)
+//	volume   the PartNumber of that collection
+//
+// The books are then validated as for POST /api/books, so a product missing
+// its title or with a wrong ISBN gets 422 and the fields at fault. The
+// result of each product also lists the ONIX elements it had which have no
+// place in a book, like the prices, in "unmapped". Both the reference tags
+// and the short tags of ONIX are read; the deletion notices, NotificationType
+// 05, are not imported.
+
+// The reference names of the short tags we read: the mapping uses the
+// former.
+var onixShortTags = map[string]string{
+	"ONIXmessage":       "ONIXMessage",
+	"header":            "Header",
+	"product":           "Product",
+	"a001":              "RecordReference",
+	"a002":              "NotificationType",
+	"productidentifier": "ProductIdentifier",
+	"b221":              "ProductIDType",
+	"b244":              "IDValue",
+	"descriptivedetail": "DescriptiveDetail",
+	"titledetail":       "TitleDetail",
+	"b202":              "TitleType",
+	"titleelement":      "TitleElement",
+	"x409":              "TitleElementLevel",
+	"b203":              "TitleText",
+	"b030":              "TitlePrefix",
+	"b031":              "TitleWithoutPrefix",
+	"x410":              "PartNumber",
+	"contributor":       "Contributor",
+	"b034":              "SequenceNumber",
+	"b035":              "ContributorRole",
+	"b036":              "PersonName",
+	"b039":              "NamesBeforeKey",
+	"b040":              "KeyNames",
+	"b047":              "CorporateName",
+	"collection":        "Collection",
+	"x329":              "CollectionType",
+	"extent":            "Extent",
+	"b218":              "ExtentType",
+	"b219":              "ExtentValue",
+	"b220":              "ExtentUnit",
+	"publishingdetail":  "PublishingDetail",
+	"publishingdate":    "PublishingDate",
+	"x448":              "PublishingDateRole",
+	"b306":              "Date",
+}
+
+// The elements of the composites we map that bookFromONIX reads, or that
+// tell nothing about the book, like NoCollection.
+var onixMappedElements = map[string][]string{
+	"Product":           {"RecordReference", "NotificationType", "ProductIdentifier", "DescriptiveDetail", "PublishingDetail"},
+	"DescriptiveDetail": {"TitleDetail", "Contributor", "Collection", "NoCollection", "Extent"},
+	"PublishingDetail":  {"PublishingDate"},
+}
+
+// An element of an ONIX message, by its reference name.
+type onixElement struct {
+	name     string
+	text     string
+	children []*onixElement
+}
+
+// The first child with the given name, nil if there is none.
+func (e *onixElement) child(name string) *onixElement {
+	if e == nil {
+		return nil
+	}
+	for _, child := range e.children {
+		if child.name == name {
+			return child
+		}
+	}
+	return nil
+}
+
+// The children with the given name.
+func (e *onixElement) all(name string) []*onixElement {
+	var found []*onixElement
+	if e != nil {
+		for _, child := range e.children {
+			if child.name == name {
+				found = append(found, child)
+			}
+		}
+	}
+	return found
+}
+
+// The text of the descendant at the path of names, "" if there is none.
+func (e *onixElement) value(path ...string) string {
+	for _, name := range path {
+		e = e.child(name)
+	}
+	if e == nil {
+		return ""
+	}
+	return strings.TrimSpace(e.text)
+}
+
+// The first of the elements whose field has one of the values, in the order
+// of the values, nil if there is none.
+func onixFirst(elements []*onixElement, field string, values ...string) *onixElement {
+	for _, value := range values {
+		for _, element := range elements {
+			if element.value(field) == value {
+				return element
+			}
+		}
+	}
+	return nil
+}
+
+// Handles POST /api/import/onix, see above.
+func importONIX(coll *mongo.Collection, authors *authorStore, tx *transactions) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		switch mediaType(c) {
+		case echo.MIMEApplicationXML, echo.MIMETextXML:
+		default:
+			return newProblem(http.StatusUnsupportedMediaType, "content type must be application/xml")
+		}
+		atomic, err := parseBoolParam(c, "atomic")
+		if err != nil {
+			return newProblem(http.StatusBadRequest, err.Error())
+		}
+		products, err := readONIX(c.Request().Body)
+		if err != nil {
+			return err
+		}
+		if len(products) == 0 {
+			return newProblem(http.StatusBadRequest, "the message contains no product")
+		}
+
+		results := make([]onixResult, len(products))
+		var inputs []map[string]interface{}
+		// For every book we insert, the index of its product in the message
+		var positions []int
+		for i, product := range products {
+			input, unmapped := bookFromONIX(product)
+			results[i].Index = i
+			results[i].Unmapped = unmapped
+			if product.value("NotificationType") == "05" {
+				results[i].ID, _ = input["id"].(string)
+				results[i].Status = http.StatusUnprocessableEntity
+				results[i].Error = "deletion notices are not imported"
+				continue
+			}
+			inputs = append(inputs, input)
+			positions = append(positions, i)
+		}
+		if len(inputs) > 0 {
+			for j, result := range insertBooks(c, coll, authors, tx, inputs, atomic) {
+				i := positions[j]
+				result.Index = i
+				results[i].batchResult = result
+			}
+		}
+		return c.JSON(http.StatusMultiStatus, map[string]interface{}{"results": results})
+	}
+}
+
+// The result of a product, see above.
+type onixResult struct {
+	batchResult
+	Unmapped []string `json:"unmapped,omitempty"`
+}
+
+// Reads the products of an ONIX 3.0 message, refusing with 400 Bad Request
+// what is not one.
+func readONIX(body io.Reader) ([]*onixElement, error) {
+	decoder := xml.NewDecoder(body)
+	// Older files are often in ISO-8859-1 or Windows-1252
+	decoder.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		encoding, err := htmlindex.Get(label)
+		if err != nil {
+			return nil, err
+		}
+		return encoding.NewDecoder().Reader(input), nil
+	}
+
+	root, err := nextElement(decoder)
+	if err != nil {
+		return nil, invalidONIX(err)
+	}
+	if onixName(root.Name) != "ONIXMessage" {
+		return nil, newProblem(http.StatusBadRequest, "the body must be an ONIX message, <ONIXMessage>")
+	}
+	release := ""
+	for _, attr := range root.Attr {
+		if attr.Name.Local == "release" {
+			release = attr.Value
+		}
+	}
+	if !strings.HasPrefix(release, "3.") {
+		return nil, newProblem(http.StatusBadRequest, "only ONIX 3.0 messages are supported, with release=\"3.0\"")
+	}
+
+	var products []*onixElement
+	for {
+		start, err := nextElement(decoder)
+		if errors.Is(err, io.EOF) {
+			return products, nil
+		}
+		if err != nil {
+			return nil, invalidONIX(err)
+		}
+		if onixName(start.Name) != "Product" {
+			// The Header, about the sender
+			if err := decoder.Skip(); err != nil {
+				return nil, invalidONIX(err)
+			}
+			continue
+		}
+		if len(products) == maxBatchSize {
+			return nil, newProblem(http.StatusBadRequest,
+				fmt.Sprintf("a message may contain at most %d products", maxBatchSize))
+		}
+		product, err := readElement(decoder, start)
+		if err != nil {
+			return nil, invalidONIX(err)
+		}
+		products = append(products, product)
+	}
+}
+
+func invalidONIX(err error) *problemError {
+	return newProblem(http.StatusBadRequest, "invalid ONIX message: "+err.Error())
+}
+
+// The next element starting in the current one, io.EOF when it ends.
+func nextElement(decoder *xml.Decoder) (xml.StartElement, error) {
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			return token, nil
+		case xml.EndElement:
+			return xml.StartElement{}, io.EOF
+		}
+	}
+}
+
+// Reads the element that started with start, and everything in it.
+func readElement(decoder *xml.Decoder, start xml.StartElement) (*onixElement, error) {
+	element := &onixElement{name: onixName(start.Name)}
+	var text strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			child, err := readElement(decoder, token)
+			if err != nil {
+				return nil, err
+			}
+			element.children = append(element.children, child)
+		case xml.CharData:
+			text.Write(token)
+		case xml.EndElement:
+			element.text = text.String()
+			return element, nil
+		}
+	}
+}
+
+// The reference name of an element, whichever tags the message uses.
+func onixName(name xml.Name) string {
+	if reference, ok := onixShortTags[name.Local]; ok {
+		return reference
+	}
+	return name.Local
+}
+
+// The body of a POST /api/books for a product, see above, and the ONIX
+// elements left out of it.
+func bookFromONIX(product *onixElement) (map[string]interface{}, []string) {
+	input := map[string]interface{}{}
+	set := func(key string, value string) {
+		if value != "" {
+			input[key] = value
+		}
+	}
+	set("id", product.value("RecordReference"))
+
+	identifiers := product.all("ProductIdentifier")
+	if identifier := onixFirst(identifiers, "ProductIDType", "15"); identifier != nil {
+		set("edition", identifier.value("IDValue"))
+	} else if gtin := onixFirst(identifiers, "ProductIDType", "03"); gtin != nil && isbn.Validate(gtin.value("IDValue")) == nil {
+		set("edition", gtin.value("IDValue"))
+	} else if identifier := onixFirst(identifiers, "ProductIDType", "02"); identifier != nil {
+		set("edition", identifier.value("IDValue"))
+	}
+
+	detail := product.child("DescriptiveDetail")
+	set("title", onixTitle(onixFirst(detail.all("TitleDetail"), "TitleType", "01"), "01"))
+
+	contributors := detail.all("Contributor")
+	slices.SortStableFunc(contributors, func(a, b *onixElement) int {
+		x, _ := strconv.Atoi(a.value("SequenceNumber"))
+		y, _ := strconv.Atoi(b.value("SequenceNumber"))
+		return x - y
+	})
+	var names []interface{}
+	others := false
+	for _, contributor := range contributors {
+		if !slices.ContainsFunc(contributor.all("ContributorRole"), func(role *onixElement) bool {
+			return strings.TrimSpace(role.text) == "A01"
+		}) {
+			// The editors, illustrators, translators...
+			others = true
+			continue
+		}
+		if name := onixPersonName(contributor); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		input["authors"] = names
+	}
+
+	if collection := onixFirst(detail.all("Collection"), "CollectionType", "10"); collection != nil {
+		title := collection.child("TitleDetail")
+		set("series", onixTitle(title, "02"))
+		set("volume", onixFirst(title.all("TitleElement"), "TitleElementLevel", "02").value("PartNumber"))
+	}
+
+	// Only the extents in pages, not the running times of an audiobook
+	var pages []*onixElement
+	for _, extent := range detail.all("Extent") {
+		if extent.value("ExtentUnit") == "03" {
+			pages = append(pages, extent)
+		}
+	}
+	set("pages", onixFirst(pages, "ExtentType", "00", "11").value("ExtentValue"))
+
+	date := onixFirst(product.child("PublishingDetail").all("PublishingDate"), "PublishingDateRole", "01")
+	// Whatever its format, e.g. YYYYMMDD or YYYY, the date starts with the
+	// year
+	if value := date.value("Date"); len(value) >= 4 {
+		set("year", value[:4])
+	}
+
+	var unmapped []string
+	unmapped = append(unmapped, onixUnmapped(product, "")...)
+	unmapped = append(unmapped, onixUnmapped(detail, "DescriptiveDetail/")...)
+	unmapped = append(unmapped, onixUnmapped(product.child("PublishingDetail"), "PublishingDetail/")...)
+	if others {
+		unmapped = append(unmapped, "DescriptiveDetail/Contributor")
+	}
+	return input, unmapped
+}
+
+// The title of the TitleElement of the level, in a TitleDetail: its
+// TitleText, or its TitlePrefix and TitleWithoutPrefix.
+func onixTitle(detail *onixElement, level string) string {
+	elements := detail.all("TitleElement")
+	element := onixFirst(elements, "TitleElementLevel", level)
+	if element == nil && len(elements) > 0 {
+		element = elements[0]
+	}
+	if text := element.value("TitleText"); text != "" {
+		return text
+	}
+	return strings.TrimSpace(element.value("TitlePrefix") + " " + element.value("TitleWithoutPrefix"))
+}
+
+// The name of a contributor, a person or an organization.
+func onixPersonName(contributor *onixElement) string {
+	if name := contributor.value("PersonName"); name != "" {
+		return name
+	}
+	if name := strings.TrimSpace(contributor.value("NamesBeforeKey") + " " + contributor.value("KeyNames")); name != "" {
+		return name
+	}
+	return contributor.value("CorporateName")
+}
+
+// The children of a composite that bookFromONIX does not read, once each,
+// with the prefix.
+func onixUnmapped(composite *onixElement, prefix string) []string {
+	if composite == nil {
+		return nil
+	}
+	var unmapped []string
+	mapped := onixMappedElements[composite.name]
+	for _, child := range composite.children {
+		path := prefix + child.name
+		if !slices.Contains(mapped, child.name) && !slices.Contains(unmapped, path) {
+			unmapped = append(unmapped, path)
+		}
+	}
+	return unmapped
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The API is described for its integrators by an OpenAPI 3 document, see
+// https://spec.openapis.org/oas/v3.0.3, at /api/openapi.json, which the
+// Swagger UI of /api/docs shows, and lets them try.
+//
+// The paths of the document are the routes of /api/v1, as Echo has them, so
+// none is missing; apiOperations describes each of them. A new route without
+// a description is still documented, with its path only, and the server logs
+// it when it builds the document, to remind us to describe it.
+
+// A route of the API, as the document describes it.
+type apiOperation struct {
+	tag     string
+	summary string
+	// Who may call it: "" for everybody, a role, or "user" for any logged
+	// in user
+	access string
+	// The names of its query parameters, see apiParameters
+	query []string
+	// The schema of the body, in apiSchemas, if it takes one; "object" for
+	// a body we do not describe further
+	body string
+	// The status and the schema of a successful answer, 200 and no schema
+	// by default; the schema is a list of them when list is set
+	status   int
+	response string
+	list     bool
+}
+
+// The routes of the API, by their method and path in the group.
+var apiOperations = map[string]apiOperation{
+	"GET /books":                  {tag: "books", summary: "List the books, page by page, with the total in X-Total-Count", query: []string{"limit", "offset", "after", "sort", "order", "fields", "author", "publisher", "year", "edition", "tag", "include_archived"}, response: "Book", list: true},
+	"POST /books":                 {tag: "books", summary: "Add a book", access: "editor", body: "BookInput", status: http.StatusCreated, response: "Message"},
+	"POST /books/batch":           {tag: "books", summary: "Add several books, with one result per book", access: "editor", query: []string{"atomic"}, body: "object", status: http.StatusMultiStatus},
+	"DELETE /books":               {tag: "books", summary: "Delete several books, by their IDs", access: "admin", body: "object", status: http.StatusMultiStatus},
+	"PATCH /books/batch":          {tag: "books", summary: "Change several books, each with a merge patch", access: "editor", body: "object", status: http.StatusMultiStatus},
+	"POST /import/onix":           {tag: "books", summary: "Add the books of an ONIX 3.0 message, with one result per product", access: "editor", query: []string{"atomic"}, status: http.StatusMultiStatus},
+	"GET /books/recent":           {tag: "books", summary: "The last books added, newest first", query: []string{"limit"}, response: "Book", list: true},
+	"GET /books/search":           {tag: "search", summary: "Search the books, best matches first", query: []string{"q", "limit", "fuzzy", "facets", "author", "publisher", "year", "edition", "tag"}},
+	"GET /books/:id":              {tag: "books", summary: "A book", query: []string{"fields"}, response: "Book"},
+	"PUT /books/:id":              {tag: "books", summary: "Replace a book; If-Match takes its ETag", access: "editor", body: "BookInput", response: "Message"},
+	"PATCH /books/:id":            {tag: "books", summary: "Change some fields of a book, with a JSON Merge Patch or a JSON Patch", access: "editor", body: "object", response: "Message"},
+	"DELETE /books/:id":           {tag: "books", summary: "Move a book to the trash", access: "admin", response: "Message"},
+	"GET /books/:id/related":      {tag: "books", summary: "The books like this one", query: []string{"limit"}, response: "Book", list: true},
+	"POST /books/:id/cover":       {tag: "books", summary: "Upload the cover of a book, as multipart/form-data", access: "editor", body: "object"},
+	"POST /books/:id/tags":        {tag: "books", summary: "Tag a book", access: "editor", body: "object"},
+	"DELETE /books/:id/tags":      {tag: "books", summary: "Take tags off a book", access: "editor", body: "object"},
+	"POST /books/:id/archive":     {tag: "books", summary: "Archive a book withdrawn from the catalog", access: "editor", response: "Message"},
+	"POST /books/:id/unarchive":   {tag: "books", summary: "Bring an archived book back", access: "editor", response: "Message"},
+	"GET /books/trash":            {tag: "books", summary: "The deleted books", access: "admin", response: "Book", list: true},
+	"POST /books/:id/restore":     {tag: "books", summary: "Restore a book from the trash", access: "admin", response: "Message"},
+	"GET /books/:id/history":      {tag: "books", summary: "The revisions of a book, newest first", query: []string{"limit", "offset"}},
+	"POST /books/:id/revert/:rev": {tag: "books", summary: "Put a book back as it was at a revision", access: "editor", response: "Message"},
+	"PUT /books/:id/publisher":    {tag: "publishers", summary: "Link a book to its publisher", access: "editor", body: "object"},
+	"DELETE /books/:id/publisher": {tag: "publishers", summary: "Unlink a book from its publisher", access: "editor"},
+	"GET /tags":                   {tag: "books", summary: "The tags of the books, with how many books have each"},
+	"GET /series":                 {tag: "books", summary: "The series of the books"},
+	"GET /series/:name":           {tag: "books", summary: "The books of a series, in the order of their volumes", response: "Book", list: true},
+	"GET /years":                  {tag: "books", summary: "The years of the books", query: []string{"titles"}},
+	"GET /events":                 {tag: "books", summary: "The changes of the books, as Server-Sent Events; Last-Event-ID resumes them"},
+	"GET /export":                 {tag: "books", summary: "Download all the books, as JSON or NDJSON", query: []string{"format", "gzip"}},
+	"GET /suggest":                {tag: "search", summary: "The titles and authors starting with a prefix, for a search bar", query: []string{"q"}},
+
+	"GET /authors":        {tag: "authors", summary: "List the authors", response: "Author", list: true},
+	"GET /authors/:id":    {tag: "authors", summary: "An author", response: "Author"},
+	"POST /authors":       {tag: "authors", summary: "Add an author", access: "editor", body: "Author", status: http.StatusCreated, response: "Author"},
+	"PUT /authors/:id":    {tag: "authors", summary: "Replace an author", access: "editor", body: "Author", response: "Author"},
+	"DELETE /authors/:id": {tag: "authors", summary: "Delete an author without books", access: "admin"},
+
+	"GET /publishers":        {tag: "publishers", summary: "List the publishers", response: "Publisher", list: true},
+	"GET /publishers/:id":    {tag: "publishers", summary: "A publisher", response: "Publisher"},
+	"POST /publishers":       {tag: "publishers", summary: "Add a publisher", access: "editor", body: "Publisher", status: http.StatusCreated, response: "Publisher"},
+	"PUT /publishers/:id":    {tag: "publishers", summary: "Replace a publisher", access: "editor", body: "Publisher", response: "Publisher"},
+	"DELETE /publishers/:id": {tag: "publishers", summary: "Delete a publisher without books", access: "admin"},
+
+	"GET /books/:id/reviews":              {tag: "reviews", summary: "The reviews of a book, newest first", query: []string{"limit", "offset"}, response: "Review", list: true},
+	"GET /books/:id/reviews/:reviewId":    {tag: "reviews", summary: "A review", response: "Review"},
+	"POST /books/:id/reviews":             {tag: "reviews", summary: "Review a book", access: "user", body: "ReviewInput", status: http.StatusCreated, response: "Review"},
+	"PUT /books/:id/reviews/:reviewId":    {tag: "reviews", summary: "Change your review", access: "user", body: "ReviewInput", response: "Review"},
+	"DELETE /books/:id/reviews/:reviewId": {tag: "reviews", summary: "Delete your review, or any as an admin", access: "user"},
+
+	"POST /books/:id/checkout":             {tag: "checkouts", summary: "Lend a copy of a book", access: "editor", body: "object", status: http.StatusCreated, response: "Checkout"},
+	"POST /books/:id/return":               {tag: "checkouts", summary: "Take a copy back", access: "editor", body: "object", response: "Checkout"},
+	"PUT /books/:id/copies":                {tag: "checkouts", summary: "Set how many copies of a book the library has", access: "editor", body: "object"},
+	"GET /books/:id/checkouts":             {tag: "checkouts", summary: "The checkouts of a book", access: "editor", response: "Checkout", list: true},
+	"GET /checkouts":                       {tag: "checkouts", summary: "The copies lent and not returned", access: "editor", query: []string{"borrower"}, response: "Checkout", list: true},
+	"GET /checkouts/overdue":               {tag: "checkouts", summary: "The copies due and not returned", access: "editor", response: "Checkout", list: true},
+	"GET /users/me/lists":                  {tag: "lists", summary: "Your reading lists", access: "user"},
+	"GET /users/me/lists/:list":            {tag: "lists", summary: "One of your reading lists", access: "user"},
+	"PUT /users/me/lists/:list/:bookId":    {tag: "lists", summary: "Put a book on one of your reading lists", access: "user", body: "object"},
+	"DELETE /users/me/lists/:list/:bookId": {tag: "lists", summary: "Take a book off one of your reading lists", access: "user"},
+
+	"POST /auth/login":   {tag: "auth", summary: "Log in, for an access and a refresh token", body: "Login", response: "Tokens"},
+	"POST /auth/refresh": {tag: "auth", summary: "Trade a refresh token for new tokens", body: "Refresh", response: "Tokens"},
+	"POST /auth/logout":  {tag: "auth", summary: "Revoke a refresh token", body: "Refresh", status: http.StatusNoContent},
+
+	"POST /admin/keys":             {tag: "admin", summary: "Create an API key, shown only once", access: "admin", body: "object", status: http.StatusCreated},
+	"GET /admin/keys":              {tag: "admin", summary: "List the API keys, without their secret", access: "admin"},
+	"DELETE /admin/keys/:id":       {tag: "admin", summary: "Revoke an API key", access: "admin"},
+	"POST /admin/users":            {tag: "admin", summary: "Create a user", access: "admin", body: "object", status: http.StatusCreated, response: "Message"},
+	"GET /admin/cache":             {tag: "admin", summary: "How many requests the cache served", access: "admin"},
+	"GET /admin/pool":              {tag: "admin", summary: "How busy the connections to MongoDB are", access: "admin"},
+	"GET /admin/duplicates":        {tag: "admin", summary: "The books that are probably the same", access: "admin"},
+	"POST /admin/merge":            {tag: "admin", summary: "Merge duplicates into one book", access: "admin", body: "object"},
+	"GET /admin/features":          {tag: "admin", summary: "The features and whether they are on", access: "admin"},
+	"PUT /admin/features/:name":    {tag: "admin", summary: "Turn a feature on or off", access: "admin", body: "object"},
+	"DELETE /admin/features/:name": {tag: "admin", summary: "Put a feature back as configured", access: "admin"},
+	"GET /admin/maintenance":       {tag: "admin", summary: "Whether the server is read-only", access: "admin"},
+	"PUT /admin/maintenance":       {tag: "admin", summary: "Make the server read-only, or not", access: "admin", body: "object"},
+	"GET /admin/drain":             {tag: "admin", summary: "Whether the instance is draining", access: "admin"},
+	"POST /admin/drain":            {tag: "admin", summary: "Make /readyz fail, for the load balancer", access: "admin"},
+	"DELETE /admin/drain":          {tag: "admin", summary: "Stop draining", access: "admin"},
+	"POST /admin/backup":           {tag: "admin", summary: "Write a snapshot of the books", access: "admin", status: http.StatusCreated},
+	"GET /admin/backups":           {tag: "admin", summary: "The snapshots, newest first", access: "admin"},
+	"POST /admin/restore":          {tag: "admin", summary: "Replace the books with those of a snapshot", access: "admin", body: "object"},
+}
+
+// The query parameters of the routes, by name.
+var apiParameters = map[string]map[string]interface{}{
+	"limit":            queryParameter("How many items, at most", integerSchema),
+	"offset":           queryParameter("How many items to skip", integerSchema),
+	"after":            queryParameter("The cursor of the previous page, from its X-Next-Cursor header", stringSchema),
+	"sort":             queryParameter("The key to sort by, e.g. year", stringSchema),
+	"order":            queryParameter("asc or desc", map[string]interface{}{"type": "string", "enum": []string{"asc", "desc"}}),
+	"fields":           queryParameter("The keys to return, comma separated, e.g. id,title", stringSchema),
+	"author":           queryParameter("Only the books of the author", stringSchema),
+	"publisher":        queryParameter("Only the books of the publisher, by its ID", stringSchema),
+	"year":             queryParameter("Only the books of the year", integerSchema),
+	"edition":          queryParameter("Only the books of the edition", stringSchema),
+	"tag":              queryParameter("Only the books with the tag; repeat it for several", stringSchema),
+	"include_archived": queryParameter("Whether to list the archived books as well", booleanSchema),
+	"q":                required(queryParameter("The words to look for", stringSchema)),
+	"fuzzy":            queryParameter("Whether to tolerate typos", booleanSchema),
+	"facets":           queryParameter("Whether to count the books found by author, year and edition", booleanSchema),
+	"atomic":           queryParameter("Whether to add all the books or none", booleanSchema),
+	"titles":           queryParameter("Whether to list the titles of each year", booleanSchema),
+	"format":           queryParameter("json or ndjson", map[string]interface{}{"type": "string", "enum": []string{"json", "ndjson"}}),
+	"gzip":             queryParameter("Whether to compress the file", booleanSchema),
+	"borrower":         queryParameter("Only the copies lent to the borrower", stringSchema),
+}
+
+var (
+	stringSchema  = map[string]interface{}{"type": "string"}
+	integerSchema = map[string]interface{}{"type": "integer"}
+	booleanSchema = map[string]interface{}{"type": "boolean"}
+)
+
+func queryParameter(description string, schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"in": "query", "description": description, "schema": schema}
+}
+
+// The schemas of the bodies and the answers, see bookToAPI and the others.
+var apiSchemas = map[string]interface{}{
+	"Book": object(map[string]interface{}{
+		"id":              stringSchema,
+		"title":           stringSchema,
+		"author":          described(stringSchema, "The authors, joined with commas"),
+		"authors":         arrayOf(stringSchema),
+		"authorIds":       arrayOf(stringSchema),
+		"pages":           stringSchema,
+		"edition":         described(stringSchema, "The ISBN of the edition"),
+		"year":            stringSchema,
+		"series":          stringSchema,
+		"volume":          stringSchema,
+		"tags":            arrayOf(stringSchema),
+		"publisherId":     stringSchema,
+		"copies":          integerSchema,
+		"availableCopies": integerSchema,
+		"rating":          object(map[string]interface{}{"average": map[string]interface{}{"type": "number"}, "count": integerSchema}),
+		"cover":           described(stringSchema, "The path of the cover image"),
+		"archived":        booleanSchema,
+		"createdAt":       dateTimeSchema,
+		"updatedAt":       dateTimeSchema,
+	}),
+	"BookInput": required(object(map[string]interface{}{
+		"id":      stringSchema,
+		"title":   stringSchema,
+		"author":  stringSchema,
+		"pages":   stringSchema,
+		"edition": stringSchema,
+		"year":    stringSchema,
+		"series":  stringSchema,
+		"volume":  stringSchema,
+	}), "title", "author"),
+	"Author": required(object(map[string]interface{}{
+		"id":          stringSchema,
+		"name":        stringSchema,
+		"birthYear":   integerSchema,
+		"nationality": stringSchema,
+		"bio":         stringSchema,
+	}), "name"),
+	"Publisher": required(object(map[string]interface{}{
+		"id":      stringSchema,
+		"name":    stringSchema,
+		"country": stringSchema,
+		"website": stringSchema,
+	}), "name"),
+	"Review": object(map[string]interface{}{
+		"id":        stringSchema,
+		"bookId":    stringSchema,
+		"author":    described(stringSchema, "The username of the reviewer"),
+		"rating":    integerSchema,
+		"text":      stringSchema,
+		"createdAt": dateTimeSchema,
+		"updatedAt": dateTimeSchema,
+	}),
+	"ReviewInput": required(object(map[string]interface{}{
+		"rating": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 5},
+		"text":   stringSchema,
+	}), "rating"),
+	"Checkout": object(map[string]interface{}{
+		"id":           stringSchema,
+		"bookId":       stringSchema,
+		"borrower":     stringSchema,
+		"checkedOutBy": stringSchema,
+		"checkedOutAt": dateTimeSchema,
+		"dueAt":        dateTimeSchema,
+		"returnedAt":   dateTimeSchema,
+	}),
+	"Login":   required(object(map[string]interface{}{"username": stringSchema, "password": stringSchema}), "username", "password"),
+	"Refresh": required(object(map[string]interface{}{"refreshToken": stringSchema}), "refreshToken"),
+	"Tokens":  object(map[string]interface{}{"accessToken": stringSchema, "refreshToken": stringSchema}),
+	"Message": object(map[string]interface{}{"message": stringSchema}),
+	// See problem.go
+	"Problem": object(map[string]interface{}{
+		"type":     stringSchema,
+		"title":    stringSchema,
+		"status":   integerSchema,
+		"detail":   stringSchema,
+		"instance": stringSchema,
+		"errors":   described(map[string]interface{}{"type": "object", "additionalProperties": stringSchema}, "The invalid fields, and what is wrong with each"),
+	}),
+}
+
+var dateTimeSchema = map[string]interface{}{"type": "string", "format": "date-time"}
+
+func object(properties map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+func arrayOf(items interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "array", "items": items}
+}
+
+func described(schema map[string]interface{}, description string) map[string]interface{} {
+	copied := maps.Clone(schema)
+	copied["description"] = description
+	return copied
+}
+
+// Marks the fields of an object schema as required, or a parameter without
+// fields.
+func required(schema map[string]interface{}, fields ...string) map[string]interface{} {
+	if len(fields) == 0 {
+		schema["required"] = true
+	} else {
+		schema["required"] = fields
+	}
+	return schema
+}
+
+func schemaRef(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+// The ways to authenticate, see auth.go. Any of them gives a role.
+var apiSecurity = []map[string][]string{{"bearer": {}}, {"apiKey": {}}, {"adminToken": {}}}
+
+// Builds the document of the routes of the group prefix, e.g. /api/v1.
+func openAPIDocument(routes []*echo.Route, prefix string) map[string]interface{} {
+	paths := map[string]map[string]interface{}{}
+	for _, route := range routes {
+		path, ok := strings.CutPrefix(route.Path, prefix)
+		if !ok || !strings.HasPrefix(path, "/") {
+			continue
+		}
+		operation, described := apiOperations[route.Method+" "+path]
+		if !described {
+			slog.Warn("a route of the API is not described in its OpenAPI document, see apiOperations", "method", route.Method, "path", route.Path)
+		}
+
+		var parameters []interface{}
+		var segments []string
+		for _, segment := range strings.Split(path, "/") {
+			if name, ok := strings.CutPrefix(segment, ":"); ok {
+				parameters = append(parameters, map[string]interface{}{"name": name, "in": "path", "required": true, "schema": stringSchema})
+				segment = "{" + name + "}"
+			}
+			segments = append(segments, segment)
+		}
+		for _, name := range operation.query {
+			parameter := maps.Clone(apiParameters[name])
+			parameter["name"] = name
+			parameters = append(parameters, parameter)
+		}
+
+		status := operation.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := map[string]interface{}{"description": http.StatusText(status)}
+		if operation.response != "" {
+			var schema interface{} = schemaRef(operation.response)
+			if operation.list {
+				schema = arrayOf(schema)
+			}
+			success["content"] = map[string]interface{}{echo.MIMEApplicationJSON: map[string]interface{}{"schema": schema}}
+		}
+		op := map[string]interface{}{
+			"operationId": route.Method + " " + path,
+			"responses": map[string]interface{}{
+				strconv.Itoa(status): success,
+				"default": map[string]interface{}{
+					"description": "A problem, see RFC 7807 and problem.go",
+					"content":     map[string]interface{}{"application/problem+json": map[string]interface{}{"schema": schemaRef("Problem")}},
+				},
+			},
+		}
+		if operation.tag != "" {
+			op["tags"] = []string{operation.tag}
+		}
+		if operation.summary != "" {
+			op["summary"] = operation.summary
+		}
+		if len(parameters) > 0 {
+			op["parameters"] = parameters
+		}
+		if operation.body != "" {
+			schema := map[string]interface{}{"type": "object"}
+			if operation.body != "object" {
+				schema = schemaRef(operation.body)
+			}
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  map[string]interface{}{echo.MIMEApplicationJSON: map[string]interface{}{"schema": schema}},
+			}
+		}
+		if operation.access != "" {
+			op["security"] = apiSecurity
+			op["description"] = "Needs the role " + operation.access + " or above."
+			if operation.access == "user" {
+				op["description"] = "Needs a logged in user."
+			}
+		}
+
+		openAPIPath := strings.Join(segments, "/")
+		if paths[openAPIPath] == nil {
+			paths[openAPIPath] = map[string]interface{}{}
+		}
+		paths[openAPIPath][strings.ToLower(route.Method)] = op
+	}
+
+	var tags []map[string]string
+	seen := map[string]bool{}
+	for _, operation := range apiOperations {
+		if !seen[operation.tag] {
+			seen[operation.tag] = true
+			tags = append(tags, map[string]string{"name": operation.tag})
+		}
+	}
+	slices.SortFunc(tags, func(a, b map[string]string) int { return strings.Compare(a["name"], b["name"]) })
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "Bookstore API",
+			"version":     "1",
+			"description": "The books of the bookstore, their authors, publishers, reviews and checkouts. See the README for the details.",
+		},
+		"servers": []map[string]string{{"url": prefix}},
+		"tags":    tags,
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": apiSchemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer":     map[string]string{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"apiKey":     map[string]string{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"adminToken": map[string]string{"type": "apiKey", "in": "header", "name": "X-Admin-Token"},
+			},
+		},
+	}
+}
+
+// Handles GET /api/openapi.json. The document is built at the first
+// request, once every route is registered.
+func serveOpenAPI(e *echo.Echo, prefix string) echo.HandlerFunc {
+	document := sync.OnceValue(func() map[string]interface{} {
+		return openAPIDocument(e.Routes(), prefix)
+	})
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, document())
+	}
+}
+
+// The policy of /api/docs: the Swagger UI comes from unpkg.com, its style
+// sheet as well.
+const apiDocsSecurityPolicy = "default-src 'self'; script-src 'self' 'unsafe-inline' https://unpkg.com; style-src 'self' 'unsafe-inline' https://unpkg.com; img-src 'self' data: https://unpkg.com; object-src 'none'; base-uri 'self'; frame-ancestors 'none'"
+
+// Handles GET /api/docs, the Swagger UI of the document.
+func serveAPIDocs(c echo.Context) error {
+	// Unless SECURITY_CSP is off
+	if c.Response().Header().Get(echo.HeaderContentSecurityPolicy) != "" {
+		c.Response().Header().Set(echo.HeaderContentSecurityPolicy, apiDocsSecurityPolicy)
+	}
+	return c.Render(http.StatusOK, "api-docs", map[string]string{"Spec": "/api/openapi.json"})
+}
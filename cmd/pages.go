@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The pages of what only MongoDB keeps: the covers, the authors, the tags,
+// the series, the reading lists, and the years, which MongoDB counts. main
+// registers them with STORAGE=mongo only, the other pages work with any
+// storage.
+func registerMongoPages(e *echo.Echo, cols collections, auth *authenticator, cache *responseCache) {
+	authors := &authorStore{authors: cols.authors, books: cols.books, transactions: cols.transactions}
+
+	// The cover images of the books, see covers.go
+	coverImages := &coverStore{bucket: cols.covers, books: cols.books}
+	e.GET("/covers/:id", coverImages.serve)
+
+	e.GET("/authors", func(c echo.Context) error {
+		summaries, err := authors.list(c.Request().Context())
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		return c.Render(200, "authors-table", summaries)
+	}, cache.middleware(cache.ttl))
+
+	// The page of an author, opened from the authors table
+	e.GET("/authors/:id", func(c echo.Context) error {
+		found, books, err := authors.find(c.Request().Context(), c.Param("id"))
+		if err == mongo.ErrNoDocuments {
+			return newProblem(http.StatusNotFound, "author not found")
+		}
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		return c.Render(200, "author-detail", map[string]interface{}{
+			"Author":    found,
+			"Books":     booksToMaps(books),
+			"Coauthors": coauthors(found, books),
+		})
+	})
+
+	// The years and how many books came out in each, counted by the
+	// database, see findYears
+	e.GET("/years", func(c echo.Context) error {
+		years, err := findYears(c.Request().Context(), cols.books, false)
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		return c.Render(200, "years-table", years)
+	}, cache.middleware(cache.ttl))
+
+	// The tag cloud, and the books of a tag when clicking on it
+	e.GET("/tags", func(c echo.Context) error {
+		tags, err := findTags(c.Request().Context(), cols.books)
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		return c.Render(200, "tag-cloud", tagCloud(tags))
+	})
+
+	e.GET("/tags/books", func(c echo.Context) error {
+		opts := options.Find().
+			SetSort(bson.D{{Key: "BookName", Value: 1}}).
+			SetProjection(bookTableProjection)
+		cursor, err := cols.books.Find(c.Request().Context(), listed(bson.M{"Tags": normalizeTag(c.QueryParam("tag"))}), opts)
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		return streamBookTable(c, cursor)
+	})
+
+	// The series, and the volumes of one of them when clicking on it
+	e.GET("/series", func(c echo.Context) error {
+		series, err := findSeries(c.Request().Context(), cols.books)
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		return c.Render(200, "series-table", series)
+	})
+
+	// The name is a query parameter, since it may contain slashes
+	e.GET("/series/volumes", func(c echo.Context) error {
+		books, err := findSeriesBooks(c.Request().Context(), cols.books, c.QueryParam("name"), withFields(bookTableProjection, "SeriesVolume", "BookYear"))
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		return c.Render(200, "series-volumes", map[string]interface{}{
+			"Name":  c.QueryParam("name"),
+			"Books": booksToMaps(books),
+		})
+	})
+
+	// The reading lists of the logged in user. The page sends the access
+	// token it got at login; without a valid one, it shows the login form.
+	lists := &readingLists{entries: cols.readingLists, books: cols.books}
+	e.GET("/lists", func(c echo.Context) error {
+		p, err := auth.authenticate(c)
+		if err != nil || p == nil || !p.IsUser {
+			return c.Render(200, "login-form", nil)
+		}
+		byName, err := lists.booksOf(c.Request().Context(), p.Name, bookTableProjection)
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		type readingList struct {
+			Name  string
+			Books []map[string]interface{}
+		}
+		var data []readingList
+		for _, name := range listNames {
+			data = append(data, readingList{Name: name, Books: booksToMaps(byName[name])})
+		}
+		return c.Render(200, "reading-lists", data)
+	})
+}
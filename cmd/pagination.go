@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Page sizes for GET /api/books. Without query parameters a client gets the
+// first defaultPageSize books, and nobody can ask for more than maxPageSize
+// books in a single request.
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// Reads the `limit` query parameter, falling back to defaultPageSize and
+// capping it at maxPageSize.
+func parseLimit(c echo.Context) (int64, error) {
+	return parseLimitOr(c, defaultPageSize)
+}
+
+// Same as parseLimit, for the routes returning fewer books by default.
+func parseLimitOr(c echo.Context, fallback int64) (int64, error) {
+	raw := c.QueryParam("limit")
+	if raw == "" {
+		return fallback, nil
+	}
+	limit, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || limit < 1 {
+		return 0, fmt.Errorf("limit must be a positive number")
+	}
+	return min(limit, maxPageSize), nil
+}
+
+// Reads the `limit` and `offset` query parameters of a listing request.
+// Missing parameters fall back to the defaults; anything that is not a
+// non-negative number is rejected so the handler can answer with 400.
+func parsePagination(c echo.Context) (offset int64, limit int64, err error) {
+	limit, err = parseLimit(c)
+	if err != nil {
+		return 0, 0, err
+	}
+	if raw := c.QueryParam("offset"); raw != "" {
+		offset, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("offset must be zero or a positive number")
+		}
+	}
+	return offset, limit, nil
+}
+
+// A request is in cursor mode as soon as it carries the `after` parameter.
+// An empty value (`?after=`) starts at the beginning of the collection.
+func wantsCursorPagination(c echo.Context) bool {
+	return c.QueryParams().Has("after")
+}
+
+// Reads the `after` and `limit` query parameters of a cursor-mode request.
+// The cursor stays as the client sent it, the repository decodes it.
+// Combining a cursor with an offset makes no sense, so we refuse it.
+func parseCursorPagination(c echo.Context) (after string, limit int64, err error) {
+	if c.QueryParam("offset") != "" {
+		return "", 0, fmt.Errorf("offset cannot be combined with after")
+	}
+	limit, err = parseLimit(c)
+	if err != nil {
+		return "", 0, err
+	}
+	return c.QueryParam("after"), limit, nil
+}
+
+// Cursors are opaque to clients: they are just the MongoID of the last book of
+// a page, base64-encoded so nobody starts building them by hand.
+func encodeCursor(id primitive.ObjectID) string {
+	return base64.RawURLEncoding.EncodeToString(id[:])
+}
+
+func decodeCursor(cursor string) (primitive.ObjectID, error) {
+	var id primitive.ObjectID
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return id, err
+	}
+	if len(raw) != len(id) {
+		return id, fmt.Errorf("cursor has the wrong length")
+	}
+	copy(id[:], raw)
+	return id, nil
+}
+
+// Builds the URL of another page of the current request by replacing some of
+// its query parameters.
+func pageURL(c echo.Context, params map[string]string) string {
+	u := *c.Request().URL
+	q := u.Query()
+	for key, value := range params {
+		q.Set(key, value)
+	}
+	u.RawQuery = q.Encode()
+	return u.RequestURI()
+}
+
+// Tells the client where it is in the collection. X-Total-Count carries the
+// number of books, and the Link header (https://www.rfc-editor.org/rfc/rfc8288)
+// points to the neighbouring pages, so the response body can stay a plain
+// array of books.
+func setPaginationHeaders(c echo.Context, offset int64, limit int64, total int64) {
+	c.Response().Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+
+	page := func(o int64) string {
+		return pageURL(c, map[string]string{
+			"offset": strconv.FormatInt(o, 10),
+			"limit":  strconv.FormatInt(limit, 10),
+		})
+	}
+
+	var links []string
+	if offset+limit < total {
+		links = append(links, fmt.Sprintf("<%s>; rel=\"next\"", page(offset+limit)))
+	}
+	if offset > 0 {
+		links = append(links, fmt.Sprintf("<%s>; rel=\"prev\"", page(max(offset-limit, 0))))
+	}
+	if len(links) > 0 {
+		c.Response().Header().Add("Link", strings.Join(links, ", "))
+	}
+}
+
+// Cursor mode only knows the way forward. Counting the whole collection would
+// defeat the purpose, so there is no X-Total-Count here.
+func setCursorHeaders(c echo.Context, next string, limit int64) {
+	if next == "" {
+		return
+	}
+	c.Response().Header().Set("X-Next-Cursor", next)
+	link := pageURL(c, map[string]string{
+		"after": next,
+		"limit": strconv.FormatInt(limit, 10),
+	})
+	c.Response().Header().Add("Link", fmt.Sprintf("<%s>; rel=\"next\"", link))
+}
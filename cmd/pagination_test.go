@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCursors(t *testing.T) {
+	id := primitive.NewObjectID()
+	decoded, err := decodeCursor(encodeCursor(id))
+	if err != nil || decoded != id {
+		t.Errorf("got %v, %v, want %v", decoded, err, id)
+	}
+	seq, err := decodeSeqCursor(encodeSeqCursor(42))
+	if err != nil || seq != 42 {
+		t.Errorf("got %d, %v, want 42", seq, err)
+	}
+
+	invalid := []struct {
+		name   string
+		cursor string
+	}{
+		{"not base64", "not a cursor!"},
+		{"too short", encodeSeqCursor(42)},
+		{"too long", encodeCursor(id) + "AAAA"},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeCursor(tt.cursor); err == nil {
+				t.Errorf("decoded %q", tt.cursor)
+			}
+		})
+	}
+	if _, err := decodeSeqCursor(encodeCursor(id)); err == nil {
+		t.Error("decoded the cursor of MongoDB as a seq")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// The counters of the connection pools of the MongoDB client, kept by a
+// PoolMonitor, see https://www.mongodb.com/docs/drivers/go/current/fundamentals/monitoring/
+// The client has one pool per server of the deployment; the counters are
+// the sums of all of them.
+// A pool lends its connections to the operations (a "checkout") and creates
+// new ones as needed, up to the maximum size. When every connection is in
+// use, operations wait for one to come back: a long checkout means the pool
+// is too small for the load, or the database too slow.
+type poolStats struct {
+	maxSize uint64
+	minSize uint64
+
+	pools   atomic.Int64
+	open    atomic.Int64
+	inUse   atomic.Int64
+	waiting atomic.Int64
+	// Checkouts done, failed, e.g. on a timeout, and how long the done
+	// ones waited in total and at most, in nanoseconds
+	checkouts   atomic.Int64
+	failed      atomic.Int64
+	waitTotal   atomic.Int64
+	waitLongest atomic.Int64
+	// How often a server failed, and when it last did, as a Unix time
+	cleared     atomic.Int64
+	lastCleared atomic.Int64
+}
+
+// The pool monitor to give the client, see mongoConfig.clientOptions.
+func (s *poolStats) monitor() *event.PoolMonitor {
+	return &event.PoolMonitor{Event: func(e *event.PoolEvent) {
+		switch e.Type {
+		case event.PoolCreated:
+			s.pools.Add(1)
+		case event.PoolClosedEvent:
+			s.pools.Add(-1)
+		case event.PoolCleared:
+			// The server failed, its connections are closed
+			s.cleared.Add(1)
+			s.lastCleared.Store(time.Now().Unix())
+		case event.ConnectionCreated:
+			s.open.Add(1)
+		case event.ConnectionClosed:
+			s.open.Add(-1)
+		case event.GetStarted:
+			s.waiting.Add(1)
+		case event.GetSucceeded:
+			s.waiting.Add(-1)
+			s.inUse.Add(1)
+			s.checkouts.Add(1)
+			s.recordWait(e.Duration)
+		case event.GetFailed:
+			s.waiting.Add(-1)
+			s.failed.Add(1)
+		case event.ConnectionReturned:
+			s.inUse.Add(-1)
+		}
+	}}
+}
+
+func (s *poolStats) recordWait(wait time.Duration) {
+	s.waitTotal.Add(int64(wait))
+	for {
+		longest := s.waitLongest.Load()
+		if int64(wait) <= longest || s.waitLongest.CompareAndSwap(longest, int64(wait)) {
+			return
+		}
+	}
+}
+
+// The share of the connections in use, from 0 to 1: at 1, the operations
+// wait for each other.
+func (s *poolStats) saturation() float64 {
+	capacity := float64(s.maxSize) * float64(s.pools.Load())
+	if capacity == 0 {
+		return 0
+	}
+	return float64(s.inUse.Load()) / capacity
+}
+
+// Handles GET /api/admin/pool, the state of the pools and their counters
+// since the start. The durations are in milliseconds.
+func (s *poolStats) stats(c echo.Context) error {
+	checkouts := s.checkouts.Load()
+	var average float64
+	if checkouts > 0 {
+		average = float64(s.waitTotal.Load()) / float64(checkouts) / float64(time.Millisecond)
+	}
+	response := map[string]interface{}{
+		"maxPoolSize":       s.maxSize,
+		"minPoolSize":       s.minSize,
+		"pools":             s.pools.Load(),
+		"open":              s.open.Load(),
+		"inUse":             s.inUse.Load(),
+		"waiting":           s.waiting.Load(),
+		"saturation":        s.saturation(),
+		"checkouts":         checkouts,
+		"failedCheckouts":   s.failed.Load(),
+		"averageCheckoutMs": average,
+		"longestCheckoutMs": float64(s.waitLongest.Load()) / float64(time.Millisecond),
+		"cleared":           s.cleared.Load(),
+	}
+	if cleared := s.lastCleared.Load(); cleared != 0 {
+		response["lastCleared"] = time.Unix(cleared, 0).UTC().Format(time.RFC3339)
+	}
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Handlers do not write error responses themselves: they return an error,
+// and Echo hands it to problemErrorHandler, which answers with a "problem
+// details" document (https://www.rfc-editor.org/rfc/rfc7807):
+//
+//	HTTP/1.1 404 Not Found
+//	Content-Type: application/problem+json
+//
+//	{
+//	  "type": "about:blank",
+//	  "title": "Not Found",
+//	  "status": 404,
+//	  "detail": "book not found",
+//	  "instance": "/api/v1/books/example42",
+//	  "requestId": "0b1f6c1e-8f4e-4a57-9a4c-0f6e2a4f1f3d"
+//	}
+//
+// This way every error of the API looks the same, whichever handler failed.
+
+// The media type of problem details documents.
+const problemContentType = "application/problem+json"
+
+// An error carrying everything needed for its problem details response.
+// Instance and RequestID are filled in by problemErrorHandler, and cause, if any, is logged
+// but never shown to clients.
+type problemError struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// The X-Request-ID of the request, to quote when reporting the error,
+	// see requestid.go
+	RequestID string `json:"requestId,omitempty"`
+	// The invalid fields of a request body, see fieldErrors
+	Errors fieldErrors `json:"errors,omitempty"`
+
+	cause error
+	// When to try again, sent as Retry-After, if known
+	retryAfter time.Duration
+}
+
+func (p *problemError) Error() string {
+	if p.cause != nil {
+		return fmt.Sprintf("%d %s: %v", p.Status, p.Detail, p.cause)
+	}
+	return fmt.Sprintf("%d %s", p.Status, p.Detail)
+}
+
+func (p *problemError) Unwrap() error {
+	return p.cause
+}
+
+// A problem whose type is just its HTTP status, which is what the RFC calls
+// "about:blank". The title is then the status text, e.g. "Not Found".
+func newProblem(status int, detail string) *problemError {
+	return &problemError{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+// A 500 Internal Server Error caused by err, e.g. a failed database query.
+// Clients only see the detail; the cause ends up in the logs.
+func serverProblem(err error, detail string) *problemError {
+	p := newProblem(http.StatusInternalServerError, detail)
+	p.cause = err
+	return p
+}
+
+// Errors handlers can return as they are, without building a problem.
+var (
+	errBookNotFound  = errors.New("book not found")
+	errBookExists    = errors.New("another book with this ID exists")
+	errDuplicateBook = errors.New("duplicate book entry")
+	errBookModified  = errors.New("book was modified since it was read, fetch it again")
+	errInvalidCursor = errors.New("invalid cursor")
+)
+
+// The central mapping from the errors handlers return to the problems sent
+// to clients. Errors we know nothing about become a 500, without revealing
+// their message, unless the storage could not be reached: that is a 503,
+// which should not last, so the client may try again.
+func problemFor(err error) *problemError {
+	p := knownProblem(err)
+	if p.Status == http.StatusInternalServerError && storageUnavailable(err) {
+		p = newProblem(http.StatusServiceUnavailable, "the storage is unavailable, try again later")
+		p.cause = err
+		var open *circuitOpenError
+		if errors.As(err, &open) {
+			p.retryAfter = open.retryAfter
+		}
+	}
+	return p
+}
+
+// Whether the error tells that the storage is down or unreachable, rather
+// than that something is wrong with the request or with the server.
+func storageUnavailable(err error) bool {
+	switch {
+	case mongo.IsNetworkError(err), mongo.IsTimeout(err), errors.Is(err, mongo.ErrClientDisconnected):
+		return true
+	case errors.As(err, new(*circuitOpenError)):
+		// Refused without trying, see breaker.go
+		return true
+	case isPostgresUnavailable(err), isSQLiteBusy(err):
+		return true
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, sql.ErrConnDone):
+		return true
+	}
+	// Like a connection refused by PostgreSQL or Redis
+	var netErr *net.OpError
+	return errors.As(err, &netErr)
+}
+
+func knownProblem(err error) *problemError {
+	var p *problemError
+	if errors.As(err, &p) {
+		copied := *p
+		return &copied
+	}
+
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		// Raised by Echo itself, e.g. for unknown routes or bodies that
+		// cannot be parsed
+		detail := fmt.Sprint(httpErr.Message)
+		if detail == http.StatusText(httpErr.Code) {
+			detail = ""
+		}
+		p = newProblem(httpErr.Code, detail)
+		p.cause = httpErr.Internal
+		return p
+	}
+
+	var errs fieldErrors
+	if errors.As(err, &errs) {
+		p = newProblem(http.StatusUnprocessableEntity, "some fields are invalid")
+		p.Errors = errs
+		return p
+	}
+
+	switch {
+	case errors.Is(err, errBookNotFound), errors.Is(err, mongo.ErrNoDocuments):
+		return newProblem(http.StatusNotFound, "book not found")
+	case errors.Is(err, errBookExists), errors.Is(err, errDuplicateBook):
+		return newProblem(http.StatusConflict, err.Error())
+	case errors.Is(err, errBookModified):
+		return newProblem(http.StatusPreconditionFailed, err.Error())
+	case errors.Is(err, errInvalidCursor):
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+	return serverProblem(err, "internal server error")
+}
+
+// Replaces Echo's default error handler, so every error is answered with a
+// problem details document.
+func problemErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	p := problemFor(err)
+	p.Instance = c.Request().URL.RequestURI()
+	p.RequestID = requestID(c.Request().Context())
+	if p.Status >= http.StatusInternalServerError {
+		requestLogger(c).Error("could not answer a request", "status", p.Status, "error", err)
+	}
+	if p.retryAfter > 0 {
+		seconds := int(math.Ceil(p.retryAfter.Seconds()))
+		c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(seconds))
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(p.Status)
+	} else {
+		var encoded []byte
+		encoded, err = json.Marshal(p)
+		if err == nil {
+			err = c.Blob(p.Status, problemContentType, encoded)
+		}
+	}
+	if err != nil {
+		requestLogger(c).Error("could not send a problem", "error", err)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A publisher, stored in their own collection. Books reference their
+// publisher by ID (BookStore.PublisherID), set with PUT
+// /api/books/:id/publisher. As for authors, Key is the normalized name, which
+// is unique.
+type publisher struct {
+	ID        string    `bson:"_id"`
+	Name      string    `bson:"Name"`
+	Key       string    `bson:"Key"`
+	Country   string    `bson:"Country,omitempty"`
+	Website   string    `bson:"Website,omitempty"`
+	CreatedAt time.Time `bson:"CreatedAt"`
+	UpdatedAt time.Time `bson:"UpdatedAt,omitempty"`
+}
+
+// A publisher with the IDs of their books, as listed by GET /api/publishers.
+type publisherSummary struct {
+	publisher `bson:",inline"`
+	Count     int      `bson:"count"`
+	BookIDs   []string `bson:"books"`
+}
+
+// The longest value, in characters, each field of a publisher accepts.
+var maxPublisherFieldLengths = map[string]int{
+	"name":    200,
+	"country": 100,
+	"website": 300,
+}
+
+// The publishers, and the books referencing them.
+type publisherStore struct {
+	publishers *mongo.Collection
+	books      *mongo.Collection
+}
+
+// The unique index on Key keeps one publisher per name. Books are looked up
+// by PublisherID, see prepareIndexes.
+func preparePublisherIndexes(coll *mongo.Collection) error {
+	_, err := coll.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "Key", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// A publisher with the keys of the API.
+func publisherToAPI(p publisher) map[string]interface{} {
+	response := map[string]interface{}{
+		"id":   p.ID,
+		"name": p.Name,
+	}
+	if p.Country != "" {
+		response["country"] = p.Country
+	}
+	if p.Website != "" {
+		response["website"] = p.Website
+	}
+	// As for authors, see authorToAPI
+	if !p.CreatedAt.IsZero() {
+		response["createdAt"] = p.CreatedAt.UTC().Format(time.RFC3339)
+	}
+	if !p.UpdatedAt.IsZero() {
+		response["updatedAt"] = p.UpdatedAt.UTC().Format(time.RFC3339)
+	}
+	return response
+}
+
+// Builds a publisher from the body of a POST or PUT, which describes the
+// whole publisher: the name is required, the optional fields left out are
+// removed. The website must be an http or https URL.
+func publisherFromInput(input map[string]interface{}) (publisher, error) {
+	errs := fieldErrors{}
+	values := map[string]string{}
+	for key, raw := range input {
+		limit, ok := maxPublisherFieldLengths[key]
+		if key == "id" {
+			continue
+		}
+		if !ok {
+			errs[key] = "is not a field of a publisher"
+			continue
+		}
+		value, isString := raw.(string)
+		if !isString && raw != nil {
+			errs[key] = "must be a string"
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if utf8.RuneCountInString(value) > limit {
+			errs[key] = fmt.Sprintf("must be at most %d characters long", limit)
+			continue
+		}
+		values[key] = value
+	}
+	if _, invalid := errs["name"]; !invalid && values["name"] == "" {
+		errs["name"] = "is required"
+	}
+	if website := values["website"]; website != "" {
+		parsed, err := url.Parse(website)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			errs["website"] = "must be an http or https URL"
+		}
+	}
+	if len(errs) > 0 {
+		return publisher{}, errs
+	}
+	return publisher{
+		Name:    values["name"],
+		Key:     normalizeText(values["name"]),
+		Country: values["country"],
+		Website: values["website"],
+	}, nil
+}
+
+// Registers the routes of the publishers, and the ones linking a book to
+// its publisher. Reading is public; the writes get the given middleware, see
+// registerAPIv1.
+func (s *publisherStore) register(g *echo.Group, reads []echo.MiddlewareFunc, writes []echo.MiddlewareFunc) {
+	g.GET("/publishers", func(c echo.Context) error {
+		pipeline := append(bson.A{bson.M{"$sort": bson.M{"Key": 1}}}, lookupBookIDs(s.books, "PublisherID")...)
+		cursor, err := s.publishers.Aggregate(c.Request().Context(), pipeline)
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		var publishers []publisherSummary
+		if err = cursor.All(c.Request().Context(), &publishers); err != nil {
+			return serverProblem(err, "database error")
+		}
+		response := []map[string]interface{}{}
+		for _, summary := range publishers {
+			formatted := publisherToAPI(summary.publisher)
+			formatted["count"] = summary.Count
+			formatted["books"] = summary.BookIDs
+			response = append(response, formatted)
+		}
+		return c.JSON(http.StatusOK, response)
+	}, reads...)
+
+	g.GET("/publishers/:id", func(c echo.Context) error {
+		var found publisher
+		err := s.publishers.FindOne(c.Request().Context(), bson.M{"_id": c.Param("id")}).Decode(&found)
+		if err == mongo.ErrNoDocuments {
+			return newProblem(http.StatusNotFound, "publisher not found")
+		}
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		return c.JSON(http.StatusOK, publisherToAPI(found))
+	}, reads...)
+
+	g.POST("/publishers", func(c echo.Context) error {
+		var input map[string]interface{}
+		if err := c.Bind(&input); err != nil {
+			return newProblem(http.StatusBadRequest, "invalid request body")
+		}
+		created, err := publisherFromInput(input)
+		if err != nil {
+			return err
+		}
+		created.ID = primitive.NewObjectID().Hex()
+		created.CreatedAt = time.Now()
+		created.UpdatedAt = created.CreatedAt
+
+		_, err = s.publishers.InsertOne(c.Request().Context(), created)
+		if mongo.IsDuplicateKeyError(err) {
+			return newProblem(http.StatusConflict, "another publisher has this name")
+		}
+		if err != nil {
+			return serverProblem(err, "could not insert publisher")
+		}
+		return c.JSON(http.StatusCreated, publisherToAPI(created))
+	}, writes...)
+
+	g.PUT("/publishers/:id", func(c echo.Context) error {
+		id := c.Param("id")
+		var input map[string]interface{}
+		if err := bindBody(c, &input); err != nil {
+			return newProblem(http.StatusBadRequest, "invalid request body")
+		}
+		if bodyID, ok := input["id"]; ok && bodyID != id {
+			return fieldErrors{"id": "must be the ID of the URL"}
+		}
+		updated, err := publisherFromInput(input)
+		if err != nil {
+			return err
+		}
+
+		set := bson.M{"Name": updated.Name, "Key": updated.Key, "UpdatedAt": time.Now()}
+		unset := bson.M{}
+		for field, value := range map[string]string{"Country": updated.Country, "Website": updated.Website} {
+			if value == "" {
+				unset[field] = ""
+			} else {
+				set[field] = value
+			}
+		}
+		update := bson.M{"$set": set}
+		if len(unset) > 0 {
+			update["$unset"] = unset
+		}
+
+		err = s.publishers.FindOneAndUpdate(c.Request().Context(), bson.M{"_id": id}, update,
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&updated)
+		if mongo.IsDuplicateKeyError(err) {
+			return newProblem(http.StatusConflict, "another publisher has this name")
+		}
+		if err == mongo.ErrNoDocuments {
+			return newProblem(http.StatusNotFound, "publisher not found")
+		}
+		if err != nil {
+			return serverProblem(err, "failed to update publisher")
+		}
+		return c.JSON(http.StatusOK, publisherToAPI(updated))
+	}, writes...)
+
+	// Only publishers without books can be deleted, like authors
+	g.DELETE("/publishers/:id", func(c echo.Context) error {
+		id := c.Param("id")
+		count, err := s.books.CountDocuments(c.Request().Context(), live(bson.M{"PublisherID": id}))
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		if count > 0 {
+			return newProblem(http.StatusConflict, fmt.Sprintf("the publisher still has %d books", count))
+		}
+
+		result, err := s.publishers.DeleteOne(c.Request().Context(), bson.M{"_id": id})
+		if err != nil {
+			return serverProblem(err, "could not delete publisher")
+		}
+		if result.DeletedCount == 0 {
+			return newProblem(http.StatusNotFound, "publisher not found")
+		}
+		// Books in the trash forget the publisher
+		_, err = s.books.UpdateMany(c.Request().Context(),
+			bson.M{"PublisherID": id},
+			bson.M{"$unset": bson.M{"PublisherID": ""}},
+		)
+		if err != nil {
+			return serverProblem(err, "could not update the books of the publisher")
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "publisher deleted"})
+	}, writes...)
+
+	// Links a book to a publisher, with {"publisherId": "..."}
+	g.PUT("/books/:id/publisher", func(c echo.Context) error {
+		var input struct {
+			PublisherID string `json:"publisherId"`
+		}
+		if err := c.Bind(&input); err != nil {
+			return newProblem(http.StatusBadRequest, "invalid request body")
+		}
+		if input.PublisherID == "" {
+			return fieldErrors{"publisherId": "is required"}
+		}
+		count, err := s.publishers.CountDocuments(c.Request().Context(), bson.M{"_id": input.PublisherID})
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		if count == 0 {
+			return fieldErrors{"publisherId": "is not the ID of a publisher"}
+		}
+		return s.setPublisher(c, bson.M{"$set": bson.M{"PublisherID": input.PublisherID}})
+	}, writes...)
+}
+
+// Applies the update to the publisher of the book of the URL.
+func (s *publisherStore) setPublisher(c echo.Context, update bson.M) error {
+	update["$inc"] = bson.M{"Version": 1}
+	update["$currentDate"] = bson.M{"UpdatedAt": true}
+	result, err := s.books.UpdateOne(c.Request().Context(), live(bson.M{"ID": c.Param("id")}), update)
+	if err != nil {
+		return serverProblem(err, "failed to update book")
+	}
+	if result.MatchedCount == 0 {
+		return errBookNotFound
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "book updated"})
+}
+
+// Handles DELETE /api/books/:id/publisher, unlinking the book from its
+// publisher. The publisher itself stays.
+func (s *publisherStore) unlink(c echo.Context) error {
+	return s.setPublisher(c, bson.M{"$unset": bson.M{"PublisherID": ""}})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestPutPublisher(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"without the id", `{"name": "Ace Books", "country": "US"}`, http.StatusOK},
+		{"with the id of the URL", `{"id": "p1", "name": "Ace Books"}`, http.StatusOK},
+		{"with another id", `{"id": "p2", "name": "Ace Books"}`, http.StatusUnprocessableEntity},
+		{"without a name", `{"country": "US"}`, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withMockMongo(t, func(mt *mtest.T) {
+				publishers := &publisherStore{publishers: mt.Coll, books: mt.Coll}
+				e := echo.New()
+				e.HTTPErrorHandler = problemErrorHandler
+				publishers.register(e.Group("/api"), nil, nil)
+
+				mt.AddMockResponses(mockOK(bson.E{Key: "value", Value: bson.D{{Key: "_id", Value: "p1"}, {Key: "Name", Value: "Ace Books"}}}))
+				rec := sendJSON(e, http.MethodPut, "/api/publishers/p1", tt.body)
+				if rec.Code != tt.status {
+					t.Fatalf("got %d, want %d: %s", rec.Code, tt.status, rec.Body)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The API keys a listing can be sorted by. Each of them has an index, see
+// prepareIndexes.
+var sortableFields = []string{"title", "author", "year", "createdAt", "updatedAt"}
+
+// Reads `?sort=title|author|year|createdAt|updatedAt&order=asc|desc` into the field to sort by,
+// "" for the insertion order, and whether the order is descending.
+func parseSort(c echo.Context) (string, bool, error) {
+	descending := false
+	switch strings.ToLower(c.QueryParam("order")) {
+	case "", "asc":
+	case "desc":
+		descending = true
+	default:
+		return "", false, fmt.Errorf("order must be asc or desc")
+	}
+
+	sortKey := c.QueryParam("sort")
+	if sortKey != "" && !slices.Contains(sortableFields, sortKey) {
+		return "", false, fmt.Errorf("sort must be one of %s", strings.Join(sortableFields, ", "))
+	}
+	return sortKey, descending, nil
+}
+
+// Reads the filters of `?author=...&year=...&edition=...&tag=...`, and
+// `publisher=...`, the ID of a publisher, see mongoFilter, and
+// `created_since=...` or `updated_since=...`, a date like 2024-01-01 or a
+// time like 2024-01-01T12:00:00Z.
+// Parameters can be combined, and a book must match all of them; `tag` may be
+// given several times, for books having all these tags.
+// The author is matched case-insensitively anywhere in the name, so
+// `author=shelley` finds "Mary Shelley".
+func parseFilter(c echo.Context) (bookFilter, error) {
+	filter := bookFilter{
+		Author:    c.QueryParam("author"),
+		Publisher: c.QueryParam("publisher"),
+	}
+	if raw := c.QueryParam("year"); raw != "" {
+		year, err := strconv.Atoi(raw)
+		if err != nil {
+			return bookFilter{}, fmt.Errorf("year must be a number")
+		}
+		filter.Year = year
+	}
+	if edition := c.QueryParam("edition"); edition != "" {
+		filter.Edition = storedValue("edition", edition).(string)
+	}
+	for _, tag := range c.QueryParams()["tag"] {
+		if tag = normalizeTag(tag); tag != "" {
+			filter.Tags = append(filter.Tags, tag)
+		}
+	}
+	var err error
+	if filter.CreatedSince, err = parseSince(c, "created_since"); err != nil {
+		return bookFilter{}, err
+	}
+	if filter.UpdatedSince, err = parseSince(c, "updated_since"); err != nil {
+		return bookFilter{}, err
+	}
+	if filter.IncludeArchived, err = parseBoolParam(c, "include_archived"); err != nil {
+		return bookFilter{}, err
+	}
+	return filter, nil
+}
+
+// Reads a time like `?updated_since=2024-01-01`, zero when missing. A date is
+// the start of the day in UTC.
+func parseSince(c echo.Context, name string) (time.Time, error) {
+	raw := c.QueryParam(name)
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if since, err := time.Parse(layout, raw); err == nil {
+			return since, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%s must be a date like 2024-01-01 or a time like 2024-01-01T12:00:00Z", name)
+}
+
+// Reads a flag like `?fuzzy=true`, false when missing.
+func parseBoolParam(c echo.Context, name string) (bool, error) {
+	value := c.QueryParam(name)
+	if value == "" {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false", name)
+	}
+	return enabled, nil
+}
+
+// Reads `?fields=id,title,author` into the list of API keys to return. The
+// second value tells whether the parameter was given: without it, every
+// field is returned and the whole documents are read, see mongoProjection.
+func parseFields(c echo.Context) ([]string, bool, error) {
+	raw := c.QueryParam("fields")
+	if raw == "" {
+		return apiFields, false, nil
+	}
+
+	var fields []string
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSpace(field)
+		if _, ok := bookFields[field]; !ok {
+			return nil, false, fmt.Errorf("unknown field %q, fields must be among %s", field, strings.Join(apiFields, ", "))
+		}
+		if !slices.Contains(fields, field) {
+			fields = append(fields, field)
+		}
+	}
+	return fields, true, nil
+}
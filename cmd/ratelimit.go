@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// With RATE_LIMIT=true, each client may only make so many requests, so a
+// runaway script cannot keep the others from being served. A client is its
+// API key, when it sends a valid one, or else its IP address: a made-up key
+// does not get a bucket of its own. Its reads and its
+// writes are limited apart, by token buckets: a request takes a token, and
+// the tokens come back at RATE_LIMIT_READS or RATE_LIMIT_WRITES per minute,
+// up to the burst. A client without tokens left gets 429 Too Many Requests,
+// with a Retry-After header telling in how many seconds the next one comes.
+// The buckets are kept in memory, or in Redis with RATE_LIMIT_STORE=redis,
+// so the instances behind a load balancer share them. When Redis fails, the
+// requests go through rather than failing as well.
+
+// How fast a bucket fills and how many tokens it holds.
+type rateBudget struct {
+	perMinute int
+	burst     int
+}
+
+// The tokens coming back every second.
+func (b rateBudget) rate() float64 {
+	return float64(b.perMinute) / 60
+}
+
+// How long the bucket takes to get the tokens back.
+func (b rateBudget) until(tokens float64) time.Duration {
+	return time.Duration(tokens / b.rate() * float64(time.Second))
+}
+
+// Where the buckets are kept.
+type bucketStore interface {
+	// Takes a token from the bucket of key, which is full the first time.
+	// Without a token left, returns how long until the next one, and 0
+	// otherwise.
+	take(ctx context.Context, key string, budget rateBudget) (time.Duration, error)
+}
+
+type rateLimiter struct {
+	reads  rateBudget
+	writes rateBudget
+	store  bucketStore
+	// Checks the API keys, see rateLimiter.client
+	auth *authenticator
+	keys *keyChecks
+	// Where the address of the client comes from
+	trustProxy bool
+}
+
+// The limiter of the settings. The Redis client is the one of the cache, see
+// responseCache.
+func newRateLimiter(settings config.RateLimit, client *redis.Client, auth *authenticator) *rateLimiter {
+	limiter := &rateLimiter{
+		reads:      rateBudget{perMinute: settings.Reads, burst: settings.ReadBurst},
+		writes:     rateBudget{perMinute: settings.Writes, burst: settings.WriteBurst},
+		auth:       auth,
+		keys:       &keyChecks{checked: map[string]keyCheck{}},
+		trustProxy: settings.TrustProxy,
+	}
+	if settings.Store == "redis" {
+		limiter.store = &redisBuckets{client: client}
+	} else {
+		limiter.store = &memoryBuckets{buckets: map[string]*tokenBucket{}}
+	}
+	return limiter
+}
+
+func (l *rateLimiter) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		budget, kind := l.writes, "write"
+		switch c.Request().Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			budget, kind = l.reads, "read"
+		}
+		if budget.perMinute == 0 {
+			return next(c)
+		}
+
+		key := "ratelimit:" + kind + ":" + l.client(c)
+		wait, err := l.store.take(c.Request().Context(), key, budget)
+		if err != nil {
+			requestLogger(c).Error("could not check the rate limit", "error", err)
+			return next(c)
+		}
+		if wait > 0 {
+			seconds := int(math.Ceil(wait.Seconds()))
+			c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(seconds))
+			return newProblem(http.StatusTooManyRequests,
+				fmt.Sprintf("too many %ss, try again in %d seconds", kind, seconds))
+		}
+		return next(c)
+	}
+}
+
+// Who the request comes from: a hash of its API key, which must not end up
+// in Redis, or its IP address. The key is only looked at, whatever the other
+// credentials of the request, once it is known to be valid; an invalid one,
+// or one we cannot check, counts for the address. What a key turned out to
+// be is remembered for a while, see keyChecks, so the limiter does not look
+// it up in MongoDB on every request.
+func (l *rateLimiter) client(c echo.Context) string {
+	if key := c.Request().Header.Get(apiKeyHeader); key != "" {
+		sum := sha256.Sum256([]byte(key))
+		hash := base64.RawURLEncoding.EncodeToString(sum[:16])
+		valid, known := l.keys.get(hash, time.Now())
+		if !known {
+			// A failed lookup says nothing of the key, so it is tried again
+			// the next time
+			if found, err := l.auth.keys.lookup(c.Request().Context(), key); err == nil {
+				valid = found != nil
+				l.keys.set(hash, valid, time.Now())
+			}
+		}
+		if valid {
+			return "key:" + hash
+		}
+	}
+	if l.trustProxy {
+		return "ip:" + c.RealIP()
+	}
+	return "ip:" + echo.ExtractIPDirect()(c.Request())
+}
+
+// How long the limiter trusts what it found out about an API key. A key
+// revoked meanwhile keeps its bucket that long, which only changes whose
+// requests it counts: the key itself no longer gets a request through.
+const keyCheckTTL = time.Minute
+
+// The API keys the limiter has looked up, by their hash.
+type keyChecks struct {
+	mu        sync.Mutex
+	checked   map[string]keyCheck
+	lastSweep time.Time
+}
+
+type keyCheck struct {
+	valid bool
+	until time.Time
+}
+
+// Whether the key is valid, and whether we know it at all.
+func (k *keyChecks) get(hash string, now time.Time) (valid bool, known bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	check, ok := k.checked[hash]
+	if !ok || now.After(check.until) {
+		return false, false
+	}
+	return check.valid, true
+}
+
+func (k *keyChecks) set(hash string, valid bool, now time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	// Like memoryBuckets.sweep, so made-up keys do not stay in memory
+	if now.Sub(k.lastSweep) >= time.Minute {
+		k.lastSweep = now
+		for key, check := range k.checked {
+			if now.After(check.until) {
+				delete(k.checked, key)
+			}
+		}
+	}
+	k.checked[hash] = keyCheck{valid: valid, until: now.Add(keyCheckTTL)}
+}
+
+// The buckets of this instance.
+type memoryBuckets struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	// When it is full again, unless it is used
+	fullAt time.Time
+}
+
+func (m *memoryBuckets) take(_ context.Context, key string, budget rateBudget) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.sweep(now)
+
+	bucket, ok := m.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(budget.burst), updated: now}
+		m.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(budget.burst), bucket.tokens+now.Sub(bucket.updated).Seconds()*budget.rate())
+	bucket.updated = now
+	wait := time.Duration(0)
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+	} else {
+		wait = budget.until(1 - bucket.tokens)
+	}
+	bucket.fullAt = now.Add(budget.until(float64(budget.burst) - bucket.tokens))
+	return wait, nil
+}
+
+// Once a minute, forgets the buckets full again, which is the same as having
+// none, so the clients seen once do not stay in memory for ever.
+func (m *memoryBuckets) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < time.Minute {
+		return
+	}
+	m.lastSweep = now
+	for key, bucket := range m.buckets {
+		if now.After(bucket.fullAt) {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// The buckets in Redis: a hash per bucket, with its tokens and the time they
+// were counted, which expires once the bucket is full again.
+type redisBuckets struct {
+	client *redis.Client
+}
+
+// Updates a bucket at once, so two instances cannot take the same token.
+// The time is the one of Redis, the same for all the instances.
+var takeToken = redis.NewScript(`
+redis.replicate_commands()
+local rate = tonumber(ARGV[1]) / 1000
+local burst = tonumber(ARGV[2])
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local tokens = tonumber(redis.call("HGET", KEYS[1], "tokens"))
+local updated = tonumber(redis.call("HGET", KEYS[1], "updated"))
+if tokens == nil or updated == nil then
+	tokens, updated = burst, now
+end
+tokens = math.min(burst, tokens + (now - updated) * rate)
+
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) / rate)
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "updated", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate))
+return wait
+`)
+
+func (r *redisBuckets) take(ctx context.Context, key string, budget rateBudget) (time.Duration, error) {
+	wait, err := takeToken.Run(ctx, r.client, []string{key}, budget.rate(), budget.burst).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestRateLimiterClient(t *testing.T) {
+	tests := []struct {
+		name string
+		// The key found in MongoDB, if any
+		found  bson.D
+		prefix string
+	}{
+		{"with a valid key", bson.D{{Key: "_id", Value: "k1"}, {Key: "Name", Value: "ci"}}, "key:"},
+		{"with a made-up key", nil, "ip:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withMockMongo(t, func(mt *mtest.T) {
+				auth := &authenticator{keys: newAPIKeyAuth(mt.Coll, "")}
+				limiter := newRateLimiter(config.RateLimit{Reads: 60, ReadBurst: 10}, nil, auth)
+				if tt.found != nil {
+					mt.AddMockResponses(mockCursor(mt, tt.found))
+				} else {
+					mt.AddMockResponses(mockCursor(mt))
+				}
+
+				// Only the first request looks the key up: there is no
+				// response for a second find
+				for i := 0; i < 3; i++ {
+					req := httptest.NewRequest(http.MethodGet, "/api/books", nil)
+					req.Header.Set(apiKeyHeader, "some-key")
+					client := limiter.client(echo.New().NewContext(req, httptest.NewRecorder()))
+					if !strings.HasPrefix(client, tt.prefix) {
+						t.Errorf("request %d: got the client %q, want %s...", i, client, tt.prefix)
+					}
+				}
+				if sent := sentCommands(mt); len(sent) != 1 {
+					t.Errorf("sent %v, want a single find", sent)
+				}
+			})
+		})
+	}
+}
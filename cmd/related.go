@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How many related books we suggest when the client does not say.
+const defaultRelatedCount = 10
+
+// A book related to another one, with the reasons why: "author" for the
+// same author, "title" for a similar title, "decade" for the same decade.
+type relatedBook struct {
+	BookStore
+	Reasons []string
+}
+
+// What each reason weighs when ranking the related books: a book by the
+// same author is the best suggestion, one of the same decade the weakest.
+var relatedReasons = []string{"author", "title", "decade"}
+
+// Finds up to limit other books by the same author, with a similar title
+// (through the text search) or from the same decade. Books related in
+// several ways come first, then those sharing the stronger reasons, see
+// relatedReasons.
+func (s *bookSearch) related(ctx context.Context, book BookStore, limit int64) ([]relatedBook, error) {
+	others := listed(bson.M{"ID": bson.M{"$ne": book.ID}})
+	found := map[string]*relatedBook{}
+	var order []string
+	add := func(reason string, books []BookStore) {
+		for _, other := range books {
+			if found[other.ID] == nil {
+				found[other.ID] = &relatedBook{BookStore: other}
+				order = append(order, other.ID)
+			}
+			found[other.ID].Reasons = append(found[other.ID].Reasons, reason)
+		}
+	}
+
+	// Books by any of its authors
+	if len(book.BookAuthors) > 0 {
+		byAuthor, err := s.findRelated(ctx, bson.M{"BookAuthor": bson.M{"$in": book.BookAuthors}}, others, limit)
+		if err != nil {
+			return nil, err
+		}
+		add("author", byAuthor)
+	}
+
+	hits, err := s.search(ctx, book.BookName, others, limit)
+	if err != nil {
+		return nil, err
+	}
+	var byTitle []BookStore
+	for _, hit := range hits {
+		byTitle = append(byTitle, hit.BookStore)
+	}
+	add("title", byTitle)
+
+	if book.BookYear > 0 {
+		start := book.BookYear - book.BookYear%10
+		decade := bson.M{"BookYear": bson.M{"$gte": start, "$lt": start + 10}}
+		byDecade, err := s.findRelated(ctx, decade, others, limit)
+		if err != nil {
+			return nil, err
+		}
+		add("decade", byDecade)
+	}
+
+	related := []relatedBook{}
+	for _, id := range order {
+		related = append(related, *found[id])
+	}
+	// A stable sort keeps the order of the queries among equals
+	slices.SortStableFunc(related, func(a, b relatedBook) int {
+		if len(a.Reasons) != len(b.Reasons) {
+			return len(b.Reasons) - len(a.Reasons)
+		}
+		return slices.Index(relatedReasons, a.Reasons[0]) - slices.Index(relatedReasons, b.Reasons[0])
+	})
+	if int64(len(related)) > limit {
+		related = related[:limit]
+	}
+	return related, nil
+}
+
+func (s *bookSearch) findRelated(ctx context.Context, filter bson.M, others bson.M, limit int64) ([]BookStore, error) {
+	cursor, err := s.coll.Find(ctx, bson.M{"$and": bson.A{filter, others}}, options.Find().SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	var books []BookStore
+	if err = cursor.All(ctx, &books); err != nil {
+		return nil, err
+	}
+	return books, nil
+}
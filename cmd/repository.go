@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The operations on the books the main routes of the API need, whatever
+// stores them: listing, reading, creating, replacing, deleting and searching
+// books. The handlers of these routes only know this interface, so another
+// database, or a fake one in a test, can take the place of MongoDB. The more
+// specialized routes, like the batches, the patches or the tags, still work
+// on the collection.
+// Every method only sees the live books, see trash.go. Besides failures of
+// the database, the methods return the errors of problem.go: errBookNotFound,
+// errBookExists, errDuplicateBook, errBookModified and errInvalidCursor.
+// The context is the one of the request, see requestid.go.
+type BookRepository interface {
+	// One page of the books matching the query
+	FindAll(ctx context.Context, query bookQuery) (bookList, error)
+	FindByID(ctx context.Context, id string) (BookStore, error)
+	// Adds a book, unless another one has its ID or the very same fields
+	Insert(ctx context.Context, book BookStore) error
+	// Replaces the book with the given ID. With versions, the book is only
+	// replaced if it is in one of them, see parseIfMatch.
+	Update(ctx context.Context, id string, book BookStore, versions []int64) error
+	// Moves the book to the trash, with the same condition as Update
+	Delete(ctx context.Context, id string, versions []int64) error
+	// Archives the book, or takes it out of the archive, with the same
+	// condition as Update, see archive.go
+	Archive(ctx context.Context, id string, archived bool, versions []int64) error
+	// The books best matching the words of the query, best first
+	Search(ctx context.Context, query string, filter bookFilter, limit int64) ([]searchHit, error)
+}
+
+// The filters of a listing, see parseFilter. Empty fields do not filter.
+type bookFilter struct {
+	// Any part of the name of an author, ignoring case
+	Author string
+	Year   int
+	// As stored, see storedValue
+	Edition   string
+	Publisher string
+	// The book must have all of them
+	Tags []string
+	// The books added, or changed, at this time or later
+	CreatedSince time.Time
+	UpdatedSince time.Time
+	// Also lists the archived books, see archive.go
+	IncludeArchived bool
+}
+
+func (f bookFilter) isEmpty() bool {
+	return f.Author == "" && f.Year == 0 && f.Edition == "" && f.Publisher == "" && len(f.Tags) == 0 &&
+		f.CreatedSince.IsZero() && f.UpdatedSince.IsZero() && !f.IncludeArchived
+}
+
+// What GET /api/books asks for.
+type bookQuery struct {
+	Filter bookFilter
+	// One of sortableFields, "" for the insertion order
+	Sort       string
+	Descending bool
+	// The API keys of the fields to read, nil for all of them
+	Fields []string
+	// In cursor mode, the page starts after the cursor After, given by the
+	// previous page, "" for the first one; otherwise it starts at Offset
+	Cursor bool
+	After  string
+	Offset int64
+	Limit  int64
+}
+
+// A page of books. Total is the number of books matching the query, in
+// offset mode; Next the cursor of the next page, in cursor mode, "" on the
+// last page.
+type bookList struct {
+	Books []BookStore
+	Total int64
+	Next  string
+}
+
+// The error a handler returns for an error of a BookRepository: the errors
+// of problem.go as they are, anything else as a failure of the database.
+func repositoryError(err error, detail string) error {
+	for _, known := range []error{errBookNotFound, errBookExists, errDuplicateBook, errBookModified, errInvalidCursor} {
+		if errors.Is(err, known) {
+			return err
+		}
+	}
+	return serverProblem(err, detail)
+}
+
+// The repository of the main routes, chosen with STORAGE: "mongo", the
+// default, for the books collection, "postgres" for the database at
+// POSTGRES_URL, see postgres.go, or "sqlite" for the file at SQLITE_PATH,
+// see sqlite.go.
+func openBookRepository(settings config.Storage, coll *mongo.Collection, listings *mongo.Collection, search *bookSearch, revisions *revisionStore) (BookRepository, error) {
+	switch settings.Kind {
+	case "mongo":
+		return &mongoBookRepository{coll: coll, listings: listings, search: search, revisions: revisions}, nil
+	case "postgres":
+		return openPostgresRepository(settings.PostgresURL)
+	case "sqlite":
+		return openSQLiteRepository(settings.SQLitePath)
+	default:
+		return nil, fmt.Errorf("STORAGE must be mongo, postgres or sqlite, not %q", settings.Kind)
+	}
+}
+
+// The BookRepository of the books collection, searched by bookSearch. Every
+// update keeps the book as it was, see revisions.go. FindAll reads from
+// listings, the same collection with the read preference of the listings,
+// see mongoConfig.listings.
+type mongoBookRepository struct {
+	coll      *mongo.Collection
+	listings  *mongo.Collection
+	search    *bookSearch
+	revisions *revisionStore
+}
+
+// The MongoDB filter of a bookFilter. Year and edition must match exactly,
+// which lets MongoDB answer them from the indexes.
+func mongoFilter(f bookFilter) bson.M {
+	filter := bson.M{}
+	if f.Author != "" {
+		filter[bookFields["author"]] = bson.M{
+			"$regex":   regexp.QuoteMeta(f.Author),
+			"$options": "i",
+		}
+	}
+	if f.Year != 0 {
+		filter[bookFields["year"]] = f.Year
+	}
+	if f.Edition != "" {
+		filter[bookFields["edition"]] = f.Edition
+	}
+	if f.Publisher != "" {
+		filter["PublisherID"] = f.Publisher
+	}
+	if len(f.Tags) > 0 {
+		filter["Tags"] = bson.M{"$all": f.Tags}
+	}
+	if !f.CreatedSince.IsZero() {
+		filter["CreatedAt"] = bson.M{"$gte": f.CreatedSince}
+	}
+	if !f.UpdatedSince.IsZero() {
+		filter["UpdatedAt"] = bson.M{"$gte": f.UpdatedSince}
+	}
+	if !f.IncludeArchived {
+		filter["Archived"] = bson.M{"$ne": true}
+	}
+	return filter
+}
+
+// The MongoDB sort of a query. Without a sort field, books come in insertion
+// order, which for MongoIDs is the same as sorting by _id. The MongoID is
+// always the last sort key, so books sharing the same author or year still
+// have a stable order.
+func mongoSort(query bookQuery) bson.D {
+	direction := 1
+	if query.Descending {
+		direction = -1
+	}
+	if query.Sort == "" {
+		return bson.D{{Key: "_id", Value: direction}}
+	}
+	return bson.D{
+		{Key: sortField(query.Sort), Value: direction},
+		{Key: "_id", Value: direction},
+	}
+}
+
+// The projection reading only the given fields, so the database does not
+// even send us the others; nil, i.e. whole documents, without fields.
+func mongoProjection(fields []string) bson.M {
+	if fields == nil {
+		return nil
+	}
+	projection := bson.M{}
+	for _, field := range fields {
+		projection[bookFields[field]] = 1
+	}
+	return projection
+}
+
+func (r *mongoBookRepository) FindAll(ctx context.Context, query bookQuery) (bookList, error) {
+	filter := mongoFilter(query.Filter)
+	projection := mongoProjection(query.Fields)
+	if query.Cursor {
+		return r.findAfter(ctx, filter, projection, query.After, query.Limit)
+	}
+	return r.findPage(ctx, filter, projection, mongoSort(query), query.Offset, query.Limit)
+}
+
+// Same as findAllBooks, but only returns one "page" of the collection: we skip
+// the first `offset` documents and return at most `limit` of them. The sort
+// always ends with the MongoID, which keeps the order stable between two
+// requests, otherwise MongoDB is free to return equal books in any order.
+// The total is the number of books matching the filter, so clients know how
+// many pages there are.
+// A nil projection returns whole documents.
+func (r *mongoBookRepository) findPage(ctx context.Context, filter bson.M, projection bson.M, sort bson.D, offset int64, limit int64) (bookList, error) {
+	filter = live(filter)
+	total, err := r.listings.CountDocuments(ctx, filter, countOptions(ctx))
+	if err != nil {
+		return bookList{}, err
+	}
+
+	opts := findOptions(ctx).
+		SetSort(sort).
+		SetSkip(offset).
+		SetLimit(limit)
+	if projection != nil {
+		opts.SetProjection(projection)
+	}
+	cursor, err := r.listings.Find(ctx, filter, opts)
+	if err != nil {
+		return bookList{}, err
+	}
+	var results []BookStore
+	if err = cursor.All(ctx, &results); err != nil {
+		return bookList{}, err
+	}
+
+	return bookList{Books: results, Total: total}, nil
+}
+
+// The cursor flavour of findPage. Instead of skipping documents, which
+// forces MongoDB to walk over all of them, we continue right after the last
+// MongoID the client has seen. The _id field is always indexed, so this costs
+// the same on the first page as on the thousandth one.
+// We ask for one book more than requested: if it exists, there is a next page
+// and we return the cursor pointing at the last book of this page.
+// The MongoID is part of every projection unless excluded explicitly, so the
+// cursor can always be built.
+func (r *mongoBookRepository) findAfter(ctx context.Context, filter bson.M, projection bson.M, after string, limit int64) (bookList, error) {
+	filter = live(filter)
+	if after != "" {
+		id, err := decodeCursor(after)
+		if err != nil {
+			return bookList{}, errInvalidCursor
+		}
+		filter["_id"] = bson.M{"$gt": id}
+	}
+
+	opts := findOptions(ctx).
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(limit + 1)
+	if projection != nil {
+		opts.SetProjection(projection)
+	}
+	cursor, err := r.listings.Find(ctx, filter, opts)
+	if err != nil {
+		return bookList{}, err
+	}
+	var results []BookStore
+	if err = cursor.All(ctx, &results); err != nil {
+		return bookList{}, err
+	}
+
+	next := ""
+	if int64(len(results)) > limit {
+		results = results[:limit]
+		next = encodeCursor(results[len(results)-1].MongoID)
+	}
+
+	return bookList{Books: results, Next: next}, nil
+}
+
+func (r *mongoBookRepository) FindByID(ctx context.Context, id string) (BookStore, error) {
+	var book BookStore
+	err := r.coll.FindOne(ctx, live(bson.M{"ID": id}), findOneOptions(ctx)).Decode(&book)
+	if err == mongo.ErrNoDocuments {
+		return BookStore{}, errBookNotFound
+	}
+	return book, err
+}
+
+func (r *mongoBookRepository) Insert(ctx context.Context, book BookStore) error {
+	count, err := r.coll.CountDocuments(ctx, live(duplicateFilter(book)), countOptions(ctx))
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errDuplicateBook
+	}
+
+	// The unique index on the ID has the last word, see prepareIndexes
+	_, err = r.coll.InsertOne(ctx, book, insertOneOptions(ctx))
+	if mongo.IsDuplicateKeyError(err) {
+		return errBookExists
+	}
+	return err
+}
+
+func (r *mongoBookRepository) Update(ctx context.Context, id string, book BookStore, versions []int64) error {
+	before, err := r.updateOne(ctx, id, replaceUpdate(book), versions)
+	if err != nil {
+		return err
+	}
+	r.revisions.record(ctx, before)
+	return nil
+}
+
+func (r *mongoBookRepository) Delete(ctx context.Context, id string, versions []int64) error {
+	_, err := r.updateOne(ctx, id, trashUpdate(), versions)
+	return err
+}
+
+func (r *mongoBookRepository) Archive(ctx context.Context, id string, archived bool, versions []int64) error {
+	_, err := r.updateOne(ctx, id, archiveUpdate(archived), versions)
+	return err
+}
+
+// Applies the update to the live book with the given ID, if it is in one of
+// the versions, and returns the book as it was before.
+func (r *mongoBookRepository) updateOne(ctx context.Context, id string, update bson.M, versions []int64) (BookStore, error) {
+	filter := live(bson.M{"ID": id})
+	if versions != nil {
+		matchVersions(filter, versions)
+	}
+	var before BookStore
+	err := r.coll.FindOneAndUpdate(ctx, filter, update, findOneAndUpdateOptions(ctx)).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		if versions != nil {
+			return BookStore{}, notFoundOrPreconditionFailed(ctx, r.coll, id)
+		}
+		return BookStore{}, errBookNotFound
+	}
+	return before, err
+}
+
+func (r *mongoBookRepository) Search(ctx context.Context, query string, filter bookFilter, limit int64) ([]searchHit, error) {
+	return r.search.search(ctx, query, mongoFilter(filter), limit)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Every request gets an ID, in its X-Request-ID header: the one the client
+// or a proxy in front of the server sent, or a new UUID. The response sends
+// it back, the problem documents have it as requestId, every message logged
+// for the request tells it, see requestLogger, and so do the operations on
+// the books in MongoDB, as their comment, which the profiler and the slow
+// query log of MongoDB show, e.g.
+//
+//	db.system.profile.find({"command.comment": "request 0b1f..."})
+//
+// so a failed request can be followed from the client down to the database.
+
+// The longest request ID accepted from a client. Longer ones, or those with
+// other characters than letters, digits and -_.:, are replaced, so nobody
+// can write what they want into the logs.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// Gives the request its ID, see above, and keeps it in the context of the
+// request.
+func assignRequestID(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.Request().Header.Get(echo.HeaderXRequestID)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		c.Response().Header().Set(echo.HeaderXRequestID, id)
+		ctx := context.WithValue(c.Request().Context(), requestIDKey{}, id)
+		c.SetRequest(c.Request().WithContext(ctx))
+		return next(c)
+	}
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.', r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// The ID of the request the context belongs to, "" for the work the server
+// does on its own, like the migrations.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// The comment of the MongoDB operations run for the request of ctx.
+func mongoComment(ctx context.Context) string {
+	return "request " + requestID(ctx)
+}
+
+// The options of the operations on the books, with the comment of the
+// request of ctx, if any.
+
+func findOptions(ctx context.Context) *options.FindOptions {
+	opts := options.Find()
+	if requestID(ctx) != "" {
+		opts.SetComment(mongoComment(ctx))
+	}
+	return opts
+}
+
+func findOneOptions(ctx context.Context) *options.FindOneOptions {
+	opts := options.FindOne()
+	if requestID(ctx) != "" {
+		opts.SetComment(mongoComment(ctx))
+	}
+	return opts
+}
+
+func findOneAndUpdateOptions(ctx context.Context) *options.FindOneAndUpdateOptions {
+	opts := options.FindOneAndUpdate()
+	if requestID(ctx) != "" {
+		opts.SetComment(mongoComment(ctx))
+	}
+	return opts
+}
+
+func countOptions(ctx context.Context) *options.CountOptions {
+	opts := options.Count()
+	if requestID(ctx) != "" {
+		opts.SetComment(mongoComment(ctx))
+	}
+	return opts
+}
+
+func insertOneOptions(ctx context.Context) *options.InsertOneOptions {
+	opts := options.InsertOne()
+	if requestID(ctx) != "" {
+		opts.SetComment(mongoComment(ctx))
+	}
+	return opts
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Some errors of MongoDB only last a moment: a connection cut, or a primary
+// stepping down while the replica set elects another, which takes a few
+// seconds. The operations of the main routes are tried again then, up to
+// MONGO_OPERATION_RETRIES times, rather than failing the request at once.
+// Before each retry, the repository waits a random time, up to
+// MONGO_OPERATION_RETRY_DELAY the first time and twice as long every time
+// after, so the instances retrying together do not all hit MongoDB at the
+// same moment again.
+//
+// The reads are tried again after any of these errors. The updates, the
+// deletions and the archiving are only tried again when MongoDB tells that
+// it did not apply them, see notApplied: after a connection cut, the first
+// attempt may have worked, and trying it again would fail on the version it
+// changed. The inserts never are, their retry would find the book it added.
+// The driver already tries each operation a second time by itself, see
+// https://www.mongodb.com/docs/manual/core/retryable-writes/; this comes on
+// top, for the elections longer than that.
+
+// The longest wait between two attempts.
+const maxOperationRetryDelay = 2 * time.Second
+
+// The codes of the errors of MongoDB telling that the server is not, or no
+// longer, the primary, or is shutting down: it did not do what it was asked.
+var notPrimaryCodes = []int{
+	91,    // ShutdownInProgress
+	189,   // PrimarySteppedDown
+	10107, // NotWritablePrimary
+	11600, // InterruptedAtShutdown
+	11602, // InterruptedDueToReplStateChange
+	13435, // NotPrimaryNoSecondaryOk
+	13436, // NotPrimaryOrSecondary
+}
+
+// Whether MongoDB did not apply the operation, and could on another try.
+func notApplied(err error) bool {
+	var serverErr mongo.ServerError
+	if !errors.As(err, &serverErr) {
+		return false
+	}
+	// Not the RetryableWriteError label: the driver puts it on the
+	// connections cut as well
+	for _, code := range notPrimaryCodes {
+		if serverErr.HasErrorCode(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a read failed for a reason that may be gone on another try.
+func transient(err error) bool {
+	return notApplied(err) || mongo.IsNetworkError(err)
+}
+
+// A BookRepository trying its operations again, see above.
+type retryRepository struct {
+	repo     BookRepository
+	attempts int
+	delay    time.Duration
+	// Called before each retry, for the metrics
+	retried func(operation string)
+}
+
+func newRetryRepository(repo BookRepository, settings config.Mongo, retried func(operation string)) *retryRepository {
+	return &retryRepository{
+		repo:     repo,
+		attempts: settings.OperationRetries + 1,
+		delay:    settings.OperationRetryDelay,
+		retried:  retried,
+	}
+}
+
+// Runs call until it works, fails for good, or runs out of attempts, or the
+// request is cancelled. retryable tells which errors are worth another try.
+func retried[T any](r *retryRepository, ctx context.Context, operation string, retryable func(error) bool, call func() (T, error)) (T, error) {
+	delay := r.delay
+	for attempt := 1; ; attempt++ {
+		result, err := call()
+		if err == nil || attempt == r.attempts || !retryable(err) {
+			return result, err
+		}
+
+		// Full jitter, see
+		// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+		wait := time.Duration(rand.Int64N(int64(delay)) + 1)
+		slog.Debug("trying an operation of the storage again", "operation", operation, "attempt", attempt+1, "wait", wait,
+			"request_id", requestID(ctx), "error", err)
+		r.retried(operation)
+		select {
+		case <-ctx.Done():
+			return result, err
+		case <-time.After(wait):
+		}
+		delay = min(2*delay, maxOperationRetryDelay)
+	}
+}
+
+func retriedErr(r *retryRepository, ctx context.Context, operation string, retryable func(error) bool, call func() error) error {
+	_, err := retried(r, ctx, operation, retryable, func() (struct{}, error) {
+		return struct{}{}, call()
+	})
+	return err
+}
+
+func (r *retryRepository) FindAll(ctx context.Context, query bookQuery) (bookList, error) {
+	return retried(r, ctx, "find_all", transient, func() (bookList, error) {
+		return r.repo.FindAll(ctx, query)
+	})
+}
+
+func (r *retryRepository) FindByID(ctx context.Context, id string) (BookStore, error) {
+	return retried(r, ctx, "find_by_id", transient, func() (BookStore, error) {
+		return r.repo.FindByID(ctx, id)
+	})
+}
+
+func (r *retryRepository) Insert(ctx context.Context, book BookStore) error {
+	return r.repo.Insert(ctx, book)
+}
+
+func (r *retryRepository) Update(ctx context.Context, id string, book BookStore, versions []int64) error {
+	return retriedErr(r, ctx, "update", notApplied, func() error {
+		return r.repo.Update(ctx, id, book, versions)
+	})
+}
+
+func (r *retryRepository) Delete(ctx context.Context, id string, versions []int64) error {
+	return retriedErr(r, ctx, "delete", notApplied, func() error {
+		return r.repo.Delete(ctx, id, versions)
+	})
+}
+
+func (r *retryRepository) Archive(ctx context.Context, id string, archived bool, versions []int64) error {
+	return retriedErr(r, ctx, "archive", notApplied, func() error {
+		return r.repo.Archive(ctx, id, archived, versions)
+	})
+}
+
+func (r *retryRepository) Search(ctx context.Context, query string, filter bookFilter, limit int64) ([]searchHit, error) {
+	return retried(r, ctx, "search", transient, func() ([]searchHit, error) {
+		return r.repo.Search(ctx, query, filter, limit)
+	})
+}
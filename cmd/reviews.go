@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The longest review text, in characters.
+const maxReviewLength = 5000
+
+// A review of a book by a logged in user, who has at most one review per
+// book. The rating goes from 1 to 5 stars, the text is optional.
+type review struct {
+	ID        string    `bson:"_id" json:"id"`
+	BookID    string    `bson:"BookID" json:"bookId"`
+	Username  string    `bson:"Username" json:"author"`
+	Rating    int       `bson:"Rating" json:"rating"`
+	Text      string    `bson:"Text,omitempty" json:"text,omitempty"`
+	CreatedAt time.Time `bson:"CreatedAt" json:"createdAt"`
+	UpdatedAt time.Time `bson:"UpdatedAt,omitempty" json:"updatedAt,omitempty"`
+}
+
+// The average rating of a book and the number of reviews it is based on,
+// stored with the book so that listing books does not need the reviews.
+type ratingSummary struct {
+	Average float64 `bson:"Average" json:"average"`
+	Count   int     `bson:"Count" json:"count"`
+}
+
+// The reviews, stored in their own collection, and the books they are about.
+type reviewStore struct {
+	reviews *mongo.Collection
+	books   *mongo.Collection
+}
+
+// The unique index keeps one review per user and book, and serves listing
+// the reviews of a book.
+func prepareReviewIndexes(coll *mongo.Collection) error {
+	_, err := coll.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "BookID", Value: 1}, {Key: "Username", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// Reads the rating and the text of a review from the body of a POST or PUT.
+func reviewFromInput(input map[string]interface{}) (review, error) {
+	errs := fieldErrors{}
+	var result review
+	for key, raw := range input {
+		switch key {
+		case "rating":
+			rating, ok := raw.(float64)
+			if !ok || rating != math.Trunc(rating) || rating < 1 || rating > 5 {
+				errs[key] = "must be a whole number from 1 to 5"
+				continue
+			}
+			result.Rating = int(rating)
+		case "text":
+			text, ok := raw.(string)
+			if !ok && raw != nil {
+				errs[key] = "must be a string"
+				continue
+			}
+			text = strings.TrimSpace(text)
+			if utf8.RuneCountInString(text) > maxReviewLength {
+				errs[key] = fmt.Sprintf("must be at most %d characters long", maxReviewLength)
+				continue
+			}
+			result.Text = text
+		default:
+			errs[key] = "is not a field of a review"
+		}
+	}
+	if _, invalid := errs["rating"]; !invalid && result.Rating == 0 {
+		errs["rating"] = "is required"
+	}
+	if len(errs) > 0 {
+		return review{}, errs
+	}
+	return result, nil
+}
+
+func (r *reviewStore) checkBook(ctx context.Context, bookID string) error {
+	count, err := r.books.CountDocuments(ctx, live(bson.M{"ID": bookID}))
+	if err != nil {
+		return serverProblem(err, "database error")
+	}
+	if count == 0 {
+		return errBookNotFound
+	}
+	return nil
+}
+
+// Finds the review of the URL, which must be about the book of the URL.
+func (r *reviewStore) find(c echo.Context) (review, error) {
+	var found review
+	err := r.reviews.FindOne(c.Request().Context(), bson.M{
+		"_id":    c.Param("reviewId"),
+		"BookID": c.Param("id"),
+	}).Decode(&found)
+	if err == mongo.ErrNoDocuments {
+		return review{}, newProblem(http.StatusNotFound, "review not found")
+	}
+	if err != nil {
+		return review{}, serverProblem(err, "database error")
+	}
+	return found, nil
+}
+
+// Computes the rating of the book again from its reviews, after one of them
+// changed. The rating is part of the book, so its version goes up.
+func (r *reviewStore) refreshRating(ctx context.Context, bookID string) error {
+	pipeline := bson.A{
+		bson.M{"$match": bson.M{"BookID": bookID}},
+		bson.M{"$group": bson.M{
+			"_id":     nil,
+			"Average": bson.M{"$avg": "$Rating"},
+			"Count":   bson.M{"$sum": 1},
+		}},
+	}
+	cursor, err := r.reviews.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	var ratings []ratingSummary
+	if err = cursor.All(ctx, &ratings); err != nil {
+		return err
+	}
+
+	update := bson.M{"$inc": bson.M{"Version": 1}, "$currentDate": bson.M{"UpdatedAt": true}}
+	if len(ratings) == 0 {
+		update["$unset"] = bson.M{"Rating": ""}
+	} else {
+		rating := ratings[0]
+		rating.Average = math.Round(rating.Average*100) / 100
+		update["$set"] = bson.M{"Rating": rating}
+	}
+	_, err = r.books.UpdateOne(ctx, live(bson.M{"ID": bookID}), update)
+	return err
+}
+
+// Registers the routes of the reviews. Everybody can read them; writing
+// them needs the given middleware, which must let only logged in users
+// through: the author of a review is the user who wrote it.
+func (r *reviewStore) register(g *echo.Group, reads []echo.MiddlewareFunc, users []echo.MiddlewareFunc) {
+	// The newest reviews first
+	g.GET("/books/:id/reviews", func(c echo.Context) error {
+		bookID := c.Param("id")
+		if err := r.checkBook(c.Request().Context(), bookID); err != nil {
+			return err
+		}
+		opts := options.Find().SetSort(bson.D{{Key: "CreatedAt", Value: -1}, {Key: "_id", Value: -1}})
+		cursor, err := r.reviews.Find(c.Request().Context(), bson.M{"BookID": bookID}, opts)
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		reviews := []review{}
+		if err = cursor.All(c.Request().Context(), &reviews); err != nil {
+			return serverProblem(err, "database error")
+		}
+		return c.JSON(http.StatusOK, reviews)
+	}, reads...)
+
+	g.GET("/books/:id/reviews/:reviewId", func(c echo.Context) error {
+		found, err := r.find(c)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, found)
+	}, reads...)
+
+	g.POST("/books/:id/reviews", func(c echo.Context) error {
+		bookID := c.Param("id")
+		var input map[string]interface{}
+		if err := bindBody(c, &input); err != nil {
+			return newProblem(http.StatusBadRequest, "invalid request body")
+		}
+		created, err := reviewFromInput(input)
+		if err != nil {
+			return err
+		}
+		if err := r.checkBook(c.Request().Context(), bookID); err != nil {
+			return err
+		}
+
+		created.ID = primitive.NewObjectID().Hex()
+		created.BookID = bookID
+		created.Username = currentPrincipal(c).Name
+		created.CreatedAt = time.Now()
+		_, err = r.reviews.InsertOne(c.Request().Context(), created)
+		if mongo.IsDuplicateKeyError(err) {
+			return newProblem(http.StatusConflict, "you already reviewed this book, change your review instead")
+		}
+		if err != nil {
+			return serverProblem(err, "could not insert review")
+		}
+		if err := r.refreshRating(c.Request().Context(), bookID); err != nil {
+			return serverProblem(err, "could not update the rating of the book")
+		}
+		return c.JSON(http.StatusCreated, created)
+	}, users...)
+
+	// Only the author of a review can change it
+	g.PUT("/books/:id/reviews/:reviewId", func(c echo.Context) error {
+		var input map[string]interface{}
+		if err := bindBody(c, &input); err != nil {
+			return newProblem(http.StatusBadRequest, "invalid request body")
+		}
+		changed, err := reviewFromInput(input)
+		if err != nil {
+			return err
+		}
+		found, err := r.find(c)
+		if err != nil {
+			return err
+		}
+		if found.Username != currentPrincipal(c).Name {
+			return newProblem(http.StatusForbidden, "only the author of a review can change it")
+		}
+
+		found.Rating = changed.Rating
+		found.Text = changed.Text
+		found.UpdatedAt = time.Now()
+		update := bson.M{"$set": bson.M{"Rating": found.Rating, "UpdatedAt": found.UpdatedAt}}
+		if found.Text == "" {
+			update["$unset"] = bson.M{"Text": ""}
+		} else {
+			update["$set"].(bson.M)["Text"] = found.Text
+		}
+		if _, err := r.reviews.UpdateOne(c.Request().Context(), bson.M{"_id": found.ID}, update); err != nil {
+			return serverProblem(err, "failed to update review")
+		}
+		if err := r.refreshRating(c.Request().Context(), found.BookID); err != nil {
+			return serverProblem(err, "could not update the rating of the book")
+		}
+		return c.JSON(http.StatusOK, found)
+	}, users...)
+
+	// Authors delete their own reviews, admins any review
+	g.DELETE("/books/:id/reviews/:reviewId", func(c echo.Context) error {
+		found, err := r.find(c)
+		if err != nil {
+			return err
+		}
+		p := currentPrincipal(c)
+		if found.Username != p.Name && !p.Role.atLeast(roleAdmin) {
+			return newProblem(http.StatusForbidden, "only the author of a review or an admin can delete it")
+		}
+
+		if _, err := r.reviews.DeleteOne(c.Request().Context(), bson.M{"_id": found.ID}); err != nil {
+			return serverProblem(err, "could not delete review")
+		}
+		if err := r.refreshRating(c.Request().Context(), found.BookID); err != nil {
+			return serverProblem(err, "could not update the rating of the book")
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "review deleted"})
+	}, users...)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// The routes of the reviews on a mocked MongoDB, for the user "ada".
+func newReviewServer(mt *mtest.T) *echo.Echo {
+	reviews := &reviewStore{reviews: mt.Coll, books: mt.Coll}
+	e := echo.New()
+	e.HTTPErrorHandler = problemErrorHandler
+	reviews.register(e.Group("/api"), nil, []echo.MiddlewareFunc{asPrincipal(principal{Name: "ada", Role: roleViewer, IsUser: true})})
+	return e
+}
+
+// What refreshRating reads and writes after a review changed.
+func mockRatingRefresh(mt *mtest.T, rating int) []bson.D {
+	return []bson.D{
+		mockCursor(mt, bson.D{{Key: "_id", Value: nil}, {Key: "Average", Value: float64(rating)}, {Key: "Count", Value: 1}}),
+		mockOK(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+	}
+}
+
+func TestPostReview(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"with a text", `{"rating": 4, "text": "A classic"}`, http.StatusCreated},
+		{"without a text", `{"rating": 5}`, http.StatusCreated},
+		{"without a rating", `{"text": "A classic"}`, http.StatusUnprocessableEntity},
+		{"with half a star", `{"rating": 3.5}`, http.StatusUnprocessableEntity},
+		{"with an unknown field", `{"rating": 4, "stars": 4}`, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withMockMongo(t, func(mt *mtest.T) {
+				e := newReviewServer(mt)
+				// The book exists, the review is inserted
+				mt.AddMockResponses(mockCursor(mt, bson.D{{Key: "n", Value: 1}}), mockOK(bson.E{Key: "n", Value: 1}))
+				mt.AddMockResponses(mockRatingRefresh(mt, 4)...)
+
+				rec := sendJSON(e, http.MethodPost, "/api/books/dune/reviews", tt.body)
+				if rec.Code != tt.status {
+					t.Fatalf("got %d, want %d: %s", rec.Code, tt.status, rec.Body)
+				}
+				if tt.status != http.StatusCreated {
+					return
+				}
+				var created review
+				if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+					t.Fatal(err)
+				}
+				if created.BookID != "dune" || created.Username != "ada" || created.Rating == 0 {
+					t.Errorf("created %+v", created)
+				}
+			})
+		})
+	}
+}
+
+func TestPutReview(t *testing.T) {
+	withMockMongo(t, func(mt *mtest.T) {
+		e := newReviewServer(mt)
+		mt.AddMockResponses(
+			// The review of ada
+			mockCursor(mt, bson.D{{Key: "_id", Value: "r1"}, {Key: "BookID", Value: "dune"}, {Key: "Username", Value: "ada"}, {Key: "Rating", Value: 2}}),
+			mockOK(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+		)
+		mt.AddMockResponses(mockRatingRefresh(mt, 5)...)
+
+		rec := sendJSON(e, http.MethodPut, "/api/books/dune/reviews/r1", `{"rating": 5, "text": "Better the second time"}`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", rec.Code, rec.Body)
+		}
+		var changed review
+		if err := json.Unmarshal(rec.Body.Bytes(), &changed); err != nil {
+			t.Fatal(err)
+		}
+		if changed.ID != "r1" || changed.Rating != 5 {
+			t.Errorf("changed %+v", changed)
+		}
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The collection keeping the books as they were before each change.
+const revisionsCollection = "book_revisions"
+
+// A book as it was before a PUT or a PATCH changed it. The revision is the
+// version the book had, see concurrency.go, so it matches the ETag a client
+// read it with. Other changes, like checkouts or reviews, count the version
+// up without keeping a revision, so the numbers have gaps.
+type bookRevision struct {
+	MongoID  primitive.ObjectID `bson:"_id,omitempty"`
+	BookID   string             `bson:"BookID"`
+	Revision int64              `bson:"Revision"`
+	Book     BookStore          `bson:"Book"`
+	// When this version was replaced by the next one
+	ReplacedAt time.Time `bson:"ReplacedAt"`
+}
+
+// The revisions of the books, so that accidental edits can be undone. Only
+// the books stored in MongoDB have revisions, see openBookRepository.
+type revisionStore struct {
+	revisions *mongo.Collection
+}
+
+// The history of a book is listed newest first.
+func prepareRevisionIndexes(coll *mongo.Collection) error {
+	_, err := coll.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "BookID", Value: 1}, {Key: "Revision", Value: -1}},
+	})
+	return err
+}
+
+// Keeps the book as it was before a change. The change is already made, so
+// a failure is only logged: the book loses a revision, not the change.
+func (s *revisionStore) record(ctx context.Context, before BookStore) {
+	if s == nil {
+		return
+	}
+	_, err := s.revisions.InsertOne(ctx, bookRevision{
+		BookID:     before.ID,
+		Revision:   before.Version,
+		Book:       before,
+		ReplacedAt: time.Now(),
+	})
+	if err != nil {
+		slog.Error("could not keep a revision", "book", before.ID, "revision", before.Version, "error", err)
+	}
+}
+
+// Registers the routes of the revisions: everybody can read the history of
+// a book, reverting it needs the given write middleware.
+// A book deleted and created again with the same ID also lists the
+// revisions of the first one, whose numbers start again at 1.
+func (s *revisionStore) register(g *echo.Group, reads []echo.MiddlewareFunc, writes []echo.MiddlewareFunc, repo BookRepository, authors *authorStore) {
+	// The revisions of the book, newest first, paginated like GET /books
+	g.GET("/books/:id/history", func(c echo.Context) error {
+		bookID := c.Param("id")
+		offset, limit, err := parsePagination(c)
+		if err != nil {
+			return newProblem(http.StatusBadRequest, err.Error())
+		}
+		if _, err := repo.FindByID(c.Request().Context(), bookID); err != nil {
+			return repositoryError(err, "database error")
+		}
+
+		filter := bson.M{"BookID": bookID}
+		total, err := s.revisions.CountDocuments(c.Request().Context(), filter)
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		opts := options.Find().
+			SetSort(bson.D{{Key: "Revision", Value: -1}, {Key: "_id", Value: -1}}).
+			SetSkip(offset).
+			SetLimit(limit)
+		cursor, err := s.revisions.Find(c.Request().Context(), filter, opts)
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		var revisions []bookRevision
+		if err = cursor.All(c.Request().Context(), &revisions); err != nil {
+			return serverProblem(err, "database error")
+		}
+
+		response := []map[string]interface{}{}
+		for _, revision := range revisions {
+			response = append(response, map[string]interface{}{
+				"revision":   revision.Revision,
+				"replacedAt": revision.ReplacedAt.UTC().Format(time.RFC3339),
+				"book":       bookToAPI(revision.Book),
+			})
+		}
+		setPaginationHeaders(c, offset, limit, total)
+		return c.JSON(http.StatusOK, response)
+	}, reads...)
+
+	// Gives the book the fields it had in the revision back, as a PUT
+	// would: the tags, the publisher, the cover and the copies have their
+	// own routes and stay as they are. The version before the revert becomes
+	// a revision as well, so a revert can be undone too. If-Match works as
+	// for PUT.
+	g.POST("/books/:id/revert/:rev", func(c echo.Context) error {
+		bookID := c.Param("id")
+		number, err := strconv.ParseInt(c.Param("rev"), 10, 64)
+		if err != nil || number < 0 {
+			return newProblem(http.StatusBadRequest, "the revision must be a number")
+		}
+
+		// The latest one with this number, see above
+		var revision bookRevision
+		err = s.revisions.FindOne(c.Request().Context(),
+			bson.M{"BookID": bookID, "Revision": number},
+			options.FindOne().SetSort(bson.M{"_id": -1}),
+		).Decode(&revision)
+		if err == mongo.ErrNoDocuments {
+			return newProblem(http.StatusNotFound, "revision not found")
+		}
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+
+		book := revision.Book
+		book.ID = bookID
+		// The authors may have been renamed or deleted since, so the book
+		// is linked to them by name again
+		if err := authors.linkBook(c.Request().Context(), &book); err != nil {
+			return serverProblem(err, "database error")
+		}
+		if err := repo.Update(c.Request().Context(), bookID, book, parseIfMatch(c)); err != nil {
+			return repositoryError(err, "failed to revert book")
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"message":  "book reverted",
+			"revision": number,
+		})
+	}, writes...)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The validator MongoDB applies to every write into the books collection,
+// see main. A document that does not match is refused, whichever code wrote
+// it, mongosh included. The schema is built from the Go model, so a new field
+// of BookStore is part of the schema of the books without anything else to
+// change.
+var bookValidator = bson.M{"$jsonSchema": jsonSchemaOf(reflect.TypeOf(BookStore{}))}
+
+// Gives the collection the validator, replacing the one it had, so the
+// schema follows the model at every start. With the "moderate" level,
+// documents already stored that do not match yet, e.g. books waiting for a
+// migration, see migrations.go, can still be updated: only the documents
+// matching the schema must keep matching it.
+func applyValidator(db *mongo.Database, name string, validator bson.M) error {
+	return db.RunCommand(context.Background(), bson.D{
+		{Key: "collMod", Value: name},
+		{Key: "validator", Value: validator},
+		{Key: "validationLevel", Value: "moderate"},
+		{Key: "validationAction", Value: "error"},
+	}).Err()
+}
+
+// The $jsonSchema of the documents a struct is stored as, see
+// https://www.mongodb.com/docs/manual/reference/operator/query/jsonSchema/
+// Every field with a bson tag is a property, of the BSON type the driver
+// stores its Go type as. The fields whose tag has no omitempty are always
+// written, so they are required. Other properties are allowed: documents
+// may still have fields the model dropped.
+func jsonSchemaOf(t reflect.Type) bson.M {
+	properties := bson.M{}
+	required := bson.A{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, ok := field.Tag.Lookup("bson")
+		if !ok || !field.IsExported() || tag == "-" {
+			continue
+		}
+		name, flags, _ := strings.Cut(tag, ",")
+		properties[name] = schemaOfType(field.Type)
+		if !strings.Contains(flags, "omitempty") && field.Type.Kind() != reflect.Pointer {
+			required = append(required, name)
+		}
+	}
+	schema := bson.M{"bsonType": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// The schema of a value of the Go type, as the driver encodes it. The driver
+// stores an int as a 32-bit integer when it fits, and $inc keeps the type of
+// its increment, so the integers of any size match all of them.
+func schemaOfType(t reflect.Type) bson.M {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return bson.M{"bsonType": "date"}
+	case reflect.TypeOf(primitive.ObjectID{}):
+		return bson.M{"bsonType": "objectId"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaOfType(t.Elem())
+	case reflect.String:
+		return bson.M{"bsonType": "string"}
+	case reflect.Bool:
+		return bson.M{"bsonType": "bool"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return bson.M{"bsonType": bson.A{"int", "long"}}
+	case reflect.Float32, reflect.Float64:
+		return bson.M{"bsonType": "double"}
+	case reflect.Slice, reflect.Array:
+		return bson.M{"bsonType": "array", "items": schemaOfType(t.Elem())}
+	case reflect.Struct:
+		return jsonSchemaOf(t)
+	default:
+		// Anything, e.g. an interface{}
+		return bson.M{}
+	}
+}
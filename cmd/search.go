@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A book found by a search, with the relevance MongoDB computed for it: the
+// higher the score, the better the book matches the search terms.
+type searchHit struct {
+	BookStore `bson:",inline"`
+	Score     float64 `bson:"score"`
+}
+
+// How the words of the books and of the queries are compared. With stemming,
+// MongoDB reduces words to their stem in the given language and ignores its
+// stop words, so "cats" matches "The Black Cat". Without stemming, words
+// must match exactly (still ignoring case).
+// The languages MongoDB knows are listed here:
+// https://www.mongodb.com/docs/manual/reference/text-search-languages/
+type searchConfig struct {
+	Language string
+	Stemming bool
+}
+
+// The language given to MongoDB: "none" turns stemming and stop words off.
+func (config searchConfig) textLanguage() string {
+	if !config.Stemming {
+		return "none"
+	}
+	return config.Language
+}
+
+// The name of our text index. A collection can only have one text index, so
+// it covers all the searchable fields.
+const textIndexName = "books_text"
+
+// The fields of the text index with their weights: a match in the title
+// counts more than one in the author, and both more than one in the edition.
+var textIndexWeights = bson.D{
+	{Key: "BookName", Value: 10},
+	{Key: "BookAuthor", Value: 5},
+	{Key: "BookEdition", Value: 1},
+}
+
+// The full-text search over the books, see
+// https://www.mongodb.com/docs/manual/core/link-text-indexes/
+// For queries with typos, fuzzy offers a slower but tolerant alternative,
+// and suggestions completes what the user is typing.
+type bookSearch struct {
+	coll        *mongo.Collection
+	config      searchConfig
+	fuzzy       *trigramIndex
+	suggestions *suggestionTrie
+}
+
+func newBookSearch(coll *mongo.Collection, config searchConfig) *bookSearch {
+	return &bookSearch{
+		coll:        coll,
+		config:      config,
+		fuzzy:       newTrigramIndex(coll),
+		suggestions: newSuggestionTrie(coll),
+	}
+}
+
+// Wraps the routes changing books: after a successful write, the in-memory
+// indexes are outdated and get built again when next used.
+func (s *bookSearch) markStale(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+		if err == nil && c.Response().Status < 300 {
+			s.fuzzy.invalidate()
+			s.suggestions.invalidate()
+		}
+		return err
+	}
+}
+
+// Creates the text index the search runs on. Like prepareIndexes, this runs
+// at every start: an index that is already there as configured is left
+// alone, whereas one created with another language or other fields is
+// dropped and built again, since MongoDB would refuse a second text index.
+func (s *bookSearch) prepareIndex() error {
+	existing, err := s.existingTextIndex()
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		if s.indexUpToDate(existing) {
+			return nil
+		}
+		name, _ := existing["name"].(string)
+		if _, err := s.coll.Indexes().DropOne(context.Background(), name); err != nil {
+			return err
+		}
+	}
+
+	keys := bson.D{}
+	for _, field := range textIndexWeights {
+		keys = append(keys, bson.E{Key: field.Key, Value: "text"})
+	}
+	_, err = s.coll.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: keys,
+		Options: options.Index().
+			SetName(textIndexName).
+			SetWeights(textIndexWeights).
+			SetDefaultLanguage(s.config.textLanguage()),
+	})
+	return err
+}
+
+// Finds the text index of the collection, whatever its name, or nil. Text
+// indexes are listed with the special key "_fts".
+func (s *bookSearch) existingTextIndex() (bson.M, error) {
+	cursor, err := s.coll.Indexes().List(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	var indexes []bson.M
+	if err = cursor.All(context.Background(), &indexes); err != nil {
+		return nil, err
+	}
+	for _, index := range indexes {
+		if key, ok := index["key"].(bson.M); ok && key["_fts"] == "text" {
+			return index, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *bookSearch) indexUpToDate(index bson.M) bool {
+	if index["name"] != textIndexName || index["default_language"] != s.config.textLanguage() {
+		return false
+	}
+	weights, ok := index["weights"].(bson.M)
+	if !ok || len(weights) != len(textIndexWeights) {
+		return false
+	}
+	for _, field := range textIndexWeights {
+		// The server reports the weights as 32 bit integers
+		if weight, ok := weights[field.Key].(int32); !ok || int(weight) != field.Value.(int) {
+			return false
+		}
+	}
+	return true
+}
+
+// Searches the books, best matches first. MongoDB splits the query into
+// words and finds the books containing any of them, see
+// https://www.mongodb.com/docs/manual/reference/operator/query/text/
+// The filter, as given by mongoFilter, narrows the search down further.
+func (s *bookSearch) search(ctx context.Context, query string, filter bson.M, limit int64) ([]searchHit, error) {
+	score := bson.M{"$meta": "textScore"}
+	opts := findOptions(ctx).
+		SetProjection(bson.M{"score": score}).
+		SetSort(bson.D{{Key: "score", Value: score}, {Key: "_id", Value: 1}}).
+		SetLimit(limit)
+	cursor, err := s.coll.Find(ctx, s.textFilter(query, filter), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var hits []searchHit
+	if err = cursor.All(ctx, &hits); err != nil {
+		return nil, err
+	}
+	return hits, nil
+}
+
+func (s *bookSearch) textFilter(query string, filter bson.M) bson.M {
+	text := live(bson.M{"$text": bson.M{
+		"$search":   query,
+		"$language": s.config.textLanguage(),
+	}})
+	for field, condition := range filter {
+		text[field] = condition
+	}
+	return text
+}
+
+// The API keys we count the books of a search by.
+var facetFields = []string{"author", "year", "edition"}
+
+// How many of the books found have a given value, e.g. an author.
+type facetCount struct {
+	Value string `bson:"_id" json:"value"`
+	Count int    `bson:"count" json:"count"`
+}
+
+// Like search, but also counts all the books found (not only the first
+// limit ones) by each of the facetFields, most frequent values first. Books
+// without a value for a field are not counted for it.
+// A single aggregation computes everything: $facet runs one sub-pipeline per
+// result on the matched books, see
+// https://www.mongodb.com/docs/manual/reference/operator/aggregation/facet/
+func (s *bookSearch) facetedSearch(ctx context.Context, query string, filter bson.M, limit int64) ([]searchHit, map[string][]facetCount, error) {
+	facets := bson.M{
+		"hits": bson.A{
+			bson.M{"$sort": bson.D{{Key: "score", Value: -1}, {Key: "_id", Value: 1}}},
+			bson.M{"$limit": limit},
+		},
+	}
+	for _, field := range facetFields {
+		facets[field] = bson.A{
+			// A book with several authors counts for each of them; other
+			// fields have one value, which $unwind keeps as it is
+			bson.M{"$unwind": "$" + bookFields[field]},
+			bson.M{"$match": bson.M{bookFields[field]: bson.M{"$nin": bson.A{"", nil}}}},
+			// Facet values are strings, like the years in the API
+			bson.M{"$group": bson.M{"_id": bson.M{"$toString": "$" + bookFields[field]}, "count": bson.M{"$sum": 1}}},
+			bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+		}
+	}
+	pipeline := bson.A{
+		bson.M{"$match": s.textFilter(query, filter)},
+		// The score has to be kept in a field to be seen by the sub-pipelines
+		bson.M{"$addFields": bson.M{"score": bson.M{"$meta": "textScore"}}},
+		bson.M{"$facet": facets},
+	}
+
+	cursor, err := s.coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, nil, err
+	}
+	var results []bson.Raw
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, nil, err
+	}
+
+	// $facet always outputs exactly one document
+	if len(results) != 1 {
+		return nil, nil, fmt.Errorf("facet search returned %d documents", len(results))
+	}
+	var hits []searchHit
+	if err = results[0].Lookup("hits").Unmarshal(&hits); err != nil {
+		return nil, nil, err
+	}
+	counts := map[string][]facetCount{}
+	for _, field := range facetFields {
+		values := []facetCount{}
+		if err = results[0].Lookup(field).Unmarshal(&values); err != nil {
+			return nil, nil, err
+		}
+		counts[field] = values
+	}
+	return hits, counts, nil
+}
+
+// A hit with the API keys, plus its score.
+func hitToAPI(hit searchHit) map[string]interface{} {
+	formatted := bookToAPI(hit.BookStore)
+	formatted["score"] = hit.Score
+	return formatted
+}
+
+// The books of the hits, in the generic maps the templates work with.
+func hitsToMaps(hits []searchHit) []map[string]interface{} {
+	var books []BookStore
+	for _, hit := range hits {
+		books = append(books, hit.BookStore)
+	}
+	return booksToMaps(books)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// Sets the headers of the SECURITY_* settings on every response:
+//
+//   - Content-Security-Policy, where the pages may load scripts, styles and
+//     fonts from, so an injected <script> pointing elsewhere does not run
+//   - X-Frame-Options, whether other sites may show the pages in a frame,
+//     to trick the users into clicking
+//   - Referrer-Policy, how much of the URL other sites learn from the links
+//   - X-Content-Type-Options: nosniff, so browsers trust the Content-Type
+//     rather than guessing, e.g. a JSON body as HTML
+//   - Strict-Transport-Security, with TLS on, so browsers never come back
+//     over plain HTTP
+//
+// A handler may still set its own, e.g. a looser policy for a page that
+// needs one.
+func securityHeaders(settings config.Security, tls bool) echo.MiddlewareFunc {
+	header := func(value string) string {
+		if value == "off" {
+			return ""
+		}
+		return value
+	}
+	secure := middleware.SecureConfig{
+		ContentSecurityPolicy: header(settings.ContentSecurityPolicy),
+		XFrameOptions:         header(settings.FrameOptions),
+		ReferrerPolicy:        header(settings.ReferrerPolicy),
+		HSTSExcludeSubdomains: !settings.HSTSIncludeSubdomains,
+	}
+	if settings.ContentTypeNosniff {
+		secure.ContentTypeNosniff = "nosniff"
+	}
+	if tls {
+		secure.HSTSMaxAge = int(settings.HSTSMaxAge / time.Second)
+	}
+	return middleware.SecureWithConfig(secure)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"gopkg.in/yaml.v3"
+)
+
+// The books to insert at the first start: those of the seed file, by
+// default the starter catalog of data/books.json, or none when seeding is
+// disabled. The file is read at every start, and only its books missing from
+// the database are inserted, see prepareData: the books edited since are left
+// as they are.
+func seedBooks(settings config.Seed) ([]BookStore, error) {
+	if !settings.Enabled {
+		return nil, nil
+	}
+	books, err := loadSeedFile(settings.File)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the seed file %s: %w", settings.File, err)
+	}
+	return books, nil
+}
+
+// Does what prepareData does for the other storages, through their
+// BookRepository: the books of startData whose ID is not there yet are
+// inserted, as POST /books would.
+func seedRepository(repo BookRepository, startData []BookStore) error {
+	for _, book := range startData {
+		_, err := repo.FindByID(context.Background(), book.ID)
+		if err == nil {
+			slog.Debug("the book of the sample data is already there", "id", book.ID)
+			continue
+		}
+		if !errors.Is(err, errBookNotFound) {
+			return fmt.Errorf("could not look for the book %s: %w", book.ID, err)
+		}
+		book.Version = 1
+		book.CreatedAt = time.Now()
+		book.UpdatedAt = book.CreatedAt
+		if err = repo.Insert(context.Background(), book); err != nil {
+			return fmt.Errorf("could not add the book %s: %w", book.ID, err)
+		}
+		slog.Debug("added a book of the sample data", "id", book.ID)
+	}
+	return nil
+}
+
+// Reads a list of books with the keys of the API, as sent to POST /books:
+//
+//	[{"id": "example1", "title": "The Vortex", "author": "José Eustasio Rivera", "year": 1924}]
+//
+// Files ending in .yaml or .yml are YAML, the others JSON. Every book is
+// validated like a created one, see bookFromCreateInput, so the seed data
+// cannot hold books the API would refuse.
+func loadSeedFile(path string) ([]BookStore, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+		// Turned into JSON, so that its values have the types of a request
+		// body, e.g. float64 for the numbers
+		var parsed interface{}
+		if err := yaml.Unmarshal(content, &parsed); err != nil {
+			return nil, err
+		}
+		if content, err = json.Marshal(parsed); err != nil {
+			return nil, err
+		}
+	}
+
+	var inputs []map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	if err := decoder.Decode(&inputs); err != nil {
+		return nil, fmt.Errorf("must be a list of books: %w", err)
+	}
+	books := make([]BookStore, 0, len(inputs))
+	seen := map[string]bool{}
+	for i, input := range inputs {
+		book, err := bookFromCreateInput(input)
+		if err != nil {
+			return nil, fmt.Errorf("book %d: %w", i+1, err)
+		}
+		if seen[book.ID] {
+			return nil, fmt.Errorf("book %d: the ID %s is used twice", i+1, book.ID)
+		}
+		seen[book.ID] = true
+		books = append(books, book)
+	}
+	return books, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// A volume of a series, as listed by GET /api/series.
+type seriesVolume struct {
+	Volume int    `bson:"volume" json:"volume,omitempty"`
+	ID     string `bson:"id" json:"id"`
+	Title  string `bson:"title" json:"title"`
+}
+
+// A series with its volumes in reading order.
+type seriesSummary struct {
+	Name    string         `bson:"_id" json:"series"`
+	Count   int            `bson:"count" json:"count"`
+	Volumes []seriesVolume `bson:"volumes" json:"volumes"`
+}
+
+// The order to read a series in: by volume, then the books without a volume
+// number by year. HasVolume is added by the pipelines, since $sort alone
+// would put the books without a volume first.
+var readingOrder = bson.D{
+	{Key: "HasVolume", Value: -1},
+	{Key: "SeriesVolume", Value: 1},
+	{Key: "BookYear", Value: 1},
+	{Key: "_id", Value: 1},
+}
+
+// Lists every series in alphabetical order, with its volumes in reading
+// order. Books in the trash are left out.
+func findSeries(ctx context.Context, coll *mongo.Collection) ([]seriesSummary, error) {
+	pipeline := bson.A{
+		bson.M{"$match": listed(bson.M{"Series": bson.M{"$exists": true}})},
+		bson.M{"$addFields": bson.M{"HasVolume": bson.M{"$gt": bson.A{"$SeriesVolume", nil}}}},
+		bson.M{"$sort": readingOrder},
+		bson.M{"$group": bson.M{
+			"_id":   "$Series",
+			"count": bson.M{"$sum": 1},
+			"volumes": bson.M{"$push": bson.M{
+				"volume": "$SeriesVolume",
+				"id":     "$ID",
+				"title":  "$BookName",
+			}},
+		}},
+		bson.M{"$sort": bson.M{"_id": 1}},
+	}
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	series := []seriesSummary{}
+	if err = cursor.All(ctx, &series); err != nil {
+		return nil, err
+	}
+	return series, nil
+}
+
+// Returns the books of the series in reading order. A nil projection reads
+// whole books, see findAllBooks.
+func findSeriesBooks(ctx context.Context, coll *mongo.Collection, name string, projection bson.M) ([]BookStore, error) {
+	pipeline := bson.A{
+		bson.M{"$match": listed(bson.M{"Series": name})},
+		bson.M{"$addFields": bson.M{"HasVolume": bson.M{"$gt": bson.A{"$SeriesVolume", nil}}}},
+		bson.M{"$sort": readingOrder},
+	}
+	if projection != nil {
+		// After the sort, which needs the fields of the reading order
+		pipeline = append(pipeline, bson.M{"$project": projection})
+	}
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	books := []BookStore{}
+	if err = cursor.All(ctx, &books); err != nil {
+		return nil, err
+	}
+	return books, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/labstack/echo/v4"
+	"google.golang.org/grpc"
+)
+
+// Serves the requests on PORT, or UNIX_SOCKET, and HTTP_REDIRECT_PORT if
+// any, see tls.go, and the calls of rpc on GRPC_PORT, if any, see grpc.go,
+// until the process gets SIGINT (Ctrl+C) or SIGTERM, which Docker and
+// Kubernetes send to stop a container. The server then stops accepting
+// connections, and waits up to SHUTDOWN_TIMEOUT for the requests in flight to
+// be answered, so a rolling deployment does not cut them off; those still
+// running after it are. The error tells why the server could not start, e.g.
+// a port in use, or that the timeout was reached.
+func serve(e *echo.Echo, rpc *grpc.Server, settings config.Config) error {
+	stopped, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// The timeouts of the connections, see limits.go
+	applyTimeouts(settings.Limits, e.Server, e.TLSServer)
+	redirect := redirectServer(e, settings)
+	// BIND_ADDRESS, PORT and UNIX_SOCKET, see listen.go
+	if err := listenUnixSocket(e, settings); err != nil {
+		return fmt.Errorf("could not listen on %s: %w", settings.UnixSocket, err)
+	}
+	failed := make(chan error, 3)
+	go func() {
+		failed <- startServer(e, listenAddress(settings, settings.Port), settings.TLS)
+	}()
+	if redirect != nil {
+		applyTimeouts(settings.Limits, redirect)
+		go func() {
+			failed <- redirect.ListenAndServe()
+		}()
+	}
+	if rpc != nil {
+		go func() {
+			failed <- startGRPCServer(rpc, settings)
+		}()
+	}
+	select {
+	case err := <-failed:
+		return err
+	case <-stopped.Done():
+	}
+	// A second Ctrl+C kills the server at once, as it did before
+	stop()
+
+	timeout := settings.ShutdownTimeout
+	slog.Info("shutting down, waiting for the requests in flight", "timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if redirect != nil {
+		// Its own requests are answered at once
+		redirect.Shutdown(ctx)
+	}
+	if rpc != nil {
+		stopGRPCServer(ctx, rpc)
+	}
+	if err := e.Shutdown(ctx); err != nil {
+		return fmt.Errorf("could not finish the requests in flight: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// The schema of the books in an SQLite file, to run the API on a laptop
+// without a database server, see openBookRepository. The driver is
+// written in Go, so nothing needs to be installed either.
+// SQLite has no arrays: the names, the IDs of the authors and the tags are
+// JSON arrays, which its JSON functions read. The other columns are the ones
+// of postgres.go. Dates are RFC 3339 strings.
+// The full-text search is an FTS5 table next to the books, kept up to date by
+// triggers; its rowid is the seq of the book.
+var sqliteMigrations = []sqlMigration{
+	{1, "create books", []string{
+		`CREATE TABLE books (
+			seq           INTEGER PRIMARY KEY AUTOINCREMENT,
+			id            TEXT NOT NULL CHECK (id <> ''),
+			title         TEXT NOT NULL CHECK (title <> ''),
+			authors       TEXT NOT NULL DEFAULT '[]' CHECK (json_type(authors) = 'array'),
+			author_ids    TEXT NOT NULL DEFAULT '[]' CHECK (json_type(author_ids) = 'array'),
+			edition       TEXT NOT NULL DEFAULT '',
+			pages         INTEGER NOT NULL DEFAULT 0 CHECK (pages >= 0),
+			year          INTEGER NOT NULL DEFAULT 0,
+			series        TEXT NOT NULL DEFAULT '',
+			series_volume INTEGER NOT NULL DEFAULT 0 CHECK (series_volume >= 0),
+			publisher_id  TEXT NOT NULL DEFAULT '',
+			tags          TEXT NOT NULL DEFAULT '[]' CHECK (json_type(tags) = 'array'),
+			copies        INTEGER NOT NULL DEFAULT 0 CHECK (copies >= 0),
+			checked_out   INTEGER NOT NULL DEFAULT 0 CHECK (checked_out >= 0),
+			version       INTEGER NOT NULL DEFAULT 0,
+			created_at    TEXT,
+			deleted_at    TEXT,
+			-- A book without Copies has one, see bookCopies
+			CHECK (checked_out <= max(copies, 1)),
+			CHECK (series_volume = 0 OR series <> '')
+		)`,
+		`CREATE UNIQUE INDEX books_id ON books (id) WHERE deleted_at IS NULL`,
+		`CREATE INDEX books_title ON books (title, seq)`,
+		`CREATE INDEX books_authors ON books (authors, seq)`,
+		`CREATE INDEX books_year ON books (year, seq)`,
+		`CREATE INDEX books_edition ON books (edition)`,
+		`CREATE INDEX books_publisher ON books (publisher_id)`,
+		`CREATE VIRTUAL TABLE books_search USING fts5 (title, authors, edition)`,
+		`CREATE TRIGGER books_search_insert AFTER INSERT ON books BEGIN
+			INSERT INTO books_search (rowid, title, authors, edition)
+			VALUES (new.seq, new.title, (SELECT group_concat(value, ' ') FROM json_each(new.authors)), new.edition);
+		END`,
+		`CREATE TRIGGER books_search_update AFTER UPDATE OF title, authors, edition ON books BEGIN
+			DELETE FROM books_search WHERE rowid = old.seq;
+			INSERT INTO books_search (rowid, title, authors, edition)
+			VALUES (new.seq, new.title, (SELECT group_concat(value, ' ') FROM json_each(new.authors)), new.edition);
+		END`,
+		`CREATE TRIGGER books_search_delete AFTER DELETE ON books BEGIN
+			DELETE FROM books_search WHERE rowid = old.seq;
+		END`,
+	}},
+	{2, "add updated_at", []string{
+		`ALTER TABLE books ADD COLUMN updated_at TEXT`,
+		`UPDATE books SET updated_at = created_at`,
+		`CREATE INDEX books_created_at ON books (created_at, seq)`,
+		`CREATE INDEX books_updated_at ON books (updated_at, seq)`,
+	}},
+	{3, "add archived", []string{
+		`ALTER TABLE books ADD COLUMN archived INTEGER NOT NULL DEFAULT 0 CHECK (archived IN (0, 1))`,
+	}},
+}
+
+// The BookRepository of an SQLite file.
+type sqliteBookRepository struct {
+	db *sql.DB
+}
+
+// Opens the database in the file at the path, creating it if needed, and
+// brings its schema up to date.
+func openSQLiteRepository(path string) (*sqliteBookRepository, error) {
+	// Other connections wait for a write to finish instead of failing
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// Only one writer at a time anyway
+	db.SetMaxOpenConns(1)
+	err = migrateSQL(db, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT NOT NULL,
+		applied_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`, `INSERT INTO schema_migrations (version, name) VALUES (?, ?) ON CONFLICT DO NOTHING`, sqliteMigrations)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not open %s: %w", path, err)
+	}
+	return &sqliteBookRepository{db: db}, nil
+}
+
+// The WHERE clause of a bookFilter, with its arguments, see postgresFilter.
+func sqliteFilter(f bookFilter, args []interface{}) (string, []interface{}) {
+	conditions := []string{"deleted_at IS NULL"}
+	if !f.IncludeArchived {
+		conditions = append(conditions, "NOT archived")
+	}
+	if f.Author != "" {
+		// lower only knows ASCII, unlike the $regex of mongoFilter
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM json_each(books.authors) WHERE instr(lower(value), lower(?)) > 0)")
+		args = append(args, f.Author)
+	}
+	if f.Year != 0 {
+		conditions = append(conditions, "year = ?")
+		args = append(args, f.Year)
+	}
+	if f.Edition != "" {
+		conditions = append(conditions, "edition = ?")
+		args = append(args, f.Edition)
+	}
+	if f.Publisher != "" {
+		conditions = append(conditions, "publisher_id = ?")
+		args = append(args, f.Publisher)
+	}
+	if len(f.Tags) > 0 {
+		// None of the tags is missing
+		conditions = append(conditions, `NOT EXISTS (SELECT 1 FROM json_each(?) AS wanted
+			WHERE wanted.value NOT IN (SELECT value FROM json_each(books.tags)))`)
+		args = append(args, jsonArray(f.Tags))
+	}
+	// The stored strings leave out the zero fractions of a second, so they
+	// only compare as times
+	if !f.CreatedSince.IsZero() {
+		conditions = append(conditions, "julianday(created_at) >= julianday(?)")
+		args = append(args, sqliteTime(f.CreatedSince))
+	}
+	if !f.UpdatedSince.IsZero() {
+		conditions = append(conditions, "julianday(updated_at) >= julianday(?)")
+		args = append(args, sqliteTime(f.UpdatedSince))
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// A time as stored in the date columns.
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// A list stored in a JSON column.
+func jsonArray[T any](values []T) string {
+	if values == nil {
+		return "[]"
+	}
+	encoded, _ := json.Marshal(values)
+	return string(encoded)
+}
+
+// Reads a row of sqlBookColumns.
+func scanSQLiteBook(row interface{ Scan(...interface{}) error }) (BookStore, int64, error) {
+	var book BookStore
+	var seq int64
+	var authors, authorIDs, tags string
+	var createdAt, updatedAt sql.NullString
+	err := row.Scan(&seq, &book.ID, &book.BookName, &authors, &authorIDs,
+		&book.BookEdition, &book.BookPages, &book.BookYear,
+		&book.Series, &book.SeriesVolume, &book.PublisherID, &tags,
+		&book.Copies, &book.CheckedOut, &book.Version, &createdAt, &updatedAt, &book.Archived)
+	if err != nil {
+		return BookStore{}, 0, err
+	}
+	lists := []struct {
+		column string
+		list   *[]string
+	}{{authors, &book.BookAuthors}, {authorIDs, &book.AuthorIDs}, {tags, &book.Tags}}
+	for _, l := range lists {
+		if err = json.Unmarshal([]byte(l.column), l.list); err != nil {
+			return BookStore{}, 0, err
+		}
+	}
+	if createdAt.Valid {
+		if book.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt.String); err != nil {
+			return BookStore{}, 0, err
+		}
+	}
+	if updatedAt.Valid {
+		if book.UpdatedAt, err = time.Parse(time.RFC3339Nano, updatedAt.String); err != nil {
+			return BookStore{}, 0, err
+		}
+	}
+	// Empty arrays are left out, like in the documents
+	if len(book.AuthorIDs) == 0 {
+		book.AuthorIDs = nil
+	}
+	if len(book.Tags) == 0 {
+		book.Tags = nil
+	}
+	return book, seq, err
+}
+
+func (r *sqliteBookRepository) FindAll(ctx context.Context, query bookQuery) (bookList, error) {
+	where, args := sqliteFilter(query.Filter, nil)
+	var list bookList
+
+	var order string
+	limit := query.Limit
+	if query.Cursor {
+		if query.After != "" {
+			after, err := decodeSeqCursor(query.After)
+			if err != nil {
+				return bookList{}, errInvalidCursor
+			}
+			where += " AND seq > ?"
+			args = append(args, after)
+		}
+		// One more, to know whether there is a next page, see findAfter
+		order = "seq"
+		limit++
+	} else {
+		err := r.db.QueryRowContext(ctx, "SELECT count(*) FROM books WHERE "+where, args...).Scan(&list.Total)
+		if err != nil {
+			return bookList{}, err
+		}
+		direction := "ASC"
+		if query.Descending {
+			direction = "DESC"
+		}
+		order = "seq " + direction
+		if column, ok := sqlSortColumns[query.Sort]; ok {
+			order = column + " " + direction + ", " + order
+		}
+	}
+
+	args = append(args, limit, query.Offset)
+	rows, err := r.db.QueryContext(ctx,
+		fmt.Sprintf("SELECT %s FROM books WHERE %s ORDER BY %s LIMIT ? OFFSET ?", sqlBookColumns, where, order),
+		args...)
+	if err != nil {
+		return bookList{}, err
+	}
+	defer rows.Close()
+
+	var last int64
+	for rows.Next() {
+		book, seq, err := scanSQLiteBook(rows)
+		if err != nil {
+			return bookList{}, err
+		}
+		if query.Cursor && int64(len(list.Books)) == query.Limit {
+			list.Next = encodeSeqCursor(last)
+			break
+		}
+		if query.Fields != nil {
+			book = onlyFields(book, query.Fields)
+		}
+		list.Books = append(list.Books, book)
+		last = seq
+	}
+	return list, rows.Err()
+}
+
+func (r *sqliteBookRepository) FindByID(ctx context.Context, id string) (BookStore, error) {
+	row := r.db.QueryRowContext(ctx,
+		"SELECT "+sqlBookColumns+" FROM books WHERE id = ? AND deleted_at IS NULL", id)
+	book, _, err := scanSQLiteBook(row)
+	if err == sql.ErrNoRows {
+		return BookStore{}, errBookNotFound
+	}
+	return book, err
+}
+
+// Whether the error is a violation of a unique index.
+func isSQLiteUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+// Whether the error is the file being locked by another writer for longer
+// than the busy timeout.
+func isSQLiteBusy(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	// The primary code, without the extended one
+	code := sqliteErr.Code() & 0xff
+	return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+}
+
+func (r *sqliteBookRepository) Insert(ctx context.Context, book BookStore) error {
+	// The same fields as duplicateFilter
+	var count int64
+	err := r.db.QueryRowContext(ctx, `SELECT count(*) FROM books
+		WHERE deleted_at IS NULL AND id = ? AND title = ? AND authors = ?
+		AND edition = ? AND pages = ? AND year = ?`,
+		book.ID, book.BookName, jsonArray(book.BookAuthors), book.BookEdition, book.BookPages, book.BookYear,
+	).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errDuplicateBook
+	}
+
+	var createdAt, updatedAt sql.NullString
+	if !book.CreatedAt.IsZero() {
+		createdAt = sql.NullString{String: sqliteTime(book.CreatedAt), Valid: true}
+	}
+	if !book.UpdatedAt.IsZero() {
+		updatedAt = sql.NullString{String: sqliteTime(book.UpdatedAt), Valid: true}
+	}
+	_, err = r.db.ExecContext(ctx, `INSERT INTO books
+		(id, title, authors, author_ids, edition, pages, year, series, series_volume,
+		publisher_id, tags, copies, checked_out, version, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		book.ID, book.BookName, jsonArray(book.BookAuthors), jsonArray(book.AuthorIDs),
+		book.BookEdition, book.BookPages, book.BookYear, book.Series, book.SeriesVolume,
+		book.PublisherID, jsonArray(book.Tags), book.Copies, book.CheckedOut, book.Version,
+		createdAt, updatedAt)
+	if isSQLiteUniqueViolation(err) {
+		return errBookExists
+	}
+	return err
+}
+
+// Replaces the same fields as replaceUpdate, see postgresBookRepository.Update.
+func (r *sqliteBookRepository) Update(ctx context.Context, id string, book BookStore, versions []int64) error {
+	err := r.updateOne(ctx, id, versions, `id = ?, title = ?, authors = ?, author_ids = ?,
+		edition = ?, pages = ?, year = ?, series = ?, series_volume = ?`,
+		book.ID, book.BookName, jsonArray(book.BookAuthors), jsonArray(book.AuthorIDs),
+		book.BookEdition, book.BookPages, book.BookYear, book.Series, book.SeriesVolume)
+	if isSQLiteUniqueViolation(err) {
+		return errBookExists
+	}
+	return err
+}
+
+func (r *sqliteBookRepository) Delete(ctx context.Context, id string, versions []int64) error {
+	return r.updateOne(ctx, id, versions, "deleted_at = ?", sqliteTime(time.Now()))
+}
+
+func (r *sqliteBookRepository) Archive(ctx context.Context, id string, archived bool, versions []int64) error {
+	return r.updateOne(ctx, id, versions, "archived = ?", archived)
+}
+
+// Sets the columns of the live book with the given ID, if it is in one of
+// the versions, increments its version and stamps its updated_at.
+func (r *sqliteBookRepository) updateOne(ctx context.Context, id string, versions []int64, set string, values ...interface{}) error {
+	args := append(values, sqliteTime(time.Now()), id)
+	statement := "UPDATE books SET " + set + ", version = version + 1, updated_at = ? WHERE id = ? AND deleted_at IS NULL"
+	if versions != nil {
+		statement += " AND version IN (SELECT value FROM json_each(?))"
+		args = append(args, jsonArray(versions))
+	}
+
+	result, err := r.db.ExecContext(ctx, statement, args...)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil || updated > 0 {
+		return err
+	}
+	if versions == nil {
+		return errBookNotFound
+	}
+
+	// Either the book does not exist, or it is in another version
+	var exists bool
+	err = r.db.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM books WHERE id = ? AND deleted_at IS NULL)", id).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errBookModified
+	}
+	return errBookNotFound
+}
+
+// The words of a query in the syntax of FTS5, where a book matches any of
+// them, like in the text search of MongoDB. Each word is quoted, so
+// characters like " or - are not operators.
+func sqliteSearchQuery(query string) string {
+	var words []string
+	for _, word := range strings.Fields(query) {
+		words = append(words, `"`+strings.ReplaceAll(word, `"`, `""`)+`"`)
+	}
+	return strings.Join(words, " OR ")
+}
+
+// Ranks the books with FTS5. bm25 gives the best matches the lowest
+// numbers, so the score is its opposite. The words are compared without
+// stemming, as with SEARCH_STEMMING=false for MongoDB.
+func (r *sqliteBookRepository) Search(ctx context.Context, query string, filter bookFilter, limit int64) ([]searchHit, error) {
+	if strings.TrimSpace(query) == "" {
+		return nil, nil
+	}
+	where, args := sqliteFilter(filter, []interface{}{sqliteSearchQuery(query)})
+	args = append(args, limit)
+	rows, err := r.db.QueryContext(ctx,
+		fmt.Sprintf(`SELECT %s, score FROM books JOIN (
+				SELECT rowid, -bm25(books_search) AS score FROM books_search WHERE books_search MATCH ?
+			) AS found ON found.rowid = books.seq
+			WHERE %s ORDER BY score DESC, seq LIMIT ?`, sqlBookColumns, where),
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hits []searchHit
+	for rows.Next() {
+		var score float64
+		book, _, err := scanSQLiteBook(scoredRow{rows, &score})
+		if err != nil {
+			return nil, err
+		}
+		hits = append(hits, searchHit{BookStore: book, Score: score})
+	}
+	return hits, rows.Err()
+}
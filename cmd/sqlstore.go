@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"strconv"
+)
+
+// What the SQL repositories share, see postgres.go and sqlite.go.
+
+// The columns of a book, in the order scanBook and scanSQLiteBook read them.
+const sqlBookColumns = `seq, id, title, authors, author_ids, edition, pages, year,
+	series, series_volume, publisher_id, tags, copies, checked_out, version, created_at, updated_at, archived`
+
+// The columns a listing can be sorted by, for each of sortableFields.
+var sqlSortColumns = map[string]string{
+	"title":     "title",
+	"author":    "authors",
+	"year":      "year",
+	"createdAt": "created_at",
+	"updatedAt": "updated_at",
+}
+
+// A change of the schema of a SQL database. As for MongoDB, see
+// migrations.go, new ones go at the end of the list.
+type sqlMigration struct {
+	version    int
+	name       string
+	statements []string
+}
+
+// Applies the migrations not recorded yet in the schema_migrations table,
+// created by the first statement. Each migration runs in its own transaction
+// with its record, made by the claim statement, which must do nothing when
+// the version is recorded already: both databases roll back a failed ALTER
+// TABLE like any other statement. Another instance starting at the same time
+// waits on the record until we commit, then skips the migration.
+func migrateSQL(db *sql.DB, create string, claim string, migrations []sqlMigration) error {
+	if _, err := db.ExecContext(context.Background(), create); err != nil {
+		return fmt.Errorf("could not create schema_migrations: %w", err)
+	}
+	for _, m := range migrations {
+		if err := applySQLMigration(db, claim, m); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+func applySQLMigration(db *sql.DB, claim string, m sqlMigration) error {
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(context.Background(), claim, m.version, m.name)
+	if err != nil {
+		return err
+	}
+	if claimed, err := result.RowsAffected(); err != nil || claimed == 0 {
+		// Already applied
+		return err
+	}
+	for _, statement := range m.statements {
+		if _, err := tx.ExecContext(context.Background(), statement); err != nil {
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	slog.Info("applied a migration of the SQL schema", "version", m.version, "name", m.name)
+	return nil
+}
+
+// Keeps only the given API fields of a book, as the projection of
+// mongoProjection does.
+func onlyFields(book BookStore, fields []string) BookStore {
+	var kept BookStore
+	for _, field := range fields {
+		switch field {
+		case "id":
+			kept.ID = book.ID
+		case "title":
+			kept.BookName = book.BookName
+		case "author":
+			kept.BookAuthors = book.BookAuthors
+		case "edition":
+			kept.BookEdition = book.BookEdition
+		case "pages":
+			kept.BookPages = book.BookPages
+		case "year":
+			kept.BookYear = book.BookYear
+		case "series":
+			kept.Series = book.Series
+		case "volume":
+			kept.SeriesVolume = book.SeriesVolume
+		}
+	}
+	return kept
+}
+
+// Cursors are the seq of the last book of a page, base64-encoded like the
+// ones of MongoDB, see encodeCursor.
+func encodeSeqCursor(seq int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(seq, 10)))
+}
+
+func decodeSeqCursor(cursor string) (int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(raw), 10, 64)
+}
+
+// A row with the score after the columns of a book.
+type scoredRow struct {
+	rows  *sql.Rows
+	score *float64
+}
+
+func (s scoredRow) Scan(dest ...interface{}) error {
+	return s.rows.Scan(append(dest, s.score)...)
+}
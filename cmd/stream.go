@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// How many rows a streamed table sends at once.
+const streamFlushRows = 100
+
+// The books of a streamed table: a *mongo.Cursor, or the pages of a
+// BookRepository, see repositoryRows.
+type bookRows interface {
+	Next(ctx context.Context) bool
+	Decode(val interface{}) error
+	Err() error
+	Close(ctx context.Context) error
+}
+
+// Renders the books of the cursor as the "book-table" template does, one row
+// at a time, instead of reading them all with cursor.All first: however many
+// books there are, only one is in memory at a time. The rows are sent as they
+// come, so the browser shows the first ones before the last are read.
+// Once the first row is sent, the status cannot change anymore: an error
+// while reading the cursor ends the table early and only shows in the
+// request log, problemErrorHandler cannot answer with a problem anymore.
+func streamBookTable(c echo.Context, cursor bookRows) error {
+	defer cursor.Close(c.Request().Context())
+
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+	c.Response().WriteHeader(http.StatusOK)
+	// Rendered straight into the response: c.Render would write the header
+	// again for every row
+	render := c.Echo().Renderer
+	if err := render.Render(c.Response(), "book-table-head", "books", c); err != nil {
+		return err
+	}
+	rows := 0
+	for cursor.Next(c.Request().Context()) {
+		var book BookStore
+		if err := cursor.Decode(&book); err != nil {
+			return err
+		}
+		if err := render.Render(c.Response(), "book-row", booksToMaps([]BookStore{book})[0], c); err != nil {
+			return err
+		}
+		if rows++; rows%streamFlushRows == 0 {
+			flush(c)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	return render.Render(c.Response(), "book-table-foot", nil, c)
+}
+
+// Sends what the handler wrote so far. Writers that cannot, like the
+// recorder of the response cache, send it once their buffer is full instead.
+func flush(c echo.Context) {
+	_ = http.NewResponseController(c.Response()).Flush()
+}
+
+// All the listed books of a BookRepository, in the order they were added,
+// read a page of maxPageSize books at a time, as with GET /books?after=.
+// For the storages without a cursor of their own, see main.
+type repositoryRows struct {
+	repo  BookRepository
+	page  []BookStore
+	after string
+	last  bool
+	err   error
+}
+
+func (r *repositoryRows) Next(ctx context.Context) bool {
+	if len(r.page) > 0 {
+		r.page = r.page[1:]
+	}
+	for len(r.page) == 0 {
+		if r.last || r.err != nil {
+			return false
+		}
+		list, err := r.repo.FindAll(ctx, bookQuery{Cursor: true, After: r.after, Limit: maxPageSize})
+		if err != nil {
+			r.err = err
+			return false
+		}
+		r.page, r.after, r.last = list.Books, list.Next, list.Next == ""
+	}
+	return true
+}
+
+// Only decodes into a *BookStore, which is all streamBookTable asks for.
+func (r *repositoryRows) Decode(val interface{}) error {
+	*val.(*BookStore) = r.page[0]
+	return nil
+}
+
+func (r *repositoryRows) Err() error {
+	return r.err
+}
+
+func (r *repositoryRows) Close(ctx context.Context) error {
+	return nil
+}
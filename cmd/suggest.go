@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The most suggestions returned for one prefix.
+const maxSuggestions = 10
+
+// A title or an author completing what the user typed.
+type suggestion struct {
+	Text  string `json:"text"`
+	Field string `json:"field"`
+}
+
+// An in-memory trie of the titles and authors, for the typeahead of the
+// search bar: following the letters typed so far leads to every suggestion
+// starting with them. Each title and author is inserted once per word, so
+// "shel" also suggests "Mary Shelley".
+// Like the trigramIndex, it is built when first needed and again after
+// every write through the API.
+type suggestionTrie struct {
+	coll *mongo.Collection
+
+	mu    sync.Mutex
+	stale bool
+	root  *trieNode
+}
+
+type trieNode struct {
+	children map[rune]*trieNode
+	// The suggestions whose word ends here
+	suggestions []suggestion
+}
+
+func newSuggestionTrie(coll *mongo.Collection) *suggestionTrie {
+	return &suggestionTrie{coll: coll, stale: true}
+}
+
+func (t *suggestionTrie) invalidate() {
+	t.mu.Lock()
+	t.stale = true
+	t.mu.Unlock()
+}
+
+func (t *suggestionTrie) rebuild() error {
+	opts := options.Find().SetProjection(bson.M{"BookName": 1, "BookAuthor": 1})
+	cursor, err := t.coll.Find(context.Background(), listed(bson.M{}), opts)
+	if err != nil {
+		return err
+	}
+	var books []BookStore
+	if err = cursor.All(context.Background(), &books); err != nil {
+		return err
+	}
+
+	t.root = &trieNode{}
+	seen := map[suggestion]bool{}
+	for _, book := range books {
+		suggestions := []suggestion{{book.BookName, "title"}}
+		for _, name := range book.BookAuthors {
+			suggestions = append(suggestions, suggestion{name, "author"})
+		}
+		for _, s := range suggestions {
+			if s.Text == "" || seen[s] {
+				continue
+			}
+			seen[s] = true
+			for _, word := range wordStarts(s.Text) {
+				t.root.insert(word, s)
+			}
+		}
+	}
+	t.stale = false
+	return nil
+}
+
+// The text from the start of each of its words on, in lowercase: "Mary
+// Shelley" gives "mary shelley" and "shelley".
+func wordStarts(text string) []string {
+	lower := strings.ToLower(text)
+	var starts []string
+	for i, r := range lower {
+		if r != ' ' && (i == 0 || lower[i-1] == ' ') {
+			starts = append(starts, lower[i:])
+		}
+	}
+	return starts
+}
+
+func (n *trieNode) insert(key string, s suggestion) {
+	for _, r := range key {
+		if n.children == nil {
+			n.children = map[rune]*trieNode{}
+		}
+		child, ok := n.children[r]
+		if !ok {
+			child = &trieNode{}
+			n.children[r] = child
+		}
+		n = child
+	}
+	n.suggestions = append(n.suggestions, s)
+}
+
+// Returns up to maxSuggestions titles and authors starting with the prefix,
+// or having a word starting with it, in alphabetical order.
+func (t *suggestionTrie) suggest(prefix string) ([]suggestion, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stale {
+		if err := t.rebuild(); err != nil {
+			return nil, err
+		}
+	}
+
+	node := t.root
+	for _, r := range strings.ToLower(prefix) {
+		if node = node.children[r]; node == nil {
+			return []suggestion{}, nil
+		}
+	}
+
+	// A book may be reached through several of its words
+	found := []suggestion{}
+	seen := map[suggestion]bool{}
+	node.collect(func(s suggestion) bool {
+		if !seen[s] {
+			seen[s] = true
+			found = append(found, s)
+		}
+		return len(found) < maxSuggestions
+	})
+	return found, nil
+}
+
+// Walks the subtree in alphabetical order, handing every suggestion to
+// visit until it returns false.
+func (n *trieNode) collect(visit func(suggestion) bool) bool {
+	for _, s := range n.suggestions {
+		if !visit(s) {
+			return false
+		}
+	}
+	runes := make([]rune, 0, len(n.children))
+	for r := range n.children {
+		runes = append(runes, r)
+	}
+	slices.Sort(runes)
+	for _, r := range runes {
+		if !n.children[r].collect(visit) {
+			return false
+		}
+	}
+	return true
+}
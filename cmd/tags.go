@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The most tags a request may add or remove at once, and the longest tag.
+const (
+	maxTagsPerRequest = 20
+	maxTagLength      = 50
+)
+
+// A tag with the number of books having it, as listed by GET /api/tags.
+type tagSummary struct {
+	Tag   string `bson:"_id" json:"tag"`
+	Count int    `bson:"count" json:"count"`
+}
+
+// Tags are stored in lowercase and with single spaces, so "Science Fiction"
+// and "science  fiction" are the same tag.
+func normalizeTag(tag string) string {
+	return strings.Join(strings.Fields(strings.ToLower(tag)), " ")
+}
+
+// Reads the body of POST and DELETE /api/books/:id/tags, e.g.
+// {"tags": ["gothic", "horror"]}, into normalized tags without duplicates.
+func parseTagsInput(c echo.Context) ([]string, error) {
+	var input struct {
+		Tags []string `json:"tags"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return nil, newProblem(http.StatusBadRequest, "request body must be {\"tags\": [...]}")
+	}
+	if len(input.Tags) == 0 || len(input.Tags) > maxTagsPerRequest {
+		return nil, fieldErrors{"tags": fmt.Sprintf("must contain between 1 and %d tags", maxTagsPerRequest)}
+	}
+
+	var tags []string
+	for _, raw := range input.Tags {
+		tag := normalizeTag(raw)
+		if tag == "" {
+			return nil, fieldErrors{"tags": "cannot contain empty tags"}
+		}
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			return nil, fieldErrors{"tags": fmt.Sprintf("must be at most %d characters long each", maxTagLength)}
+		}
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil
+}
+
+// Applies the update to the tags of the book with the given ID and answers
+// with the tags it has afterwards. Changing the tags is a change of the book,
+// so its version goes up as well.
+func updateTags(c echo.Context, coll *mongo.Collection, update bson.M) error {
+	update["$inc"] = bson.M{"Version": 1}
+	update["$currentDate"] = bson.M{"UpdatedAt": true}
+	var book BookStore
+	err := coll.FindOneAndUpdate(c.Request().Context(),
+		live(bson.M{"ID": c.Param("id")}),
+		update,
+		options.FindOneAndUpdate().
+			SetReturnDocument(options.After).
+			SetProjection(bson.M{"Tags": 1}),
+	).Decode(&book)
+	if err != nil {
+		return err
+	}
+	if book.Tags == nil {
+		book.Tags = []string{}
+	}
+	return c.JSON(http.StatusOK, map[string][]string{"tags": book.Tags})
+}
+
+// Handles POST /api/books/:id/tags. Tags the book already has are left
+// alone.
+func addTags(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		tags, err := parseTagsInput(c)
+		if err != nil {
+			return err
+		}
+		return updateTags(c, coll, bson.M{"$addToSet": bson.M{"Tags": bson.M{"$each": tags}}})
+	}
+}
+
+// Handles DELETE /api/books/:id/tags. Tags the book does not have are
+// ignored.
+func removeTags(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		tags, err := parseTagsInput(c)
+		if err != nil {
+			return err
+		}
+		return updateTags(c, coll, bson.M{"$pullAll": bson.M{"Tags": tags}})
+	}
+}
+
+// Lists every tag with the number of books having it, the most used first.
+// Books in the trash are left out.
+func findTags(ctx context.Context, coll *mongo.Collection) ([]tagSummary, error) {
+	pipeline := bson.A{
+		bson.M{"$match": listed(bson.M{"Tags.0": bson.M{"$exists": true}})},
+		bson.M{"$unwind": "$Tags"},
+		bson.M{"$group": bson.M{"_id": "$Tags", "count": bson.M{"$sum": 1}}},
+		bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+	}
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	tags := []tagSummary{}
+	if err = cursor.All(ctx, &tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// A tag of the tag cloud, with the font size showing how often it is used.
+type cloudTag struct {
+	Tag   string
+	Count int
+	Size  string
+}
+
+// Sizes the tags of the /tags page between 1em, for the least used, and
+// 2.5em, for the most used, in alphabetical order.
+func tagCloud(tags []tagSummary) []cloudTag {
+	least, most := 0, 0
+	for i, tag := range tags {
+		if i == 0 || tag.Count < least {
+			least = tag.Count
+		}
+		if tag.Count > most {
+			most = tag.Count
+		}
+	}
+
+	cloud := []cloudTag{}
+	for _, tag := range tags {
+		size := 1.0
+		if most > least {
+			size += 1.5 * float64(tag.Count-least) / float64(most-least)
+		}
+		cloud = append(cloud, cloudTag{Tag: tag.Tag, Count: tag.Count, Size: fmt.Sprintf("%.2fem", size)})
+	}
+	sort.Slice(cloud, func(i, j int) bool { return cloud[i].Tag < cloud[j].Tag })
+	return cloud
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/CAPS-Cloud/exercises/internal/config"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The server speaks HTTPS itself when told how to get its certificate,
+// rather than behind a proxy doing it for it:
+//
+//   - with TLS_CERT_FILE and TLS_KEY_FILE, the files of a certificate and of
+//     its key, in PEM
+//   - with TLS_AUTOCERT_DOMAINS, from Let's Encrypt, which checks that the
+//     server answers for the domains. The certificates are kept in
+//     TLS_AUTOCERT_CACHE, so a restart does not ask for new ones, and renewed
+//     before they expire.
+//
+// With HTTP_REDIRECT_PORT, usually 80, a second listener sends the clients
+// of plain HTTP to HTTPS, and answers the challenges of Let's Encrypt.
+
+// Starts listening at the address, with HTTPS if the settings say so. It
+// returns when the server stops, like e.Start. Echo does not print where it
+// listens, see main; we log it instead. Over plain HTTP, we open the
+// listener ourselves, so the address logged is the one bound, e.g. the
+// port picked for PORT=0, or the UNIX_SOCKET.
+func startServer(e *echo.Echo, address string, settings config.TLS) error {
+	switch {
+	case settings.CertFile != "":
+		slog.Info("HTTPS server starting", "address", address, "certificate", settings.CertFile)
+		return e.StartTLS(address, settings.CertFile, settings.KeyFile)
+	case len(settings.AutocertDomains) > 0:
+		e.AutoTLSManager.Cache = autocert.DirCache(settings.AutocertCache)
+		e.AutoTLSManager.HostPolicy = autocert.HostWhitelist(settings.AutocertDomains...)
+		e.AutoTLSManager.Email = settings.AutocertEmail
+		slog.Info("HTTPS server starting", "address", address, "domains", settings.AutocertDomains)
+		return e.StartAutoTLS(address)
+	default:
+		if e.Listener == nil {
+			listener, err := net.Listen("tcp", address)
+			if err != nil {
+				return err
+			}
+			e.Listener = listener
+		}
+		slog.Info("HTTP server started", "address", e.Listener.Addr().String())
+		return e.Start(address)
+	}
+}
+
+// The listener of HTTP_REDIRECT_PORT, at BIND_ADDRESS, nil without one. It
+// redirects to the same host and path on PORT, the one of HTTPS.
+func redirectServer(e *echo.Echo, settings config.Config) *http.Server {
+	if settings.TLS.RedirectPort == 0 {
+		return nil
+	}
+	var handler http.Handler = httpsRedirect(settings.Port)
+	if len(settings.TLS.AutocertDomains) > 0 {
+		// Let's Encrypt may check the domains over plain HTTP
+		handler = e.AutoTLSManager.HTTPHandler(handler)
+	}
+	return &http.Server{
+		Addr:    listenAddress(settings, settings.TLS.RedirectPort),
+		Handler: handler,
+	}
+}
+
+// Redirects every request to HTTPS. 308 Permanent Redirect, unlike 301,
+// keeps the method and the body of a POST.
+func httpsRedirect(port int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			// No port, but maybe an IPv6 address, like [::1]
+			host = strings.Trim(host, "[]")
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build tools
+
+package main
+
+// The generator of graphql_generated.go, kept in go.mod for go generate, see
+// graphql.go
+import _ "github.com/99designs/gqlgen"
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Runs the operations changing several documents, like a checkout and the
+// copies of its book, in a transaction: either every change is applied, or
+// none is. MongoDB only has transactions on replica sets and sharded
+// clusters, see https://www.mongodb.com/docs/manual/core/transactions/
+// On a standalone server, the operations run without one, and undo their
+// first changes themselves when a later one fails, see inTransaction. Other
+// requests may then see the changes of a failed operation for a moment.
+type transactions struct {
+	client    *mongo.Client
+	supported bool
+}
+
+// Asks the server whether it can run transactions: the members of a replica
+// set tell its name, and the routers of a sharded cluster say "isdbgrid".
+func prepareTransactions(client *mongo.Client) (*transactions, error) {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	err := client.Database("admin").RunCommand(context.Background(), bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if err != nil {
+		return nil, err
+	}
+	supported := hello.SetName != "" || hello.Msg == "isdbgrid"
+	if !supported {
+		slog.Warn("MongoDB is a standalone server, operations on several documents run without transactions")
+	}
+	return &transactions{client: client, supported: supported}, nil
+}
+
+// Runs fn in a transaction, if the server has them, and returns its error.
+// Every operation of fn must use the context it gets, which ends with ctx,
+// usually the one of the request. fn may run several times, when MongoDB
+// asks to retry the transaction, so it must not change anything besides the
+// database.
+func (t *transactions) run(ctx context.Context, fn func(ctx context.Context) error) error {
+	if t == nil || !t.supported {
+		return fn(ctx)
+	}
+	session, err := t.client.StartSession()
+	if err != nil {
+		return err
+	}
+	// Even when the request was cancelled, so the transaction is aborted
+	defer session.EndSession(context.WithoutCancel(ctx))
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(ctx)
+	})
+	return err
+}
+
+// Reports whether the context is the one of a transaction, see run. Without
+// one, fn has to undo its changes itself when it fails halfway.
+func inTransaction(ctx context.Context) bool {
+	return mongo.SessionFromContext(ctx) != nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The name of the index purging the trash.
+const trashIndexName = "trash_ttl"
+
+// Lets MongoDB delete the books that stayed longer than retention in the
+// trash, with a TTL index on DeletedAt: the books not in the trash have no
+// DeletedAt, so they are never touched. The TTL monitor runs about once a
+// minute, so a book may stay a little longer. See
+// https://www.mongodb.com/docs/manual/core/index-ttl/
+// When the retention changed since the last start, the existing index is
+// modified in place instead of built again.
+func prepareTrashIndex(coll *mongo.Collection, retention time.Duration) error {
+	seconds := int32(retention.Seconds())
+	cursor, err := coll.Indexes().List(context.Background())
+	if err != nil {
+		return err
+	}
+	var indexes []bson.M
+	if err = cursor.All(context.Background(), &indexes); err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if index["name"] != trashIndexName {
+			continue
+		}
+		if index["expireAfterSeconds"] == seconds {
+			return nil
+		}
+		cmd := bson.D{
+			{Key: "collMod", Value: coll.Name()},
+			{Key: "index", Value: bson.M{"name": trashIndexName, "expireAfterSeconds": seconds}},
+		}
+		return coll.Database().RunCommand(context.Background(), cmd).Err()
+	}
+
+	_, err = coll.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "DeletedAt", Value: 1}},
+		Options: options.Index().SetName(trashIndexName).SetExpireAfterSeconds(seconds),
+	})
+	return err
+}
+
+// Deleting a book only moves it to the trash, by setting its DeletedAt, so
+// it can be restored. Every query must leave the trash out: this returns a
+// copy of the filter that does.
+func live(filter bson.M) bson.M {
+	result := bson.M{"DeletedAt": bson.M{"$exists": false}}
+	for key, value := range filter {
+		result[key] = value
+	}
+	return result
+}
+
+// The update moving books to the trash. Like any other change, it counts the
+// version up, so a client holding the book's ETag notices.
+func trashUpdate() bson.M {
+	return bson.M{
+		"$set":         bson.M{"DeletedAt": time.Now()},
+		"$inc":         bson.M{"Version": 1},
+		"$currentDate": bson.M{"UpdatedAt": true},
+	}
+}
+
+// The books in the trash, as opposed to live.
+func trashed(filter bson.M) bson.M {
+	result := bson.M{"DeletedAt": bson.M{"$exists": true}}
+	for key, value := range filter {
+		result[key] = value
+	}
+	return result
+}
+
+// Handles GET /api/books/trash: the deleted books, last deleted first, with
+// the time they were deleted.
+func listTrash(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		limit, err := parseLimit(c)
+		if err != nil {
+			return newProblem(http.StatusBadRequest, err.Error())
+		}
+		opts := options.Find().
+			SetSort(bson.D{{Key: "DeletedAt", Value: -1}, {Key: "_id", Value: -1}}).
+			SetLimit(limit)
+		cursor, err := coll.Find(c.Request().Context(), trashed(bson.M{}), opts)
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		var books []BookStore
+		if err = cursor.All(c.Request().Context(), &books); err != nil {
+			return serverProblem(err, "database error")
+		}
+
+		response := []map[string]interface{}{}
+		for _, book := range books {
+			formatted := bookToAPI(book)
+			formatted["deletedAt"] = book.DeletedAt.UTC().Format(time.RFC3339)
+			response = append(response, formatted)
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+// Handles POST /api/books/:id/restore, taking the book out of the trash.
+// The ID may have been given to a new book since; restoring the old one
+// would make it ambiguous, so this is a 409 Conflict. If the trash holds
+// several books with the ID, the last deleted one is restored.
+func restoreBook(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		bookID := c.Param("id")
+		count, err := coll.CountDocuments(c.Request().Context(), live(bson.M{"ID": bookID}))
+		if err != nil {
+			return serverProblem(err, "database error")
+		}
+		if count > 0 {
+			return newProblem(http.StatusConflict, "another book with this ID exists")
+		}
+
+		err = coll.FindOneAndUpdate(c.Request().Context(),
+			trashed(bson.M{"ID": bookID}),
+			bson.M{"$unset": bson.M{"DeletedAt": ""}, "$inc": bson.M{"Version": 1}, "$currentDate": bson.M{"UpdatedAt": true}},
+			options.FindOneAndUpdate().SetSort(bson.D{{Key: "DeletedAt", Value: -1}}),
+		).Err()
+		if err == mongo.ErrNoDocuments {
+			return newProblem(http.StatusNotFound, "book not found in the trash")
+		}
+		if mongo.IsDuplicateKeyError(err) {
+			// A book with the ID was created since we counted
+			return newProblem(http.StatusConflict, "another book with this ID exists")
+		}
+		if err != nil {
+			return serverProblem(err, "could not restore book")
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "book restored"})
+	}
+}
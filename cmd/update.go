@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"slices"
+	"strconv"
+
+	"github.com/CAPS-Cloud/exercises/internal/isbn"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The fields a client must always send when it describes a whole book.
+var requiredFields = []string{"title", "author"}
+
+// Builds the complete document a PUT replaces the stored book with. PUT
+// describes the full new state of the book, so the required fields must be
+// present, and optional fields that are left out are removed from the
+// database.
+// The `id` in the body is optional (see README), but if it is there it must
+// be the one of the URL: the ID of a book cannot be changed.
+// Every problem with the input is collected into the returned fieldErrors.
+func bookFromInput(bookID string, input map[string]interface{}) (BookStore, error) {
+	errs := fieldErrors{}
+	checkBodyID(bookID, input, errs)
+
+	values := map[string]string{}
+	for key, raw := range input {
+		// The authors are read by authorsFromInput
+		if key == "id" || key == "author" || key == "authors" {
+			continue
+		}
+		if _, ok := bookFields[key]; !ok {
+			errs[key] = "is not a field of a book"
+			continue
+		}
+		value, message := inputValue(key, raw)
+		if message != "" {
+			errs[key] = message
+			continue
+		}
+		if value == "" {
+			continue
+		}
+		if message := validateField(key, value); message != "" {
+			errs[key] = message
+			continue
+		}
+		values[key] = value
+	}
+	authors, authorsKey := authorsFromInput(input, errs)
+	if authorsKey == "" {
+		authorsKey = "author"
+	}
+	if _, invalid := errs[authorsKey]; !invalid && len(authors) == 0 {
+		errs[authorsKey] = "is required"
+	}
+	for _, field := range requiredFields {
+		if field == "author" {
+			continue
+		}
+		if _, invalid := errs[field]; !invalid && values[field] == "" {
+			errs[field] = "is required"
+		}
+	}
+	if values["volume"] != "" && values["series"] == "" {
+		errs["volume"] = "needs a series"
+	}
+	if len(errs) > 0 {
+		return BookStore{}, errs
+	}
+
+	return BookStore{
+		ID:          bookID,
+		BookName:    values["title"],
+		BookAuthors: authors,
+		// Validated values, so there is no error
+		BookEdition:  storedValue("edition", values["edition"]).(string),
+		BookPages:    storedValue("pages", values["pages"]).(int),
+		BookYear:     storedValue("year", values["year"]).(int),
+		Series:       values["series"],
+		SeriesVolume: storedValue("volume", values["volume"]).(int),
+	}, nil
+}
+
+// Builds the document for a new book from the body of a create request.
+// Unlike for an update, the ID comes from the body, so it is required.
+func bookFromCreateInput(input map[string]interface{}) (BookStore, error) {
+	id, _ := input["id"].(string)
+	book, err := bookFromInput(id, input)
+
+	errs, _ := err.(fieldErrors)
+	if errs == nil {
+		errs = fieldErrors{}
+	}
+	if id == "" {
+		errs["id"] = "is required"
+	} else if message := validateField("id", id); message != "" {
+		errs["id"] = message
+	}
+	if len(errs) > 0 {
+		return BookStore{}, errs
+	}
+	return book, nil
+}
+
+// The update turning the stored book into the given one. Empty optional
+// fields are removed, as they would be by replacing the whole document, but
+// we keep the MongoID and count up the version.
+func replaceUpdate(book BookStore) bson.M {
+	set := bson.M{
+		"ID":         book.ID,
+		"BookName":   book.BookName,
+		"BookAuthor": book.BookAuthors,
+	}
+	unset := bson.M{}
+	if len(book.AuthorIDs) > 0 {
+		set["AuthorID"] = book.AuthorIDs
+	} else {
+		unset["AuthorID"] = ""
+	}
+	optional := map[string]interface{}{
+		"BookEdition":  book.BookEdition,
+		"BookPages":    book.BookPages,
+		"BookYear":     book.BookYear,
+		"Series":       book.Series,
+		"SeriesVolume": book.SeriesVolume,
+	}
+	for field, value := range optional {
+		if value == "" || value == 0 {
+			unset[field] = ""
+		} else {
+			set[field] = value
+		}
+	}
+
+	update := bson.M{"$set": set, "$inc": bson.M{"Version": 1}, "$currentDate": bson.M{"UpdatedAt": true}}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return update
+}
+
+// Translates a JSON Merge Patch (https://www.rfc-editor.org/rfc/rfc7386) into
+// a MongoDB update. In a merge patch, every key that is present replaces the
+// stored value, a `null` removes the field, and absent keys are left alone.
+// Our books are flat, so there is no nested object to merge recursively.
+// Required fields can be changed but not removed.
+func mergePatchUpdate(bookID string, patch map[string]interface{}) (bson.M, error) {
+	errs := fieldErrors{}
+	checkBodyID(bookID, patch, errs)
+
+	set := bson.M{}
+	unset := bson.M{}
+	for key, raw := range patch {
+		if key == "id" || key == "author" || key == "authors" {
+			continue
+		}
+		mongoField, ok := bookFields[key]
+		if !ok {
+			errs[key] = "is not a field of a book"
+			continue
+		}
+		if raw == nil {
+			if isRequired(key) {
+				errs[key] = "cannot be removed"
+				continue
+			}
+			unset[mongoField] = ""
+			continue
+		}
+		value, message := inputValue(key, raw)
+		if message != "" {
+			errs[key] = message
+			continue
+		}
+		if value == "" {
+			if isRequired(key) {
+				errs[key] = "cannot be empty"
+			} else {
+				unset[mongoField] = ""
+			}
+			continue
+		}
+		if message := validateField(key, value); message != "" {
+			errs[key] = message
+			continue
+		}
+		set[mongoField] = storedValue(key, value)
+	}
+	if authors, key := authorsFromInput(patch, errs); key != "" {
+		if _, invalid := errs[key]; !invalid && len(authors) == 0 {
+			errs[key] = "cannot be removed"
+		} else if !invalid {
+			set["BookAuthor"] = authors
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	if len(update) > 0 {
+		update["$inc"] = bson.M{"Version": 1}
+		update["$currentDate"] = bson.M{"UpdatedAt": true}
+	}
+	return update, nil
+}
+
+// The value of a field as we store it: numbers for numericFields, whose
+// value must be validated or empty, strings otherwise. An empty number is 0,
+// i.e. not stored. Editions are stored as ISBN-13 without hyphens, so the
+// same ISBN is always the same string.
+func storedValue(field string, value string) interface{} {
+	if field == "edition" {
+		if normalized, err := isbn.Normalize(value); err == nil {
+			return normalized
+		}
+		return value
+	}
+	if !numericFields[field] {
+		return value
+	}
+	if value == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		// Cannot match any stored number, e.g. in a filter
+		return value
+	}
+	return n
+}
+
+// Decodes a JSON object from a request body. Echo's Bind only understands
+// plain application/json, whereas patches come with their own media types.
+func decodeJSONObject(body io.Reader) (map[string]interface{}, error) {
+	var object map[string]interface{}
+	if err := json.NewDecoder(body).Decode(&object); err != nil {
+		return nil, err
+	}
+	if object == nil {
+		return nil, fmt.Errorf("body must be a JSON object")
+	}
+	return object, nil
+}
+
+// Reads the body of the request into input, like c.Bind, but only the
+// body: c.Bind copies the path parameters in first, and into a map they go
+// as []string, e.g. the "id" of /books/:id.
+func bindBody(c echo.Context, input interface{}) error {
+	return (&echo.DefaultBinder{}).BindBody(c, input)
+}
+
+// The ID in the body, if the client sent one, must be the one of the URL.
+func checkBodyID(bookID string, input map[string]interface{}, errs fieldErrors) {
+	raw, ok := input["id"]
+	if !ok {
+		return
+	}
+	if id, isString := raw.(string); !isString || id != bookID {
+		errs["id"] = "cannot be changed"
+	}
+}
+
+func isRequired(field string) bool {
+	return slices.Contains(requiredFields, field)
+}
+
+// The media type of the request body, without parameters like charset.
+func mediaType(c echo.Context) string {
+	mediaType, _, err := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
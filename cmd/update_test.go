@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Decodes a body the way the handlers do.
+func decodeInput(t *testing.T, body string) map[string]interface{} {
+	t.Helper()
+	var input map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &input); err != nil {
+		t.Fatal(err)
+	}
+	return input
+}
+
+func TestMergePatchUpdate(t *testing.T) {
+	changes := func(set bson.M, unset bson.M) bson.M {
+		update := bson.M{"$inc": bson.M{"Version": 1}, "$currentDate": bson.M{"UpdatedAt": true}}
+		if set != nil {
+			update["$set"] = set
+		}
+		if unset != nil {
+			update["$unset"] = unset
+		}
+		return update
+	}
+	tests := []struct {
+		name  string
+		patch string
+		want  bson.M
+		// The fields in error, when it fails
+		errs []string
+	}{
+		{"sets a field", `{"year": 1831}`, changes(bson.M{"BookYear": 1831}, nil), nil},
+		{"removes a field with null", `{"series": null}`, changes(nil, bson.M{"Series": ""}), nil},
+		{"removes a field with an empty string", `{"pages": ""}`, changes(nil, bson.M{"BookPages": ""}), nil},
+		{"normalizes the edition", `{"edition": "0-306-40615-2"}`, changes(bson.M{"BookEdition": "9780306406157"}, nil), nil},
+		{"sets the authors", `{"authors": ["Neil Gaiman", "Terry Pratchett"]}`, changes(bson.M{"BookAuthor": []string{"Neil Gaiman", "Terry Pratchett"}}, nil), nil},
+		{"with the id of the URL", `{"id": "dune", "title": "Dune"}`, changes(bson.M{"BookName": "Dune"}, nil), nil},
+		{"changes nothing", `{}`, bson.M{}, nil},
+		{"removes the title", `{"title": null}`, nil, []string{"title"}},
+		{"empties the title", `{"title": ""}`, nil, []string{"title"}},
+		{"removes the author", `{"author": null}`, nil, []string{"author"}},
+		{"with another id", `{"id": "other"}`, nil, []string{"id"}},
+		{"with several mistakes", `{"colour": "red", "year": "soon", "pages": 0}`, nil, []string{"colour", "pages", "year"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			update, err := mergePatchUpdate("dune", decodeInput(t, tt.patch))
+			if tt.errs != nil {
+				checkFieldErrors(t, err, tt.errs)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(update, tt.want) {
+				t.Errorf("got %v, want %v", update, tt.want)
+			}
+		})
+	}
+}
+
+func TestBookFromCreateInput(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want BookStore
+		errs []string
+	}{
+		{
+			name: "with every field",
+			body: `{"id": "good-omens", "title": "Good Omens", "authors": ["Neil Gaiman", "Terry Pratchett"], "edition": "0-575-04800-X", "pages": "288", "year": 1990, "series": "Omens", "volume": 1}`,
+			want: BookStore{ID: "good-omens", BookName: "Good Omens", BookAuthors: []string{"Neil Gaiman", "Terry Pratchett"},
+				BookEdition: "9780575048003", BookPages: 288, BookYear: 1990, Series: "Omens", SeriesVolume: 1},
+		},
+		{
+			name: "with the required fields",
+			body: `{"id": "dune", "title": "Dune", "author": "Frank Herbert"}`,
+			want: BookStore{ID: "dune", BookName: "Dune", BookAuthors: []string{"Frank Herbert"}},
+		},
+		{"without anything", `{}`, BookStore{}, []string{"author", "id", "title"}},
+		{"with a volume but no series", `{"id": "dune", "title": "Dune", "author": "Frank Herbert", "volume": 2}`, BookStore{}, []string{"volume"}},
+		{"with authors that disagree", `{"id": "dune", "title": "Dune", "author": "Frank Herbert", "authors": ["Brian Herbert"]}`, BookStore{}, []string{"author"}},
+		{"with a wrong edition", `{"id": "dune", "title": "Dune", "author": "Frank Herbert", "edition": "978-0-306-40615-8"}`, BookStore{}, []string{"edition"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			book, err := bookFromCreateInput(decodeInput(t, tt.body))
+			if tt.errs != nil {
+				checkFieldErrors(t, err, tt.errs)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(book, tt.want) {
+				t.Errorf("got %+v, want %+v", book, tt.want)
+			}
+		})
+	}
+}
+
+// Checks that err lists exactly the fields given.
+func checkFieldErrors(t *testing.T, err error, fields []string) {
+	t.Helper()
+	errs, ok := err.(fieldErrors)
+	if !ok {
+		t.Fatalf("got %v, want field errors", err)
+	}
+	if len(errs) != len(fields) {
+		t.Errorf("got %v, want errors on %v", errs, fields)
+	}
+	for _, field := range fields {
+		if _, ok := errs[field]; !ok {
+			t.Errorf("got %v, want an error on %s", errs, field)
+		}
+	}
+}
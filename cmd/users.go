@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The shortest password we accept.
+const minPasswordLength = 8
+
+// A user who can log in, see jwt.go. Usernames are unique, so they serve as
+// the MongoID. Unlike API keys, passwords are chosen by people and often
+// guessable, so they are hashed with bcrypt, which is slow on purpose.
+type user struct {
+	Username     string    `bson:"_id"`
+	PasswordHash []byte    `bson:"PasswordHash"`
+	Role         role      `bson:"Role,omitempty"`
+	CreatedAt    time.Time `bson:"CreatedAt"`
+}
+
+// Compared against when the user does not exist, so a login takes as long
+// for an unknown user as for a wrong password, and does not reveal which
+// usernames exist.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// Returns the user if the password is theirs, otherwise nil.
+func checkPassword(ctx context.Context, users *mongo.Collection, username string, password string) (*user, error) {
+	var found user
+	err := users.FindOne(ctx, bson.M{"_id": username}).Decode(&found)
+	if err == mongo.ErrNoDocuments {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if bcrypt.CompareHashAndPassword(found.PasswordHash, []byte(password)) != nil {
+		return nil, nil
+	}
+	return &found, nil
+}
+
+// Handles POST /api/admin/users, creating a user from
+// {"username": "ada", "password": "...", "role": "editor"}, the role being
+// optional.
+func createUser(users *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var input struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Role     string `json:"role"`
+		}
+		if err := c.Bind(&input); err != nil {
+			return newProblem(http.StatusBadRequest, "invalid request body")
+		}
+		input.Username = strings.TrimSpace(input.Username)
+		errs := fieldErrors{}
+		if input.Username == "" {
+			errs["username"] = "is required"
+		}
+		// bcrypt only looks at the first 72 bytes
+		if len(input.Password) < minPasswordLength || len(input.Password) > 72 {
+			errs["password"] = "must be between 8 and 72 characters"
+		}
+		userRole, ok := parseRole(input.Role)
+		if !ok {
+			errs["role"] = roleError
+		}
+		if len(errs) > 0 {
+			return errs
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return serverProblem(err, "could not create user")
+		}
+		_, err = users.InsertOne(c.Request().Context(), user{
+			Username:     input.Username,
+			PasswordHash: hash,
+			Role:         userRole,
+			CreatedAt:    time.Now(),
+		})
+		if mongo.IsDuplicateKeyError(err) {
+			return newProblem(http.StatusConflict, "username already taken")
+		}
+		if err != nil {
+			return serverProblem(err, "could not create user")
+		}
+		return c.JSON(http.StatusCreated, map[string]string{"message": "user created"})
+	}
+}
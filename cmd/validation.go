@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/CAPS-Cloud/exercises/internal/isbn"
+)
+
+// The validation errors of a request body, by API key, e.g.
+//
+//	{"year": "must be a number", "title": "is required"}
+//
+// Handlers return it as an error, and problemFor turns it into a 422
+// Unprocessable Content response listing every field, so forms can highlight
+// all the offending inputs at once.
+type fieldErrors map[string]string
+
+func (fe fieldErrors) Error() string {
+	var parts []string
+	for field, message := range fe {
+		parts = append(parts, field+" "+message)
+	}
+	sort.Strings(parts)
+	return "invalid fields: " + strings.Join(parts, ", ")
+}
+
+// The longest value, in characters, each field accepts.
+var maxFieldLengths = map[string]int{
+	"id":      64,
+	"title":   300,
+	"author":  200,
+	"edition": 17,
+	"pages":   6,
+	"year":    4,
+	"series":  200,
+	"volume":  4,
+}
+
+// The fields stored as numbers. The API accepts them as JSON numbers or as
+// strings, like "1818", the format of its responses.
+var numericFields = map[string]bool{"pages": true, "year": true, "volume": true}
+
+// Reads the value a client sent for a field as a string, as validateField
+// expects it, or returns what is wrong with it.
+func inputValue(field string, raw interface{}) (string, string) {
+	switch value := raw.(type) {
+	case string:
+		return value, ""
+	case float64:
+		// JSON numbers are decoded as float64
+		if numericFields[field] && value == float64(int(value)) {
+			return strconv.Itoa(int(value)), ""
+		}
+	}
+	if numericFields[field] {
+		return "", "must be a whole number"
+	}
+	return "", "must be a string"
+}
+
+// Checks the value of one field, returning what is wrong with it, or "" if
+// nothing is. Empty values are checked by the callers, since they are fine
+// for optional fields.
+func validateField(field string, value string) string {
+	if limit, ok := maxFieldLengths[field]; ok && utf8.RuneCountInString(value) > limit {
+		return fmt.Sprintf("must be at most %d characters long", limit)
+	}
+
+	switch field {
+	case "edition":
+		// With or without hyphens, e.g. 958-30-0804-4 or 978-3-649-64609-9
+		switch isbn.Validate(value) {
+		case isbn.ErrChecksum:
+			return "has a wrong check digit"
+		case isbn.ErrFormat:
+			return "must be an ISBN-10 or ISBN-13"
+		}
+	case "pages", "volume":
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 1 {
+			return "must be a positive number"
+		}
+	case "year":
+		year, err := strconv.Atoi(value)
+		if err != nil {
+			return "must be a number"
+		}
+		// There was no year 0, and we store it for "no year"
+		if year == 0 {
+			return "cannot be 0"
+		}
+		// Announced books may be a little ahead of us
+		if year > time.Now().Year()+1 {
+			return "cannot be in the future"
+		}
+	}
+	return ""
+}
+
+// The most authors a book may have.
+const maxAuthorsPerBook = 20
+
+// Reads the authors of a book from the body of a request. Clients send
+// "author", one name as they always did, or "authors", a list of names,
+// e.g. ["Neil Gaiman", "Terry Pratchett"]. A single string is always one
+// name, even with commas. Both keys may be sent, like GET returns them, as
+// long as they agree: "author" is then the names joined by joinAuthors.
+// Returns the key the names come from, "" if the body has neither, and adds
+// the problems to errs. Names that are the same author, like "mary shelley"
+// and "Mary Shelley", are only kept once.
+func authorsFromInput(input map[string]interface{}, errs fieldErrors) ([]string, string) {
+	rawList, hasList := input["authors"]
+	rawName, hasName := input["author"]
+	switch {
+	case hasList && hasName:
+		names := authorNames("authors", rawList, errs)
+		fromName := authorNames("author", rawName, errs)
+		_, invalidList := errs["authors"]
+		_, invalidName := errs["author"]
+		if !invalidList && !invalidName && joinAuthors(fromName) != joinAuthors(names) {
+			errs["author"] = "does not match authors"
+		}
+		return names, "authors"
+	case hasList:
+		return authorNames("authors", rawList, errs), "authors"
+	case hasName:
+		return authorNames("author", rawName, errs), "author"
+	}
+	return nil, ""
+}
+
+// Reads a name or a list of names, see authorsFromInput. null, "" and []
+// are no names.
+func authorNames(key string, raw interface{}, errs fieldErrors) []string {
+	var list []interface{}
+	switch value := raw.(type) {
+	case nil:
+		return nil
+	case string:
+		if strings.TrimSpace(value) == "" {
+			return nil
+		}
+		list = []interface{}{value}
+	case []interface{}:
+		list = value
+	default:
+		errs[key] = "must be a string or a list of strings"
+		return nil
+	}
+	if len(list) > maxAuthorsPerBook {
+		errs[key] = fmt.Sprintf("must have at most %d names", maxAuthorsPerBook)
+		return nil
+	}
+
+	var names []string
+	seen := map[string]bool{}
+	for _, raw := range list {
+		name, ok := raw.(string)
+		if !ok {
+			errs[key] = "must be a string or a list of strings"
+			return nil
+		}
+		if strings.TrimSpace(name) == "" {
+			errs[key] = "cannot contain empty names"
+			return nil
+		}
+		if message := validateField("author", name); message != "" {
+			errs[key] = message
+			return nil
+		}
+		if !seen[normalizeText(name)] {
+			seen[normalizeText(name)] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// The names of the authors of a book as one string, like the API had for
+// the author before books could have several, e.g. "Neil Gaiman, Terry
+// Pratchett".
+func joinAuthors(names []string) string {
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateField(t *testing.T) {
+	nextYear := strconv.Itoa(time.Now().Year() + 1)
+	tests := []struct {
+		field   string
+		value   string
+		message string
+	}{
+		{"title", "Frankenstein", ""},
+		{"title", strings.Repeat("a", 301), "must be at most 300 characters long"},
+		{"edition", "978-3-649-64609-9", ""},
+		{"edition", "958-30-0804-4", ""},
+		{"edition", "978-3-649-64609-8", "has a wrong check digit"},
+		{"edition", "first", "must be an ISBN-10 or ISBN-13"},
+		{"pages", "280", ""},
+		{"pages", "0", "must be a positive number"},
+		{"volume", "two", "must be a positive number"},
+		{"year", "-44", ""},
+		{"year", nextYear, ""},
+		{"year", "0", "cannot be 0"},
+		{"year", "9999", "cannot be in the future"},
+		{"year", "soon", "must be a number"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field+"="+tt.value, func(t *testing.T) {
+			if message := validateField(tt.field, tt.value); message != tt.message {
+				t.Errorf("got %q, want %q", message, tt.message)
+			}
+		})
+	}
+}
+
+func TestInputValue(t *testing.T) {
+	tests := []struct {
+		field   string
+		raw     interface{}
+		value   string
+		message string
+	}{
+		{"title", "Dune", "Dune", ""},
+		{"year", float64(1965), "1965", ""},
+		{"year", "1965", "1965", ""},
+		{"year", 1965.5, "", "must be a whole number"},
+		{"title", float64(1), "", "must be a string"},
+		{"title", true, "", "must be a string"},
+	}
+	for _, tt := range tests {
+		value, message := inputValue(tt.field, tt.raw)
+		if value != tt.value || message != tt.message {
+			t.Errorf("%s=%v: got %q, %q, want %q, %q", tt.field, tt.raw, value, message, tt.value, tt.message)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+// Package bookpb holds the messages and the service of books.proto, the
+// BookService the server offers over gRPC, see cmd/grpc.go. After a change of
+// books.proto, regenerate them with go generate ./internal/bookpb, which needs
+// protoc, protoc-gen-go and protoc-gen-go-grpc.
+package bookpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative books.proto
@@ -0,0 +1,121 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// The name of a setting on the command line: MONGO_URI is --mongo-uri.
+func flagName(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+}
+
+// Parses the command line: one flag per setting, and --config for the
+// file. Returns the values of the flags given, by the names of their
+// settings, and the path of the file.
+// Go accepts both -port and --port, and -port 8080 as well as -port=8080.
+func parseFlags(args []string, all []setting) (map[string]string, string, error) {
+	flags := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	path := flags.String("config", "", "a YAML or TOML `file` with settings, see the README")
+	names := map[string]string{}
+	for _, s := range all {
+		fallback := s.fallback
+		if s.secret != "" {
+			// The usage is no place for passwords, even default ones
+			fallback = ""
+		}
+		flags.String(flagName(s.name), fallback, "same as "+s.name)
+		names[flagName(s.name)] = s.name
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, "", err
+	}
+	if flags.NArg() > 0 {
+		return nil, "", fmt.Errorf("unexpected argument %q, settings are given as flags like --port=8080", flags.Arg(0))
+	}
+
+	values := map[string]string{}
+	flags.Visit(func(f *flag.Flag) {
+		if name, ok := names[f.Name]; ok {
+			values[name] = f.Value.String()
+		}
+	})
+	return values, *path, nil
+}
+
+// Reads the settings of a YAML or TOML file, by its extension. Its keys are
+// the names of the settings in lowercase, e.g. in YAML:
+//
+//	port: 8080
+//	mongo_uri: mongodb://db.example.com:27017
+//	cache_ttl: 1m
+//	seed: false
+//
+// Durations are strings, in TOML as well: cache_ttl = "1m". Lists are either
+// lists or comma separated strings. A key that is no
+// setting is refused, so a typo does not go unnoticed.
+func readFile(path string, all []setting) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("the name must end with .yaml, .yml or .toml")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	known := map[string]bool{}
+	for _, s := range all {
+		known[s.name] = true
+	}
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	values := map[string]string{}
+	var errs []error
+	for _, key := range keys {
+		name := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		if !known[name] {
+			errs = append(errs, fmt.Errorf("unknown setting %q", key))
+			continue
+		}
+		switch value := raw[key].(type) {
+		case nil:
+			// An empty value, like in the environment
+			values[name] = ""
+		case string:
+			values[name] = value
+		case bool, int, int64, uint64, float64:
+			values[name] = fmt.Sprint(value)
+		case []interface{}:
+			// A list, like the domains of TLS_AUTOCERT_DOMAINS
+			var items []string
+			for _, item := range value {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[name] = strings.Join(items, ",")
+		default:
+			errs = append(errs, fmt.Errorf("%s must be a single value, like a string or a number", key))
+		}
+	}
+	return values, errors.Join(errs...)
+}
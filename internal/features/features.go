@@ -0,0 +1,132 @@
+// Package features turns on and off the features still being rolled out.
+//
+// Each feature has a name, like fuzzy_search, and is on or off by default.
+// The configuration may change that at the start, with a list of names such
+// as "fuzzy_search,-book_merge": a name turns its feature on, and a name
+// after a minus turns it off. While the server runs, an admin may override
+// a feature, e.g. to turn off one that misbehaves without waiting for a
+// deployment, and reset it to what the configuration said. The overrides
+// are kept in memory: they hold until a restart, and for one instance only.
+package features
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// The name is not the one of a known feature.
+var ErrUnknown = errors.New("unknown feature")
+
+// A feature, as the code knows it.
+type Definition struct {
+	Name string
+	// What the feature does, for the admins
+	Description string
+	Default     bool
+}
+
+// The state of a feature, as listed by Set.List.
+type Flag struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+	// What the configuration says, which Reset goes back to
+	Configured bool `json:"configured"`
+	// Whether an admin changed it since the start
+	Overridden bool `json:"overridden"`
+}
+
+// The features and their state. It is safe for concurrent use.
+type Set struct {
+	mu          sync.RWMutex
+	definitions []Definition
+	configured  map[string]bool
+	overrides   map[string]bool
+}
+
+// The features of the definitions, changed by the settings of the
+// configuration, see above. A setting naming no definition is an error.
+func New(definitions []Definition, settings []string) (*Set, error) {
+	s := &Set{
+		definitions: definitions,
+		configured:  map[string]bool{},
+		overrides:   map[string]bool{},
+	}
+	for _, d := range definitions {
+		s.configured[d.Name] = d.Default
+	}
+	var errs []error
+	for _, setting := range settings {
+		name, off := strings.CutPrefix(strings.TrimSpace(setting), "-")
+		if _, ok := s.configured[name]; !ok {
+			errs = append(errs, fmt.Errorf("%w %q, the features are %s", ErrUnknown, name, strings.Join(s.names(), ", ")))
+			continue
+		}
+		s.configured[name] = !off
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return s, nil
+}
+
+func (s *Set) names() []string {
+	var names []string
+	for _, d := range s.definitions {
+		names = append(names, d.Name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Whether the feature is on. An unknown feature is off.
+func (s *Set) Enabled(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if enabled, ok := s.overrides[name]; ok {
+		return enabled
+	}
+	return s.configured[name]
+}
+
+// Turns the feature on or off, whatever the configuration says.
+func (s *Set) Override(name string, enabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.configured[name]; !ok {
+		return fmt.Errorf("%w %q", ErrUnknown, name)
+	}
+	s.overrides[name] = enabled
+	return nil
+}
+
+// Takes back the override of the feature, if any.
+func (s *Set) Reset(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.configured[name]; !ok {
+		return fmt.Errorf("%w %q", ErrUnknown, name)
+	}
+	delete(s.overrides, name)
+	return nil
+}
+
+// The state of every feature, by name.
+func (s *Set) List() []Flag {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	flags := []Flag{}
+	for _, d := range s.definitions {
+		flag := Flag{Name: d.Name, Description: d.Description, Configured: s.configured[d.Name]}
+		flag.Enabled, flag.Overridden = s.overrides[d.Name]
+		if !flag.Overridden {
+			flag.Enabled = flag.Configured
+		}
+		flags = append(flags, flag)
+	}
+	slices.SortFunc(flags, func(a, b Flag) int { return strings.Compare(a.Name, b.Name) })
+	return flags
+}
@@ -0,0 +1,133 @@
+// Package isbn checks and converts International Standard Book Numbers.
+//
+// An ISBN comes in two forms: the old ISBN-10, like 958-30-0804-4, and the
+// ISBN-13 used since 2007, like 978-3-649-64609-9. Both end with a check
+// digit computed from the others, which catches most typos. Each ISBN-10
+// has an ISBN-13 with the prefix 978, so converting from 10 to 13 always
+// works, whereas only the 978 ISBN-13s have an ISBN-10.
+// The hyphens split an ISBN into groups whose lengths depend on the
+// publisher, so they only help reading. This package ignores them, and its
+// normalized form has none: equal numbers are equal strings.
+package isbn
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	// The value is not made of 10 or 13 digits (the last one of an ISBN-10
+	// may be an X, meaning 10).
+	ErrFormat = errors.New("not an ISBN-10 or ISBN-13")
+	// The digits do not add up to the check digit.
+	ErrChecksum = errors.New("wrong ISBN check digit")
+	// An ISBN-13 not starting with 978 has no ISBN-10.
+	ErrNoISBN10 = errors.New("ISBN-13 has no ISBN-10")
+)
+
+// Removes the hyphens and spaces, and capitalizes a final x.
+func Clean(value string) string {
+	value = strings.NewReplacer("-", "", " ", "").Replace(value)
+	return strings.ToUpper(value)
+}
+
+// Checks the form and the check digit of an ISBN-10 or ISBN-13, which may
+// contain hyphens or spaces.
+func Validate(value string) error {
+	digits := Clean(value)
+	switch len(digits) {
+	case 10:
+		if !allDigits(digits[:9]) || !(isDigit(digits[9]) || digits[9] == 'X') {
+			return ErrFormat
+		}
+		if checkDigit10(digits[:9]) != digits[9] {
+			return ErrChecksum
+		}
+	case 13:
+		if !allDigits(digits) {
+			return ErrFormat
+		}
+		if checkDigit13(digits[:12]) != digits[12] {
+			return ErrChecksum
+		}
+	default:
+		return ErrFormat
+	}
+	return nil
+}
+
+// Returns the ISBN-13 of a valid ISBN, without hyphens: the two forms of the
+// same book give the same result.
+func Normalize(value string) (string, error) {
+	return To13(value)
+}
+
+// Converts a valid ISBN to an ISBN-13 without hyphens.
+func To13(value string) (string, error) {
+	if err := Validate(value); err != nil {
+		return "", err
+	}
+	digits := Clean(value)
+	if len(digits) == 13 {
+		return digits, nil
+	}
+	body := "978" + digits[:9]
+	return body + string(checkDigit13(body)), nil
+}
+
+// Converts a valid ISBN to an ISBN-10 without hyphens, if it has one.
+func To10(value string) (string, error) {
+	if err := Validate(value); err != nil {
+		return "", err
+	}
+	digits := Clean(value)
+	if len(digits) == 10 {
+		return digits, nil
+	}
+	if !strings.HasPrefix(digits, "978") {
+		return "", ErrNoISBN10
+	}
+	body := digits[3:12]
+	return body + string(checkDigit10(body)), nil
+}
+
+// The digits of an ISBN-10 are weighted 10, 9, ... 2, and the check digit
+// makes the sum a multiple of 11.
+func checkDigit10(body string) byte {
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += int(body[i]-'0') * (10 - i)
+	}
+	check := (11 - sum%11) % 11
+	if check == 10 {
+		return 'X'
+	}
+	return byte('0' + check)
+}
+
+// The digits of an ISBN-13 are weighted 1, 3, 1, 3, ... and the check
+// digit makes the sum a multiple of 10.
+func checkDigit13(body string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		weight := 1
+		if i%2 == 1 {
+			weight = 3
+		}
+		sum += int(body[i]-'0') * weight
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+func allDigits(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if !isDigit(value[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
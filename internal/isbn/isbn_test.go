@@ -0,0 +1,61 @@
+package isbn
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		value string
+		err   error
+	}{
+		{"0-306-40615-2", nil},
+		{"978-0-306-40615-7", nil},
+		{"978 3 649 64609 9", nil},
+		{"080442957x", nil},
+		{"0-306-40615-3", ErrChecksum},
+		{"978-0-306-40615-8", ErrChecksum},
+		{"03064061X2", ErrFormat},
+		{"978030640615X", ErrFormat},
+		{"12345", ErrFormat},
+		{"", ErrFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if err := Validate(tt.value); !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		value string
+		to13  string
+		to10  string
+		err10 error
+	}{
+		{"0-306-40615-2", "9780306406157", "0306406152", nil},
+		{"978-0-306-40615-7", "9780306406157", "0306406152", nil},
+		{"080442957X", "9780804429573", "080442957X", nil},
+		{"979-10-90636-07-1", "9791090636071", "", ErrNoISBN10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			to13, err := To13(tt.value)
+			if err != nil || to13 != tt.to13 {
+				t.Errorf("To13: got %q, %v, want %q", to13, err, tt.to13)
+			}
+			normalized, err := Normalize(tt.value)
+			if err != nil || normalized != tt.to13 {
+				t.Errorf("Normalize: got %q, %v, want %q", normalized, err, tt.to13)
+			}
+			to10, err := To10(tt.value)
+			if !errors.Is(err, tt.err10) || to10 != tt.to10 {
+				t.Errorf("To10: got %q, %v, want %q, %v", to10, err, tt.to10, tt.err10)
+			}
+		})
+	}
+}